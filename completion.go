@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alecthomas/kong"
+)
+
+// completionScripts hold the scripts that hook each shell up to the complete command
+var completionScripts = map[string]string{
+	"bash": `_nuntius() {
+	local IFS=$'\n'
+	COMPREPLY=($(nuntius complete -- "${COMP_LINE:0:$COMP_POINT}" 2>/dev/null))
+}
+complete -F _nuntius nuntius
+`,
+	"zsh": `#compdef nuntius
+_nuntius() {
+	local -a suggestions
+	suggestions=(${(f)"$(nuntius complete -- "${BUFFER[1,$CURSOR]}" 2>/dev/null)"})
+	compadd -a suggestions
+}
+compdef _nuntius nuntius
+`,
+	"fish": `complete -c nuntius -f -a '(nuntius complete -- (commandline -cp) 2>/dev/null)'
+`,
+}
+
+type CompletionCommand struct {
+	Shell string `arg enum:"bash,zsh,fish" help:"The shell to complete commands in: bash, zsh, or fish."`
+}
+
+func (cmd *CompletionCommand) Run() error {
+	fmt.Print(completionScripts[cmd.Shell])
+	return nil
+}
+
+// CompleteCommand prints the suggestions for a partial command line, for the completion scripts
+type CompleteCommand struct {
+	Line string `arg optional help:"The command line, up to the cursor."`
+}
+
+func (cmd *CompleteCommand) Run(database string, pass passphrase) error {
+	suggestions, err := complete(database, pass, cmd.Line)
+	if err != nil {
+		return err
+	}
+	for _, suggestion := range suggestions {
+		fmt.Println(suggestion)
+	}
+	return nil
+}
+
+// completeFriend is the value of the complete tag on arguments holding the name of a friend
+const completeFriend = "friend"
+
+// friendNames returns the names of all of our friends, in order
+func friendNames(database string, pass passphrase) ([]string, error) {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return nil, err
+	}
+	friends, err := store.ListFriends()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(friends))
+	for i, friend := range friends {
+		names[i] = friend.Name
+	}
+	return names, nil
+}
+
+// findFlag looks up a flag by name, in a command or any of its parents
+func findFlag(node *kong.Node, name string) *kong.Flag {
+	for _, group := range node.AllFlags(false) {
+		for _, flag := range group {
+			if flag.Name == name || (len(name) == 1 && flag.Short == rune(name[0])) {
+				return flag
+			}
+		}
+	}
+	return nil
+}
+
+// completeArgument returns the suggestions for the positional argument at some index of a command
+//
+// Commands whose server url is optional can have the name of a friend right away, since the url
+// might come from the config file.
+func completeArgument(node *kong.Node, index int, database string, pass passphrase) ([]string, error) {
+	if index >= len(node.Positional) {
+		return nil, nil
+	}
+	arg := node.Positional[index]
+	isFriend := arg.Tag.Get("complete") == completeFriend
+	if arg.Name == "url" && index+1 < len(node.Positional) {
+		isFriend = node.Positional[index+1].Tag.Get("complete") == completeFriend
+	}
+	if isFriend {
+		return friendNames(database, pass)
+	}
+	if arg.Enum != "" {
+		return strings.Split(arg.Enum, ","), nil
+	}
+	return nil, nil
+}
+
+// complete returns the suggestions for the last word of a command line, which is cut off at the cursor
+//
+// Commands, friend names, and the choices of arguments like the shell are completed.
+// A --database flag on the line is used to find the friends, instead of the default.
+func complete(database string, pass passphrase, line string) ([]string, error) {
+	words := strings.Fields(line)
+	// The first word is the name of the program
+	if len(words) > 0 {
+		words = words[1:]
+	}
+	current := ""
+	if len(words) > 0 && !strings.HasSuffix(line, " ") {
+		current = words[len(words)-1]
+		words = words[:len(words)-1]
+	}
+
+	parser, err := kong.New(&cliArgs{})
+	if err != nil {
+		return nil, err
+	}
+	node := parser.Model.Node
+	var positional []string
+	// valueOf is the flag whose value is the next word, if any
+	var valueOf *kong.Flag
+	for _, word := range words {
+		if valueOf != nil {
+			if valueOf.Name == "database" {
+				database = word
+			}
+			valueOf = nil
+			continue
+		}
+		if strings.HasPrefix(word, "-") {
+			name := strings.TrimLeft(word, "-")
+			value := ""
+			hasValue := false
+			if i := strings.Index(name, "="); i >= 0 {
+				name, value, hasValue = name[:i], name[i+1:], true
+			}
+			flag := findFlag(node, name)
+			if flag == nil || flag.IsBool() {
+				continue
+			}
+			if !hasValue {
+				valueOf = flag
+			} else if flag.Name == "database" {
+				database = value
+			}
+			continue
+		}
+		if len(positional) == 0 {
+			found := false
+			for _, child := range node.Children {
+				if child.Name == word {
+					node = child
+					found = true
+					break
+				}
+			}
+			if found {
+				continue
+			}
+		}
+		positional = append(positional, word)
+	}
+	if valueOf != nil || strings.HasPrefix(current, "-") {
+		return nil, nil
+	}
+
+	var candidates []string
+	if node.Type == kong.ApplicationNode {
+		for _, child := range node.Children {
+			if !child.Hidden {
+				candidates = append(candidates, child.Name)
+			}
+		}
+	} else {
+		candidates, err = completeArgument(node, len(positional), database, pass)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var suggestions []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, current) {
+			suggestions = append(suggestions, candidate)
+		}
+	}
+	return suggestions, nil
+}
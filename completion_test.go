@@ -0,0 +1,118 @@
+package main
+
+import (
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/cronokirby/nuntius/internal/client"
+	"github.com/cronokirby/nuntius/internal/crypto"
+)
+
+func TestCompleteFriendNames(t *testing.T) {
+	database := path.Join(t.TempDir(), "client.db")
+	store, err := client.NewStore(database)
+	if err != nil {
+		t.Errorf("couldn't create store: %v", err)
+		return
+	}
+	for _, name := range []string{"bob", "alice", "albert"} {
+		pub, _, err := crypto.GenerateIdentity()
+		if err != nil {
+			t.Errorf("couldn't generate identity: %v", err)
+			return
+		}
+		_, err = store.AddFriend(pub, name, false)
+		if err != nil {
+			t.Errorf("couldn't add friend: %v", err)
+			return
+		}
+	}
+
+	cases := []struct {
+		line     string
+		expected []string
+	}{
+		{"nuntius chat ", []string{"albert", "alice", "bob"}},
+		{"nuntius chat al", []string{"albert", "alice"}},
+		{"nuntius chat http://localhost:1234 b", []string{"bob"}},
+		{"nuntius --json rename-friend a", []string{"albert", "alice"}},
+		{"nuntius rename-friend alice ", nil},
+		{"nuntius add-friend ", []string{"albert", "alice", "bob"}},
+	}
+	for _, c := range cases {
+		suggestions, err := complete(database, "", c.line)
+		if err != nil {
+			t.Errorf("couldn't complete %q: %v", c.line, err)
+			return
+		}
+		if !reflect.DeepEqual(suggestions, c.expected) {
+			t.Errorf("%q: expected %q, found %q", c.line, c.expected, suggestions)
+			return
+		}
+	}
+}
+
+func TestCompleteCommands(t *testing.T) {
+	other := path.Join(t.TempDir(), "other.db")
+	suggestions, err := complete(other, "", "nuntius rena")
+	if err != nil {
+		t.Errorf("couldn't complete: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(suggestions, []string{"rename-friend"}) {
+		t.Errorf("unexpected suggestions: %q", suggestions)
+		return
+	}
+	suggestions, err = complete(other, "", "nuntius completion ")
+	if err != nil {
+		t.Errorf("couldn't complete: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(suggestions, []string{"bash", "zsh", "fish"}) {
+		t.Errorf("unexpected suggestions: %q", suggestions)
+		return
+	}
+	suggestions, err = complete(other, "", "nuntius co")
+	if err != nil {
+		t.Errorf("couldn't complete: %v", err)
+		return
+	}
+	for _, suggestion := range suggestions {
+		if suggestion == "complete" {
+			t.Errorf("hidden command was suggested: %q", suggestions)
+			return
+		}
+	}
+}
+
+func TestCompleteUsesDatabaseFlag(t *testing.T) {
+	database := path.Join(t.TempDir(), "client.db")
+	store, err := client.NewStore(database)
+	if err != nil {
+		t.Errorf("couldn't create store: %v", err)
+		return
+	}
+	pub, _, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	_, err = store.AddFriend(pub, "alice", false)
+	if err != nil {
+		t.Errorf("couldn't add friend: %v", err)
+		return
+	}
+	other := path.Join(t.TempDir(), "other.db")
+	for _, line := range []string{"nuntius --database=" + database + " chat ", "nuntius --database " + database + " chat "} {
+		suggestions, err := complete(other, "", line)
+		if err != nil {
+			t.Errorf("couldn't complete %q: %v", line, err)
+			return
+		}
+		if !reflect.DeepEqual(suggestions, []string{"alice"}) {
+			t.Errorf("%q: unexpected suggestions: %q", line, suggestions)
+			return
+		}
+	}
+}
@@ -3,10 +3,18 @@ module github.com/cronokirby/nuntius
 go 1.16
 
 require (
-	filippo.io/edwards25519 v1.0.0-rc.1 // indirect
-	github.com/alecthomas/kong v0.2.16 // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
-	github.com/gorilla/websocket v1.4.2 // indirect
+	filippo.io/edwards25519 v1.0.0-rc.1
+	github.com/BurntSushi/toml v1.0.0
+	github.com/alecthomas/kong v0.2.16
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
+	github.com/lib/pq v1.10.2
+	github.com/prometheus/client_golang v1.9.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	github.com/tyler-smith/go-bip39 v1.1.0
 	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a
+	golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c
+	google.golang.org/protobuf v1.27.1
 	modernc.org/sqlite v1.10.7
 )
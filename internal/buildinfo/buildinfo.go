@@ -0,0 +1,17 @@
+// Package buildinfo describes the build of nuntius that's running.
+//
+// The values are filled in when building, with flags like:
+//
+//	go build -ldflags "-X github.com/cronokirby/nuntius/internal/buildinfo.Version=v1.0.0"
+//
+// Builds without these flags report "dev" for each of them.
+package buildinfo
+
+// Version is the version of the module, like v1.0.0
+var Version = "dev"
+
+// Commit is the git commit the build comes from
+var Commit = "dev"
+
+// Date is when the build was made
+var Date = "dev"
@@ -2,24 +2,220 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/user"
 	"path"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cronokirby/nuntius/internal/crypto"
+	"github.com/cronokirby/nuntius/internal/migrate"
 	"github.com/cronokirby/nuntius/internal/server"
 	"github.com/gorilla/websocket"
 )
 
+// ErrNoSuchFriend is returned when no friend with a given name exists
+var ErrNoSuchFriend = errors.New("no such friend")
+
+// ErrFriendExists is returned when a friend with a given name already exists
+var ErrFriendExists = errors.New("friend already exists")
+
+// ErrNoSuchGroup is returned when no group with a given name exists
+var ErrNoSuchGroup = errors.New("no such group")
+
+// ErrGroupExists is returned when a group with a given name already exists
+var ErrGroupExists = errors.New("group already exists")
+
+// ErrNoSuchSession is returned when we haven't saved a session with a friend
+var ErrNoSuchSession = errors.New("no such session")
+
+// ErrNoSuchOnetime is returned when burning a onetime key we don't have, or have already used
+var ErrNoSuchOnetime = errors.New("no such onetime key")
+
+// ErrSendTimeout is returned when the connection to the server doesn't take a message in time
+var ErrSendTimeout = errors.New("timed out sending to the server")
+
+// ErrBadPassphrase is returned when a database can't be unlocked with a passphrase
+var ErrBadPassphrase = errors.New("bad passphrase")
+
+// ErrPassphraseRequired is returned when opening an encrypted database without a passphrase
+var ErrPassphraseRequired = errors.New("database is encrypted, and needs a passphrase")
+
+// ErrIdentityEncrypted is returned when reading an identity protected by a passphrase, without that passphrase
+var ErrIdentityEncrypted = errors.New("identity is protected by a passphrase")
+
+// ErrIdentityExists is returned when importing an archive over an existing identity
+var ErrIdentityExists = errors.New("an identity already exists")
+
+// ErrBadArchive is returned when an archive is malformed, or can't be decrypted with a passphrase
+var ErrBadArchive = errors.New("bad archive, or bad passphrase")
+
+// ErrNoReceipt is returned when a friend doesn't acknowledge a message in time
+var ErrNoReceipt = errors.New("friend didn't acknowledge the message")
+
+// ErrFriendNotOnline is returned when a friend doesn't answer our attempt to start a session in time
+//
+// The server silently drops requests for friends who aren't connected, so this is the most
+// likely reason.
+var ErrFriendNotOnline = errors.New("friend is not online")
+
+// ErrFriendNotRegistered is returned when a friend hasn't registered their keys with the server
+var ErrFriendNotRegistered = errors.New("friend hasn't registered with this server yet")
+
+// ErrFileTooLarge is returned when a file doesn't fit in a single message
+var ErrFileTooLarge = fmt.Errorf("file doesn't fit in a message of %d bytes", server.DefaultMaxMessageBytes)
+
+// ErrBadPrekeySignature is returned when a prekey wasn't signed by the identity it belongs to
+var ErrBadPrekeySignature = errors.New("couldn't verify prekey signature")
+
+// ErrBadNameSignature is returned when a name in a server's directory wasn't signed by the identity it points to
+var ErrBadNameSignature = errors.New("couldn't verify name signature")
+
+// ErrNameNotFound is returned when no identity published a name in a server's directory
+var ErrNameNotFound = errors.New("nobody published this name")
+
+// ErrFriendKeyChanged is returned when adding a friend whose name is already used by a different identity
+//
+// This could mean that someone is trying to impersonate that friend.
+var ErrFriendKeyChanged = errors.New("friend's identity key has changed")
+
+// ErrNotFound matches an APIError for a request the server couldn't find anything for
+var ErrNotFound = errors.New("not found")
+
+// ErrBadRequest matches an APIError for a request the server rejected as invalid
+var ErrBadRequest = errors.New("bad request")
+
+// ErrServer matches an APIError for a request the server failed to handle
+var ErrServer = errors.New("server error")
+
+// APIError is returned when the server answers a request with an unsuccessful status
+//
+// This can be matched against ErrNotFound, ErrBadRequest, and ErrServer with errors.Is.
+type APIError struct {
+	// Status is the HTTP status code the server answered with
+	Status int
+	// Body is the explanation the server gave, if any
+	Body string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Status == http.StatusNotFound
+	case ErrBadRequest:
+		return e.Status == http.StatusBadRequest
+	case ErrServer:
+		return e.Status >= 500
+	default:
+		return false
+	}
+}
+
+// maxErrorBody is the most we read of the body of an unsuccessful response
+const maxErrorBody = 1024
+
+// checkResponse returns an APIError if the server didn't answer a request successfully
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return &APIError{Status: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+}
+
+// AddFriendStatus is what adding a friend did to our existing friends
+type AddFriendStatus int
+
+const (
+	// FriendCreated means that this is a new friend
+	FriendCreated AddFriendStatus = iota + 1
+	// FriendUpdatedName means that we already knew this identity, under another name
+	FriendUpdatedName
+	// FriendUnchanged means that we already knew this identity, under the same name
+	FriendUnchanged
+	// FriendKeyConflict means that the name is used by a different identity, which was kept
+	FriendKeyConflict
+	// FriendKeyReplaced means that the name was used by a different identity, which was replaced
+	FriendKeyReplaced
+)
+
+// Friend associates a name with the identity of a friend
+type Friend struct {
+	Name string
+	Pub  crypto.IdentityPub
+	// Verified is true if we've checked our safety number with this friend
+	Verified bool
+	// ChangedAt is the last time this friend's identity was replaced, or the zero time if it never was
+	ChangedAt time.Time
+}
+
+// GroupIDSize is the number of bytes in the id of a group
+const GroupIDSize = 16
+
+// Group is a named set of friends we chat with together
+type Group struct {
+	// ID identifies the group, and needs to be shared by all of its members
+	ID   []byte
+	Name string
+	// Members are the identities of the other members of the group
+	Members []crypto.IdentityPub
+}
+
+// NewGroupID generates a random id for a new group
+func NewGroupID() ([]byte, error) {
+	id := make([]byte, GroupIDSize)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// StoredMessage is a message we've sent to, or received from, a friend
+type StoredMessage struct {
+	// Outgoing is true if we sent this message
+	Outgoing bool
+	// Body is the plaintext of the message
+	Body string
+	// SentAt is the time at which the message was sent, or received
+	SentAt time.Time
+}
+
+// QueuedMessage is a message we've sent to a friend, who hasn't acknowledged it yet
+type QueuedMessage struct {
+	// AckID is the id our friend acknowledges the message with
+	AckID []byte
+	// Body is the plaintext of the message
+	Body string
+	// CreatedAt is when we first tried to send the message
+	CreatedAt time.Time
+}
+
 // ClientStore represents a store for information local to the client application.
 //
 // This allows us to store things like a user's personal private keys,
@@ -28,31 +224,150 @@ type ClientStore interface {
 	// GetIdentity returns the user's current identity, if any, or an error
 	GetIdentity() (crypto.IdentityPub, error)
 	// GetIdentity returns the user's current identity, and private key, if any, or an error
+	//
+	// If the identity is protected by a passphrase, this returns ErrIdentityEncrypted.
 	GetFullIdentity() (crypto.IdentityPub, crypto.IdentityPriv, error)
 	// SaveIdentity saves an identity key-pair, replacing any existing identity
 	SaveIdentity(crypto.IdentityPub, crypto.IdentityPriv) error
-	// AddFriend registers a friend by identity, and name
-	AddFriend(crypto.IdentityPub, string) error
+	// GetFullIdentityPair is like GetFullIdentity, but returns both parts of the identity together
+	GetFullIdentityPair() (crypto.IdentityKeyPair, error)
+	// SaveIdentityPair is like SaveIdentity, but takes both parts of the identity together
+	SaveIdentityPair(crypto.IdentityKeyPair) error
+	// GetIdentitySeed returns the seed used to derive the user's identity, if any, or an error
+	//
+	// If the identity is protected by a passphrase, this returns ErrIdentityEncrypted.
+	GetIdentitySeed() ([]byte, error)
+	// SaveIdentityEncrypted saves an identity key-pair, protecting the private key with a passphrase
+	SaveIdentityEncrypted(crypto.IdentityPub, crypto.IdentityPriv, string) error
+	// GetFullIdentityDecrypted returns the user's current identity, using a passphrase to unlock it
+	//
+	// A passphrase not matching the one the identity was saved with returns ErrBadPassphrase.
+	// Identities not protected by a passphrase are returned as is.
+	GetFullIdentityDecrypted(string) (crypto.IdentityPub, crypto.IdentityPriv, error)
+	// GetIdentitySeedDecrypted returns the seed of the user's identity, using a passphrase to unlock it
+	GetIdentitySeedDecrypted(string) ([]byte, error)
+	// AddFriend registers a friend by identity, and name, returning what changed
+	//
+	// Adding a friend that already exists with the same identity does nothing, and adding
+	// an identity we know under another name renames them.
+	// If the name is used by a different identity, this returns ErrFriendKeyChanged,
+	// unless force is set, in which case the identity is replaced, and no longer verified.
+	AddFriend(pub crypto.IdentityPub, name string, force bool) (AddFriendStatus, error)
+	// VerifyFriend marks a friend as verified, returning ErrNoSuchFriend if they don't exist
+	VerifyFriend(string) error
+	// BlockFriend makes us ignore all messages from an identity
+	BlockFriend(crypto.IdentityPub) error
+	// UnblockFriend stops ignoring messages from an identity
+	UnblockFriend(crypto.IdentityPub) error
+	// IsBlocked checks whether or not we're ignoring messages from an identity
+	IsBlocked(crypto.IdentityPub) (bool, error)
 	// GetFriend looks up a friend's identity key, using their name
 	GetFriend(string) (crypto.IdentityPub, error)
-	// SavePrekey saves a full prekey pair, possibly failing
-	SavePrekey(crypto.ExchangePub, crypto.ExchangePriv) error
+	// GetFriendName looks up a friend's name, using their identity key
+	//
+	// This returns ErrNoSuchFriend if the identity doesn't belong to a friend.
+	GetFriendName(crypto.IdentityPub) (string, error)
+	// ListFriends returns all of the friends we've registered, ordered by name
+	ListFriends() ([]Friend, error)
+	// RemoveFriend removes a friend by name, returning ErrNoSuchFriend if they don't exist
+	RemoveFriend(string) error
+	// RenameFriend changes the name of a friend, keeping their identity
+	//
+	// This returns ErrNoSuchFriend if the old name doesn't exist, and ErrFriendExists
+	// if the new name is already taken.
+	RenameFriend(string, string) error
+	// CreateGroup saves a new group, returning ErrGroupExists if the name is already taken
+	CreateGroup(Group) error
+	// GetGroup looks up a group, along with its members, using its name
+	//
+	// This returns ErrNoSuchGroup if the group doesn't exist.
+	GetGroup(string) (Group, error)
+	// ListGroups returns all of the groups we've created, ordered by name
+	ListGroups() ([]Group, error)
+	// NextPrekeyID returns an unused id for a new prekey
+	NextPrekeyID() (uint32, error)
+	// SavePrekey saves a full prekey pair, along with its id, possibly failing
+	SavePrekey(uint32, crypto.ExchangePub, crypto.ExchangePriv) error
+	// SavePrekeyPair is like SavePrekey, but takes both parts of the prekey together
+	SavePrekeyPair(uint32, crypto.ExchangeKeyPair) error
+	// LatestPrekeyTime returns when the newest prekey was saved, and false if there are no prekeys
+	LatestPrekeyTime() (time.Time, bool, error)
 	// SaveBundle saves the public and private parts of a bundle, possibly failing
 	SaveBundle(crypto.BundlePub, crypto.BundlePriv) error
+	// RemoveBundle deletes the onetime keys of a bundle, for bundles that never reached a server
+	RemoveBundle(crypto.BundlePub) error
 	// GetPreKey retrieves the private part of a prekey
-	GetPrekey(crypto.ExchangePub) (crypto.ExchangePriv, error)
+	//
+	// The prekey is looked up by id, and needs to match the public part.
+	GetPrekey(uint32, crypto.ExchangePub) (crypto.ExchangePriv, error)
 	// HasPreKey checks if a prekey exists at all
 	HasPrekey() (bool, error)
 	// BurnOneTime retrieves a one time key, also deleting it
+	//
+	// This returns ErrNoSuchOnetime if the key doesn't exist, or was already burned.
 	BurnOnetime(crypto.ExchangePub) (crypto.ExchangePriv, error)
+	// SaveMessage records a message we've sent to, or received from, a friend
+	SaveMessage(friend crypto.IdentityPub, outgoing bool, body string, t time.Time) error
+	// GetHistory returns the last messages exchanged with a friend, with the newest last
+	GetHistory(friend crypto.IdentityPub, limit int) ([]StoredMessage, error)
+	// SearchHistory returns the last messages exchanged with a friend containing some text, with the newest last
+	//
+	// The search ignores the case of ASCII letters.
+	SearchHistory(friend crypto.IdentityPub, query string, limit int) ([]StoredMessage, error)
+	// EnqueueMessage adds a message to the outbox, before we send it to a friend
+	EnqueueMessage(friend crypto.IdentityPub, ackID []byte, body string) error
+	// MarkDelivered records that our friend acknowledged a message in the outbox
+	//
+	// Marking a message that isn't in the outbox does nothing.
+	MarkDelivered(ackID []byte) error
+	// UndeliveredMessages returns the messages a friend hasn't acknowledged yet, oldest first
+	UndeliveredMessages(friend crypto.IdentityPub) ([]QueuedMessage, error)
+	// QueueDepth returns the number of messages in the outbox that haven't been acknowledged
+	QueueDepth() (int, error)
+	// SaveSession saves the state of our session with a friend, replacing any previous state
+	SaveSession(friend crypto.IdentityPub, ratchet *crypto.DoubleRatchet, additional []byte) error
+	// GetSession loads the state of our session with a friend
+	//
+	// This returns ErrNoSuchSession if we haven't saved a session with them.
+	GetSession(friend crypto.IdentityPub) (crypto.DoubleRatchet, []byte, error)
+	// DeleteSession forgets our session with a friend, so that the next chat negotiates a new one
+	//
+	// Deleting a session we haven't saved does nothing.
+	DeleteSession(friend crypto.IdentityPub) error
+	// Export writes all of our state to an archive, encrypted with a passphrase
+	Export(passphrase string) ([]byte, error)
+	// Import replaces all of our state with the contents of an archive, encrypted with a passphrase
+	//
+	// This returns ErrIdentityExists if we already have an identity, unless force is set,
+	// and ErrBadArchive if the archive can't be decrypted.
+	Import(archive []byte, passphrase string, force bool) error
 }
 
+// now returns the current time, and can be replaced in tests
+var now = time.Now
+
+// ackTimeout is how long we wait for a friend to acknowledge a message, before flagging it
+var ackTimeout = 30 * time.Second
+
+// sendTimeout is how long we wait for the connection to take a message, when it's stalled by a reconnect for example
+var sendTimeout = 10 * time.Second
+
+// maxSendAttempts is how many times we send a message before waiting for the next chat to try again
+const maxSendAttempts = 3
+
 // This will be the path after the Home directory where we put our SQLite database.
 const _DEFAULT_DATABASE_PATH = ".nuntius/client.db"
 
+// MemoryDatabase can be used as the path to a database, to keep everything in memory instead
+//
+// Everything in the database is lost once it's closed.
+const MemoryDatabase = ":memory:"
+
 // clientDatabase is used to implement ClientStore over an SQLite database
 type clientDatabase struct {
 	*sql.DB
+	// key encrypts private keys in the database, if set
+	key crypto.MessageKey
 }
 
 // newClientDatabase creates a clientDatabase, given a path to an SQLite database
@@ -67,517 +382,3160 @@ func newClientDatabase(database string) (*clientDatabase, error) {
 		}
 		database = path.Join(usr.HomeDir, _DEFAULT_DATABASE_PATH)
 	}
-	os.MkdirAll(path.Dir(database), os.ModePerm)
+	if database != MemoryDatabase {
+		os.MkdirAll(path.Dir(database), os.ModePerm)
+	}
 	db, err := sql.Open("sqlite", database)
 	if err != nil {
 		return nil, err
 	}
+	// With a single connection, the pragmas below apply to every query.
+	// This also keeps an in memory database alive, since each connection would have its own.
+	db.SetMaxOpenConns(1)
+	// WAL lets readers and a writer work at once, and other processes wait for locks instead of failing
+	_, err = db.Exec("PRAGMA journal_mode=WAL; PRAGMA busy_timeout=5000;")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS meta (
+		name TEXT PRIMARY KEY NOT NULL,
+		value BLOB NOT NULL
+	);
+	`)
+	if err != nil {
+		return nil, err
+	}
+	err = migrate.Run(db, clientMigrations)
+	if err != nil {
+		return nil, err
+	}
+	return &clientDatabase{DB: db}, nil
+}
+
+// clientMigrations brings the schema of a client's database up to date
+//
+// New migrations go at the end, and existing ones shouldn't change.
+var clientMigrations = []migrate.Step{
+	createClientTables,
+	expirePrekeys,
+	createOutbox,
+}
+
+// createOutbox creates the table holding the messages our friends haven't acknowledged yet
+func createOutbox(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS outbox (
+		id INTEGER PRIMARY KEY,
+		friend_pub BLOB NOT NULL,
+		ack_id BLOB UNIQUE NOT NULL,
+		body TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		delivered BOOLEAN NOT NULL DEFAULT false
+	);
+	`)
+	return err
+}
+
+// expirePrekeys makes our prekeys look stale, so that a new one gets registered
+//
+// Servers drop the keys signed before version 2 of the protocol. The prekeys are
+// kept, so that sessions started with them can still be accepted.
+func expirePrekeys(tx *sql.Tx) error {
+	_, err := tx.Exec("UPDATE prekey SET created_at = 0;")
+	return err
+}
+
+// createClientTables creates the tables of a client's database
+//
+// Databases from before migrations were tracked get the columns they were missing.
+func createClientTables(tx *sql.Tx) error {
+	err := migratePrekeys(tx)
+	if err != nil {
+		return err
+	}
+	err = migrateFriends(tx)
+	if err != nil {
+		return err
+	}
+	err = migrateIdentity(tx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
 	CREATE TABLE IF NOT EXISTS identity (
 		id BOOLEAN PRIMARY KEY CONSTRAINT one_row CHECK (id) NOT NULL,
 		public BLOB NOT NULL,
-		private BLOB NOT NULL
+		private BLOB NOT NULL,
+		seed BLOB NOT NULL,
+		kdf_salt BLOB,
+		verifier BLOB
 	);
 
 	CREATE TABLE IF NOT EXISTS friend (
  		public BLOB PRIMARY KEY NOT NULL,
-  	name TEXT NOT NULL
+  	name TEXT NOT NULL,
+		verified BOOLEAN NOT NULL DEFAULT false,
+		changed_at INTEGER NOT NULL DEFAULT 0
 	);
 
 	CREATE TABLE IF NOT EXISTS prekey (
 		public BLOB PRIMARY KEY NOT NULL,
-		private BLOB NOT NULL
+		private BLOB NOT NULL,
+		created_at INTEGER NOT NULL,
+		key_id INTEGER UNIQUE NOT NULL
 	);
 
 	CREATE TABLE IF NOT EXISTS onetime (
 		public BLOB PRIMARY KEY NOT NUll,
 		private BLOB NOT NULL
 	);
+
+	CREATE TABLE IF NOT EXISTS blocked (
+		public BLOB PRIMARY KEY NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS "group" (
+		id BLOB PRIMARY KEY NOT NULL,
+		name TEXT UNIQUE NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS group_member (
+		group_id BLOB NOT NULL,
+		member BLOB NOT NULL,
+		PRIMARY KEY (group_id, member)
+	);
+
+	CREATE TABLE IF NOT EXISTS message (
+		id INTEGER PRIMARY KEY,
+		friend_pub BLOB NOT NULL,
+		direction TEXT NOT NULL CHECK (direction IN ('in', 'out')),
+		body TEXT NOT NULL,
+		sent_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS session (
+		friend_pub BLOB PRIMARY KEY NOT NULL,
+		ratchet BLOB NOT NULL,
+		additional BLOB NOT NULL
+	);
 	`)
-	if err != nil {
-		return nil, err
-	}
-	return &clientDatabase{db}, nil
+	return err
 }
 
-func (store *clientDatabase) GetIdentity() (crypto.IdentityPub, error) {
-	var pub crypto.IdentityPub
-	err := store.QueryRow("SELECT public FROM identity LIMIT 1;").Scan(&pub)
-	if err == sql.ErrNoRows {
-		return nil, nil
+// migratePrekeys moves prekeys from the old table, which didn't have ids or timestamps
+//
+// Old prekeys use their row number as an id, and are treated as infinitely old.
+func migratePrekeys(tx *sql.Tx) error {
+	var exists int
+	err := tx.QueryRow(`
+	SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'prekey';
+	`).Scan(&exists)
+	if err != nil {
+		return err
 	}
+	var count int
+	err = tx.QueryRow(`
+	SELECT COUNT(*) FROM pragma_table_info('prekey') WHERE name = 'key_id';
+	`).Scan(&count)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return pub, nil
+	if exists == 0 || count > 0 {
+		return nil
+	}
+	_, err = tx.Exec(`
+	ALTER TABLE prekey RENAME TO old_prekey;
+
+	CREATE TABLE prekey (
+		public BLOB PRIMARY KEY NOT NULL,
+		private BLOB NOT NULL,
+		created_at INTEGER NOT NULL,
+		key_id INTEGER UNIQUE NOT NULL
+	);
+
+	INSERT INTO prekey (public, private, created_at, key_id)
+	SELECT public, private, 0, rowid FROM old_prekey;
+
+	DROP TABLE old_prekey;
+	`)
+	return err
 }
 
-func (store *clientDatabase) GetFullIdentity() (crypto.IdentityPub, crypto.IdentityPriv, error) {
-	var pub crypto.IdentityPub
-	var priv crypto.IdentityPriv
-	err := store.QueryRow("SELECT public, private FROM identity LIMIT 1;").Scan(&pub, &priv)
-	if err == sql.ErrNoRows {
-		return nil, nil, nil
+// migrateFriends adds the verification columns to an old friend table
+func migrateFriends(tx *sql.Tx) error {
+	var exists int
+	err := tx.QueryRow(`
+	SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'friend';
+	`).Scan(&exists)
+	if err != nil {
+		return err
 	}
+	var count int
+	err = tx.QueryRow(`
+	SELECT COUNT(*) FROM pragma_table_info('friend') WHERE name = 'verified';
+	`).Scan(&count)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	return pub, priv, nil
+	if exists == 0 || count > 0 {
+		return nil
+	}
+	_, err = tx.Exec(`
+	ALTER TABLE friend ADD COLUMN verified BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE friend ADD COLUMN changed_at INTEGER NOT NULL DEFAULT 0;
+	`)
+	return err
 }
 
-func (store *clientDatabase) SaveIdentity(pub crypto.IdentityPub, priv crypto.IdentityPriv) error {
-	_, err := store.Exec(`
-	INSERT OR REPLACE INTO identity (id, public, private) VALUES (true, $1, $2);
-	`, pub, priv)
+// migrateIdentity adds the columns used to back up an identity, and to protect it with a passphrase
+//
+// Old identities get their seed from their private key, which was stored in the clear.
+func migrateIdentity(tx *sql.Tx) error {
+	var exists int
+	err := tx.QueryRow(`
+	SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'identity';
+	`).Scan(&exists)
 	if err != nil {
 		return err
 	}
-	return nil
+	if exists == 0 {
+		return nil
+	}
+	var count int
+	err = tx.QueryRow(`
+	SELECT COUNT(*) FROM pragma_table_info('identity') WHERE name = 'seed';
+	`).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		_, err = tx.Exec(`
+		ALTER TABLE identity ADD COLUMN seed BLOB;
+		UPDATE identity SET seed = substr(private, 1, $1);
+		`, ed25519.SeedSize)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.QueryRow(`
+	SELECT COUNT(*) FROM pragma_table_info('identity') WHERE name = 'kdf_salt';
+	`).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err = tx.Exec(`
+	ALTER TABLE identity ADD COLUMN kdf_salt BLOB;
+	ALTER TABLE identity ADD COLUMN verifier BLOB;
+	`)
+	return err
 }
 
-func (store *clientDatabase) AddFriend(pub crypto.IdentityPub, name string) error {
-	_, err := store.Exec(`
-	INSERT OR REPLACE INTO friend (public, name)
-	VALUES ($1, $2);
-	`, pub, name)
-	return err
+// passphraseCheck is encrypted with the key of a database, to check passphrases
+const passphraseCheck = "nuntius passphrase check"
+
+// getMeta reads a value from the meta table, returning nil if it's not present
+func (store *clientDatabase) getMeta(name string) ([]byte, error) {
+	var value []byte
+	err := store.QueryRow("SELECT value FROM meta WHERE name = $1;", name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return value, err
 }
 
-func (store *clientDatabase) GetFriend(name string) (crypto.IdentityPub, error) {
-	var pub crypto.IdentityPub
-	err := store.QueryRow("SELECT public FROM friend WHERE name = $1", name).Scan(&pub)
-	if err != nil {
-		return nil, err
+// seal encrypts a private column, if the database is encrypted
+//
+// The ciphertext is bound to the column, and the public key of its row,
+// so that it can't be moved elsewhere.
+func (store *clientDatabase) seal(column string, pub []byte, plaintext []byte) ([]byte, error) {
+	if store.key == nil {
+		return plaintext, nil
 	}
-	return pub, nil
+	return store.key.Encrypt(plaintext, append([]byte(column), pub...))
 }
 
-func (store *clientDatabase) SavePrekey(pub crypto.ExchangePub, priv crypto.ExchangePriv) error {
-	_, err := store.Exec(`
-	INSERT OR REPLACE INTO prekey (public, private) VALUES ($1, $2);
-	`, pub, priv)
+// open decrypts a private column, if the database is encrypted
+func (store *clientDatabase) open(column string, pub []byte, ciphertext []byte) ([]byte, error) {
+	if store.key == nil {
+		return ciphertext, nil
+	}
+	plaintext, err := store.key.Decrypt(ciphertext, append([]byte(column), pub...))
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("couldn't decrypt %s: %w", column, err)
 	}
-	return nil
+	return plaintext, nil
 }
 
-func (store *clientDatabase) SaveBundle(pub crypto.BundlePub, priv crypto.BundlePriv) error {
-	if pub.Len() != len(priv) {
-		return fmt.Errorf("public bundle length %d is not equal to private bundle length %d", pub.Len(), len(priv))
-	}
-	tx, err := store.Begin()
+// encryptedColumns lists the private columns we encrypt, along with the public column they're bound to
+var encryptedColumns = []struct {
+	table  string
+	column string
+	pub    string
+}{
+	{"identity", "private", "public"},
+	{"identity", "seed", "public"},
+	{"prekey", "private", "public"},
+	{"onetime", "private", "public"},
+	{"session", "ratchet", "friend_pub"},
+}
+
+// unlock derives the key of an encrypted database from a passphrase
+//
+// If the database isn't encrypted yet, this encrypts all of the private keys it contains.
+func (store *clientDatabase) unlock(passphrase string) error {
+	salt, err := store.getMeta("salt")
 	if err != nil {
 		return err
 	}
-	for i := 0; i < len(priv); i++ {
-		_, err := tx.Exec(`
-		INSERT INTO onetime (public, private) VALUES ($1, $2);
-		`, pub.Get(i), priv[i])
+	if salt != nil {
+		key := crypto.KeyFromPassphrase(passphrase, salt)
+		check, err := store.getMeta("check")
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
+		plaintext, err := key.Decrypt(check, []byte("meta.check"))
+		if err != nil || string(plaintext) != passphraseCheck {
+			return ErrBadPassphrase
+		}
+		store.key = key
+		return nil
 	}
-	return tx.Commit()
-}
 
-func (store *clientDatabase) GetPrekey(prekey crypto.ExchangePub) (crypto.ExchangePriv, error) {
-	var priv crypto.ExchangePriv
-	err := store.QueryRow("SELECT private FROM prekey WHERE public = $1;", prekey).Scan(&priv)
+	salt, err = crypto.GeneratePassphraseSalt()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return priv, nil
-}
-
-func (store *clientDatabase) HasPrekey() (bool, error) {
-	var count int
-	err := store.QueryRow("SELECT count(*) FROM prekey;").Scan(&count)
+	key := crypto.KeyFromPassphrase(passphrase, salt)
+	check, err := key.Encrypt([]byte(passphraseCheck), []byte("meta.check"))
 	if err != nil {
-		return false, err
+		return err
 	}
-	return count > 0, nil
-}
-
-func (store *clientDatabase) BurnOnetime(pub crypto.ExchangePub) (crypto.ExchangePriv, error) {
 	tx, err := store.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	var priv crypto.ExchangePriv
-	err = tx.QueryRow(`
-	SELECT private FROM onetime WHERE public = $1 LIMIT 1;
-	`, pub).Scan(&priv)
+	_, err = tx.Exec("INSERT INTO meta (name, value) VALUES ('salt', $1), ('check', $2);", salt, check)
 	if err != nil {
 		tx.Rollback()
-		return nil, err
+		return err
+	}
+	for _, c := range encryptedColumns {
+		err = encryptColumn(tx, key, c.table, c.column, c.pub)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
-	_, err = tx.Exec("DELETE FROM onetime WHERE public = $1;", pub)
+	err = tx.Commit()
 	if err != nil {
-		tx.Rollback()
-		return nil, err
+		return err
 	}
-	tx.Commit()
-	return priv, nil
+	store.key = key
+	return nil
 }
 
-// NewStore creates a new ClientStore given a path to a local database.
-//
-// This will create the database file as necessary.
-//
-// If this string is empty, a default database, placed in the user's Home directory,
-// is used instead.
-func NewStore(database string) (ClientStore, error) {
-	db, err := newClientDatabase(database)
+// encryptColumn encrypts every value in a column, which was previously stored in plaintext
+func encryptColumn(tx *sql.Tx, key crypto.MessageKey, table string, column string, pub string) error {
+	rows, err := tx.Query(fmt.Sprintf("SELECT %s, %s FROM %s;", pub, column, table))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return db, err
+	type row struct{ pub, value []byte }
+	var toEncrypt []row
+	for rows.Next() {
+		var r row
+		err := rows.Scan(&r.pub, &r.value)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		toEncrypt = append(toEncrypt, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, r := range toEncrypt {
+		ciphertext, err := key.Encrypt(r.value, append([]byte(table+"."+column), r.pub...))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET %s = $1 WHERE %s = $2;", table, column, pub), ciphertext, r.pub)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-type ClientAPI interface {
-	// SendPrekey registers a new prekey for this identity, accompanied with a signature
-	SendPrekey(crypto.IdentityPub, crypto.ExchangePub, crypto.Signature) error
-	// CountOnetimes asks how many onetime keys this identity has registered with a server
-	CountOnetimes(crypto.IdentityPub) (int, error)
-	// SendBundle sends out a bundle, accompanied with a signature
-	SendBundle(crypto.IdentityPub, crypto.BundlePub, crypto.Signature) error
-	// CreateSession accesses a new set of exchange keys for a session
-	CreateSession(crypto.IdentityPub) (crypto.ExchangePub, crypto.Signature, crypto.ExchangePub, error)
-	// Listen starts listening to messages directed towards your public identity
-	//
-	// This will spawn necssary goroutines to maintain the connection.
-	//
-	// This takes in a channel which will forward messages you want to send, and returns
-	// a channel for receiving incoming messages
-	Listen(crypto.IdentityPub, <-chan server.Message) (<-chan server.Message, error)
+func (store *clientDatabase) GetIdentity() (crypto.IdentityPub, error) {
+	var pub crypto.IdentityPub
+	err := store.QueryRow("SELECT public FROM identity LIMIT 1;").Scan(&pub)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pub, nil
 }
 
-func NewClientAPI(url string) ClientAPI {
-	return &httpClientAPI{url}
+func (store *clientDatabase) GetFullIdentity() (crypto.IdentityPub, crypto.IdentityPriv, error) {
+	var pub crypto.IdentityPub
+	var priv crypto.IdentityPriv
+	var salt []byte
+	err := store.QueryRow("SELECT public, private, kdf_salt FROM identity LIMIT 1;").Scan(&pub, &priv, &salt)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if salt != nil {
+		return nil, nil, ErrIdentityEncrypted
+	}
+	priv, err = store.open("identity.private", pub, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pub, priv, nil
 }
 
-type httpClientAPI struct {
-	root string
+// identityKey derives the key protecting an identity from a passphrase, checking it against the verifier
+func identityKey(pub crypto.IdentityPub, passphrase string, salt []byte, verifier []byte) (crypto.MessageKey, error) {
+	key := crypto.KeyFromPassphrase(passphrase, salt)
+	plaintext, err := key.Decrypt(verifier, append([]byte("identity.verifier"), pub...))
+	if err != nil || string(plaintext) != passphraseCheck {
+		return nil, ErrBadPassphrase
+	}
+	return key, nil
 }
 
-func (api *httpClientAPI) SendPrekey(identity crypto.IdentityPub, prekey crypto.ExchangePub, sig crypto.Signature) error {
-	idBase64 := base64.URLEncoding.EncodeToString(identity)
-	data := server.PrekeyRequest{
-		Prekey: prekey,
-		Sig:    sig,
+// getIdentityDecrypted reads one of the private columns of the identity, using a passphrase to unlock it
+func (store *clientDatabase) getIdentityDecrypted(column string, passphrase string) (crypto.IdentityPub, []byte, error) {
+	var pub crypto.IdentityPub
+	var value, salt, verifier []byte
+	err := store.QueryRow(
+		fmt.Sprintf("SELECT public, %s, kdf_salt, verifier FROM identity LIMIT 1;", column),
+	).Scan(&pub, &value, &salt, &verifier)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
 	}
-	body, err := json.Marshal(data)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	resp, err := http.Post(fmt.Sprintf("%s/prekey/%s", api.root, idBase64), "application/json", bytes.NewBuffer(body))
+	label := "identity." + column
+	value, err = store.open(label, pub, value)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer resp.Body.Close()
-	ok := resp.StatusCode >= 200 && resp.StatusCode < 300
-	if !ok {
-		return errors.New(resp.Status)
+	if salt == nil {
+		return pub, value, nil
 	}
-	return nil
-}
-
-func RenewPrekey(api ClientAPI, pub crypto.IdentityPub, priv crypto.IdentityPriv) (crypto.ExchangePub, crypto.ExchangePriv, error) {
-	exchangePub, exchangePriv, err := crypto.GenerateExchange()
+	key, err := identityKey(pub, passphrase, salt, verifier)
 	if err != nil {
 		return nil, nil, err
 	}
-	sig := priv.Sign(exchangePub)
-	err = api.SendPrekey(pub, exchangePub, sig)
+	value, err = key.Decrypt(value, append([]byte(label), pub...))
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't decrypt %s: %w", label, err)
+	}
+	return pub, value, nil
+}
+
+func (store *clientDatabase) GetFullIdentityDecrypted(passphrase string) (crypto.IdentityPub, crypto.IdentityPriv, error) {
+	pub, priv, err := store.getIdentityDecrypted("private", passphrase)
 	if err != nil {
 		return nil, nil, err
 	}
-	return exchangePub, exchangePriv, nil
+	return pub, priv, nil
 }
 
-func (api *httpClientAPI) CountOnetimes(identity crypto.IdentityPub) (int, error) {
-	var count int
+func (store *clientDatabase) GetIdentitySeedDecrypted(passphrase string) ([]byte, error) {
+	_, seed, err := store.getIdentityDecrypted("seed", passphrase)
+	return seed, err
+}
 
-	idBase64 := base64.URLEncoding.EncodeToString(identity)
-	resp, err := http.Get(fmt.Sprintf("%s/onetime/count/%s", api.root, idBase64))
+func (store *clientDatabase) SaveIdentityEncrypted(pub crypto.IdentityPub, priv crypto.IdentityPriv, passphrase string) error {
+	salt, err := crypto.GeneratePassphraseSalt()
 	if err != nil {
-		return count, err
+		return err
 	}
-	defer resp.Body.Close()
-	ok := resp.StatusCode >= 200 && resp.StatusCode < 300
-	if !ok {
-		return count, errors.New(resp.Status)
+	key := crypto.KeyFromPassphrase(passphrase, salt)
+	verifier, err := key.Encrypt([]byte(passphraseCheck), append([]byte("identity.verifier"), pub...))
+	if err != nil {
+		return err
 	}
-
-	var data server.CountOnetimeResponse
-	err = json.NewDecoder(resp.Body).Decode(&data)
+	wrappedPriv, err := key.Encrypt(priv, append([]byte("identity.private"), pub...))
+	if err != nil {
+		return err
+	}
+	wrappedSeed, err := key.Encrypt(ed25519.PrivateKey(priv).Seed(), append([]byte("identity.seed"), pub...))
 	if err != nil {
-		return count, err
+		return err
 	}
+	return store.saveIdentity(pub, wrappedPriv, wrappedSeed, salt, verifier)
+}
 
-	return data.Count, nil
+func (store *clientDatabase) SaveIdentity(pub crypto.IdentityPub, priv crypto.IdentityPriv) error {
+	return store.saveIdentity(pub, priv, ed25519.PrivateKey(priv).Seed(), nil, nil)
 }
 
-func (api *httpClientAPI) SendBundle(identity crypto.IdentityPub, bundle crypto.BundlePub, sig crypto.Signature) error {
-	idBase64 := base64.URLEncoding.EncodeToString(identity)
-	data := server.SendBundleRequest{
-		Bundle: bundle,
-		Sig:    sig,
+func (store *clientDatabase) GetFullIdentityPair() (crypto.IdentityKeyPair, error) {
+	pub, priv, err := store.GetFullIdentity()
+	if err != nil {
+		return crypto.IdentityKeyPair{}, err
 	}
-	body, err := json.Marshal(data)
+	return crypto.IdentityKeyPair{Pub: pub, Priv: priv}, nil
+}
+
+func (store *clientDatabase) SaveIdentityPair(pair crypto.IdentityKeyPair) error {
+	return store.SaveIdentity(pair.Pub, pair.Priv)
+}
+
+// saveIdentity writes the identity, whose private parts might be protected by a passphrase
+func (store *clientDatabase) saveIdentity(pub crypto.IdentityPub, priv []byte, seed []byte, salt []byte, verifier []byte) error {
+	seed, err := store.seal("identity.seed", pub, seed)
 	if err != nil {
 		return err
 	}
-	resp, err := http.Post(fmt.Sprintf("%s/onetime/%s", api.root, idBase64), "application/json", bytes.NewBuffer(body))
+	priv, err = store.seal("identity.private", pub, priv)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	ok := resp.StatusCode >= 200 && resp.StatusCode < 300
-	if !ok {
-		return errors.New(resp.Status)
+	_, err = store.Exec(`
+	INSERT OR REPLACE INTO identity (id, public, private, seed, kdf_salt, verifier) VALUES (true, $1, $2, $3, $4, $5);
+	`, pub, priv, seed, salt, verifier)
+	if err != nil {
+		return err
 	}
 	return nil
 }
 
-func (api *httpClientAPI) CreateSession(identity crypto.IdentityPub) (crypto.ExchangePub, crypto.Signature, crypto.ExchangePub, error) {
-	idBase64 := base64.URLEncoding.EncodeToString(identity)
-	resp, err := http.Post(fmt.Sprintf("%s/session/%s", api.root, idBase64), "application/json", nil)
+func (store *clientDatabase) GetIdentitySeed() ([]byte, error) {
+	var pub crypto.IdentityPub
+	var seed, salt []byte
+	err := store.QueryRow("SELECT public, seed, kdf_salt FROM identity LIMIT 1;").Scan(&pub, &seed, &salt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
-	defer resp.Body.Close()
+	if salt != nil {
+		return nil, ErrIdentityEncrypted
+	}
+	return store.open("identity.seed", pub, seed)
+}
 
-	ok := resp.StatusCode >= 200 && resp.StatusCode < 300
-	if !ok {
-		return nil, nil, nil, errors.New(resp.Status)
+func (store *clientDatabase) AddFriend(pub crypto.IdentityPub, name string, force bool) (AddFriendStatus, error) {
+	tx, err := store.Begin()
+	if err != nil {
+		return 0, err
+	}
+	var existing crypto.IdentityPub
+	err = tx.QueryRow("SELECT public FROM friend WHERE name = $1;", name).Scan(&existing)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return 0, err
+	}
+	if err == nil && bytes.Equal(existing, pub) {
+		tx.Rollback()
+		return FriendUnchanged, nil
+	}
+	status := FriendCreated
+	var changedAt int64
+	if err == nil {
+		if !force {
+			tx.Rollback()
+			return FriendKeyConflict, ErrFriendKeyChanged
+		}
+		_, err = tx.Exec("DELETE FROM friend WHERE name = $1;", name)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		status = FriendKeyReplaced
+		changedAt = now().Unix()
+	}
+	var oldName string
+	err = tx.QueryRow("SELECT name FROM friend WHERE public = $1;", pub).Scan(&oldName)
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return 0, err
+	}
+	if err == nil && status == FriendCreated {
+		status = FriendUpdatedName
+	}
+	// Renaming an identity we already know keeps it verified, along with its history
+	_, err = tx.Exec(`
+	INSERT INTO friend (public, name, verified, changed_at) VALUES ($1, $2, false, $3)
+	ON CONFLICT (public) DO UPDATE SET name = excluded.name, changed_at = MAX(changed_at, excluded.changed_at);
+	`, pub, name, changedAt)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
 	}
+	return status, tx.Commit()
+}
 
-	var data server.SessionResponse
-	err = json.NewDecoder(resp.Body).Decode(&data)
+func (store *clientDatabase) VerifyFriend(name string) error {
+	result, err := store.Exec("UPDATE friend SET verified = true WHERE name = $1;", name)
 	if err != nil {
-		return nil, nil, nil, err
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
 	}
+	if affected == 0 {
+		return ErrNoSuchFriend
+	}
+	return nil
+}
 
-	prekey, err := crypto.ExchangePubFromBytes(data.Prekey)
+func (store *clientDatabase) GetFriend(name string) (crypto.IdentityPub, error) {
+	var pub crypto.IdentityPub
+	err := store.QueryRow("SELECT public FROM friend WHERE name = $1", name).Scan(&pub)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
+	return pub, nil
+}
 
-	onetime, err := crypto.ExchangePubFromBytes(data.OneTime)
+func (store *clientDatabase) GetFriendName(pub crypto.IdentityPub) (string, error) {
+	var name string
+	err := store.QueryRow("SELECT name FROM friend WHERE public = $1", pub).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", ErrNoSuchFriend
+	}
 	if err != nil {
-		return nil, nil, nil, err
+		return "", err
 	}
+	return name, nil
+}
 
-	return prekey, data.Sig, onetime, nil
+func (store *clientDatabase) BlockFriend(pub crypto.IdentityPub) error {
+	_, err := store.Exec("INSERT OR IGNORE INTO blocked (public) VALUES ($1);", pub)
+	return err
 }
 
-const requiredOnetimeSize = 10
+func (store *clientDatabase) UnblockFriend(pub crypto.IdentityPub) error {
+	_, err := store.Exec("DELETE FROM blocked WHERE public = $1;", pub)
+	return err
+}
 
-func CreateNewBundleIfNecessary(api ClientAPI, store ClientStore, pub crypto.IdentityPub, priv crypto.IdentityPriv) (bool, error) {
-	count, err := api.CountOnetimes(pub)
+func (store *clientDatabase) IsBlocked(pub crypto.IdentityPub) (bool, error) {
+	var count int
+	err := store.QueryRow("SELECT COUNT(*) FROM blocked WHERE public = $1;", pub).Scan(&count)
 	if err != nil {
 		return false, err
 	}
-	if count >= requiredOnetimeSize {
-		return false, nil
-	}
-	bundlePub, bundlePriv, err := crypto.GenerateBundle()
+	return count > 0, nil
+}
+
+func (store *clientDatabase) ListFriends() ([]Friend, error) {
+	rows, err := store.Query("SELECT public, name, verified, changed_at FROM friend ORDER BY name;")
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	err = store.SaveBundle(bundlePub, bundlePriv)
+	defer rows.Close()
+	var friends []Friend
+	for rows.Next() {
+		var friend Friend
+		var changedAt int64
+		err := rows.Scan(&friend.Pub, &friend.Name, &friend.Verified, &changedAt)
+		if err != nil {
+			return nil, err
+		}
+		if changedAt != 0 {
+			friend.ChangedAt = time.Unix(changedAt, 0)
+		}
+		friends = append(friends, friend)
+	}
+	return friends, rows.Err()
+}
+
+func (store *clientDatabase) RemoveFriend(name string) error {
+	result, err := store.Exec("DELETE FROM friend WHERE name = $1;", name)
 	if err != nil {
-		return false, err
+		return err
 	}
-	sig := priv.SignBundle(bundlePub)
-	err = api.SendBundle(pub, bundlePub, sig)
+	affected, err := result.RowsAffected()
 	if err != nil {
-		return false, err
+		return err
 	}
-	return true, nil
+	if affected == 0 {
+		return ErrNoSuchFriend
+	}
+	return nil
 }
 
-func (api *httpClientAPI) Listen(id crypto.IdentityPub, in <-chan server.Message) (<-chan server.Message, error) {
-	wsRoot := strings.TrimPrefix(api.root, "http://")
-	idBase64 := base64.URLEncoding.EncodeToString(id)
-	dialUrl := url.URL{Scheme: "ws", Host: wsRoot, Path: fmt.Sprintf("/rtc/%s", idBase64)}
-	conn, _, err := websocket.DefaultDialer.Dial(dialUrl.String(), nil)
+func (store *clientDatabase) RenameFriend(oldName string, newName string) error {
+	tx, err := store.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	go func() {
-		for {
-			msg := <-in
-			err := conn.WriteJSON(msg)
-			if err != nil {
-				log.Default().Println(err)
-				continue
-			}
-		}
-	}()
-	out := make(chan server.Message)
-	go func() {
-		for {
-			var msg server.Message
-			err := conn.ReadJSON(&msg)
-			if err != nil {
-				log.Default().Println(err)
-				continue
-			}
-			out <- msg
-		}
-	}()
-	return out, nil
+	var count int
+	err = tx.QueryRow("SELECT COUNT(*) FROM friend WHERE name = $1;", newName).Scan(&count)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if count > 0 {
+		tx.Rollback()
+		return ErrFriendExists
+	}
+	result, err := tx.Exec("UPDATE friend SET name = $1 WHERE name = $2;", newName, oldName)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if affected == 0 {
+		tx.Rollback()
+		return ErrNoSuchFriend
+	}
+	return tx.Commit()
 }
 
-func StartChat(api ClientAPI, store ClientStore, me crypto.IdentityPub, myPriv crypto.IdentityPriv, them crypto.IdentityPub, in <-chan string) (<-chan string, error) {
-	inMessage := make(chan server.Message)
-	outMessage, err := api.Listen(me, inMessage)
+func (store *clientDatabase) CreateGroup(group Group) error {
+	tx, err := store.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	inMessage <- server.Message{
-		From: me,
-		To:   them,
-		Payload: server.Payload{
-			Variant: &server.QueryExchangePayload{},
-		},
+	var count int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM "group" WHERE name = $1;`, group.Name).Scan(&count)
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
-	var additional []byte
-	msg := <-outMessage
-	var ratchet crypto.DoubleRatchet
-	switch v := msg.Payload.Variant.(type) {
-	case *server.StartExchangePayload:
-		additional = append(additional, me...)
-		additional = append(additional, them...)
-
-		prekey, err := crypto.ExchangePubFromBytes(v.Prekey)
-		if err != nil {
-			return nil, err
-		}
-		if !them.Verify(v.Prekey, v.Sig) {
-			return nil, errors.New("couldn't verify prekey signature")
-		}
-		onetime, err := crypto.ExchangePubFromBytes(v.OneTime)
+	if count > 0 {
+		tx.Rollback()
+		return ErrGroupExists
+	}
+	_, err = tx.Exec(`INSERT INTO "group" (id, name) VALUES ($1, $2);`, group.ID, group.Name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, member := range group.Members {
+		_, err = tx.Exec("INSERT OR IGNORE INTO group_member (group_id, member) VALUES ($1, $2);", group.ID, member)
 		if err != nil {
-			return nil, err
+			tx.Rollback()
+			return err
 		}
-		ephemeralPub, ephemeralPriv, err := crypto.GenerateExchange()
+	}
+	return tx.Commit()
+}
+
+// getGroupMembers returns the identities of the members of a group
+func (store *clientDatabase) getGroupMembers(id []byte) ([]crypto.IdentityPub, error) {
+	rows, err := store.Query("SELECT member FROM group_member WHERE group_id = $1 ORDER BY member;", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var members []crypto.IdentityPub
+	for rows.Next() {
+		var member crypto.IdentityPub
+		err := rows.Scan(&member)
 		if err != nil {
 			return nil, err
 		}
-		secret, err := crypto.ForwardExchange(&crypto.ForwardExchangeParams{
-			Me:        myPriv,
-			Ephemeral: ephemeralPriv,
-			Identity:  them,
-			Prekey:    prekey,
-			OneTime:   onetime,
-		})
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+func (store *clientDatabase) GetGroup(name string) (Group, error) {
+	group := Group{Name: name}
+	err := store.QueryRow(`SELECT id FROM "group" WHERE name = $1;`, name).Scan(&group.ID)
+	if err == sql.ErrNoRows {
+		return Group{}, ErrNoSuchGroup
+	}
+	if err != nil {
+		return Group{}, err
+	}
+	group.Members, err = store.getGroupMembers(group.ID)
+	if err != nil {
+		return Group{}, err
+	}
+	return group, nil
+}
+
+func (store *clientDatabase) ListGroups() ([]Group, error) {
+	rows, err := store.Query(`SELECT id, name FROM "group" ORDER BY name;`)
+	if err != nil {
+		return nil, err
+	}
+	var groups []Group
+	for rows.Next() {
+		var group Group
+		err := rows.Scan(&group.ID, &group.Name)
 		if err != nil {
+			rows.Close()
 			return nil, err
 		}
-		ratchet, err = crypto.DoubleRatchetFromInitiator(secret, prekey)
+		groups = append(groups, group)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// The members are queried after closing the rows, to avoid holding two connections at once
+	for i := range groups {
+		groups[i].Members, err = store.getGroupMembers(groups[i].ID)
 		if err != nil {
 			return nil, err
 		}
-		initialData, err := ratchet.Encrypt(nil, additional)
+	}
+	return groups, nil
+}
+
+func (store *clientDatabase) NextPrekeyID() (uint32, error) {
+	var id uint32
+	err := store.QueryRow("SELECT COALESCE(MAX(key_id), 0) + 1 FROM prekey;").Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (store *clientDatabase) SavePrekey(id uint32, pub crypto.ExchangePub, priv crypto.ExchangePriv) error {
+	sealed, err := store.seal("prekey.private", pub, priv)
+	if err != nil {
+		return err
+	}
+	_, err = store.Exec(`
+	INSERT OR REPLACE INTO prekey (public, private, created_at, key_id) VALUES ($1, $2, $3, $4);
+	`, pub, sealed, now().Unix(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (store *clientDatabase) SavePrekeyPair(id uint32, pair crypto.ExchangeKeyPair) error {
+	return store.SavePrekey(id, pair.Pub, pair.Priv)
+}
+
+func (store *clientDatabase) SaveBundle(pub crypto.BundlePub, priv crypto.BundlePriv) error {
+	if pub.Len() != len(priv) {
+		return fmt.Errorf("public bundle length %d is not equal to private bundle length %d", pub.Len(), len(priv))
+	}
+	err := crypto.CheckBundleSize(len(priv))
+	if err != nil {
+		return err
+	}
+	tx, err := store.Begin()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(priv); i++ {
+		sealed, err := store.seal("onetime.private", pub.Get(i), priv[i])
 		if err != nil {
-			return nil, err
+			tx.Rollback()
+			return err
 		}
-		inMessage <- server.Message{
-			From: me,
-			To:   them,
-			Payload: server.Payload{
-				Variant: &server.EndExchangePayload{
-					Prekey:      prekey,
-					OneTime:     onetime,
-					Ephemeral:   ephemeralPub,
-					InitialData: initialData,
-				},
-			},
+		_, err = tx.Exec(`
+		INSERT INTO onetime (public, private) VALUES ($1, $2);
+		`, pub.Get(i), sealed)
+		if err != nil {
+			tx.Rollback()
+			return err
 		}
-	case *server.EndExchangePayload:
-		additional = append(additional, them...)
-		additional = append(additional, me...)
+	}
+	return tx.Commit()
+}
 
-		ephemeral, err := crypto.ExchangePubFromBytes(v.Ephemeral)
+func (store *clientDatabase) RemoveBundle(pub crypto.BundlePub) error {
+	tx, err := store.Begin()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < pub.Len(); i++ {
+		_, err = tx.Exec("DELETE FROM onetime WHERE public = $1;", pub.Get(i))
 		if err != nil {
-			return nil, err
+			tx.Rollback()
+			return err
 		}
+	}
+	return tx.Commit()
+}
 
-		prekey, err := crypto.ExchangePubFromBytes(v.Prekey)
+func (store *clientDatabase) GetPrekey(id uint32, prekey crypto.ExchangePub) (crypto.ExchangePriv, error) {
+	var priv crypto.ExchangePriv
+	err := store.QueryRow("SELECT private FROM prekey WHERE key_id = $1 AND public = $2;", id, prekey).Scan(&priv)
+	if err != nil {
+		return nil, err
+	}
+	return store.open("prekey.private", prekey, priv)
+}
+
+func (store *clientDatabase) LatestPrekeyTime() (time.Time, bool, error) {
+	var createdAt sql.NullInt64
+	err := store.QueryRow("SELECT MAX(created_at) FROM prekey;").Scan(&createdAt)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if !createdAt.Valid {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(createdAt.Int64, 0), true, nil
+}
+
+func (store *clientDatabase) HasPrekey() (bool, error) {
+	var count int
+	err := store.QueryRow("SELECT count(*) FROM prekey;").Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (store *clientDatabase) BurnOnetime(pub crypto.ExchangePub) (crypto.ExchangePriv, error) {
+	// Deleting and reading in one statement means another process can't take the
+	// write lock between the two, which busy_timeout doesn't retry
+	var priv crypto.ExchangePriv
+	err := store.QueryRow(`
+	DELETE FROM onetime WHERE public = $1 RETURNING private;
+	`, pub).Scan(&priv)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchOnetime
+	}
+	if err != nil {
+		return nil, err
+	}
+	return store.open("onetime.private", pub, priv)
+}
+
+func (store *clientDatabase) SaveMessage(friend crypto.IdentityPub, outgoing bool, body string, t time.Time) error {
+	direction := "in"
+	if outgoing {
+		direction = "out"
+	}
+	_, err := store.Exec(`
+	INSERT INTO message (friend_pub, direction, body, sent_at) VALUES ($1, $2, $3, $4);
+	`, friend, direction, body, t.UnixNano())
+	return err
+}
+
+func (store *clientDatabase) EnqueueMessage(friend crypto.IdentityPub, ackID []byte, body string) error {
+	_, err := store.Exec(`
+	INSERT INTO outbox (friend_pub, ack_id, body, created_at) VALUES ($1, $2, $3, $4);
+	`, friend, ackID, body, now().UnixNano())
+	return err
+}
+
+func (store *clientDatabase) MarkDelivered(ackID []byte) error {
+	_, err := store.Exec("UPDATE outbox SET delivered = true WHERE ack_id = $1;", ackID)
+	return err
+}
+
+func (store *clientDatabase) UndeliveredMessages(friend crypto.IdentityPub) ([]QueuedMessage, error) {
+	rows, err := store.Query(`
+	SELECT ack_id, body, created_at FROM outbox WHERE friend_pub = $1 AND NOT delivered
+	ORDER BY id;
+	`, friend)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var messages []QueuedMessage
+	for rows.Next() {
+		var createdAt int64
+		var message QueuedMessage
+		err := rows.Scan(&message.AckID, &message.Body, &createdAt)
 		if err != nil {
 			return nil, err
 		}
+		message.CreatedAt = time.Unix(0, createdAt)
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+func (store *clientDatabase) QueueDepth() (int, error) {
+	var count int
+	err := store.QueryRow("SELECT COUNT(*) FROM outbox WHERE NOT delivered;").Scan(&count)
+	return count, err
+}
+
+func (store *clientDatabase) GetHistory(friend crypto.IdentityPub, limit int) ([]StoredMessage, error) {
+	rows, err := store.Query(`
+	SELECT direction, body, sent_at FROM message WHERE friend_pub = $1
+	ORDER BY sent_at DESC, id DESC LIMIT $2;
+	`, friend, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+// escapeLike escapes the wildcards in a LIKE pattern, using a backslash as the escape character
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (store *clientDatabase) SearchHistory(friend crypto.IdentityPub, query string, limit int) ([]StoredMessage, error) {
+	rows, err := store.Query(`
+	SELECT direction, body, sent_at FROM message WHERE friend_pub = $1 AND body LIKE $2 ESCAPE '\'
+	ORDER BY sent_at DESC, id DESC LIMIT $3;
+	`, friend, "%"+escapeLike(query)+"%", limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
 
-		onetime, err := crypto.ExchangePubFromBytes(v.OneTime)
+// scanMessages reads messages selected newest first, returning them oldest first
+func scanMessages(rows *sql.Rows) ([]StoredMessage, error) {
+	defer rows.Close()
+	var messages []StoredMessage
+	for rows.Next() {
+		var direction string
+		var sentAt int64
+		var message StoredMessage
+		err := rows.Scan(&direction, &message.Body, &sentAt)
 		if err != nil {
 			return nil, err
 		}
+		message.Outgoing = direction == "out"
+		message.SentAt = time.Unix(0, sentAt)
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// We selected the newest messages first, but we want to return them in order
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
 
-		prekeyPriv, err := store.GetPrekey(prekey)
-		if err != nil {
-			return nil, err
+func (store *clientDatabase) SaveSession(friend crypto.IdentityPub, ratchet *crypto.DoubleRatchet, additional []byte) error {
+	data, err := ratchet.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	sealed, err := store.seal("session.ratchet", friend, data)
+	if err != nil {
+		return err
+	}
+	_, err = store.Exec(`
+	INSERT OR REPLACE INTO session (friend_pub, ratchet, additional) VALUES ($1, $2, $3);
+	`, friend, sealed, additional)
+	return err
+}
+
+func (store *clientDatabase) GetSession(friend crypto.IdentityPub) (crypto.DoubleRatchet, []byte, error) {
+	var ratchet crypto.DoubleRatchet
+	var sealed, additional []byte
+	err := store.QueryRow("SELECT ratchet, additional FROM session WHERE friend_pub = $1;", friend).Scan(&sealed, &additional)
+	if err == sql.ErrNoRows {
+		return ratchet, nil, ErrNoSuchSession
+	}
+	if err != nil {
+		return ratchet, nil, err
+	}
+	data, err := store.open("session.ratchet", friend, sealed)
+	if err != nil {
+		return ratchet, nil, err
+	}
+	err = ratchet.UnmarshalBinary(data)
+	if err != nil {
+		return ratchet, nil, err
+	}
+	return ratchet, additional, nil
+}
+
+func (store *clientDatabase) DeleteSession(friend crypto.IdentityPub) error {
+	_, err := store.Exec("DELETE FROM session WHERE friend_pub = $1;", friend)
+	return err
+}
+
+// archiveMagic starts every archive, and is authenticated along with its contents
+const archiveMagic = "nuntius archive v1\n"
+
+// archiveTables are the tables saved in an archive, in the order they're restored
+//
+// The meta table isn't saved, since it describes the database itself, rather than our state.
+var archiveTables = []string{"identity", "friend", "blocked", "group", "group_member", "prekey", "onetime", "message", "outbox", "session"}
+
+// archivedTable holds the rows of a table, with the values of each row in the same order as the columns
+type archivedTable struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// encryptedColumn returns the label and public column of a private column, if it's encrypted
+func encryptedColumn(table string, column string) (string, string, bool) {
+	for _, c := range encryptedColumns {
+		if c.table == table && c.column == column {
+			return c.table + "." + c.column, c.pub, true
+		}
+	}
+	return "", "", false
+}
+
+// indexOf returns the position of a string in a slice, or -1
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
 		}
+	}
+	return -1
+}
 
-		onetimePriv, err := store.BurnOnetime(onetime)
+// dumpTable reads every row of a table, decrypting its private columns
+func (store *clientDatabase) dumpTable(table string) (archivedTable, error) {
+	var dumped archivedTable
+	rows, err := store.Query(fmt.Sprintf(`SELECT * FROM "%s" ORDER BY rowid;`, table))
+	if err != nil {
+		return dumped, err
+	}
+	defer rows.Close()
+	dumped.Columns, err = rows.Columns()
+	if err != nil {
+		return dumped, err
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(dumped.Columns))
+		pointers := make([]interface{}, len(values))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		err := rows.Scan(pointers...)
 		if err != nil {
-			return nil, err
+			return dumped, err
+		}
+		for i, column := range dumped.Columns {
+			label, pubColumn, ok := encryptedColumn(table, column)
+			if !ok {
+				continue
+			}
+			ciphertext, _ := values[i].([]byte)
+			pub, _ := values[indexOf(dumped.Columns, pubColumn)].([]byte)
+			values[i], err = store.open(label, pub, ciphertext)
+			if err != nil {
+				return dumped, err
+			}
 		}
+		dumped.Rows = append(dumped.Rows, values)
+	}
+	return dumped, rows.Err()
+}
 
-		secret, err := crypto.BackwardExchange(&crypto.BackwardExchangeParams{
-			Them:      them,
-			Ephemeral: ephemeral,
-			Identity:  myPriv,
-			Prekey:    prekeyPriv,
-			OneTime:   onetimePriv,
-		})
+// dumpTables reads every table saved in an archive
+func (store *clientDatabase) dumpTables() (map[string]archivedTable, error) {
+	tables := make(map[string]archivedTable)
+	for _, table := range archiveTables {
+		dumped, err := store.dumpTable(table)
 		if err != nil {
 			return nil, err
 		}
-		ratchet = crypto.DoubleRatchetFromReceiver(secret, prekey, prekeyPriv)
-		_, err = ratchet.Decrypt(v.InitialData, additional)
+		tables[table] = dumped
+	}
+	return tables, nil
+}
+
+// archivedValue converts a value decoded from JSON back into one we can insert into a column
+//
+// Blobs are encoded as base64 strings by JSON, so the type of the column tells them apart from text.
+func archivedValue(value interface{}, columnType string) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, bool:
+		return v, nil
+	case string:
+		if columnType == "BLOB" {
+			return base64.StdEncoding.DecodeString(v)
+		}
+		return v, nil
+	case json.Number:
+		return v.Int64()
+	default:
+		return nil, fmt.Errorf("unexpected value in archive: %v", v)
+	}
+}
+
+// restoreTable replaces the rows of a table with archived ones, encrypting its private columns
+func (store *clientDatabase) restoreTable(tx *sql.Tx, table string, archived archivedTable) error {
+	_, err := tx.Exec(fmt.Sprintf(`DELETE FROM "%s";`, table))
+	if err != nil {
+		return err
+	}
+	if len(archived.Rows) == 0 {
+		return nil
+	}
+	columnTypes := make(map[string]string)
+	rows, err := tx.Query("SELECT name, type FROM pragma_table_info($1);", table)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name, columnType string
+		err := rows.Scan(&name, &columnType)
 		if err != nil {
-			return nil, err
+			rows.Close()
+			return err
 		}
+		columnTypes[name] = columnType
 	}
-	go func() {
-		for {
-			stringMsg := <-in
-			ciphertext, err := ratchet.Encrypt([]byte(stringMsg), additional)
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	quoted := make([]string, len(archived.Columns))
+	placeholders := make([]string, len(archived.Columns))
+	for i, column := range archived.Columns {
+		if _, ok := columnTypes[column]; !ok {
+			return fmt.Errorf("%w: unknown column %s.%s", ErrBadArchive, table, column)
+		}
+		quoted[i] = fmt.Sprintf(`"%s"`, column)
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	insert := fmt.Sprintf(`INSERT INTO "%s" (%s) VALUES (%s);`, table, strings.Join(quoted, ", "), strings.Join(placeholders, ", "))
+	for _, row := range archived.Rows {
+		if len(row) != len(archived.Columns) {
+			return fmt.Errorf("%w: row of %s has %d values", ErrBadArchive, table, len(row))
+		}
+		values := make([]interface{}, len(row))
+		for i, value := range row {
+			values[i], err = archivedValue(value, columnTypes[archived.Columns[i]])
 			if err != nil {
-				log.Default().Println(err)
-				continue
-			}
-			inMessage <- server.Message{
-				From: me,
-				To:   them,
-				Payload: server.Payload{
-					Variant: &server.MessagePayload{Data: ciphertext},
-				},
+				return fmt.Errorf("%w: %v", ErrBadArchive, err)
 			}
 		}
-	}()
-	out := make(chan string)
-	go func() {
-		for {
-			msg := <-outMessage
-			if !bytes.Equal(msg.From, them) {
+		for i, column := range archived.Columns {
+			label, pubColumn, ok := encryptedColumn(table, column)
+			if !ok {
 				continue
 			}
-			switch v := msg.Payload.Variant.(type) {
-			case *server.MessagePayload:
-				plaintext, err := ratchet.Decrypt(v.Data, additional)
-				if err != nil {
-					log.Default().Println(err)
-					continue
-				}
-				out <- string(plaintext)
+			plaintext, _ := values[i].([]byte)
+			var pub []byte
+			if j := indexOf(archived.Columns, pubColumn); j >= 0 {
+				pub, _ = values[j].([]byte)
+			}
+			values[i], err = store.seal(label, pub, plaintext)
+			if err != nil {
+				return err
 			}
 		}
-	}()
+		_, err = tx.Exec(insert, values...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *clientDatabase) Export(passphrase string) ([]byte, error) {
+	tables, err := store.dumpTables()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(tables)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := crypto.GeneratePassphraseSalt()
+	if err != nil {
+		return nil, err
+	}
+	key := crypto.KeyFromPassphrase(passphrase, salt)
+	header := append([]byte(archiveMagic), salt...)
+	sealed, err := key.Encrypt(data, header)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, sealed...), nil
+}
+
+func (store *clientDatabase) Import(archive []byte, passphrase string, force bool) error {
+	headerSize := len(archiveMagic) + crypto.PassphraseSaltSize
+	if len(archive) < headerSize || string(archive[:len(archiveMagic)]) != archiveMagic {
+		return ErrBadArchive
+	}
+	header := archive[:headerSize]
+	key := crypto.KeyFromPassphrase(passphrase, header[len(archiveMagic):])
+	data, err := key.Decrypt(archive[headerSize:], header)
+	if err != nil {
+		return ErrBadArchive
+	}
+	// Numbers are kept as is, rather than as floats, which can't hold every timestamp
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var tables map[string]archivedTable
+	err = decoder.Decode(&tables)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadArchive, err)
+	}
+
+	existing, err := store.GetIdentity()
+	if err != nil {
+		return err
+	}
+	if existing != nil && !force {
+		return ErrIdentityExists
+	}
+	tx, err := store.Begin()
+	if err != nil {
+		return err
+	}
+	for _, table := range archiveTables {
+		err = store.restoreTable(tx, table, tables[table])
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// NewStore creates a new ClientStore given a path to a local database.
+//
+// This will create the database file as necessary.
+//
+// If this string is empty, a default database, placed in the user's Home directory,
+// is used instead.
+//
+// If the database was encrypted with a passphrase, this returns ErrPassphraseRequired.
+func NewStore(database string) (ClientStore, error) {
+	db, err := newClientDatabase(database)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := db.getMeta("salt")
+	if err != nil {
+		return nil, err
+	}
+	if salt != nil {
+		db.Close()
+		return nil, ErrPassphraseRequired
+	}
+	return db, err
+}
+
+// NewMemoryStore creates a ClientStore keeping everything in memory, which is lost once it's closed
+//
+// This behaves exactly like a store in a file, since it uses an in memory SQLite database.
+func NewMemoryStore() (ClientStore, error) {
+	return NewStore(MemoryDatabase)
+}
+
+// NewEncryptedStore creates a ClientStore whose private keys are encrypted with a passphrase
+//
+// If the database isn't encrypted yet, the keys it already contains are encrypted.
+// A passphrase not matching the one the database was encrypted with returns ErrBadPassphrase.
+func NewEncryptedStore(database string, passphrase string) (ClientStore, error) {
+	db, err := newClientDatabase(database)
+	if err != nil {
+		return nil, err
+	}
+	err = db.unlock(passphrase)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+type ClientAPI interface {
+	// SendPrekey registers a new prekey for this identity, accompanied with its id and a signature
+	//
+	// The upload is also signed along with a counter, which needs to increase with every upload.
+	SendPrekey(ctx context.Context, identity crypto.IdentityPub, id uint32, prekey crypto.ExchangePub, sig crypto.Signature, counter uint64, uploadSig crypto.Signature) error
+	// CountOnetimes asks how many onetime keys this identity has registered with a server
+	//
+	// This also returns the most onetime keys the server stores for an identity,
+	// or 0 if it's an older server that doesn't say.
+	CountOnetimes(context.Context, crypto.IdentityPub) (int, int, error)
+	// Presence asks whether an identity is currently connected to a server
+	Presence(context.Context, crypto.IdentityPub) (bool, error)
+	// SendName publishes a name for this identity, on servers with a directory
+	//
+	// Like with prekeys, the counter needs to increase with every name published.
+	SendName(ctx context.Context, identity crypto.IdentityPub, name string, counter uint64, sig crypto.Signature) error
+	// Lookup finds the identity which published a name, on servers with a directory
+	//
+	// The signature of the name is checked against the identity, returning ErrBadNameSignature
+	// if it doesn't match. If nobody published the name, this returns ErrNameNotFound.
+	Lookup(ctx context.Context, name string) (crypto.IdentityPub, error)
+	// SendBundle sends out a bundle, accompanied with a signature
+	SendBundle(context.Context, crypto.IdentityPub, crypto.BundlePub, crypto.Signature) error
+	// CreateSession accesses a new set of exchange keys for a session
+	//
+	// The prekey signature is checked against the identity, returning ErrBadPrekeySignature
+	// if it doesn't match. If the identity has no prekey, this returns ErrFriendNotRegistered.
+	CreateSession(context.Context, crypto.IdentityPub) (*Session, error)
+	// CreateSessions accesses the keys for up to n sessions at once, each with its own onetime key
+	//
+	// The sessions share the same prekey. If the identity has no onetime keys left, this returns
+	// a single session without one. Errors are the same as with CreateSession.
+	CreateSessions(ctx context.Context, identity crypto.IdentityPub, n int) ([]*Session, error)
+	// Listen starts listening to messages directed towards your public identity
+	//
+	// This will spawn necssary goroutines to maintain the connection, reconnecting
+	// with exponential backoff if the connection fails.
+	//
+	// This takes in a channel which will forward messages you want to send, and returns
+	// a channel for receiving incoming messages
+	//
+	// The private identity key is used to prove our identity to the server.
+	//
+	// Closing the input channel makes sure that all messages have been sent, and then
+	// disconnects from the server, closing the output channel.
+	//
+	// Cancelling the context disconnects right away, closing the output channel. Messages
+	// sent afterwards are dropped, until the input channel is closed.
+	Listen(context.Context, crypto.IdentityPub, crypto.IdentityPriv, <-chan server.Message) (<-chan server.Message, error)
+}
+
+// NewClientAPI creates a ClientAPI for a server, exchanging messages as JSON
+func NewClientAPI(url string) ClientAPI {
+	return NewClientAPIWithFormat(url, server.WireJSON)
+}
+
+// NewClientAPIWithFormat creates a ClientAPI for a server, exchanging messages in a given wire format
+//
+// Older servers only understand JSON, so protobuf should only be used with servers that support it.
+func NewClientAPIWithFormat(url string, format server.WireFormat) ClientAPI {
+	return NewClientAPIWithTimeout(url, format, DefaultRequestTimeout)
+}
+
+// DefaultRequestTimeout is how long we wait for the server to answer a request, by default
+const DefaultRequestTimeout = 30 * time.Second
+
+// NewClientAPIWithTimeout creates a ClientAPI for a server, giving up on requests that take longer than timeout
+//
+// The timeout doesn't apply to the connection used to listen for messages, which stays open.
+func NewClientAPIWithTimeout(url string, format server.WireFormat, timeout time.Duration) ClientAPI {
+	return &httpClientAPI{
+		root:   url,
+		format: format,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+type httpClientAPI struct {
+	root   string
+	format server.WireFormat
+	client *http.Client
+}
+
+// get fetches a path on the server, giving up once ctx is cancelled
+func (api *httpClientAPI) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api.root+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return api.client.Do(req)
+}
+
+// post sends a JSON body to a path on the server, giving up once ctx is cancelled
+func (api *httpClientAPI) post(ctx context.Context, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api.root+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return api.client.Do(req)
+}
+
+func (api *httpClientAPI) SendPrekey(ctx context.Context, identity crypto.IdentityPub, id uint32, prekey crypto.ExchangePub, sig crypto.Signature, counter uint64, uploadSig crypto.Signature) error {
+	idBase64 := base64.URLEncoding.EncodeToString(identity)
+	data := server.PrekeyRequest{
+		KeyID:     id,
+		Prekey:    prekey,
+		Sig:       sig,
+		Counter:   counter,
+		UploadSig: uploadSig,
+		Version:   server.ProtocolVersion,
+	}
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	resp, err := api.post(ctx, "/prekey/"+idBase64, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RenewPrekey generates a new prekey, and registers it with the server under a given id
+//
+// The current time is used as the counter of the upload, so that older uploads can't be replayed.
+func RenewPrekey(ctx context.Context, api ClientAPI, pub crypto.IdentityPub, priv crypto.IdentityPriv, id uint32) (crypto.ExchangePub, crypto.ExchangePriv, error) {
+	exchangePub, exchangePriv, err := crypto.GenerateExchange()
+	if err != nil {
+		return nil, nil, err
+	}
+	sig := priv.SignPrekey(exchangePub)
+	counter := uint64(now().UnixNano())
+	err = api.SendPrekey(ctx, pub, id, exchangePub, sig, counter, priv.SignPrekeyUpload(counter, id, exchangePub))
+	if err != nil {
+		return nil, nil, err
+	}
+	return exchangePub, exchangePriv, nil
+}
+
+// prekeyIsStale checks if we have no prekey, or if the latest is older than maxAge
+func prekeyIsStale(store ClientStore, maxAge time.Duration) (bool, error) {
+	createdAt, present, err := store.LatestPrekeyTime()
+	if err != nil {
+		return false, err
+	}
+	return !present || now().Sub(createdAt) >= maxAge, nil
+}
+
+// RotatePrekeyIfStale registers a new prekey if we have none, or if the latest is older than maxAge
+//
+// Older prekeys are kept, so that sessions started with them can still be accepted.
+// This returns the new prekey, or nil if no rotation was necessary.
+func RotatePrekeyIfStale(ctx context.Context, api ClientAPI, store ClientStore, pub crypto.IdentityPub, priv crypto.IdentityPriv, maxAge time.Duration) (crypto.ExchangePub, error) {
+	stale, err := prekeyIsStale(store, maxAge)
+	if err != nil {
+		return nil, err
+	}
+	if !stale {
+		return nil, nil
+	}
+	id, err := store.NextPrekeyID()
+	if err != nil {
+		return nil, err
+	}
+	exchangePub, exchangePriv, err := RenewPrekey(ctx, api, pub, priv, id)
+	if err != nil {
+		return nil, err
+	}
+	err = store.SavePrekey(id, exchangePub, exchangePriv)
+	if err != nil {
+		return nil, err
+	}
+	return exchangePub, nil
+}
+
+func (api *httpClientAPI) CountOnetimes(ctx context.Context, identity crypto.IdentityPub) (int, int, error) {
+	idBase64 := base64.URLEncoding.EncodeToString(identity)
+	resp, err := api.get(ctx, "/onetime/count/"+idBase64)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var data server.CountOnetimeResponse
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return data.Count, data.Max, nil
+}
+
+func (api *httpClientAPI) Presence(ctx context.Context, identity crypto.IdentityPub) (bool, error) {
+	idBase64 := base64.URLEncoding.EncodeToString(identity)
+	resp, err := api.get(ctx, "/presence/"+idBase64)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp)
+	if err != nil {
+		return false, err
+	}
+
+	var data server.PresenceResponse
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return false, err
+	}
+
+	return data.Online, nil
+}
+
+func (api *httpClientAPI) SendName(ctx context.Context, identity crypto.IdentityPub, name string, counter uint64, sig crypto.Signature) error {
+	idBase64 := base64.URLEncoding.EncodeToString(identity)
+	data := server.PublishNameRequest{
+		Name:    name,
+		Counter: counter,
+		Sig:     sig,
+	}
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	resp, err := api.post(ctx, "/name/"+idBase64, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// PublishName signs a name, and publishes it in a server's directory, replacing our previous name
+//
+// The current time is used as the counter, so that older names can't be replayed.
+func PublishName(ctx context.Context, api ClientAPI, pub crypto.IdentityPub, priv crypto.IdentityPriv, name string) error {
+	counter := uint64(now().UnixNano())
+	return api.SendName(ctx, pub, name, counter, priv.SignName(counter, name))
+}
+
+func (api *httpClientAPI) Lookup(ctx context.Context, name string) (crypto.IdentityPub, error) {
+	resp, err := api.get(ctx, "/lookup/"+url.PathEscape(name))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNameNotFound
+	}
+	err = checkResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var data server.LookupResponse
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := crypto.IdentityPub(data.Identity)
+	if identity.Validate() != nil {
+		return nil, ErrBadNameSignature
+	}
+	// Otherwise, the server could point the name at any identity it likes
+	if !identity.VerifyName(data.Counter, name, data.Sig) {
+		return nil, ErrBadNameSignature
+	}
+	return identity, nil
+}
+
+func (api *httpClientAPI) SendBundle(ctx context.Context, identity crypto.IdentityPub, bundle crypto.BundlePub, sig crypto.Signature) error {
+	idBase64 := base64.URLEncoding.EncodeToString(identity)
+	data := server.SendBundleRequest{
+		Bundle:  bundle,
+		Sig:     sig,
+		Version: server.ProtocolVersion,
+	}
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	resp, err := api.post(ctx, "/onetime/"+idBase64, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Session contains the keys needed to start a session with another identity
+type Session struct {
+	// PrekeyID lets the other identity find which prekey was used
+	PrekeyID uint32
+	Prekey   crypto.ExchangePub
+	Sig      crypto.Signature
+	// OneTime is nil if the identity had no onetime keys left
+	OneTime crypto.ExchangePub
+}
+
+// requestSession asks for the keys of an identity, checking the signature of its prekey
+//
+// The query is added to the request, to ask for several onetime keys.
+func (api *httpClientAPI) requestSession(ctx context.Context, identity crypto.IdentityPub, query string) (*server.SessionResponse, crypto.ExchangePub, error) {
+	idBase64 := base64.URLEncoding.EncodeToString(identity)
+	resp, err := api.post(ctx, "/session/"+idBase64+query, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil, ErrFriendNotRegistered
+	}
+	err = checkResponse(resp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var data server.SessionResponse
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prekey, err := crypto.ExchangePubFromBytes(data.Prekey)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Otherwise, the server could substitute its own prekey
+	if !identity.VerifyPrekey(prekey, data.Sig) {
+		return nil, nil, ErrBadPrekeySignature
+	}
+	return &data, prekey, nil
+}
+
+func (api *httpClientAPI) CreateSession(ctx context.Context, identity crypto.IdentityPub) (*Session, error) {
+	data, prekey, err := api.requestSession(ctx, identity, "")
+	if err != nil {
+		return nil, err
+	}
+
+	onetime, err := onetimeFromBytes(data.OneTime)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		PrekeyID: data.KeyID,
+		Prekey:   prekey,
+		Sig:      data.Sig,
+		OneTime:  onetime,
+	}, nil
+}
+
+func (api *httpClientAPI) CreateSessions(ctx context.Context, identity crypto.IdentityPub, n int) ([]*Session, error) {
+	if n < 1 || n > server.MaxSessionOnetimes {
+		return nil, fmt.Errorf("can't create %d sessions at once", n)
+	}
+	data, prekey, err := api.requestSession(ctx, identity, fmt.Sprintf("?count=%d", n))
+	if err != nil {
+		return nil, err
+	}
+
+	onetimes := data.OneTimes
+	// Older servers ignore the count, and hand out a single key
+	if len(onetimes) == 0 && len(data.OneTime) > 0 {
+		onetimes = [][]byte{data.OneTime}
+	}
+	if len(onetimes) > n {
+		return nil, fmt.Errorf("asked for %d onetime keys, but got %d", n, len(onetimes))
+	}
+	// Without any onetime keys left, the prekey still makes for a session
+	if len(onetimes) == 0 {
+		return []*Session{{PrekeyID: data.KeyID, Prekey: prekey, Sig: data.Sig}}, nil
+	}
+	sessions := make([]*Session, len(onetimes))
+	for i, bytes := range onetimes {
+		onetime, err := crypto.ExchangePubFromBytes(bytes)
+		if err != nil {
+			return nil, err
+		}
+		sessions[i] = &Session{
+			PrekeyID: data.KeyID,
+			Prekey:   prekey,
+			Sig:      data.Sig,
+			OneTime:  onetime,
+		}
+	}
+	return sessions, nil
+}
+
+// onetimeFromBytes parses an optional onetime key, returning nil if it's absent
+func onetimeFromBytes(data []byte) (crypto.ExchangePub, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return crypto.ExchangePubFromBytes(data)
+}
+
+// DefaultOnetimeThreshold is the number of onetime keys below which we upload a new bundle
+const DefaultOnetimeThreshold = 10
+
+// needsBundle checks if a new bundle should be uploaded, given how many onetime keys the server has left
+func needsBundle(count int, threshold int) bool {
+	return threshold <= 0 || count < threshold
+}
+
+// checkOnetimeSettings returns an error if the threshold or bundle size can't work with a server
+//
+// A server storing at most max onetime keys never has as many as a threshold above max,
+// so new bundles would be uploaded forever. A max of 0 means the server didn't say.
+func checkOnetimeSettings(threshold int, bundleSize int, max int) error {
+	err := crypto.CheckBundleSize(bundleSize)
+	if err != nil {
+		return err
+	}
+	if max > 0 && threshold > max {
+		return fmt.Errorf("onetime threshold %d is above the %d onetime keys the server stores", threshold, max)
+	}
+	return nil
+}
+
+// KeyPlan describes what registering our keys with a server would do
+type KeyPlan struct {
+	// NewPrekey is true if a new prekey would be registered
+	NewPrekey bool
+	// Onetimes is the number of onetime keys the server has left
+	Onetimes int
+	// NewBundle is true if a new bundle of onetime keys would be uploaded
+	NewBundle bool
+}
+
+// PlanKeys checks what RotatePrekeyIfStale and CreateNewBundleIfNecessary would do
+//
+// Nothing is saved, or sent to the server, besides asking how many onetime keys are left.
+// The threshold and bundle size are checked in the same way.
+func PlanKeys(ctx context.Context, api ClientAPI, store ClientStore, pub crypto.IdentityPub, threshold int, bundleSize int, maxAge time.Duration) (KeyPlan, error) {
+	var plan KeyPlan
+	var err error
+	plan.NewPrekey, err = prekeyIsStale(store, maxAge)
+	if err != nil {
+		return plan, err
+	}
+	var max int
+	plan.Onetimes, max, err = api.CountOnetimes(ctx, pub)
+	if err != nil {
+		return plan, err
+	}
+	err = checkOnetimeSettings(threshold, bundleSize, max)
+	if err != nil {
+		return plan, err
+	}
+	plan.NewBundle = needsBundle(plan.Onetimes, threshold)
+	return plan, nil
+}
+
+// CreateNewBundleIfNecessary uploads a new bundle if the server has fewer onetime keys than a threshold
+//
+// A threshold <= 0 means that a new bundle is always created, unless the server
+// has no room left. The bundle has bundleSize keys, shrunk to fit in the keys the
+// server has room for. A threshold above the keys the server stores is an error.
+// This returns true if a new bundle was created.
+func CreateNewBundleIfNecessary(ctx context.Context, api ClientAPI, store ClientStore, pub crypto.IdentityPub, priv crypto.IdentityPriv, threshold int, bundleSize int) (bool, error) {
+	count, max, err := api.CountOnetimes(ctx, pub)
+	if err != nil {
+		return false, err
+	}
+	err = checkOnetimeSettings(threshold, bundleSize, max)
+	if err != nil {
+		return false, err
+	}
+	if !needsBundle(count, threshold) {
+		return false, nil
+	}
+	size := bundleSize
+	if max > 0 && size > max-count {
+		size = max - count
+	}
+	if size <= 0 {
+		return false, nil
+	}
+	err = createBundle(ctx, api, store, pub, priv, size)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// createBundle generates a bundle of count onetime keys, saving it before uploading it
+//
+// If the upload fails, the saved keys are removed again.
+func createBundle(ctx context.Context, api ClientAPI, store ClientStore, pub crypto.IdentityPub, priv crypto.IdentityPriv, count int) error {
+	bundlePub, bundlePriv, err := crypto.GenerateBundle(count)
+	if err != nil {
+		return err
+	}
+	err = store.SaveBundle(bundlePub, bundlePriv)
+	if err != nil {
+		return err
+	}
+	sig := priv.SignBundle(bundlePub)
+	err = api.SendBundle(ctx, pub, bundlePub, sig)
+	if err != nil {
+		removeErr := store.RemoveBundle(bundlePub)
+		if removeErr != nil {
+			log.Default().Printf("couldn't remove onetime keys which weren't uploaded: %v", removeErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// CreateBundles uploads count new onetime keys, even if the server has plenty left
+//
+// The count needs to fit in the room the server has left, and the keys are split into
+// bundles the server accepts. This returns how many keys were uploaded, which is less
+// than count if one of the bundles failed.
+func CreateBundles(ctx context.Context, api ClientAPI, store ClientStore, pub crypto.IdentityPub, priv crypto.IdentityPriv, count int) (int, error) {
+	if count <= 0 {
+		return 0, fmt.Errorf("can't create %d onetime keys", count)
+	}
+	onetimes, max, err := api.CountOnetimes(ctx, pub)
+	if err != nil {
+		return 0, err
+	}
+	chunk := crypto.MaxBundleSize
+	if max > 0 {
+		if count > max-onetimes {
+			return 0, fmt.Errorf("can't create %d onetime keys, the server only has room for %d more", count, max-onetimes)
+		}
+		if chunk > max {
+			chunk = max
+		}
+	}
+	uploaded := 0
+	for uploaded < count {
+		size := count - uploaded
+		if size > chunk {
+			size = chunk
+		}
+		err := createBundle(ctx, api, store, pub, priv, size)
+		if err != nil {
+			return uploaded, err
+		}
+		uploaded += size
+	}
+	return uploaded, nil
+}
+
+// MaintainKeys periodically uploads a new bundle of bundleSize keys, whenever the server has fewer onetime keys than a threshold
+//
+// This runs in the background, until ctx is cancelled. Each time a new bundle is uploaded,
+// a notification is sent on the returned channel. Errors are logged, and checking resumes
+// after the next interval.
+func MaintainKeys(ctx context.Context, api ClientAPI, store ClientStore, pub crypto.IdentityPub, priv crypto.IdentityPriv, threshold int, bundleSize int, interval time.Duration) <-chan struct{} {
+	created := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			newBundle, err := CreateNewBundleIfNecessary(ctx, api, store, pub, priv, threshold, bundleSize)
+			if err != nil {
+				log.Default().Println(err)
+				continue
+			}
+			if !newBundle {
+				continue
+			}
+			select {
+			case created <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return created
+}
+
+// The initial delay before trying to reconnect to the server
+const initialBackoff = 500 * time.Millisecond
+
+// The maximum delay between attempts to reconnect to the server
+const maxBackoff = 30 * time.Second
+
+// The number of failed attempts to reconnect to the server, after which we give up
+const maxReconnectAttempts = 10
+
+// websocketURL derives the URL used to listen for messages from the root of a server
+//
+// Servers reached over https are accessed with wss, and servers reached over http with ws.
+func websocketURL(root string, id crypto.IdentityPub) (string, error) {
+	dialUrl, err := url.Parse(root)
+	if err != nil {
+		return "", err
+	}
+	switch dialUrl.Scheme {
+	case "https":
+		dialUrl.Scheme = "wss"
+	case "http":
+		dialUrl.Scheme = "ws"
+	default:
+		return "", fmt.Errorf("unsupported URL scheme: %q", dialUrl.Scheme)
+	}
+	idBase64 := base64.URLEncoding.EncodeToString(id)
+	dialUrl.Path = fmt.Sprintf("%s/rtc/%s", strings.TrimSuffix(dialUrl.Path, "/"), idBase64)
+	return dialUrl.String(), nil
+}
+
+// dial connects to the server, and then answers its authentication challenge
+func (api *httpClientAPI) dial(ctx context.Context, id crypto.IdentityPub, priv crypto.IdentityPriv) (*websocket.Conn, error) {
+	dialUrl, err := websocketURL(api.root, id)
+	if err != nil {
+		return nil, err
+	}
+	// Older servers ignore this, and keep using JSON
+	dialUrl += "?" + url.Values{"format": {string(api.format)}}.Encode()
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, dialUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	var challenge server.AuthChallenge
+	err = conn.ReadJSON(&challenge)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	err = conn.WriteJSON(server.AuthResponse{Sig: priv.Sign(server.AuthData(challenge.Nonce))})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// serveConn forwards messages over a connection, until that connection fails, in is closed, or ctx is cancelled.
+//
+// The pending messages are sent first. The messages that couldn't be written are
+// returned, so that they can be sent again later.
+// The boolean is true if we stopped because in was closed, or ctx was cancelled.
+func serveConn(ctx context.Context, conn *websocket.Conn, format server.WireFormat, pending []server.Message, in <-chan server.Message, out chan<- server.Message) ([]server.Message, bool) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				log.Default().Println(err)
+				return
+			}
+			msg, err := server.DecodeMessage(messageType, data)
+			if err != nil {
+				log.Default().Println(err)
+				continue
+			}
+			select {
+			case out <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+	for {
+		if len(pending) == 0 {
+			select {
+			case msg, ok := <-in:
+				if !ok {
+					closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+					conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+					return nil, true
+				}
+				pending = append(pending, msg)
+			case <-done:
+				return nil, false
+			case <-ctx.Done():
+				return nil, true
+			}
+		}
+		pending[0].Version = server.MessageVersion
+		messageType, data, err := server.EncodeMessage(format, pending[0])
+		if err != nil {
+			// This message can never be sent, so there's no point in retrying it
+			log.Default().Println(err)
+			pending = pending[1:]
+			continue
+		}
+		err = conn.WriteMessage(messageType, data)
+		if err != nil {
+			log.Default().Println(err)
+			return pending, false
+		}
+		pending = pending[1:]
+	}
+}
+
+// supervise keeps a connection to the server alive, reconnecting whenever it fails
+//
+// Messages sent while we're reconnecting are held until we're connected again.
+// out is closed once in is closed, ctx is cancelled, or we've given up on reconnecting.
+func (api *httpClientAPI) supervise(ctx context.Context, id crypto.IdentityPub, priv crypto.IdentityPriv, conn *websocket.Conn, in <-chan server.Message, out chan<- server.Message) {
+	var pending []server.Message
+	for {
+		var finished bool
+		pending, finished = serveConn(ctx, conn, api.format, pending, in, out)
+		if finished {
+			break
+		}
+		conn, pending, finished = api.reconnect(ctx, id, priv, pending, in)
+		if finished {
+			break
+		}
+	}
+	close(out)
+	if ctx.Err() != nil {
+		// Whoever is still sending shouldn't block forever, now that nothing gets sent
+		for range in {
+		}
+	}
+}
+
+// reconnect dials the server again, backing off exponentially between attempts
+//
+// Messages arriving on in while we wait are added to pending. The boolean is true
+// if in was closed, ctx was cancelled, or we ran out of attempts, in which case we stop supervising.
+func (api *httpClientAPI) reconnect(ctx context.Context, id crypto.IdentityPub, priv crypto.IdentityPriv, pending []server.Message, in <-chan server.Message) (*websocket.Conn, []server.Message, bool) {
+	backoff := initialBackoff
+	for attempt := 0; attempt < maxReconnectAttempts; attempt++ {
+		timer := time.NewTimer(backoff)
+	wait:
+		for {
+			select {
+			case msg, ok := <-in:
+				if !ok {
+					timer.Stop()
+					return nil, nil, true
+				}
+				pending = append(pending, msg)
+			case <-timer.C:
+				break wait
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, nil, true
+			}
+		}
+		conn, err := api.dial(ctx, id, priv)
+		if err == nil {
+			return conn, pending, false
+		}
+		log.Default().Println(err)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	log.Default().Printf("giving up after %d attempts to reconnect", maxReconnectAttempts)
+	return nil, nil, true
+}
+
+func (api *httpClientAPI) Listen(ctx context.Context, id crypto.IdentityPub, priv crypto.IdentityPriv, in <-chan server.Message) (<-chan server.Message, error) {
+	conn, err := api.dial(ctx, id, priv)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan server.Message)
+	go api.supervise(ctx, id, priv, conn, in, out)
+	return out, nil
+}
+
+// conversation is an established session with a friend
+type conversation struct {
+	me   crypto.IdentityPub
+	them crypto.IdentityPub
+	// in is used to send messages
+	in chan<- server.Message
+	// out receives incoming messages
+	out <-chan server.Message
+	// ratchetLock protects the ratchet, since we send and receive concurrently
+	ratchetLock sync.Mutex
+	// ratchet encrypts and decrypts messages
+	ratchet crypto.DoubleRatchet
+	// additional is the data authenticated with every message
+	additional []byte
+	// received holds the ids of the messages we've received, since our friend sends them again if our ack is lost
+	received map[string]bool
+	// fingerprint summarizes the secret the session started with, or is empty for resumed sessions
+	fingerprint string
+}
+
+// seal encrypts a message with the ratchet
+func (conv *conversation) seal(plaintext, additional []byte) ([]byte, error) {
+	conv.ratchetLock.Lock()
+	defer conv.ratchetLock.Unlock()
+	return conv.ratchet.Encrypt(plaintext, additional)
+}
+
+// save persists the state of the ratchet, so that this conversation can be resumed later
+func (conv *conversation) save(store ClientStore) error {
+	conv.ratchetLock.Lock()
+	defer conv.ratchetLock.Unlock()
+	return store.SaveSession(conv.them, &conv.ratchet, conv.additional)
+}
+
+// resumeConversation loads a conversation with a friend from a session we've saved
+//
+// The conversation isn't connected yet, so its channels need to be filled in.
+func resumeConversation(store ClientStore, me crypto.IdentityPub, them crypto.IdentityPub) (*conversation, error) {
+	ratchet, additional, err := store.GetSession(them)
+	if err != nil {
+		return nil, err
+	}
+	return &conversation{me: me, them: them, ratchet: ratchet, additional: additional}, nil
+}
+
+// open decrypts a message with the ratchet
+func (conv *conversation) open(ciphertext, additional []byte) ([]byte, error) {
+	conv.ratchetLock.Lock()
+	defer conv.ratchetLock.Unlock()
+	return conv.ratchet.Decrypt(ciphertext, additional)
+}
+
+// send sends a payload to our friend, returning ErrSendTimeout if the connection is stalled
+func (conv *conversation) send(variant interface{}) error {
+	msg := server.Message{
+		From:    conv.me,
+		To:      conv.them,
+		Payload: server.Payload{Variant: variant},
+	}
+	timer := time.NewTimer(sendTimeout)
+	defer timer.Stop()
+	select {
+	case conv.in <- msg:
+		return nil
+	case <-timer.C:
+		return ErrSendTimeout
+	}
+}
+
+// handshake connects to the server, and establishes a session with a friend
+//
+// If the deadline fires before our friend answers, this returns ErrFriendNotOnline.
+// A nil deadline waits forever. Cancelling ctx gives up, returning its error.
+func handshake(ctx context.Context, api ClientAPI, store ClientStore, me crypto.IdentityPub, myPriv crypto.IdentityPriv, them crypto.IdentityPub, deadline <-chan time.Time) (*conversation, error) {
+	inMessage := make(chan server.Message)
+	outMessage, err := api.Listen(ctx, me, myPriv, inMessage)
+	if err != nil {
+		return nil, err
+	}
+	conv, err := negotiate(store, me, myPriv, them, inMessage, outMessage, deadline)
+	if err != nil {
+		close(inMessage)
+		for range outMessage {
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return conv, nil
+}
+
+// acceptExchange finishes an exchange a friend started with us, creating a conversation
+//
+// The conversation isn't connected yet, so its channels need to be filled in.
+func acceptExchange(store ClientStore, me crypto.IdentityPub, myPriv crypto.IdentityPriv, them crypto.IdentityPub, v *server.EndExchangePayload) (*conversation, error) {
+	var additional []byte
+	additional = append(additional, them...)
+	additional = append(additional, me...)
+
+	ephemeral, err := crypto.ExchangePubFromBytes(v.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	prekey, err := crypto.ExchangePubFromBytes(v.Prekey)
+	if err != nil {
+		return nil, err
+	}
+
+	onetime, err := onetimeFromBytes(v.OneTime)
+	if err != nil {
+		return nil, err
+	}
+
+	prekeyPriv, err := store.GetPrekey(v.PrekeyID, prekey)
+	if err != nil {
+		return nil, err
+	}
+
+	var onetimePriv crypto.ExchangePriv
+	if onetime != nil {
+		onetimePriv, err = store.BurnOnetime(onetime)
+		if err == ErrNoSuchOnetime {
+			return nil, fmt.Errorf("exchange from %s used a onetime key we don't have: %w", them, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	secret, err := crypto.BackwardExchange(&crypto.BackwardExchangeParams{
+		Them:      them,
+		Ephemeral: ephemeral,
+		Identity:  myPriv,
+		Prekey:    prekeyPriv,
+		OneTime:   onetimePriv,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ratchet := crypto.DoubleRatchetFromReceiver(secret, prekey, prekeyPriv)
+	fingerprint := secret.Fingerprint()
+	secret.Wipe()
+	onetimePriv.Wipe()
+	_, err = ratchet.Decrypt(v.InitialData, additional)
+	if err != nil {
+		return nil, err
+	}
+	return &conversation{me: me, them: them, ratchet: ratchet, additional: additional, fingerprint: fingerprint}, nil
+}
+
+// nextExchangeMessage waits for the next message starting or ending an exchange with a friend
+//
+// Other messages, such as those sent by other people, or left over from an older
+// session, can't be understood without a session, so they're skipped. If the deadline
+// fires first, this returns ErrFriendNotOnline.
+func nextExchangeMessage(them crypto.IdentityPub, outMessage <-chan server.Message, deadline <-chan time.Time) (server.Message, error) {
+	for {
+		select {
+		case msg, ok := <-outMessage:
+			if !ok {
+				return server.Message{}, errors.New("connection closed during handshake")
+			}
+			if !bytes.Equal(msg.From, them) {
+				continue
+			}
+			switch msg.Payload.Variant.(type) {
+			case *server.StartExchangePayload, *server.EndExchangePayload:
+				return msg, nil
+			}
+		case <-deadline:
+			return server.Message{}, ErrFriendNotOnline
+		}
+	}
+}
+
+// negotiate establishes a session with a friend, over an existing connection
+//
+// Depending on who asked to start the session first, we either initiate the exchange, or
+// receive it. If the deadline fires before our friend answers, this returns ErrFriendNotOnline.
+func negotiate(store ClientStore, me crypto.IdentityPub, myPriv crypto.IdentityPriv, them crypto.IdentityPub, inMessage chan<- server.Message, outMessage <-chan server.Message, deadline <-chan time.Time) (*conversation, error) {
+	inMessage <- server.Message{
+		From: me,
+		To:   them,
+		Payload: server.Payload{
+			Variant: &server.QueryExchangePayload{},
+		},
+	}
+	var additional []byte
+	msg, err := nextExchangeMessage(them, outMessage, deadline)
+	if err != nil {
+		return nil, err
+	}
+	var ratchet crypto.DoubleRatchet
+	var fingerprint string
+	switch v := msg.Payload.Variant.(type) {
+	case *server.StartExchangePayload:
+		additional = append(additional, me...)
+		additional = append(additional, them...)
+
+		prekey, err := crypto.ExchangePubFromBytes(v.Prekey)
+		if err != nil {
+			return nil, err
+		}
+		if !them.VerifyPrekey(v.Prekey, v.Sig) {
+			return nil, ErrBadPrekeySignature
+		}
+		// Without a onetime key, the exchange falls back to using 3 DH operations
+		onetime, err := onetimeFromBytes(v.OneTime)
+		if err != nil {
+			return nil, err
+		}
+		ephemeralPub, ephemeralPriv, err := crypto.GenerateExchange()
+		if err != nil {
+			return nil, err
+		}
+		secret, err := crypto.ForwardExchange(&crypto.ForwardExchangeParams{
+			Me:        myPriv,
+			Ephemeral: ephemeralPriv,
+			Identity:  them,
+			Prekey:    prekey,
+			OneTime:   onetime,
+		})
+		if err != nil {
+			return nil, err
+		}
+		ratchet, err = crypto.DoubleRatchetFromInitiator(secret, prekey)
+		fingerprint = secret.Fingerprint()
+		secret.Wipe()
+		ephemeralPriv.Wipe()
+		if err != nil {
+			return nil, err
+		}
+		initialData, err := ratchet.Encrypt(nil, additional)
+		if err != nil {
+			return nil, err
+		}
+		inMessage <- server.Message{
+			From: me,
+			To:   them,
+			Payload: server.Payload{
+				Variant: &server.EndExchangePayload{
+					PrekeyID:    v.KeyID,
+					Prekey:      prekey,
+					OneTime:     onetime,
+					Ephemeral:   ephemeralPub,
+					InitialData: initialData,
+				},
+			},
+		}
+	case *server.EndExchangePayload:
+		conv, err := acceptExchange(store, me, myPriv, them, v)
+		if err != nil {
+			return nil, err
+		}
+		conv.in = inMessage
+		conv.out = outMessage
+		return conv, nil
+	}
+	return &conversation{
+		me:          me,
+		them:        them,
+		in:          inMessage,
+		out:         outMessage,
+		ratchet:     ratchet,
+		additional:  additional,
+		fingerprint: fingerprint,
+	}, nil
+}
+
+// fileAdditional extends the additional data of a conversation with the metadata of a file
+//
+// This makes sure that the server can't tamper with the name or type of a file.
+func fileAdditional(additional []byte, name string, mimeType string) []byte {
+	out := append([]byte(nil), additional...)
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(name)))
+	out = append(out, length[:]...)
+	out = append(out, name...)
+	out = append(out, mimeType...)
+	return out
+}
+
+// maxSealOverhead bounds the number of bytes the ratchet adds to what it encrypts
+const maxSealOverhead = 128
+
+// checkFileSize makes sure that a file fits in a single message, since the server closes
+// the connection of clients sending larger messages.
+//
+// The limit is checked against JSON, which is larger than the other wire formats.
+func checkFileSize(me crypto.IdentityPub, them crypto.IdentityPub, name string, mimeType string, size int) error {
+	_, data, err := server.EncodeMessage(server.WireJSON, server.Message{
+		From: me,
+		To:   them,
+		Payload: server.Payload{
+			Variant: &server.FilePayload{Name: name, MimeType: mimeType, Data: make([]byte, size+maxSealOverhead)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if len(data) > server.DefaultMaxMessageBytes {
+		return ErrFileTooLarge
+	}
+	return nil
+}
+
+// SendFile establishes a session with a friend, sends them a file, and waits for them
+// to acknowledge it
+//
+// The contents of the file are encrypted, but the name and type are visible to the server.
+// Files that don't fit in a single message are rejected with ErrFileTooLarge. The timeout
+// covers the whole exchange: if our friend doesn't answer in time, this returns
+// ErrFriendNotOnline, and if they don't send back a receipt, this returns ErrNoReceipt.
+func SendFile(ctx context.Context, api ClientAPI, store ClientStore, me crypto.IdentityPub, myPriv crypto.IdentityPriv, them crypto.IdentityPub, name string, mimeType string, data []byte, timeout time.Duration) error {
+	err := checkFileSize(me, them, name, mimeType, len(data))
+	if err != nil {
+		return err
+	}
+	deadline := time.After(timeout)
+	conv, err := handshake(ctx, api, store, me, myPriv, them, deadline)
+	if err != nil {
+		return err
+	}
+	// Closing our side of the connection makes sure that everything is sent before we return
+	defer func() {
+		close(conv.in)
+		for range conv.out {
+		}
+	}()
+	ciphertext, err := conv.seal(data, fileAdditional(conv.additional, name, mimeType))
+	if err != nil {
+		return err
+	}
+	conv.in <- server.Message{
+		From: me,
+		To:   them,
+		Payload: server.Payload{
+			Variant: &server.FilePayload{Name: name, MimeType: mimeType, Data: ciphertext},
+		},
+	}
+	return conv.awaitReceipt(messageID(ciphertext), deadline)
+}
+
+// awaitReceipt waits for our friend to acknowledge one of the messages we've sent
+//
+// If the connection closes, or the deadline fires first, this returns ErrNoReceipt.
+func (conv *conversation) awaitReceipt(id []byte, deadline <-chan time.Time) error {
+	for {
+		select {
+		case msg, ok := <-conv.out:
+			if !ok {
+				return ErrNoReceipt
+			}
+			if !bytes.Equal(msg.From, conv.them) {
+				continue
+			}
+			receipt, ok := msg.Payload.Variant.(*server.ReceiptPayload)
+			if !ok || !bytes.Equal(receipt.MessageID, id) {
+				continue
+			}
+			_, err := conv.open(receipt.Data, tagAdditional(conv.additional, "receipt", id))
+			if err != nil {
+				return err
+			}
+			return nil
+		case <-deadline:
+			return ErrNoReceipt
+		}
+	}
+}
+
+// SendMessage establishes a session with a friend, sends them a single message, and waits
+// for them to acknowledge it
+//
+// The timeout covers the whole exchange: if our friend doesn't answer in time, this returns
+// ErrFriendNotOnline, and if they don't send back a receipt, this returns ErrNoReceipt.
+func SendMessage(ctx context.Context, api ClientAPI, store ClientStore, me crypto.IdentityPub, myPriv crypto.IdentityPriv, them crypto.IdentityPub, text string, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	conv, err := handshake(ctx, api, store, me, myPriv, them, deadline)
+	if err != nil {
+		return err
+	}
+	// Closing our side of the connection makes sure that everything is sent before we return
+	defer func() {
+		close(conv.in)
+		for range conv.out {
+		}
+	}()
+	ciphertext, err := conv.seal([]byte(text), conv.additional)
+	if err != nil {
+		return err
+	}
+	id := messageID(ciphertext)
+	ackID, err := newMessageID()
+	if err != nil {
+		return err
+	}
+	conv.in <- server.Message{
+		From: me,
+		To:   them,
+		Payload: server.Payload{
+			Variant: &server.MessagePayload{MessageID: ackID, Data: ciphertext},
+		},
+	}
+	err = store.SaveMessage(them, true, text, now())
+	if err != nil {
+		return err
+	}
+	return conv.awaitReceipt(id, deadline)
+}
+
+// saveReceivedFile writes a file we've received to a new temporary file, returning its path
+func saveReceivedFile(name string, data []byte) (string, error) {
+	// Only keep the base name, so that the sender can't choose where the file goes
+	name = filepath.Base(name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		name = "file"
+	}
+	file, err := os.CreateTemp("", "nuntius-*-"+name)
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		file.Close()
+		return "", err
+	}
+	return file.Name(), file.Close()
+}
+
+// EventKind distinguishes the different things that can happen during a chat
+type EventKind int
+
+const (
+	// EventMessage means that our friend sent us a message
+	EventMessage EventKind = iota
+	// EventFile means that our friend sent us a file, which we saved
+	EventFile
+	// EventTyping means that our friend started typing
+	EventTyping
+	// EventReceipt means that our friend read one of our messages
+	EventReceipt
+	// EventDelivered means that our friend received and decrypted one of our messages
+	EventDelivered
+	// EventUndelivered means that our friend didn't acknowledge one of our messages in time
+	EventUndelivered
+	// EventFingerprint answers FingerprintCommand, with the fingerprint of the session
+	EventFingerprint
+	// EventStalled means that the connection to the server didn't take one of our messages in time
+	//
+	// The message is sent again, like messages our friend doesn't acknowledge.
+	EventStalled
+)
+
+// FingerprintCommand is sent instead of a message to ask for the fingerprint of the session
+//
+// Comparing the fingerprint with our friend's, out of band, makes sure nobody is in the middle of the session.
+const FingerprintCommand = "/fp"
+
+// ChatEvent is something that happened during a chat
+type ChatEvent struct {
+	Kind EventKind
+	// Text is the body of a message, the path where a file was saved, or a fingerprint
+	//
+	// For receipts, acks, and messages that weren't acknowledged or couldn't be sent,
+	// this is the body of the message we sent.
+	Text string
+}
+
+// messageIDSize is the number of bytes in a message ID
+const messageIDSize = 16
+
+// messageID identifies a message, using its ciphertext
+func messageID(ciphertext []byte) []byte {
+	hash := sha256.Sum256(ciphertext)
+	return hash[:messageIDSize]
+}
+
+// newMessageID generates a random id for a message, which our friend acknowledges
+func newMessageID() ([]byte, error) {
+	id := make([]byte, messageIDSize)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// tagAdditional extends the additional data of a conversation for a specific kind of payload
+//
+// This means that these authenticators can't be confused with the ciphertexts of other payloads.
+func tagAdditional(additional []byte, tag string, data []byte) []byte {
+	out := append([]byte(nil), additional...)
+	out = append(out, tag...)
+	out = append(out, data...)
+	return out
+}
+
+// acknowledge sends a receipt for a message our friend sent us, given its ciphertext
+func (conv *conversation) acknowledge(ciphertext []byte) {
+	id := messageID(ciphertext)
+	data, err := conv.seal(nil, tagAdditional(conv.additional, "receipt", id))
+	if err != nil {
+		log.Default().Println(err)
+		return
+	}
+	err = conv.send(&server.ReceiptPayload{MessageID: id, Data: data})
+	if err != nil {
+		log.Default().Println(err)
+	}
+}
+
+// ack lets our friend know that we've decrypted a message, given the id they chose for it
+func (conv *conversation) ack(id []byte) {
+	data, err := conv.seal(nil, tagAdditional(conv.additional, "ack", id))
+	if err != nil {
+		log.Default().Println(err)
+		return
+	}
+	err = conv.send(&server.AckPayload{MessageID: id, Data: data})
+	if err != nil {
+		log.Default().Println(err)
+	}
+}
+
+// receive handles a message our friend sent us, emitting the events it produces
+//
+// Messages with an id are acked as soon as they're decrypted, and ones we've already
+// received under that id are only acked again. Messages and files are
+// acknowledged with a receipt, once they've been emitted. Receipts and acks we
+// receive are left to the caller, since only it knows which messages it sent.
+func (conv *conversation) receive(store ClientStore, msg server.Message, emit func(ChatEvent)) {
+	switch v := msg.Payload.Variant.(type) {
+	case *server.MessagePayload:
+		plaintext, err := conv.open(v.Data, conv.additional)
+		if err != nil {
+			log.Default().Println(err)
+			return
+		}
+		if len(v.MessageID) > 0 {
+			conv.ack(v.MessageID)
+			if conv.received[string(v.MessageID)] {
+				return
+			}
+			if conv.received == nil {
+				conv.received = make(map[string]bool)
+			}
+			conv.received[string(v.MessageID)] = true
+		}
+		err = store.SaveMessage(conv.them, false, string(plaintext), now())
+		if err != nil {
+			log.Default().Println(err)
+		}
+		emit(ChatEvent{Kind: EventMessage, Text: string(plaintext)})
+		conv.acknowledge(v.Data)
+	case *server.FilePayload:
+		data, err := conv.open(v.Data, fileAdditional(conv.additional, v.Name, v.MimeType))
+		if err != nil {
+			log.Default().Println(err)
+			return
+		}
+		path, err := saveReceivedFile(v.Name, data)
+		if err != nil {
+			log.Default().Println(err)
+			return
+		}
+		emit(ChatEvent{Kind: EventFile, Text: path})
+		conv.acknowledge(v.Data)
+	case *server.TypingPayload:
+		_, err := conv.open(v.Data, tagAdditional(conv.additional, "typing", nil))
+		if err != nil {
+			log.Default().Println(err)
+			return
+		}
+		emit(ChatEvent{Kind: EventTyping})
+	}
+}
+
+// StartChat establishes a session with a friend, and then starts chatting with them
+//
+// Messages sent over in are encrypted and sent to our friend. Sending over typing
+// lets our friend know that we've started typing. The returned channel contains
+// the events happening in the chat, including messages from our friend.
+// Sending FingerprintCommand over in emits the fingerprint of the session, instead of sending it.
+// A new session is always negotiated, so a missing session, after a reset for example, starts fresh.
+func StartChat(ctx context.Context, api ClientAPI, store ClientStore, me crypto.IdentityPub, myPriv crypto.IdentityPriv, them crypto.IdentityPub, in <-chan string, typing <-chan struct{}) (<-chan ChatEvent, error) {
+	queued, err := store.UndeliveredMessages(them)
+	if err != nil {
+		return nil, err
+	}
+	conv, err := handshake(ctx, api, store, me, myPriv, them, nil)
+	if err != nil {
+		return nil, err
+	}
+	// We remember the messages we've sent, by the id their receipts use, in order to show which ones were read
+	var sentLock sync.Mutex
+	sent := make(map[string]string)
+	// Messages waiting for an ack are flagged if it doesn't arrive in time, and map to their receipt id
+	pending := make(map[string]string)
+	out := make(chan ChatEvent)
+	// send encrypts a message from the outbox, and sends it to our friend
+	//
+	// Messages our friend doesn't ack in time are flagged, and sent again, up to maxSendAttempts times.
+	// They stay in the outbox until they're acked, so that they're sent again the next time we chat.
+	var send func(ackID []byte, body string, attempt int)
+	send = func(ackID []byte, body string, attempt int) {
+		ciphertext, err := conv.seal([]byte(body), conv.additional)
+		if err != nil {
+			log.Default().Println(err)
+			return
+		}
+		receiptID := string(messageID(ciphertext))
+		sentLock.Lock()
+		sent[receiptID] = body
+		pending[string(ackID)] = receiptID
+		sentLock.Unlock()
+		time.AfterFunc(ackTimeout, func() {
+			if ctx.Err() != nil {
+				return
+			}
+			sentLock.Lock()
+			_, present := pending[string(ackID)]
+			if present && attempt >= maxSendAttempts {
+				delete(pending, string(ackID))
+			}
+			sentLock.Unlock()
+			if !present {
+				return
+			}
+			if attempt == 1 {
+				out <- ChatEvent{Kind: EventUndelivered, Text: body}
+			}
+			if attempt < maxSendAttempts {
+				send(ackID, body, attempt+1)
+			}
+		})
+		// The message stays pending, so it's sent again if the connection recovers
+		err = conv.send(&server.MessagePayload{MessageID: ackID, Data: ciphertext})
+		if err != nil {
+			out <- ChatEvent{Kind: EventStalled, Text: body}
+		}
+	}
+	go func() {
+		// Messages left over from the last time we chatted go out first, in a session our friend can decrypt
+		for _, msg := range queued {
+			send(msg.AckID, msg.Body, 1)
+		}
+		for {
+			select {
+			case stringMsg := <-in:
+				if stringMsg == FingerprintCommand {
+					out <- ChatEvent{Kind: EventFingerprint, Text: conv.fingerprint}
+					continue
+				}
+				ackID, err := newMessageID()
+				if err != nil {
+					log.Default().Println(err)
+					continue
+				}
+				err = store.EnqueueMessage(them, ackID, stringMsg)
+				if err != nil {
+					log.Default().Println(err)
+					continue
+				}
+				send(ackID, stringMsg, 1)
+				err = store.SaveMessage(them, true, stringMsg, now())
+				if err != nil {
+					log.Default().Println(err)
+				}
+			case <-typing:
+				data, err := conv.seal(nil, tagAdditional(conv.additional, "typing", nil))
+				if err != nil {
+					log.Default().Println(err)
+					continue
+				}
+				err = conv.send(&server.TypingPayload{Data: data})
+				if err != nil {
+					log.Default().Println(err)
+				}
+			}
+		}
+	}()
+	go func() {
+		for msg := range conv.out {
+			if !bytes.Equal(msg.From, them) {
+				continue
+			}
+			// We check this for every message, so that blocking takes effect during a chat
+			blocked, err := store.IsBlocked(msg.From)
+			if err != nil {
+				log.Default().Println(err)
+				continue
+			}
+			if blocked {
+				continue
+			}
+			switch v := msg.Payload.Variant.(type) {
+			case *server.AckPayload:
+				_, err = conv.open(v.Data, tagAdditional(conv.additional, "ack", v.MessageID))
+				if err != nil {
+					log.Default().Println(err)
+					continue
+				}
+				err = store.MarkDelivered(v.MessageID)
+				if err != nil {
+					log.Default().Println(err)
+				}
+				sentLock.Lock()
+				receiptID, present := pending[string(v.MessageID)]
+				delete(pending, string(v.MessageID))
+				body := sent[receiptID]
+				sentLock.Unlock()
+				if !present {
+					continue
+				}
+				out <- ChatEvent{Kind: EventDelivered, Text: body}
+			case *server.ReceiptPayload:
+				_, err = conv.open(v.Data, tagAdditional(conv.additional, "receipt", v.MessageID))
+				if err != nil {
+					log.Default().Println(err)
+					continue
+				}
+				sentLock.Lock()
+				body, present := sent[string(v.MessageID)]
+				delete(sent, string(v.MessageID))
+				// Clients that don't send acks still send receipts, which mean the message arrived
+				var delivered []byte
+				for ackID, receiptID := range pending {
+					if receiptID == string(v.MessageID) {
+						delete(pending, ackID)
+						delivered = []byte(ackID)
+						break
+					}
+				}
+				sentLock.Unlock()
+				if delivered != nil {
+					err = store.MarkDelivered(delivered)
+					if err != nil {
+						log.Default().Println(err)
+					}
+				}
+				if !present {
+					continue
+				}
+				out <- ChatEvent{Kind: EventReceipt, Text: body}
+			default:
+				conv.receive(store, msg, func(event ChatEvent) { out <- event })
+			}
+		}
+	}()
+	return out, nil
+}
+
+// ReceiveEvent is something that happened in a conversation a friend started with us
+type ReceiveEvent struct {
+	ChatEvent
+	From crypto.IdentityPub
+	// Name is the name we gave this friend
+	Name string
+}
+
+// Receive listens for messages from any of our friends, without starting sessions ourselves
+//
+// Our friends start sessions with us when they start chatting, or send us a message.
+// Messages from identities that aren't our friends, or that we've blocked, are ignored.
+// Sessions are saved as they change, so that our friends can keep using them after we reconnect.
+func Receive(ctx context.Context, api ClientAPI, store ClientStore, me crypto.IdentityPub, myPriv crypto.IdentityPriv) (<-chan ReceiveEvent, error) {
+	inMessage := make(chan server.Message)
+	outMessage, err := api.Listen(ctx, me, myPriv, inMessage)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan ReceiveEvent)
+	go func() {
+		conversations := make(map[string]*conversation)
+		for msg := range outMessage {
+			name, err := store.GetFriendName(msg.From)
+			if err == ErrNoSuchFriend {
+				continue
+			}
+			if err != nil {
+				log.Default().Println(err)
+				continue
+			}
+			blocked, err := store.IsBlocked(msg.From)
+			if err != nil {
+				log.Default().Println(err)
+				continue
+			}
+			if blocked {
+				continue
+			}
+			// A new exchange replaces any session we had, since our friend might have reconnected
+			if v, ok := msg.Payload.Variant.(*server.EndExchangePayload); ok {
+				conv, err := acceptExchange(store, me, myPriv, msg.From, v)
+				if err != nil {
+					log.Default().Println(err)
+					continue
+				}
+				conv.in = inMessage
+				conversations[string(msg.From)] = conv
+				err = conv.save(store)
+				if err != nil {
+					log.Default().Println(err)
+				}
+				continue
+			}
+			conv, present := conversations[string(msg.From)]
+			// We might have saved the session before restarting
+			if !present {
+				conv, err = resumeConversation(store, me, msg.From)
+				if err == ErrNoSuchSession {
+					continue
+				}
+				if err != nil {
+					log.Default().Println(err)
+					continue
+				}
+				conv.in = inMessage
+				conversations[string(msg.From)] = conv
+			}
+			conv.receive(store, msg, func(event ChatEvent) {
+				out <- ReceiveEvent{ChatEvent: event, From: msg.From, Name: name}
+			})
+			err = conv.save(store)
+			if err != nil {
+				log.Default().Println(err)
+			}
+		}
+		close(out)
+	}()
+	return out, nil
+}
+
+// RunDaemon receives messages from any of our friends, telling a notifier about each message or file
+//
+// Like with Receive, messages are saved to our history, and sessions are saved as well,
+// so that they survive restarting the daemon. Notifications run in the background, so that a slow
+// notifier doesn't hold up other messages. This runs until the connection to the server is
+// closed, or ctx is cancelled, and then waits for the remaining notifications.
+// The notifier can be nil, in which case messages are only saved.
+func RunDaemon(ctx context.Context, api ClientAPI, store ClientStore, me crypto.IdentityPub, myPriv crypto.IdentityPriv, notifier Notifier) error {
+	out, err := Receive(ctx, api, store, me, myPriv)
+	if err != nil {
+		return err
+	}
+	var notifications sync.WaitGroup
+	for event := range out {
+		if notifier != nil && (event.Kind == EventMessage || event.Kind == EventFile) {
+			notifications.Add(1)
+			go func(event ReceiveEvent) {
+				defer notifications.Done()
+				notifier.Notify(event.From, event.Name, event.Text)
+			}(event)
+		}
+	}
+	notifications.Wait()
+	return nil
+}
+
+// GroupEvent is a message sent to a group by one of its members
+type GroupEvent struct {
+	From crypto.IdentityPub
+	Text string
+}
+
+// memberBufferSize is the number of messages from a group member we buffer before blocking
+const memberBufferSize = 16
+
+// member is an established session with one of the members of a group
+type member struct {
+	pub  crypto.IdentityPub
+	conv *conversation
+}
+
+// StartGroupChat establishes a session with every member of a group, and then starts chatting with them
+//
+// Every message sent over in is encrypted once for each member, and tagged with the id of the group.
+// This waits until a session with every member has been established.
+func StartGroupChat(ctx context.Context, api ClientAPI, store ClientStore, me crypto.IdentityPub, myPriv crypto.IdentityPriv, group Group, in <-chan string) (<-chan GroupEvent, error) {
+	if len(group.Members) == 0 {
+		return nil, errors.New("group has no members")
+	}
+	inMessage := make(chan server.Message)
+	outMessage, err := api.Listen(ctx, me, myPriv, inMessage)
+	if err != nil {
+		return nil, err
+	}
+	// We share a single connection, so messages need to be sent to the right session
+	memberOut := make(map[string]chan server.Message)
+	for _, pub := range group.Members {
+		memberOut[string(pub)] = make(chan server.Message, memberBufferSize)
+	}
+	// Closing stop ends every session, which lets us give up while still negotiating
+	stop := make(chan struct{})
+	go func() {
+		defer func() {
+			for _, c := range memberOut {
+				close(c)
+			}
+		}()
+		for {
+			select {
+			case msg, ok := <-outMessage:
+				if !ok {
+					return
+				}
+				c, present := memberOut[string(msg.From)]
+				if !present {
+					continue
+				}
+				select {
+				case c <- msg:
+				case <-stop:
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	type result struct {
+		member member
+		err    error
+	}
+	results := make(chan result, len(memberOut))
+	for pubString := range memberOut {
+		pub := crypto.IdentityPub(pubString)
+		go func() {
+			conv, err := negotiate(store, me, myPriv, pub, inMessage, memberOut[string(pub)], nil)
+			results <- result{member{pub, conv}, err}
+		}()
+	}
+	members := make([]member, 0, len(memberOut))
+	for i := 0; i < len(memberOut); i++ {
+		r := <-results
+		if r.err != nil {
+			// The other negotiations need to stop using the connection before we close it
+			close(stop)
+			for j := i + 1; j < len(memberOut); j++ {
+				<-results
+			}
+			close(inMessage)
+			for range outMessage {
+			}
+			return nil, r.err
+		}
+		members = append(members, r.member)
+	}
+
+	go func() {
+		for stringMsg := range in {
+			for _, m := range members {
+				ciphertext, err := m.conv.seal([]byte(stringMsg), tagAdditional(m.conv.additional, "group", group.ID))
+				if err != nil {
+					log.Default().Println(err)
+					continue
+				}
+				err = m.conv.send(&server.GroupMessagePayload{GroupID: group.ID, Data: ciphertext})
+				if err != nil {
+					log.Default().Println(err)
+				}
+			}
+		}
+	}()
+	out := make(chan GroupEvent)
+	for _, m := range members {
+		go func(m member) {
+			for msg := range memberOut[string(m.pub)] {
+				blocked, err := store.IsBlocked(m.pub)
+				if err != nil {
+					log.Default().Println(err)
+					continue
+				}
+				if blocked {
+					continue
+				}
+				v, ok := msg.Payload.Variant.(*server.GroupMessagePayload)
+				if !ok || !bytes.Equal(v.GroupID, group.ID) {
+					continue
+				}
+				plaintext, err := m.conv.open(v.Data, tagAdditional(m.conv.additional, "group", group.ID))
+				if err != nil {
+					log.Default().Println(err)
+					continue
+				}
+				out <- GroupEvent{From: m.pub, Text: string(plaintext)}
+			}
+		}(m)
+	}
 	return out, nil
 }
@@ -0,0 +1,4249 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cronokirby/nuntius/internal/crypto"
+	"github.com/cronokirby/nuntius/internal/migrate"
+	"github.com/cronokirby/nuntius/internal/server"
+	"github.com/gorilla/websocket"
+	_ "modernc.org/sqlite"
+)
+
+func newTestStore(t *testing.T) ClientStore {
+	store, err := NewStore(path.Join(t.TempDir(), "client.db"))
+	if err != nil {
+		t.Fatalf("couldn't create store: %v", err)
+	}
+	return store
+}
+
+func newTestMemoryStore(t *testing.T) ClientStore {
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatalf("couldn't create store: %v", err)
+	}
+	t.Cleanup(func() { store.(*clientDatabase).Close() })
+	return store
+}
+
+// storeKinds lists every way of creating a store, so that the same tests can run against each of them
+var storeKinds = []struct {
+	name     string
+	newStore func(t *testing.T) ClientStore
+}{
+	{"file", newTestStore},
+	{"memory", newTestMemoryStore},
+}
+
+func newTestIdentity(t *testing.T) crypto.IdentityPub {
+	pub, _, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("couldn't generate identity: %v", err)
+	}
+	return pub
+}
+
+func TestListFriendsSorted(t *testing.T) {
+	store := newTestStore(t)
+	for _, name := range []string{"carol", "alice", "bob"} {
+		_, err := store.AddFriend(newTestIdentity(t), name, false)
+		if err != nil {
+			t.Errorf("couldn't add friend: %v", err)
+			return
+		}
+	}
+	friends, err := store.ListFriends()
+	if err != nil {
+		t.Errorf("couldn't list friends: %v", err)
+		return
+	}
+	expected := []string{"alice", "bob", "carol"}
+	if len(friends) != len(expected) {
+		t.Errorf("expected %d friends, found %d", len(expected), len(friends))
+		return
+	}
+	for i, friend := range friends {
+		if friend.Name != expected[i] {
+			t.Errorf("friend %d is %s, expected %s", i, friend.Name, expected[i])
+			return
+		}
+		pub, err := store.GetFriend(friend.Name)
+		if err != nil {
+			t.Errorf("couldn't get friend: %v", err)
+			return
+		}
+		if !bytes.Equal(pub, friend.Pub) {
+			t.Errorf("friend %s has the wrong key", friend.Name)
+			return
+		}
+	}
+}
+
+func TestRemoveFriend(t *testing.T) {
+	store := newTestStore(t)
+	_, err := store.AddFriend(newTestIdentity(t), "alice", false)
+	if err != nil {
+		t.Errorf("couldn't add friend: %v", err)
+		return
+	}
+	err = store.RemoveFriend("alice")
+	if err != nil {
+		t.Errorf("couldn't remove friend: %v", err)
+		return
+	}
+	_, err = store.GetFriend("alice")
+	if err == nil {
+		t.Error("removed friend still exists")
+		return
+	}
+	err = store.RemoveFriend("alice")
+	if !errors.Is(err, ErrNoSuchFriend) {
+		t.Errorf("expected ErrNoSuchFriend, found %v", err)
+		return
+	}
+}
+
+func TestRenameFriend(t *testing.T) {
+	store := newTestStore(t)
+	alice := newTestIdentity(t)
+	_, err := store.AddFriend(alice, "alice", false)
+	if err != nil {
+		t.Errorf("couldn't add friend: %v", err)
+		return
+	}
+	err = store.RenameFriend("alice", "ally")
+	if err != nil {
+		t.Errorf("couldn't rename friend: %v", err)
+		return
+	}
+	pub, err := store.GetFriend("ally")
+	if err != nil {
+		t.Errorf("couldn't get renamed friend: %v", err)
+		return
+	}
+	if !bytes.Equal(pub, alice) {
+		t.Error("renamed friend has the wrong key")
+		return
+	}
+	err = store.RenameFriend("alice", "bob")
+	if !errors.Is(err, ErrNoSuchFriend) {
+		t.Errorf("expected ErrNoSuchFriend, found %v", err)
+		return
+	}
+}
+
+func TestRenameFriendCollision(t *testing.T) {
+	store := newTestStore(t)
+	alice := newTestIdentity(t)
+	bob := newTestIdentity(t)
+	_, err := store.AddFriend(alice, "alice", false)
+	if err != nil {
+		t.Errorf("couldn't add friend: %v", err)
+		return
+	}
+	_, err = store.AddFriend(bob, "bob", false)
+	if err != nil {
+		t.Errorf("couldn't add friend: %v", err)
+		return
+	}
+	err = store.RenameFriend("alice", "bob")
+	if !errors.Is(err, ErrFriendExists) {
+		t.Errorf("expected ErrFriendExists, found %v", err)
+		return
+	}
+	friends, err := store.ListFriends()
+	if err != nil {
+		t.Errorf("couldn't list friends: %v", err)
+		return
+	}
+	if len(friends) != 2 {
+		t.Errorf("expected 2 friends, found %d", len(friends))
+		return
+	}
+	if friends[0].Name != "alice" || !bytes.Equal(friends[0].Pub, alice) {
+		t.Errorf("alice was modified: %v", friends[0])
+		return
+	}
+	if friends[1].Name != "bob" || !bytes.Equal(friends[1].Pub, bob) {
+		t.Errorf("bob was modified: %v", friends[1])
+		return
+	}
+}
+
+func TestHistoryRoundtrip(t *testing.T) {
+	store := newTestStore(t)
+	alice := newTestIdentity(t)
+	bob := newTestIdentity(t)
+	start := time.Unix(1624000000, 0)
+	for i := 0; i < 5; i++ {
+		err := store.SaveMessage(alice, i%2 == 0, fmt.Sprintf("message %d", i), start.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Errorf("couldn't save message: %v", err)
+			return
+		}
+	}
+	err := store.SaveMessage(bob, false, "hello bob", start)
+	if err != nil {
+		t.Errorf("couldn't save message: %v", err)
+		return
+	}
+
+	history, err := store.GetHistory(alice, 3)
+	if err != nil {
+		t.Errorf("couldn't get history: %v", err)
+		return
+	}
+	if len(history) != 3 {
+		t.Errorf("expected 3 messages, found %d", len(history))
+		return
+	}
+	for i, message := range history {
+		expected := fmt.Sprintf("message %d", i+2)
+		if message.Body != expected {
+			t.Errorf("message %d is %q, expected %q", i, message.Body, expected)
+			return
+		}
+		if message.Outgoing != (i%2 == 0) {
+			t.Errorf("message %d has the wrong direction", i)
+			return
+		}
+		if !message.SentAt.Equal(start.Add(time.Duration(i+2) * time.Minute)) {
+			t.Errorf("message %d has the wrong time: %v", i, message.SentAt)
+			return
+		}
+	}
+
+	history, err = store.GetHistory(bob, 10)
+	if err != nil {
+		t.Errorf("couldn't get history: %v", err)
+		return
+	}
+	if len(history) != 1 || history[0].Body != "hello bob" {
+		t.Errorf("unexpected history for bob: %v", history)
+		return
+	}
+}
+
+func TestSearchHistory(t *testing.T) {
+	store := newTestStore(t)
+	alice := newTestIdentity(t)
+	bob := newTestIdentity(t)
+	start := time.Unix(1624000000, 0)
+	bodies := []string{"lunch tomorrow?", "sure, where?", "Lunch at noon", "100% done", "see you"}
+	for i, body := range bodies {
+		err := store.SaveMessage(alice, i%2 == 0, body, start.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Errorf("couldn't save message: %v", err)
+			return
+		}
+	}
+
+	matches, err := store.SearchHistory(alice, "lunch", 10)
+	if err != nil {
+		t.Errorf("couldn't search history: %v", err)
+		return
+	}
+	if len(matches) != 2 || matches[0].Body != "lunch tomorrow?" || matches[1].Body != "Lunch at noon" {
+		t.Errorf("unexpected matches: %v", matches)
+		return
+	}
+	if !matches[1].SentAt.Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("match has the wrong time: %v", matches[1].SentAt)
+		return
+	}
+
+	matches, err = store.SearchHistory(alice, "lunch", 1)
+	if err != nil {
+		t.Errorf("couldn't search history: %v", err)
+		return
+	}
+	if len(matches) != 1 || matches[0].Body != "Lunch at noon" {
+		t.Errorf("limit didn't keep the newest match: %v", matches)
+		return
+	}
+
+	for _, query := range []string{"dinner", "0%d", "_"} {
+		matches, err = store.SearchHistory(alice, query, 10)
+		if err != nil {
+			t.Errorf("couldn't search history: %v", err)
+			return
+		}
+		if len(matches) != 0 {
+			t.Errorf("%q shouldn't match anything, found %v", query, matches)
+			return
+		}
+	}
+
+	matches, err = store.SearchHistory(bob, "lunch", 10)
+	if err != nil {
+		t.Errorf("couldn't search history: %v", err)
+		return
+	}
+	if len(matches) != 0 {
+		t.Errorf("found matches without any history: %v", matches)
+		return
+	}
+}
+
+func TestListenReconnects(t *testing.T) {
+	id, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	var upgrader websocket.Upgrader
+	var connections int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		nonce := []byte("nonce")
+		conn.WriteJSON(server.AuthChallenge{Nonce: nonce})
+		var response server.AuthResponse
+		err = conn.ReadJSON(&response)
+		if err != nil || !id.Verify(server.AuthData(nonce), response.Sig) {
+			return
+		}
+		i := atomic.AddInt32(&connections, 1)
+		conn.WriteJSON(server.Message{
+			Payload: server.Payload{Variant: &server.MessagePayload{Data: []byte{byte(i)}}},
+		})
+	}))
+	defer srv.Close()
+
+	api := NewClientAPI(srv.URL)
+	out, err := api.Listen(context.Background(), id, priv, make(chan server.Message))
+	if err != nil {
+		t.Errorf("couldn't listen: %v", err)
+		return
+	}
+	for i := 1; i <= 2; i++ {
+		select {
+		case msg := <-out:
+			payload, ok := msg.Payload.Variant.(*server.MessagePayload)
+			if !ok || !bytes.Equal(payload.Data, []byte{byte(i)}) {
+				t.Errorf("unexpected message: %v", msg)
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("timed out waiting for message %d", i)
+			return
+		}
+	}
+}
+
+func TestListenSetsMessageVersion(t *testing.T) {
+	id, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	var upgrader websocket.Upgrader
+	received := make(chan server.Message, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		nonce := []byte("nonce")
+		conn.WriteJSON(server.AuthChallenge{Nonce: nonce})
+		var response server.AuthResponse
+		err = conn.ReadJSON(&response)
+		if err != nil || !id.Verify(server.AuthData(nonce), response.Sig) {
+			return
+		}
+		var message server.Message
+		err = conn.ReadJSON(&message)
+		if err != nil {
+			return
+		}
+		received <- message
+	}))
+	defer srv.Close()
+
+	in := make(chan server.Message)
+	_, err = NewClientAPI(srv.URL).Listen(context.Background(), id, priv, in)
+	if err != nil {
+		t.Errorf("couldn't listen: %v", err)
+		return
+	}
+	defer close(in)
+	in <- server.Message{To: id, Payload: server.Payload{Variant: &server.MessagePayload{Data: []byte{1}}}}
+	select {
+	case message := <-received:
+		if message.Version != server.MessageVersion {
+			t.Errorf("expected version %d, found %d", server.MessageVersion, message.Version)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("timed out waiting for message")
+		return
+	}
+}
+
+func TestListenInProtobuf(t *testing.T) {
+	id, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	var upgrader websocket.Upgrader
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") != string(server.WireProtobuf) {
+			t.Errorf("unexpected format: %q", r.URL.Query().Get("format"))
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		nonce := []byte("nonce")
+		conn.WriteJSON(server.AuthChallenge{Nonce: nonce})
+		var response server.AuthResponse
+		err = conn.ReadJSON(&response)
+		if err != nil || !id.Verify(server.AuthData(nonce), response.Sig) {
+			return
+		}
+		// Messages are relayed back to the client as they are, in binary frames
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			t.Errorf("expected a binary message, found type %d", messageType)
+			return
+		}
+		conn.WriteMessage(messageType, data)
+		conn.ReadMessage()
+	}))
+	defer srv.Close()
+
+	in := make(chan server.Message)
+	out, err := NewClientAPIWithFormat(srv.URL, server.WireProtobuf).Listen(context.Background(), id, priv, in)
+	if err != nil {
+		t.Errorf("couldn't listen: %v", err)
+		return
+	}
+	defer close(in)
+	in <- server.Message{To: id, Payload: server.Payload{Variant: &server.MessagePayload{Data: []byte{1}}}}
+	select {
+	case message := <-out:
+		payload, ok := message.Payload.Variant.(*server.MessagePayload)
+		if !ok || !bytes.Equal(payload.Data, []byte{1}) || message.Version != server.MessageVersion {
+			t.Errorf("unexpected message: %v", message)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("timed out waiting for message")
+		return
+	}
+}
+
+func TestPresence(t *testing.T) {
+	id := newTestIdentity(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/presence/"+base64.URLEncoding.EncodeToString(id) {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(server.PresenceResponse{Online: true})
+	}))
+	defer srv.Close()
+
+	online, err := NewClientAPI(srv.URL).Presence(context.Background(), id)
+	if err != nil {
+		t.Errorf("couldn't query presence: %v", err)
+		return
+	}
+	if !online {
+		t.Errorf("expected friend to be online")
+		return
+	}
+}
+
+func TestCancelledRequestReturnsPromptly(t *testing.T) {
+	id := newTestIdentity(t)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	// The server waits for its handlers to finish when closing
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, _, err := NewClientAPI(srv.URL).CountOnetimes(ctx, id)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the request to be cancelled, found %v", err)
+		return
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("request took %v to return", elapsed)
+		return
+	}
+}
+
+func TestRequestTimesOut(t *testing.T) {
+	id := newTestIdentity(t)
+	pub, _, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate exchange: %v", err)
+		return
+	}
+	bundlePub, _, err := crypto.GenerateBundle(1)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	// The server waits for its handlers to finish when closing
+	defer close(release)
+
+	api := NewClientAPIWithTimeout(srv.URL, server.WireJSON, 50*time.Millisecond)
+	ctx := context.Background()
+	requests := map[string]func() error{
+		"SendPrekey": func() error {
+			return api.SendPrekey(ctx, id, 0, pub, nil, 1, nil)
+		},
+		"CountOnetimes": func() error {
+			_, _, err := api.CountOnetimes(ctx, id)
+			return err
+		},
+		"SendBundle": func() error {
+			return api.SendBundle(ctx, id, bundlePub, nil)
+		},
+		"CreateSession": func() error {
+			_, err := api.CreateSession(ctx, id)
+			return err
+		},
+	}
+	for name, request := range requests {
+		start := time.Now()
+		err := request()
+		if err == nil {
+			t.Errorf("%s: expected a timeout", name)
+			return
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s took %v to return", name, elapsed)
+			return
+		}
+	}
+}
+
+func TestAPIErrorsAreTyped(t *testing.T) {
+	id := newTestIdentity(t)
+	pub, _, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate exchange: %v", err)
+		return
+	}
+	status := int32(http.StatusNotFound)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "some explanation", int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+
+	api := NewClientAPI(srv.URL)
+	ctx := context.Background()
+	_, _, err = api.CountOnetimes(ctx, id)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, found %v", err)
+		return
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Errorf("expected an APIError, found %v", err)
+		return
+	}
+	if apiErr.Status != http.StatusNotFound || apiErr.Body != "some explanation" {
+		t.Errorf("unexpected error contents: %+v", apiErr)
+		return
+	}
+	if errors.Is(err, ErrBadRequest) || errors.Is(err, ErrServer) {
+		t.Errorf("%v matches the wrong errors", err)
+		return
+	}
+
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	err = api.SendPrekey(ctx, id, 0, pub, nil, 1, nil)
+	if !errors.Is(err, ErrBadRequest) {
+		t.Errorf("expected ErrBadRequest, found %v", err)
+		return
+	}
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	_, err = api.Presence(ctx, id)
+	if !errors.Is(err, ErrServer) {
+		t.Errorf("expected ErrServer, found %v", err)
+		return
+	}
+}
+
+func TestListenStopsWhenCancelled(t *testing.T) {
+	id, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	var upgrader websocket.Upgrader
+	closed := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		nonce := []byte("nonce")
+		conn.WriteJSON(server.AuthChallenge{Nonce: nonce})
+		// Keep the connection open until the client goes away
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				close(closed)
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := make(chan server.Message)
+	defer close(in)
+	out, err := NewClientAPI(srv.URL).Listen(ctx, id, priv, in)
+	if err != nil {
+		t.Errorf("couldn't listen: %v", err)
+		return
+	}
+	cancel()
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Error("unexpected message")
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("output wasn't closed after cancelling")
+		return
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("connection wasn't closed after cancelling")
+		return
+	}
+	// Sending shouldn't block, even though nothing gets sent anymore
+	select {
+	case in <- server.Message{Payload: server.Payload{Variant: &server.MessagePayload{Data: []byte{1}}}}:
+	case <-time.After(time.Second):
+		t.Error("message wasn't accepted after cancelling")
+		return
+	}
+}
+
+func TestListenClosesConnectionWhenInputCloses(t *testing.T) {
+	id, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	var upgrader websocket.Upgrader
+	received := make(chan server.Message, 1)
+	closed := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		nonce := []byte("nonce")
+		conn.WriteJSON(server.AuthChallenge{Nonce: nonce})
+		var response server.AuthResponse
+		conn.ReadJSON(&response)
+		for {
+			var message server.Message
+			err := conn.ReadJSON(&message)
+			if err != nil {
+				close(closed)
+				return
+			}
+			received <- message
+		}
+	}))
+	defer srv.Close()
+
+	in := make(chan server.Message)
+	out, err := NewClientAPI(srv.URL).Listen(context.Background(), id, priv, in)
+	if err != nil {
+		t.Errorf("couldn't listen: %v", err)
+		return
+	}
+	in <- server.Message{To: id, Payload: server.Payload{Variant: &server.MessagePayload{Data: []byte{1}}}}
+	close(in)
+	// Messages sent before closing the input still make it to the server
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Error("message wasn't sent before closing")
+		return
+	}
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Error("unexpected message")
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("output wasn't closed after closing the input")
+		return
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("connection wasn't closed after closing the input")
+		return
+	}
+}
+
+func TestListenStopsWhileReconnecting(t *testing.T) {
+	id, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	var upgrader websocket.Upgrader
+	var connections int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only the first connection succeeds, so the client keeps trying to reconnect
+		if atomic.AddInt32(&connections, 1) > 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		nonce := []byte("nonce")
+		conn.WriteJSON(server.AuthChallenge{Nonce: nonce})
+		var response server.AuthResponse
+		conn.ReadJSON(&response)
+	}))
+	defer srv.Close()
+
+	api := NewClientAPI(srv.URL)
+	in := make(chan server.Message)
+	out, err := api.Listen(context.Background(), id, priv, in)
+	if err != nil {
+		t.Errorf("couldn't listen: %v", err)
+		return
+	}
+	// Give the client time to notice the connection closing, and start backing off
+	time.Sleep(initialBackoff / 5)
+	select {
+	case in <- server.Message{Payload: server.Payload{Variant: &server.MessagePayload{Data: []byte{1}}}}:
+	case <-time.After(time.Second):
+		t.Error("message wasn't accepted while reconnecting")
+		return
+	}
+	close(in)
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Error("unexpected message")
+			return
+		}
+	case <-time.After(initialBackoff / 2):
+		t.Error("out wasn't closed after closing in")
+		return
+	}
+}
+
+func TestWebsocketURL(t *testing.T) {
+	id := newTestIdentity(t)
+	idBase64 := base64.URLEncoding.EncodeToString(id)
+	cases := map[string]string{
+		"https://example.com":      "wss://example.com/rtc/" + idBase64,
+		"http://localhost:1234":    "ws://localhost:1234/rtc/" + idBase64,
+		"https://example.com/api/": "wss://example.com/api/rtc/" + idBase64,
+	}
+	for root, expected := range cases {
+		actual, err := websocketURL(root, id)
+		if err != nil {
+			t.Errorf("couldn't derive URL from %s: %v", root, err)
+			return
+		}
+		if actual != expected {
+			t.Errorf("%s != %s", actual, expected)
+			return
+		}
+	}
+	_, err := websocketURL("ftp://example.com", id)
+	if err == nil {
+		t.Errorf("expected error for unsupported scheme")
+		return
+	}
+}
+
+// fakeAPI is an in-memory ClientAPI, recording the keys sent to it
+type fakeAPI struct {
+	sync.Mutex
+	prekeys  []crypto.ExchangePub
+	bundles  []crypto.BundlePub
+	onetimes int
+	// max is the most onetime keys the server stores, or 0 for no limit
+	max int
+	// incoming is returned from Listen, letting tests act as the server
+	incoming chan server.Message
+	// sent receives the messages sent through Listen
+	sent chan server.Message
+}
+
+func (api *fakeAPI) SendPrekey(ctx context.Context, identity crypto.IdentityPub, id uint32, prekey crypto.ExchangePub, sig crypto.Signature, counter uint64, uploadSig crypto.Signature) error {
+	if !identity.VerifyPrekey(prekey, sig) {
+		return errors.New("bad prekey signature")
+	}
+	if !identity.VerifyPrekeyUpload(counter, id, prekey, uploadSig) {
+		return errors.New("bad upload signature")
+	}
+	api.Lock()
+	defer api.Unlock()
+	api.prekeys = append(api.prekeys, prekey)
+	return nil
+}
+
+func (api *fakeAPI) CountOnetimes(ctx context.Context, identity crypto.IdentityPub) (int, int, error) {
+	api.Lock()
+	defer api.Unlock()
+	return api.onetimes, api.max, nil
+}
+
+func (api *fakeAPI) Presence(ctx context.Context, identity crypto.IdentityPub) (bool, error) {
+	return false, errors.New("presence isn't supported")
+}
+
+func (api *fakeAPI) SendName(ctx context.Context, identity crypto.IdentityPub, name string, counter uint64, sig crypto.Signature) error {
+	return errors.New("names aren't supported")
+}
+
+func (api *fakeAPI) Lookup(ctx context.Context, name string) (crypto.IdentityPub, error) {
+	return nil, errors.New("names aren't supported")
+}
+
+func (api *fakeAPI) SendBundle(ctx context.Context, identity crypto.IdentityPub, bundle crypto.BundlePub, sig crypto.Signature) error {
+	if !identity.VerifyBundle(bundle, sig) {
+		return errors.New("bad bundle signature")
+	}
+	api.Lock()
+	defer api.Unlock()
+	if api.max > 0 && api.onetimes+bundle.Len() > api.max {
+		return errors.New("too many onetime keys")
+	}
+	api.bundles = append(api.bundles, bundle)
+	api.onetimes += bundle.Len()
+	return nil
+}
+
+func (api *fakeAPI) CreateSession(ctx context.Context, identity crypto.IdentityPub) (*Session, error) {
+	return nil, errors.New("sessions aren't supported")
+}
+
+func (api *fakeAPI) CreateSessions(ctx context.Context, identity crypto.IdentityPub, n int) ([]*Session, error) {
+	return nil, errors.New("sessions aren't supported")
+}
+
+func (api *fakeAPI) Listen(ctx context.Context, identity crypto.IdentityPub, priv crypto.IdentityPriv, in <-chan server.Message) (<-chan server.Message, error) {
+	if api.incoming == nil {
+		return nil, errors.New("listening isn't supported")
+	}
+	go func() {
+		for message := range in {
+			api.sent <- message
+		}
+		close(api.incoming)
+	}()
+	return api.incoming, nil
+}
+
+// testChat is a chat started by alice, with bob's client on the other end
+type testChat struct {
+	api        *fakeAPI
+	store      ClientStore
+	alice      crypto.IdentityPub
+	bob        crypto.IdentityPub
+	ratchet    crypto.DoubleRatchet
+	additional []byte
+	in         chan string
+	typing     chan struct{}
+	out        <-chan ChatEvent
+}
+
+// startTestChat has alice start a session with bob, whose client uses StartChat
+func startTestChat(t *testing.T) *testChat {
+	store := newTestStore(t)
+	alice, alicePriv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("couldn't generate identity: %v", err)
+	}
+	bob, bobPriv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("couldn't generate identity: %v", err)
+	}
+	prekey, prekeyPriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Fatalf("couldn't generate prekey: %v", err)
+	}
+	err = store.SavePrekey(1, prekey, prekeyPriv)
+	if err != nil {
+		t.Fatalf("couldn't save prekey: %v", err)
+	}
+
+	ephemeral, ephemeralPriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Fatalf("couldn't generate ephemeral key: %v", err)
+	}
+	secret, err := crypto.ForwardExchange(&crypto.ForwardExchangeParams{
+		Me:        alicePriv,
+		Ephemeral: ephemeralPriv,
+		Identity:  bob,
+		Prekey:    prekey,
+	})
+	if err != nil {
+		t.Fatalf("couldn't exchange keys: %v", err)
+	}
+	ratchet, err := crypto.DoubleRatchetFromInitiator(secret, prekey)
+	if err != nil {
+		t.Fatalf("couldn't create ratchet: %v", err)
+	}
+	additional := append(append([]byte(nil), alice...), bob...)
+	initialData, err := ratchet.Encrypt(nil, additional)
+	if err != nil {
+		t.Fatalf("couldn't encrypt initial data: %v", err)
+	}
+
+	api := &fakeAPI{incoming: make(chan server.Message, 16), sent: make(chan server.Message, 16)}
+	api.incoming <- server.Message{From: alice, To: bob, Payload: server.Payload{
+		Variant: &server.EndExchangePayload{
+			PrekeyID:    1,
+			Prekey:      prekey,
+			Ephemeral:   ephemeral,
+			InitialData: initialData,
+		},
+	}}
+	in := make(chan string)
+	typing := make(chan struct{})
+	out, err := StartChat(context.Background(), api, store, bob, bobPriv, alice, in, typing)
+	if err != nil {
+		t.Fatalf("couldn't start chat: %v", err)
+	}
+	// The first message bob sends is the query for alice's prekey
+	select {
+	case <-api.sent:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("bob didn't query alice's prekey")
+	}
+	return &testChat{api, store, alice, bob, ratchet, additional, in, typing, out}
+}
+
+// send has alice send a message to bob
+func (chat *testChat) send(t *testing.T, text string) {
+	ciphertext, err := chat.ratchet.Encrypt([]byte(text), chat.additional)
+	if err != nil {
+		t.Fatalf("couldn't encrypt message: %v", err)
+	}
+	chat.api.incoming <- server.Message{From: chat.alice, To: chat.bob, Payload: server.Payload{
+		Variant: &server.MessagePayload{Data: ciphertext},
+	}}
+}
+
+// newRealServer runs a server with a fresh database until the test ends, returning its url
+func newRealServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(ctx, server.Config{Database: path.Join(t.TempDir(), "server.db")}, listener)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return "http://" + listener.Addr().String()
+}
+
+// countSavedOnetimes returns the number of onetime keys in a store
+func countSavedOnetimes(t *testing.T, store ClientStore) int {
+	var saved int
+	err := store.(*clientDatabase).QueryRow("SELECT COUNT(*) FROM onetime;").Scan(&saved)
+	if err != nil {
+		t.Fatalf("couldn't count saved onetime keys: %v", err)
+	}
+	return saved
+}
+
+func TestCreateBundles(t *testing.T) {
+	store := newTestStore(t)
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	api := NewClientAPI(newRealServer(t))
+	ctx := context.Background()
+	_, err = CreateBundles(ctx, api, store, pub, priv, 0)
+	if err == nil {
+		t.Errorf("expected an error when creating no keys")
+		return
+	}
+	uploaded, err := CreateBundles(ctx, api, store, pub, priv, 100)
+	if err != nil {
+		t.Errorf("couldn't create bundles: %v", err)
+		return
+	}
+	onetimes, max, err := api.CountOnetimes(ctx, pub)
+	if err != nil {
+		t.Errorf("couldn't count onetime keys: %v", err)
+		return
+	}
+	if uploaded != 100 || onetimes != 100 {
+		t.Errorf("expected 100 onetime keys uploaded, found %d, with %d on the server", uploaded, onetimes)
+		return
+	}
+	if saved := countSavedOnetimes(t, store); saved != 100 {
+		t.Errorf("expected 100 onetime keys saved, found %d", saved)
+		return
+	}
+
+	// Going over the server's cap uploads nothing, and leaves nothing behind
+	uploaded, err = CreateBundles(ctx, api, store, pub, priv, max-onetimes+1)
+	if err == nil || uploaded != 0 {
+		t.Errorf("expected nothing uploaded over the cap, found %d, %v", uploaded, err)
+		return
+	}
+	// The same goes for bundles the server refuses
+	err = createBundle(ctx, api, store, pub, priv, max-onetimes+1)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusConflict {
+		t.Errorf("expected the server to refuse the bundle, found %v", err)
+		return
+	}
+	if saved := countSavedOnetimes(t, store); saved != 100 {
+		t.Errorf("expected 100 onetime keys saved, found %d", saved)
+		return
+	}
+}
+
+func TestCreateNewBundleWithZeroThreshold(t *testing.T) {
+	store := newTestStore(t)
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	api := &fakeAPI{onetimes: 1000}
+	for i := 0; i < 2; i++ {
+		created, err := CreateNewBundleIfNecessary(context.Background(), api, store, pub, priv, 0, crypto.DefaultBundleSize)
+		if err != nil {
+			t.Errorf("couldn't create bundle: %v", err)
+			return
+		}
+		if !created {
+			t.Errorf("expected bundle to be created with a threshold of 0")
+			return
+		}
+	}
+	if len(api.bundles) != 2 {
+		t.Errorf("expected 2 bundles, found %d", len(api.bundles))
+		return
+	}
+}
+
+func TestCreateNewBundleWithLargeThreshold(t *testing.T) {
+	store := newTestStore(t)
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	api := &fakeAPI{}
+	threshold := 2*crypto.DefaultBundleSize + 1
+	for i := 0; i < 3; i++ {
+		created, err := CreateNewBundleIfNecessary(context.Background(), api, store, pub, priv, threshold, crypto.DefaultBundleSize)
+		if err != nil {
+			t.Errorf("couldn't create bundle: %v", err)
+			return
+		}
+		if !created {
+			t.Errorf("expected bundle %d to be created, with %d keys on the server", i, api.onetimes)
+			return
+		}
+	}
+	created, err := CreateNewBundleIfNecessary(context.Background(), api, store, pub, priv, threshold, crypto.DefaultBundleSize)
+	if err != nil {
+		t.Errorf("couldn't check bundle: %v", err)
+		return
+	}
+	if created {
+		t.Errorf("bundle created with %d keys above a threshold of %d", api.onetimes, threshold)
+		return
+	}
+}
+
+func TestCreateNewBundleFitsOnServer(t *testing.T) {
+	store := newTestStore(t)
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	// The server only has room for part of a bundle
+	api := &fakeAPI{onetimes: 100, max: 128}
+	created, err := CreateNewBundleIfNecessary(context.Background(), api, store, pub, priv, 120, crypto.DefaultBundleSize)
+	if err != nil {
+		t.Errorf("couldn't create bundle: %v", err)
+		return
+	}
+	if !created || api.onetimes != api.max {
+		t.Errorf("expected the bundle to fill the server, found %d keys", api.onetimes)
+		return
+	}
+	for _, threshold := range []int{120, 0} {
+		created, err = CreateNewBundleIfNecessary(context.Background(), api, store, pub, priv, threshold, crypto.DefaultBundleSize)
+		if err != nil {
+			t.Errorf("couldn't check bundle with threshold %d: %v", threshold, err)
+			return
+		}
+		if created {
+			t.Errorf("bundle created with threshold %d on a full server", threshold)
+			return
+		}
+	}
+}
+
+func TestOnetimeSettingsAreChecked(t *testing.T) {
+	store := newTestStore(t)
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	api := &fakeAPI{max: 128}
+	created, err := CreateNewBundleIfNecessary(context.Background(), api, store, pub, priv, 10, 16)
+	if err != nil {
+		t.Errorf("couldn't create bundle: %v", err)
+		return
+	}
+	if !created || len(api.bundles) != 1 || api.bundles[0].Len() != 16 {
+		t.Errorf("expected a bundle of 16 keys, found %d bundles", len(api.bundles))
+		return
+	}
+
+	// The server never has more keys than it stores, so this threshold is never met
+	_, err = CreateNewBundleIfNecessary(context.Background(), api, store, pub, priv, api.max+1, 16)
+	if err == nil {
+		t.Errorf("expected an error for a threshold above the server's cap")
+		return
+	}
+	_, err = PlanKeys(context.Background(), api, store, pub, api.max+1, 16, time.Hour)
+	if err == nil {
+		t.Errorf("expected an error when planning with a threshold above the server's cap")
+		return
+	}
+	for _, size := range []int{0, crypto.MaxBundleSize + 1} {
+		_, err = CreateNewBundleIfNecessary(context.Background(), api, store, pub, priv, 10, size)
+		if err == nil {
+			t.Errorf("expected an error for a bundle size of %d", size)
+			return
+		}
+	}
+	if len(api.bundles) != 1 {
+		t.Errorf("bundles were uploaded with bad settings")
+		return
+	}
+}
+
+func TestPlanKeysChangesNothing(t *testing.T) {
+	store := newTestStore(t)
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	api := &fakeAPI{onetimes: 3}
+	maxAge := 24 * time.Hour
+
+	plan, err := PlanKeys(context.Background(), api, store, pub, 10, crypto.DefaultBundleSize, maxAge)
+	if err != nil {
+		t.Errorf("couldn't plan keys: %v", err)
+		return
+	}
+	if plan != (KeyPlan{NewPrekey: true, Onetimes: 3, NewBundle: true}) {
+		t.Errorf("unexpected plan: %+v", plan)
+		return
+	}
+	if len(api.prekeys) != 0 || len(api.bundles) != 0 {
+		t.Errorf("planning sent keys to the server")
+		return
+	}
+	_, present, err := store.LatestPrekeyTime()
+	if err != nil {
+		t.Errorf("couldn't get prekey time: %v", err)
+		return
+	}
+	if present {
+		t.Errorf("planning saved a prekey")
+		return
+	}
+
+	_, err = RotatePrekeyIfStale(context.Background(), api, store, pub, priv, maxAge)
+	if err != nil {
+		t.Errorf("couldn't rotate prekey: %v", err)
+		return
+	}
+	_, err = CreateNewBundleIfNecessary(context.Background(), api, store, pub, priv, 10, crypto.DefaultBundleSize)
+	if err != nil {
+		t.Errorf("couldn't create bundle: %v", err)
+		return
+	}
+	plan, err = PlanKeys(context.Background(), api, store, pub, 10, crypto.DefaultBundleSize, maxAge)
+	if err != nil {
+		t.Errorf("couldn't plan keys: %v", err)
+		return
+	}
+	if plan.NewPrekey || plan.NewBundle {
+		t.Errorf("expected nothing left to do: %+v", plan)
+		return
+	}
+}
+
+func TestRotatePrekeyIfStale(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	current := start
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	store := newTestStore(t)
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	api := &fakeAPI{}
+	maxAge := 24 * time.Hour
+
+	first, err := RotatePrekeyIfStale(context.Background(), api, store, pub, priv, maxAge)
+	if err != nil {
+		t.Errorf("couldn't rotate prekey: %v", err)
+		return
+	}
+	if first == nil {
+		t.Errorf("expected a prekey to be created when none exist")
+		return
+	}
+
+	current = start.Add(maxAge - time.Minute)
+	fresh, err := RotatePrekeyIfStale(context.Background(), api, store, pub, priv, maxAge)
+	if err != nil {
+		t.Errorf("couldn't rotate prekey: %v", err)
+		return
+	}
+	if fresh != nil {
+		t.Errorf("prekey was rotated while still fresh")
+		return
+	}
+
+	current = start.Add(maxAge + time.Minute)
+	stale, err := RotatePrekeyIfStale(context.Background(), api, store, pub, priv, maxAge)
+	if err != nil {
+		t.Errorf("couldn't rotate prekey: %v", err)
+		return
+	}
+	if stale == nil {
+		t.Errorf("stale prekey wasn't rotated")
+		return
+	}
+	if len(api.prekeys) != 2 {
+		t.Errorf("expected 2 prekeys to be sent, found %d", len(api.prekeys))
+		return
+	}
+	// The old prekey needs to stick around for sessions that were started with it
+	_, err = store.GetPrekey(1, first)
+	if err != nil {
+		t.Errorf("old prekey was removed: %v", err)
+		return
+	}
+}
+
+func TestMaintainKeysUploadsBundle(t *testing.T) {
+	store := newTestStore(t)
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	api := &fakeAPI{onetimes: DefaultOnetimeThreshold - 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	created := MaintainKeys(ctx, api, store, pub, priv, DefaultOnetimeThreshold, crypto.DefaultBundleSize, 10*time.Millisecond)
+	select {
+	case <-created:
+	case <-time.After(5 * time.Second):
+		t.Errorf("no bundle was uploaded")
+		return
+	}
+	api.Lock()
+	defer api.Unlock()
+	if len(api.bundles) != 1 {
+		t.Errorf("expected 1 bundle, found %d", len(api.bundles))
+		return
+	}
+}
+
+// newSessionServer serves a fixed session response for any identity
+func newSessionServer(t *testing.T, response server.SessionResponse) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestNegotiateSkipsUnrelatedMessages(t *testing.T) {
+	them := newTestIdentity(t)
+	other := newTestIdentity(t)
+	out := make(chan server.Message, 3)
+	out <- server.Message{From: other, Payload: server.Payload{Variant: &server.StartExchangePayload{}}}
+	out <- server.Message{From: them, Payload: server.Payload{Variant: &server.TypingPayload{}}}
+	out <- server.Message{From: them, Payload: server.Payload{Variant: &server.StartExchangePayload{KeyID: 1}}}
+	close(out)
+	msg, err := nextExchangeMessage(them, out, nil)
+	if err != nil {
+		t.Errorf("couldn't get exchange message: %v", err)
+		return
+	}
+	v, ok := msg.Payload.Variant.(*server.StartExchangePayload)
+	if !ok || v.KeyID != 1 {
+		t.Errorf("unexpected message: %v", msg)
+		return
+	}
+	_, err = nextExchangeMessage(them, out, nil)
+	if err == nil {
+		t.Error("expected an error once the connection is closed")
+		return
+	}
+}
+
+func TestAcceptExchangeFromParams(t *testing.T) {
+	alice, alicePriv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	bob, bobPriv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	bobStore := newTestStore(t)
+	prekey, prekeyPriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	err = bobStore.SavePrekey(1, prekey, prekeyPriv)
+	if err != nil {
+		t.Errorf("couldn't save prekey: %v", err)
+		return
+	}
+
+	// The initiator's side of the exchange is built by hand, like another client would
+	ephemeral, ephemeralPriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate ephemeral key: %v", err)
+		return
+	}
+	secret, err := crypto.ForwardExchange(&crypto.ForwardExchangeParams{
+		Me:        alicePriv,
+		Ephemeral: ephemeralPriv,
+		Identity:  bob,
+		Prekey:    prekey,
+	})
+	if err != nil {
+		t.Errorf("couldn't run forward exchange: %v", err)
+		return
+	}
+	ratchet, err := crypto.DoubleRatchetFromInitiator(secret, prekey)
+	if err != nil {
+		t.Errorf("couldn't create ratchet: %v", err)
+		return
+	}
+	initialData, err := ratchet.Encrypt(nil, append(append([]byte{}, alice...), bob...))
+	if err != nil {
+		t.Errorf("couldn't encrypt initial data: %v", err)
+		return
+	}
+	conv, err := acceptExchange(bobStore, bob, bobPriv, alice, &server.EndExchangePayload{
+		PrekeyID:    1,
+		Prekey:      prekey,
+		Ephemeral:   ephemeral,
+		InitialData: initialData,
+	})
+	if err != nil {
+		t.Errorf("couldn't accept exchange: %v", err)
+		return
+	}
+	if conv.fingerprint != secret.Fingerprint() {
+		t.Errorf("exchange derived different secrets")
+		return
+	}
+}
+
+func TestCreateSessionVerifiesPrekey(t *testing.T) {
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	prekey, _, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	sig := priv.SignPrekey(prekey)
+
+	srv := newSessionServer(t, server.SessionResponse{KeyID: 3, Prekey: prekey, Sig: sig})
+	session, err := NewClientAPI(srv.URL).CreateSession(context.Background(), pub)
+	if err != nil {
+		t.Errorf("couldn't create session: %v", err)
+		return
+	}
+	if session.PrekeyID != 3 || !bytes.Equal(session.Prekey, prekey) || session.OneTime != nil {
+		t.Errorf("unexpected session: %v", session)
+		return
+	}
+
+	tampered := append(crypto.Signature(nil), sig...)
+	tampered[0] ^= 1
+	srv = newSessionServer(t, server.SessionResponse{Prekey: prekey, Sig: tampered})
+	_, err = NewClientAPI(srv.URL).CreateSession(context.Background(), pub)
+	if !errors.Is(err, ErrBadPrekeySignature) {
+		t.Errorf("expected ErrBadPrekeySignature, found %v", err)
+		return
+	}
+}
+
+func TestPublishNameAndLookup(t *testing.T) {
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	var published server.PublishNameRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			json.NewDecoder(r.Body).Decode(&published)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if r.URL.Path != "/lookup/"+published.Name {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(server.LookupResponse{Identity: pub, Counter: published.Counter, Sig: published.Sig})
+	}))
+	defer srv.Close()
+
+	api := NewClientAPI(srv.URL)
+	err = PublishName(context.Background(), api, pub, priv, "alice")
+	if err != nil {
+		t.Errorf("couldn't publish name: %v", err)
+		return
+	}
+	found, err := api.Lookup(context.Background(), "alice")
+	if err != nil {
+		t.Errorf("couldn't look up name: %v", err)
+		return
+	}
+	if !bytes.Equal(found, pub) {
+		t.Errorf("expected %s, found %s", pub, found)
+		return
+	}
+	_, err = api.Lookup(context.Background(), "bob")
+	if err != ErrNameNotFound {
+		t.Errorf("expected ErrNameNotFound, found %v", err)
+		return
+	}
+}
+
+func newLookupServer(t *testing.T, response server.LookupResponse) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLookupRejectsForgedNames(t *testing.T) {
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	other, _, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	// The server could leave out the signature, point the name at another identity, or swap the name
+	for _, response := range []server.LookupResponse{
+		{Identity: pub, Counter: 1},
+		{Identity: other, Counter: 1, Sig: priv.SignName(1, "alice")},
+		{Identity: pub, Counter: 1, Sig: priv.SignName(1, "alicia")},
+		{Identity: pub, Counter: 2, Sig: priv.SignName(1, "alice")},
+		{Identity: pub[:10], Counter: 1, Sig: priv.SignName(1, "alice")},
+	} {
+		srv := newLookupServer(t, response)
+		_, err = NewClientAPI(srv.URL).Lookup(context.Background(), "alice")
+		if !errors.Is(err, ErrBadNameSignature) {
+			t.Errorf("expected ErrBadNameSignature, found %v", err)
+			return
+		}
+	}
+}
+
+func TestCreateSessions(t *testing.T) {
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	prekey, _, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	var onetimes [][]byte
+	for i := 0; i < 3; i++ {
+		onetime, _, err := crypto.GenerateExchange()
+		if err != nil {
+			t.Errorf("couldn't generate onetime key: %v", err)
+			return
+		}
+		onetimes = append(onetimes, onetime)
+	}
+	var query atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query.Store(r.URL.RawQuery)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(server.SessionResponse{KeyID: 3, Prekey: prekey, Sig: priv.SignPrekey(prekey), OneTimes: onetimes})
+	}))
+	defer srv.Close()
+
+	sessions, err := NewClientAPI(srv.URL).CreateSessions(context.Background(), pub, 3)
+	if err != nil {
+		t.Errorf("couldn't create sessions: %v", err)
+		return
+	}
+	if query.Load() != "count=3" {
+		t.Errorf("unexpected query: %v", query.Load())
+		return
+	}
+	if len(sessions) != 3 {
+		t.Errorf("expected 3 sessions, found %d", len(sessions))
+		return
+	}
+	for i, session := range sessions {
+		if session.PrekeyID != 3 || !bytes.Equal(session.Prekey, prekey) || !bytes.Equal(session.OneTime, onetimes[i]) {
+			t.Errorf("unexpected session: %v", session)
+			return
+		}
+	}
+
+	_, err = NewClientAPI(srv.URL).CreateSessions(context.Background(), pub, 2)
+	if err == nil {
+		t.Errorf("expected an error when getting more keys than asked for")
+		return
+	}
+	srv = newSessionServer(t, server.SessionResponse{KeyID: 3, Prekey: prekey, Sig: priv.SignPrekey(prekey)})
+	sessions, err = NewClientAPI(srv.URL).CreateSessions(context.Background(), pub, 3)
+	if err != nil {
+		t.Errorf("couldn't create sessions: %v", err)
+		return
+	}
+	if len(sessions) != 1 || sessions[0].OneTime != nil {
+		t.Errorf("expected a single session without onetime key: %v", sessions)
+		return
+	}
+}
+
+func TestCreateSessionWithoutPrekey(t *testing.T) {
+	pub := newTestIdentity(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "identity has no prekey", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	_, err := NewClientAPI(srv.URL).CreateSession(context.Background(), pub)
+	if !errors.Is(err, ErrFriendNotRegistered) {
+		t.Errorf("expected ErrFriendNotRegistered, found %v", err)
+		return
+	}
+}
+
+func TestOlderPrekeyResolves(t *testing.T) {
+	store := newTestStore(t)
+	var pubs []crypto.ExchangePub
+	var privs []crypto.ExchangePriv
+	for i := 0; i < 2; i++ {
+		id, err := store.NextPrekeyID()
+		if err != nil {
+			t.Errorf("couldn't get prekey id: %v", err)
+			return
+		}
+		if id != uint32(i+1) {
+			t.Errorf("expected prekey id %d, found %d", i+1, id)
+			return
+		}
+		pub, priv, err := crypto.GenerateExchange()
+		if err != nil {
+			t.Errorf("couldn't generate prekey: %v", err)
+			return
+		}
+		err = store.SavePrekey(id, pub, priv)
+		if err != nil {
+			t.Errorf("couldn't save prekey: %v", err)
+			return
+		}
+		pubs = append(pubs, pub)
+		privs = append(privs, priv)
+	}
+	for i := range pubs {
+		priv, err := store.GetPrekey(uint32(i+1), pubs[i])
+		if err != nil {
+			t.Errorf("couldn't get prekey %d: %v", i+1, err)
+			return
+		}
+		if !bytes.Equal(priv, privs[i]) {
+			t.Errorf("prekey %d doesn't match", i+1)
+			return
+		}
+	}
+	// The id and public key need to refer to the same prekey
+	_, err := store.GetPrekey(1, pubs[1])
+	if err == nil {
+		t.Errorf("expected mismatched prekey lookup to fail")
+		return
+	}
+}
+
+func TestAddFriendSameKey(t *testing.T) {
+	store := newTestStore(t)
+	alice := newTestIdentity(t)
+	status, err := store.AddFriend(alice, "alice", false)
+	if err != nil {
+		t.Errorf("couldn't add friend: %v", err)
+		return
+	}
+	if status != FriendCreated {
+		t.Errorf("expected FriendCreated, found %v", status)
+		return
+	}
+	err = store.VerifyFriend("alice")
+	if err != nil {
+		t.Errorf("couldn't verify friend: %v", err)
+		return
+	}
+	status, err = store.AddFriend(alice, "alice", false)
+	if err != nil {
+		t.Errorf("adding the same friend again failed: %v", err)
+		return
+	}
+	if status != FriendUnchanged {
+		t.Errorf("expected FriendUnchanged, found %v", status)
+		return
+	}
+	friends, err := store.ListFriends()
+	if err != nil {
+		t.Errorf("couldn't list friends: %v", err)
+		return
+	}
+	if len(friends) != 1 || !friends[0].Verified || !friends[0].ChangedAt.IsZero() {
+		t.Errorf("adding the same friend modified them: %v", friends)
+		return
+	}
+}
+
+func TestAddFriendChangedKey(t *testing.T) {
+	store := newTestStore(t)
+	alice := newTestIdentity(t)
+	_, err := store.AddFriend(alice, "alice", false)
+	if err != nil {
+		t.Errorf("couldn't add friend: %v", err)
+		return
+	}
+	status, err := store.AddFriend(newTestIdentity(t), "alice", false)
+	if !errors.Is(err, ErrFriendKeyChanged) || status != FriendKeyConflict {
+		t.Errorf("expected ErrFriendKeyChanged and FriendKeyConflict, found %v %v", err, status)
+		return
+	}
+	pub, err := store.GetFriend("alice")
+	if err != nil {
+		t.Errorf("couldn't get friend: %v", err)
+		return
+	}
+	if !bytes.Equal(pub, alice) {
+		t.Errorf("friend's key was overwritten without force")
+		return
+	}
+}
+
+func TestAddFriendForced(t *testing.T) {
+	changed := time.Unix(1600000000, 0)
+	now = func() time.Time { return changed }
+	defer func() { now = time.Now }()
+
+	store := newTestStore(t)
+	_, err := store.AddFriend(newTestIdentity(t), "alice", false)
+	if err != nil {
+		t.Errorf("couldn't add friend: %v", err)
+		return
+	}
+	err = store.VerifyFriend("alice")
+	if err != nil {
+		t.Errorf("couldn't verify friend: %v", err)
+		return
+	}
+	alice := newTestIdentity(t)
+	status, err := store.AddFriend(alice, "alice", true)
+	if err != nil {
+		t.Errorf("couldn't force friend: %v", err)
+		return
+	}
+	if status != FriendKeyReplaced {
+		t.Errorf("expected FriendKeyReplaced, found %v", status)
+		return
+	}
+	friends, err := store.ListFriends()
+	if err != nil {
+		t.Errorf("couldn't list friends: %v", err)
+		return
+	}
+	if len(friends) != 1 {
+		t.Errorf("expected 1 friend, found %v", friends)
+		return
+	}
+	friend := friends[0]
+	if !bytes.Equal(friend.Pub, alice) || friend.Verified || !friend.ChangedAt.Equal(changed) {
+		t.Errorf("unexpected friend after forced overwrite: %v", friend)
+		return
+	}
+}
+
+func TestAddFriendUpdatesName(t *testing.T) {
+	store := newTestStore(t)
+	alice := newTestIdentity(t)
+	_, err := store.AddFriend(alice, "alice", false)
+	if err != nil {
+		t.Errorf("couldn't add friend: %v", err)
+		return
+	}
+	err = store.VerifyFriend("alice")
+	if err != nil {
+		t.Errorf("couldn't verify friend: %v", err)
+		return
+	}
+	status, err := store.AddFriend(alice, "alicia", false)
+	if err != nil {
+		t.Errorf("couldn't add friend again: %v", err)
+		return
+	}
+	if status != FriendUpdatedName {
+		t.Errorf("expected FriendUpdatedName, found %v", status)
+		return
+	}
+	friends, err := store.ListFriends()
+	if err != nil {
+		t.Errorf("couldn't list friends: %v", err)
+		return
+	}
+	if len(friends) != 1 || friends[0].Name != "alicia" || !bytes.Equal(friends[0].Pub, alice) || !friends[0].Verified {
+		t.Errorf("unexpected friends after renaming: %v", friends)
+		return
+	}
+}
+
+func TestChatSendsAndReceivesConcurrently(t *testing.T) {
+	chat := startTestChat(t)
+	const count = 200
+	// Alice's side of the session is shared by her goroutines, just like bob's
+	var aliceLock sync.Mutex
+	errs := make(chan error, 2)
+	go func() {
+		for i := 0; i < count; i++ {
+			aliceLock.Lock()
+			ciphertext, err := chat.ratchet.Encrypt([]byte(fmt.Sprintf("from alice %d", i)), chat.additional)
+			aliceLock.Unlock()
+			if err != nil {
+				errs <- err
+				return
+			}
+			chat.api.incoming <- server.Message{From: chat.alice, To: chat.bob, Payload: server.Payload{
+				Variant: &server.MessagePayload{Data: ciphertext},
+			}}
+		}
+	}()
+	go func() {
+		for i := 0; i < count; i++ {
+			chat.in <- fmt.Sprintf("from bob %d", i)
+			if i%10 == 0 {
+				chat.typing <- struct{}{}
+			}
+		}
+	}()
+	decrypted := make(chan string)
+	go func() {
+		for msg := range chat.api.sent {
+			var data []byte
+			var additional []byte
+			switch v := msg.Payload.Variant.(type) {
+			case *server.MessagePayload:
+				data, additional = v.Data, chat.additional
+			case *server.TypingPayload:
+				data, additional = v.Data, tagAdditional(chat.additional, "typing", nil)
+			case *server.ReceiptPayload:
+				data, additional = v.Data, tagAdditional(chat.additional, "receipt", v.MessageID)
+			case *server.AckPayload:
+				data, additional = v.Data, tagAdditional(chat.additional, "ack", v.MessageID)
+			default:
+				continue
+			}
+			aliceLock.Lock()
+			plaintext, err := chat.ratchet.Decrypt(data, additional)
+			aliceLock.Unlock()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, ok := msg.Payload.Variant.(*server.MessagePayload); ok {
+				decrypted <- string(plaintext)
+			}
+		}
+	}()
+
+	received, sent := 0, 0
+	timeout := time.After(30 * time.Second)
+	for received < count || sent < count {
+		select {
+		case event := <-chat.out:
+			if event.Kind == EventMessage {
+				received++
+			}
+		case <-decrypted:
+			sent++
+		case err := <-errs:
+			t.Errorf("alice failed: %v", err)
+			return
+		case <-timeout:
+			t.Errorf("timed out with %d messages received, and %d sent", received, sent)
+			return
+		}
+	}
+}
+
+func TestBlockedMessagesAreDropped(t *testing.T) {
+	chat := startTestChat(t)
+	chat.send(t, "hello")
+	select {
+	case event := <-chat.out:
+		if event.Kind != EventMessage || event.Text != "hello" {
+			t.Errorf("unexpected event: %v", event)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("didn't receive message before blocking")
+		return
+	}
+
+	err := chat.store.BlockFriend(chat.alice)
+	if err != nil {
+		t.Errorf("couldn't block friend: %v", err)
+		return
+	}
+	chat.send(t, "blocked")
+	select {
+	case event := <-chat.out:
+		t.Errorf("received %v from a blocked friend", event)
+		return
+	case <-time.After(200 * time.Millisecond):
+	}
+	history, err := chat.store.GetHistory(chat.alice, 10)
+	if err != nil {
+		t.Errorf("couldn't get history: %v", err)
+		return
+	}
+	if len(history) != 1 {
+		t.Errorf("expected only 1 message in history, found %v", history)
+		return
+	}
+}
+
+// roundtripJSON encodes and decodes a message, like the server would
+func roundtripJSON(t *testing.T, message server.Message) server.Message {
+	data, err := json.Marshal(message)
+	if err != nil {
+		t.Fatalf("couldn't encode message: %v", err)
+	}
+	var decoded server.Message
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		t.Fatalf("couldn't decode message: %v", err)
+	}
+	return decoded
+}
+
+func TestSendFile(t *testing.T) {
+	store := newTestStore(t)
+	alice, alicePriv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	bob, bobPriv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	prekey, prekeyPriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	api := &fakeAPI{incoming: make(chan server.Message, 1), sent: make(chan server.Message, 16)}
+	api.incoming <- server.Message{From: bob, To: alice, Payload: server.Payload{
+		Variant: &server.StartExchangePayload{KeyID: 1, Prekey: prekey, Sig: bobPriv.SignPrekey(prekey)},
+	}}
+	contents := []byte{0, 1, 2, 0xFF, 0xFE, '\n', 0}
+	sent := make(chan error, 1)
+	go func() {
+		sent <- SendFile(context.Background(), api, store, alice, alicePriv, bob, "data.bin", "application/octet-stream", contents, 5*time.Second)
+	}()
+
+	<-api.sent
+	end, ok := roundtripJSON(t, <-api.sent).Payload.Variant.(*server.EndExchangePayload)
+	if !ok {
+		t.Errorf("expected end of exchange")
+		return
+	}
+	file, ok := roundtripJSON(t, <-api.sent).Payload.Variant.(*server.FilePayload)
+	if !ok {
+		t.Errorf("expected file")
+		return
+	}
+	if file.Name != "data.bin" || file.MimeType != "application/octet-stream" {
+		t.Errorf("unexpected file metadata: %s %s", file.Name, file.MimeType)
+		return
+	}
+
+	secret, err := crypto.BackwardExchange(&crypto.BackwardExchangeParams{
+		Them:      alice,
+		Ephemeral: end.Ephemeral,
+		Identity:  bobPriv,
+		Prekey:    prekeyPriv,
+	})
+	if err != nil {
+		t.Errorf("couldn't exchange keys: %v", err)
+		return
+	}
+	ratchet := crypto.DoubleRatchetFromReceiver(secret, prekey, prekeyPriv)
+	additional := append(append([]byte(nil), alice...), bob...)
+	_, err = ratchet.Decrypt(end.InitialData, additional)
+	if err != nil {
+		t.Errorf("couldn't decrypt initial data: %v", err)
+		return
+	}
+	// The metadata is authenticated, so changing it makes decryption fail
+	_, err = ratchet.Decrypt(file.Data, fileAdditional(additional, "other.bin", file.MimeType))
+	if err == nil {
+		t.Errorf("decrypted file with tampered name")
+		return
+	}
+	data, err := ratchet.Decrypt(file.Data, fileAdditional(additional, file.Name, file.MimeType))
+	if err != nil {
+		t.Errorf("couldn't decrypt file: %v", err)
+		return
+	}
+	if !bytes.Equal(data, contents) {
+		t.Errorf("%v != %v", data, contents)
+		return
+	}
+
+	id := messageID(file.Data)
+	receipt, err := ratchet.Encrypt(nil, tagAdditional(additional, "receipt", id))
+	if err != nil {
+		t.Errorf("couldn't encrypt receipt: %v", err)
+		return
+	}
+	api.incoming <- server.Message{From: bob, To: alice, Payload: server.Payload{
+		Variant: &server.ReceiptPayload{MessageID: id, Data: receipt},
+	}}
+	err = <-sent
+	if err != nil {
+		t.Errorf("couldn't send file: %v", err)
+		return
+	}
+}
+
+func TestSendFileTooLarge(t *testing.T) {
+	store := newTestStore(t)
+	alice, alicePriv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	bob := newTestIdentity(t)
+	api := &fakeAPI{incoming: make(chan server.Message, 1), sent: make(chan server.Message, 16)}
+	contents := make([]byte, server.DefaultMaxMessageBytes)
+	err = SendFile(context.Background(), api, store, alice, alicePriv, bob, "data.bin", "application/octet-stream", contents, time.Second)
+	if err != ErrFileTooLarge {
+		t.Errorf("expected ErrFileTooLarge, found %v", err)
+		return
+	}
+	select {
+	case msg := <-api.sent:
+		t.Errorf("message sent for a file that's too large: %v", msg)
+		return
+	default:
+	}
+}
+
+func TestReceiveFile(t *testing.T) {
+	chat := startTestChat(t)
+	contents := []byte{0xCA, 0xFE, 0, 0xBA, 0xBE}
+	ciphertext, err := chat.ratchet.Encrypt(contents, fileAdditional(chat.additional, "../../evil.bin", "application/octet-stream"))
+	if err != nil {
+		t.Errorf("couldn't encrypt file: %v", err)
+		return
+	}
+	chat.api.incoming <- roundtripJSON(t, server.Message{From: chat.alice, To: chat.bob, Payload: server.Payload{
+		Variant: &server.FilePayload{Name: "../../evil.bin", MimeType: "application/octet-stream", Data: ciphertext},
+	}})
+	var event ChatEvent
+	select {
+	case event = <-chat.out:
+	case <-time.After(5 * time.Second):
+		t.Errorf("didn't receive file")
+		return
+	}
+	if event.Kind != EventFile {
+		t.Errorf("unexpected event: %v", event)
+		return
+	}
+	path := event.Text
+	defer os.Remove(path)
+	if filepath.Dir(path) != filepath.Clean(os.TempDir()) {
+		t.Errorf("file was saved outside of the temporary directory: %s", path)
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Errorf("couldn't read received file: %v", err)
+		return
+	}
+	if !bytes.Equal(data, contents) {
+		t.Errorf("%v != %v", data, contents)
+		return
+	}
+}
+
+// receive waits for the next message bob sends to alice
+func (chat *testChat) receive(t *testing.T) server.Message {
+	select {
+	case msg := <-chat.api.sent:
+		return roundtripJSON(t, msg)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("bob didn't send a message")
+	}
+	return server.Message{}
+}
+
+func TestReceiptIsSent(t *testing.T) {
+	chat := startTestChat(t)
+	ciphertext, err := chat.ratchet.Encrypt([]byte("hello"), chat.additional)
+	if err != nil {
+		t.Errorf("couldn't encrypt message: %v", err)
+		return
+	}
+	chat.api.incoming <- server.Message{From: chat.alice, To: chat.bob, Payload: server.Payload{
+		Variant: &server.MessagePayload{Data: ciphertext},
+	}}
+	<-chat.out
+	receipt, ok := chat.receive(t).Payload.Variant.(*server.ReceiptPayload)
+	if !ok {
+		t.Errorf("expected receipt")
+		return
+	}
+	if !bytes.Equal(receipt.MessageID, messageID(ciphertext)) {
+		t.Errorf("receipt for unexpected message: %v", receipt.MessageID)
+		return
+	}
+	_, err = chat.ratchet.Decrypt(receipt.Data, tagAdditional(chat.additional, "receipt", receipt.MessageID))
+	if err != nil {
+		t.Errorf("couldn't authenticate receipt: %v", err)
+		return
+	}
+}
+
+func TestReceiptIsReceived(t *testing.T) {
+	chat := startTestChat(t)
+	chat.in <- "hello"
+	message, ok := chat.receive(t).Payload.Variant.(*server.MessagePayload)
+	if !ok {
+		t.Errorf("expected message")
+		return
+	}
+	_, err := chat.ratchet.Decrypt(message.Data, chat.additional)
+	if err != nil {
+		t.Errorf("couldn't decrypt message: %v", err)
+		return
+	}
+	id := messageID(message.Data)
+	data, err := chat.ratchet.Encrypt(nil, tagAdditional(chat.additional, "receipt", id))
+	if err != nil {
+		t.Errorf("couldn't encrypt receipt: %v", err)
+		return
+	}
+	chat.api.incoming <- roundtripJSON(t, server.Message{From: chat.alice, To: chat.bob, Payload: server.Payload{
+		Variant: &server.ReceiptPayload{MessageID: id, Data: data},
+	}})
+	select {
+	case event := <-chat.out:
+		if event.Kind != EventReceipt || event.Text != "hello" {
+			t.Errorf("unexpected event: %v", event)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("didn't receive receipt")
+		return
+	}
+}
+
+func TestAckIsSent(t *testing.T) {
+	chat := startTestChat(t)
+	ciphertext, err := chat.ratchet.Encrypt([]byte("hello"), chat.additional)
+	if err != nil {
+		t.Errorf("couldn't encrypt message: %v", err)
+		return
+	}
+	id := []byte("0123456789abcdef")
+	chat.api.incoming <- server.Message{From: chat.alice, To: chat.bob, Payload: server.Payload{
+		Variant: &server.MessagePayload{MessageID: id, Data: ciphertext},
+	}}
+	<-chat.out
+	ack, ok := chat.receive(t).Payload.Variant.(*server.AckPayload)
+	if !ok {
+		t.Errorf("expected ack")
+		return
+	}
+	if !bytes.Equal(ack.MessageID, id) {
+		t.Errorf("ack for unexpected message: %v", ack.MessageID)
+		return
+	}
+	_, err = chat.ratchet.Decrypt(ack.Data, tagAdditional(chat.additional, "ack", ack.MessageID))
+	if err != nil {
+		t.Errorf("couldn't authenticate ack: %v", err)
+		return
+	}
+	// The receipt still follows, once the message has been shown
+	_, ok = chat.receive(t).Payload.Variant.(*server.ReceiptPayload)
+	if !ok {
+		t.Errorf("expected receipt")
+		return
+	}
+}
+
+func TestAckIsReceived(t *testing.T) {
+	chat := startTestChat(t)
+	chat.in <- "hello"
+	message, ok := chat.receive(t).Payload.Variant.(*server.MessagePayload)
+	if !ok {
+		t.Errorf("expected message")
+		return
+	}
+	if len(message.MessageID) != messageIDSize {
+		t.Errorf("expected message to have an id, found %v", message.MessageID)
+		return
+	}
+	_, err := chat.ratchet.Decrypt(message.Data, chat.additional)
+	if err != nil {
+		t.Errorf("couldn't decrypt message: %v", err)
+		return
+	}
+	data, err := chat.ratchet.Encrypt(nil, tagAdditional(chat.additional, "ack", message.MessageID))
+	if err != nil {
+		t.Errorf("couldn't encrypt ack: %v", err)
+		return
+	}
+	chat.api.incoming <- roundtripJSON(t, server.Message{From: chat.alice, To: chat.bob, Payload: server.Payload{
+		Variant: &server.AckPayload{MessageID: message.MessageID, Data: data},
+	}})
+	select {
+	case event := <-chat.out:
+		if event.Kind != EventDelivered || event.Text != "hello" {
+			t.Errorf("unexpected event: %v", event)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("didn't receive ack")
+		return
+	}
+}
+
+func TestUnackedMessageIsFlagged(t *testing.T) {
+	oldTimeout := ackTimeout
+	ackTimeout = 50 * time.Millisecond
+	defer func() { ackTimeout = oldTimeout }()
+
+	chat := startTestChat(t)
+	chat.in <- "hello"
+	_, ok := chat.receive(t).Payload.Variant.(*server.MessagePayload)
+	if !ok {
+		t.Errorf("expected message")
+		return
+	}
+	select {
+	case event := <-chat.out:
+		if event.Kind != EventUndelivered || event.Text != "hello" {
+			t.Errorf("unexpected event: %v", event)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("message wasn't flagged")
+		return
+	}
+}
+
+func TestStalledConnectionTimesOut(t *testing.T) {
+	oldTimeout := sendTimeout
+	sendTimeout = 50 * time.Millisecond
+	defer func() { sendTimeout = oldTimeout }()
+
+	chat := startTestChat(t)
+	// Nobody reads what bob sends, so the connection stops taking messages once its buffer is full,
+	// and it's holding on to the first message
+	for i := 0; i < cap(chat.api.sent); i++ {
+		chat.api.sent <- server.Message{}
+	}
+	chat.in <- "first"
+	chat.in <- "hello"
+	select {
+	case event := <-chat.out:
+		if event.Kind != EventStalled || event.Text != "hello" {
+			t.Errorf("unexpected event: %v", event)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("stalled connection wasn't noticed")
+		return
+	}
+	// Input is still taken afterwards, instead of hanging on the first message
+	select {
+	case chat.in <- "again":
+	case <-time.After(5 * time.Second):
+		t.Errorf("input hung after the connection stalled")
+		return
+	}
+}
+
+func TestUnackedMessageIsRetried(t *testing.T) {
+	oldTimeout := ackTimeout
+	ackTimeout = 50 * time.Millisecond
+	defer func() { ackTimeout = oldTimeout }()
+
+	chat := startTestChat(t)
+	chat.in <- "hello"
+	// The first attempt never makes it to alice, like when writing to the server fails
+	first, ok := chat.receive(t).Payload.Variant.(*server.MessagePayload)
+	if !ok {
+		t.Errorf("expected message")
+		return
+	}
+	depth, err := chat.store.QueueDepth()
+	if err != nil {
+		t.Errorf("couldn't get queue depth: %v", err)
+		return
+	}
+	if depth != 1 {
+		t.Errorf("expected 1 queued message, found %d", depth)
+		return
+	}
+	select {
+	case event := <-chat.out:
+		if event.Kind != EventUndelivered {
+			t.Errorf("unexpected event: %v", event)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("message wasn't flagged")
+		return
+	}
+
+	retried, ok := chat.receive(t).Payload.Variant.(*server.MessagePayload)
+	if !ok {
+		t.Errorf("expected message to be retried")
+		return
+	}
+	if !bytes.Equal(retried.MessageID, first.MessageID) {
+		t.Errorf("retried message has a different id")
+		return
+	}
+	plaintext, err := chat.ratchet.Decrypt(retried.Data, chat.additional)
+	if err != nil {
+		t.Errorf("couldn't decrypt message: %v", err)
+		return
+	}
+	if string(plaintext) != "hello" {
+		t.Errorf("unexpected message: %q", plaintext)
+		return
+	}
+	data, err := chat.ratchet.Encrypt(nil, tagAdditional(chat.additional, "ack", retried.MessageID))
+	if err != nil {
+		t.Errorf("couldn't encrypt ack: %v", err)
+		return
+	}
+	chat.api.incoming <- roundtripJSON(t, server.Message{From: chat.alice, To: chat.bob, Payload: server.Payload{
+		Variant: &server.AckPayload{MessageID: retried.MessageID, Data: data},
+	}})
+	select {
+	case event := <-chat.out:
+		if event.Kind != EventDelivered || event.Text != "hello" {
+			t.Errorf("unexpected event: %v", event)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("didn't receive ack")
+		return
+	}
+	depth, err = chat.store.QueueDepth()
+	if err != nil {
+		t.Errorf("couldn't get queue depth: %v", err)
+		return
+	}
+	if depth != 0 {
+		t.Errorf("expected no queued messages, found %d", depth)
+		return
+	}
+}
+
+func TestRepeatedMessageIsIgnored(t *testing.T) {
+	chat := startTestChat(t)
+	id := []byte("0123456789abcdef")
+	for i := 0; i < 2; i++ {
+		ciphertext, err := chat.ratchet.Encrypt([]byte("hello"), chat.additional)
+		if err != nil {
+			t.Errorf("couldn't encrypt message: %v", err)
+			return
+		}
+		chat.api.incoming <- server.Message{From: chat.alice, To: chat.bob, Payload: server.Payload{
+			Variant: &server.MessagePayload{MessageID: id, Data: ciphertext},
+		}}
+		// Both copies are acked, since the first ack might be the one that was lost
+		if _, ok := chat.receive(t).Payload.Variant.(*server.AckPayload); !ok {
+			t.Errorf("expected ack")
+			return
+		}
+		if i > 0 {
+			break
+		}
+		select {
+		case event := <-chat.out:
+			if event.Kind != EventMessage {
+				t.Errorf("unexpected event: %v", event)
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("didn't receive message")
+			return
+		}
+		if _, ok := chat.receive(t).Payload.Variant.(*server.ReceiptPayload); !ok {
+			t.Errorf("expected receipt")
+			return
+		}
+	}
+	select {
+	case event := <-chat.out:
+		t.Errorf("unexpected event: %v", event)
+		return
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestFingerprintCommand(t *testing.T) {
+	chat := startTestChat(t)
+	chat.in <- FingerprintCommand
+	select {
+	case event := <-chat.out:
+		if event.Kind != EventFingerprint || event.Text == "" {
+			t.Errorf("unexpected event: %v", event)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("fingerprint wasn't shown")
+		return
+	}
+	select {
+	case msg := <-chat.api.sent:
+		t.Errorf("command was sent: %v", msg)
+		return
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTypingIsSent(t *testing.T) {
+	chat := startTestChat(t)
+	chat.typing <- struct{}{}
+	typing, ok := chat.receive(t).Payload.Variant.(*server.TypingPayload)
+	if !ok {
+		t.Errorf("expected typing indicator")
+		return
+	}
+	_, err := chat.ratchet.Decrypt(typing.Data, tagAdditional(chat.additional, "typing", nil))
+	if err != nil {
+		t.Errorf("couldn't authenticate typing indicator: %v", err)
+		return
+	}
+}
+
+func TestTypingIsReceived(t *testing.T) {
+	chat := startTestChat(t)
+	// An indicator authenticated as a normal message should be ignored
+	forged, err := chat.ratchet.Encrypt(nil, chat.additional)
+	if err != nil {
+		t.Errorf("couldn't encrypt typing indicator: %v", err)
+		return
+	}
+	chat.api.incoming <- roundtripJSON(t, server.Message{From: chat.alice, To: chat.bob, Payload: server.Payload{
+		Variant: &server.TypingPayload{Data: forged},
+	}})
+	data, err := chat.ratchet.Encrypt(nil, tagAdditional(chat.additional, "typing", nil))
+	if err != nil {
+		t.Errorf("couldn't encrypt typing indicator: %v", err)
+		return
+	}
+	chat.api.incoming <- roundtripJSON(t, server.Message{From: chat.alice, To: chat.bob, Payload: server.Payload{
+		Variant: &server.TypingPayload{Data: data},
+	}})
+	select {
+	case event := <-chat.out:
+		if event.Kind != EventTyping {
+			t.Errorf("unexpected event: %v", event)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("didn't receive typing indicator")
+		return
+	}
+}
+
+// fakeNetwork relays messages between several clients, like the server would
+type fakeNetwork struct {
+	sync.Mutex
+	// exchanges holds the keys handed out for each identity
+	exchanges map[string]server.StartExchangePayload
+	// clients holds the connected clients
+	clients map[string]chan server.Message
+	// queries counts the exchanges queried by each identity
+	queries map[string]int
+}
+
+func newFakeNetwork() *fakeNetwork {
+	return &fakeNetwork{
+		exchanges: make(map[string]server.StartExchangePayload),
+		clients:   make(map[string]chan server.Message),
+		queries:   make(map[string]int),
+	}
+}
+
+// join creates a client on this network, with a saved prekey
+func (network *fakeNetwork) join(t *testing.T) (crypto.IdentityPub, crypto.IdentityPriv, ClientStore) {
+	store := newTestStore(t)
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("couldn't generate identity: %v", err)
+	}
+	prekey, prekeyPriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Fatalf("couldn't generate prekey: %v", err)
+	}
+	err = store.SavePrekey(1, prekey, prekeyPriv)
+	if err != nil {
+		t.Fatalf("couldn't save prekey: %v", err)
+	}
+	network.Lock()
+	defer network.Unlock()
+	network.exchanges[string(pub)] = server.StartExchangePayload{KeyID: 1, Prekey: prekey, Sig: priv.SignPrekey(prekey)}
+	return pub, priv, store
+}
+
+// queried returns the number of exchanges an identity has queried
+func (network *fakeNetwork) queried(pub crypto.IdentityPub) int {
+	network.Lock()
+	defer network.Unlock()
+	return network.queries[string(pub)]
+}
+
+// connected checks whether an identity is connected to the network
+func (network *fakeNetwork) connected(pub crypto.IdentityPub) bool {
+	network.Lock()
+	defer network.Unlock()
+	_, present := network.clients[string(pub)]
+	return present
+}
+
+// disconnect closes the connection of a client, like a server going away
+func (network *fakeNetwork) disconnect(pub crypto.IdentityPub) {
+	network.Lock()
+	defer network.Unlock()
+	out, present := network.clients[string(pub)]
+	if present {
+		delete(network.clients, string(pub))
+		close(out)
+	}
+}
+
+// networkAPI is the ClientAPI of a client connected to a fakeNetwork
+type networkAPI struct {
+	fakeAPI
+	network *fakeNetwork
+}
+
+func (api *networkAPI) Listen(ctx context.Context, identity crypto.IdentityPub, priv crypto.IdentityPriv, in <-chan server.Message) (<-chan server.Message, error) {
+	network := api.network
+	out := make(chan server.Message, 64)
+	network.Lock()
+	network.clients[string(identity)] = out
+	network.Unlock()
+	go func() {
+		for message := range roundtripMessages(in) {
+			network.Lock()
+			to, present := network.clients[string(message.To)]
+			if _, ok := message.Payload.Variant.(*server.QueryExchangePayload); ok {
+				network.queries[string(identity)]++
+				// Like the server, we only start exchanges with connected clients
+				if present {
+					exchange := network.exchanges[string(message.To)]
+					out <- server.Message{From: message.To, To: identity, Payload: server.Payload{Variant: &exchange}}
+				}
+			} else if present {
+				message.From = identity
+				to <- message
+			}
+			network.Unlock()
+		}
+		// Like the real API, closing the input disconnects us, unless we've already been disconnected
+		network.Lock()
+		if network.clients[string(identity)] == out {
+			delete(network.clients, string(identity))
+			close(out)
+		}
+		network.Unlock()
+	}()
+	return out, nil
+}
+
+// waitFor polls a condition until it holds, returning false if it never does
+func waitFor(condition func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// roundtripMessages encodes and decodes messages, like the server would
+func roundtripMessages(in <-chan server.Message) <-chan server.Message {
+	out := make(chan server.Message)
+	go func() {
+		for message := range in {
+			data, err := json.Marshal(message)
+			if err != nil {
+				panic(err)
+			}
+			var decoded server.Message
+			err = json.Unmarshal(data, &decoded)
+			if err != nil {
+				panic(err)
+			}
+			out <- decoded
+		}
+		close(out)
+	}()
+	return out
+}
+
+func TestGroupChatClosesConnectionOnError(t *testing.T) {
+	store := newTestStore(t)
+	alice, alicePriv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	bob := newTestIdentity(t)
+	carol := newTestIdentity(t)
+	prekey, _, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	api := &fakeAPI{incoming: make(chan server.Message, 1), sent: make(chan server.Message, 16)}
+	// Bob's prekey isn't signed by him, so negotiating with him fails, while carol never answers
+	api.incoming <- server.Message{From: bob, To: alice, Payload: server.Payload{
+		Variant: &server.StartExchangePayload{KeyID: 1, Prekey: prekey, Sig: alicePriv.SignPrekey(prekey)},
+	}}
+	group := Group{ID: []byte("group"), Name: "friends", Members: []crypto.IdentityPub{bob, carol}}
+	_, err = StartGroupChat(context.Background(), api, store, alice, alicePriv, group, make(chan string))
+	if err != ErrBadPrekeySignature {
+		t.Errorf("expected ErrBadPrekeySignature, found %v", err)
+		return
+	}
+	_, ok := <-api.incoming
+	if ok {
+		t.Error("connection wasn't closed")
+		return
+	}
+}
+
+func TestGroupChat(t *testing.T) {
+	network := newFakeNetwork()
+	type client struct {
+		pub   crypto.IdentityPub
+		priv  crypto.IdentityPriv
+		store ClientStore
+		in    chan string
+		out   <-chan GroupEvent
+	}
+	clients := make([]*client, 3)
+	for i := range clients {
+		pub, priv, store := network.join(t)
+		clients[i] = &client{pub: pub, priv: priv, store: store, in: make(chan string)}
+	}
+	id, err := NewGroupID()
+	if err != nil {
+		t.Errorf("couldn't generate group id: %v", err)
+		return
+	}
+
+	errs := make(chan error, len(clients))
+	for i, c := range clients {
+		var members []crypto.IdentityPub
+		for j, other := range clients {
+			if j != i {
+				members = append(members, other.pub)
+			}
+		}
+		group := Group{ID: id, Name: "friends", Members: members}
+		err := c.store.CreateGroup(group)
+		if err != nil {
+			t.Errorf("couldn't create group: %v", err)
+			return
+		}
+		group, err = c.store.GetGroup("friends")
+		if err != nil {
+			t.Errorf("couldn't get group: %v", err)
+			return
+		}
+		go func(c *client) {
+			out, err := StartGroupChat(context.Background(), &networkAPI{network: network}, c.store, c.pub, c.priv, group, c.in)
+			c.out = out
+			errs <- err
+		}(c)
+		// Each client needs to query the others before the next one connects
+		if !waitFor(func() bool { return network.queried(c.pub) == len(members) }) {
+			t.Errorf("client %d didn't query the other members", i)
+			return
+		}
+	}
+	for range clients {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Errorf("couldn't start group chat: %v", err)
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("timed out starting group chat")
+			return
+		}
+	}
+
+	clients[0].in <- "hello group"
+	for _, c := range clients[1:] {
+		select {
+		case event := <-c.out:
+			if !bytes.Equal(event.From, clients[0].pub) || event.Text != "hello group" {
+				t.Errorf("unexpected event: %v", event)
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("group message wasn't delivered")
+			return
+		}
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	network := newFakeNetwork()
+	alice, alicePriv, aliceStore := network.join(t)
+	bob, bobPriv, bobStore := network.join(t)
+
+	type started struct {
+		out <-chan ChatEvent
+		err error
+	}
+	bobStarted := make(chan started, 1)
+	go func() {
+		out, err := StartChat(context.Background(), &networkAPI{network: network}, bobStore, bob, bobPriv, alice, make(chan string), make(chan struct{}))
+		bobStarted <- started{out, err}
+	}()
+	// Bob needs to be connected before alice queries his keys
+	if !waitFor(func() bool { return network.queried(bob) == 1 }) {
+		t.Errorf("bob didn't query alice's keys")
+		return
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- SendMessage(context.Background(), &networkAPI{network: network}, aliceStore, alice, alicePriv, bob, "hello bob", 5*time.Second)
+	}()
+	chat := <-bobStarted
+	if chat.err != nil {
+		t.Errorf("couldn't start chat: %v", chat.err)
+		return
+	}
+	// Bob only sends back a receipt once the message has been shown
+	event := <-chat.out
+	if event.Kind != EventMessage || event.Text != "hello bob" {
+		t.Errorf("unexpected event: %v", event)
+		return
+	}
+	err := <-sent
+	if err != nil {
+		t.Errorf("couldn't send message: %v", err)
+		return
+	}
+	history, err := aliceStore.GetHistory(bob, 10)
+	if err != nil {
+		t.Errorf("couldn't get history: %v", err)
+		return
+	}
+	if len(history) != 1 || history[0].Body != "hello bob" || !history[0].Outgoing {
+		t.Errorf("unexpected history: %v", history)
+		return
+	}
+}
+
+func TestSendMessageWithoutReceipt(t *testing.T) {
+	store := newTestStore(t)
+	alice, alicePriv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	bob, bobPriv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	prekey, _, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	api := &fakeAPI{incoming: make(chan server.Message, 1), sent: make(chan server.Message, 16)}
+	api.incoming <- server.Message{From: bob, To: alice, Payload: server.Payload{
+		Variant: &server.StartExchangePayload{KeyID: 1, Prekey: prekey, Sig: bobPriv.SignPrekey(prekey)},
+	}}
+	err = SendMessage(context.Background(), api, store, alice, alicePriv, bob, "anyone there?", 50*time.Millisecond)
+	if err != ErrNoReceipt {
+		t.Errorf("expected ErrNoReceipt, found %v", err)
+		return
+	}
+}
+
+func TestSendMessageFriendNotOnline(t *testing.T) {
+	store := newTestStore(t)
+	alice, alicePriv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	bob, _, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	// The server never answers our query, like when bob isn't connected
+	api := &fakeAPI{incoming: make(chan server.Message), sent: make(chan server.Message, 16)}
+	err = SendMessage(context.Background(), api, store, alice, alicePriv, bob, "anyone there?", 50*time.Millisecond)
+	if err != ErrFriendNotOnline {
+		t.Errorf("expected ErrFriendNotOnline, found %v", err)
+		return
+	}
+}
+
+func TestReceiveFromSeveralFriends(t *testing.T) {
+	network := newFakeNetwork()
+	bob, bobPriv, bobStore := network.join(t)
+	out, err := Receive(context.Background(), &networkAPI{network: network}, bobStore, bob, bobPriv)
+	if err != nil {
+		t.Errorf("couldn't start receiving: %v", err)
+		return
+	}
+
+	for _, name := range []string{"alice", "carol"} {
+		pub, priv, store := network.join(t)
+		_, err := bobStore.AddFriend(pub, name, false)
+		if err != nil {
+			t.Errorf("couldn't add friend: %v", err)
+			return
+		}
+		sent := make(chan error, 1)
+		go func() {
+			sent <- SendMessage(context.Background(), &networkAPI{network: network}, store, pub, priv, bob, "hello from "+name, 5*time.Second)
+		}()
+		select {
+		case event := <-out:
+			if event.Kind != EventMessage || event.Name != name || !bytes.Equal(event.From, pub) || event.Text != "hello from "+name {
+				t.Errorf("unexpected event: %v", event)
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("message from %s wasn't received", name)
+			return
+		}
+		err = <-sent
+		if err != nil {
+			t.Errorf("couldn't send message: %v", err)
+			return
+		}
+	}
+}
+
+// chanNotifier sends every notification it gets to a channel, as an event
+type chanNotifier chan ReceiveEvent
+
+func (notifier chanNotifier) Notify(from crypto.IdentityPub, name, body string) {
+	notifier <- ReceiveEvent{ChatEvent: ChatEvent{Kind: EventMessage, Text: body}, From: from, Name: name}
+}
+
+func TestRunDaemon(t *testing.T) {
+	network := newFakeNetwork()
+	bob, bobPriv, bobStore := network.join(t)
+	hooked := make(chan ReceiveEvent, 2)
+	go func() {
+		err := RunDaemon(context.Background(), &networkAPI{network: network}, bobStore, bob, bobPriv, chanNotifier(hooked))
+		if err != nil {
+			t.Errorf("daemon failed: %v", err)
+		}
+	}()
+
+	if !waitFor(func() bool { return network.connected(bob) }) {
+		t.Errorf("bob's daemon didn't connect")
+		return
+	}
+
+	names := []string{"alice", "carol"}
+	friends := make(map[string]crypto.IdentityPub)
+	for _, name := range names {
+		pub, priv, store := network.join(t)
+		friends[name] = pub
+		_, err := bobStore.AddFriend(pub, name, false)
+		if err != nil {
+			t.Errorf("couldn't add friend: %v", err)
+			return
+		}
+		// The daemon acknowledges messages by itself, so this returns once it has received them
+		err = SendMessage(context.Background(), &networkAPI{network: network}, store, pub, priv, bob, "hello from "+name, 5*time.Second)
+		if err != nil {
+			t.Errorf("couldn't send message: %v", err)
+			return
+		}
+	}
+
+	for _, name := range names {
+		select {
+		case event := <-hooked:
+			if event.Name != name || event.Text != "hello from "+name {
+				t.Errorf("unexpected event: %v", event)
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("hook didn't fire for %s", name)
+			return
+		}
+		history, err := bobStore.GetHistory(friends[name], 10)
+		if err != nil {
+			t.Errorf("couldn't get history: %v", err)
+			return
+		}
+		if len(history) != 1 || history[0].Body != "hello from "+name || history[0].Outgoing {
+			t.Errorf("unexpected history for %s: %v", name, history)
+			return
+		}
+	}
+}
+
+func TestRunDaemonResumesSessions(t *testing.T) {
+	network := newFakeNetwork()
+	bob, bobPriv, bobStore := network.join(t)
+	alice, alicePriv, aliceStore := network.join(t)
+	_, err := bobStore.AddFriend(alice, "alice", false)
+	if err != nil {
+		t.Errorf("couldn't add friend: %v", err)
+		return
+	}
+	hooked := make(chan ReceiveEvent, 2)
+	startDaemon := func() <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			done <- RunDaemon(context.Background(), &networkAPI{network: network}, bobStore, bob, bobPriv, chanNotifier(hooked))
+		}()
+		return done
+	}
+	expectHooked := func(text string) bool {
+		select {
+		case event := <-hooked:
+			if event.Name != "alice" || event.Text != text {
+				t.Errorf("unexpected event: %v", event)
+				return false
+			}
+			return true
+		case <-time.After(5 * time.Second):
+			t.Errorf("hook didn't fire for %s", text)
+			return false
+		}
+	}
+
+	done := startDaemon()
+	if !waitFor(func() bool { return network.connected(bob) }) {
+		t.Errorf("bob's daemon didn't connect")
+		return
+	}
+	in := make(chan string)
+	out, err := StartChat(context.Background(), &networkAPI{network: network}, aliceStore, alice, alicePriv, bob, in, nil)
+	if err != nil {
+		t.Errorf("couldn't start chat: %v", err)
+		return
+	}
+	in <- "before restart"
+	if !expectHooked("before restart") {
+		return
+	}
+
+	network.disconnect(bob)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("daemon failed: %v", err)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("daemon didn't stop after disconnecting")
+		return
+	}
+	startDaemon()
+	if !waitFor(func() bool { return network.connected(bob) }) {
+		t.Errorf("bob's daemon didn't reconnect")
+		return
+	}
+
+	// Alice keeps using the same session, which bob needs to have saved
+	in <- "after restart"
+	if !expectHooked("after restart") {
+		return
+	}
+	for {
+		select {
+		case event := <-out:
+			if event.Kind == EventReceipt && event.Text == "after restart" {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("alice didn't get a receipt after the restart")
+			return
+		}
+	}
+}
+
+func TestResetSessionForcesHandshake(t *testing.T) {
+	network := newFakeNetwork()
+	bob, bobPriv, bobStore := network.join(t)
+	alice, alicePriv, aliceStore := network.join(t)
+	_, err := bobStore.AddFriend(alice, "alice", false)
+	if err != nil {
+		t.Errorf("couldn't add friend: %v", err)
+		return
+	}
+	hooked := make(chan ReceiveEvent, 2)
+	startDaemon := func() <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			done <- RunDaemon(context.Background(), &networkAPI{network: network}, bobStore, bob, bobPriv, chanNotifier(hooked))
+		}()
+		return done
+	}
+	chat := func(text string) bool {
+		in := make(chan string)
+		_, err := StartChat(context.Background(), &networkAPI{network: network}, aliceStore, alice, alicePriv, bob, in, nil)
+		if err != nil {
+			t.Errorf("couldn't start chat: %v", err)
+			return false
+		}
+		in <- text
+		select {
+		case event := <-hooked:
+			if event.Text != text {
+				t.Errorf("unexpected event: %v", event)
+				return false
+			}
+			return true
+		case <-time.After(5 * time.Second):
+			t.Errorf("hook didn't fire for %s", text)
+			return false
+		}
+	}
+
+	done := startDaemon()
+	if !waitFor(func() bool { return network.connected(bob) }) {
+		t.Errorf("bob's daemon didn't connect")
+		return
+	}
+	if !chat("before reset") {
+		return
+	}
+	network.disconnect(bob)
+	<-done
+
+	_, _, err = bobStore.GetSession(alice)
+	if err != nil {
+		t.Errorf("session wasn't saved: %v", err)
+		return
+	}
+	err = bobStore.DeleteSession(alice)
+	if err != nil {
+		t.Errorf("couldn't delete session: %v", err)
+		return
+	}
+	_, _, err = bobStore.GetSession(alice)
+	if err != ErrNoSuchSession {
+		t.Errorf("expected ErrNoSuchSession, found %v", err)
+		return
+	}
+	err = bobStore.DeleteSession(alice)
+	if err != nil {
+		t.Errorf("deleting a missing session failed: %v", err)
+		return
+	}
+
+	startDaemon()
+	if !waitFor(func() bool { return network.connected(bob) }) {
+		t.Errorf("bob's daemon didn't reconnect")
+		return
+	}
+	if !chat("after reset") {
+		return
+	}
+	if queried := network.queried(alice); queried != 2 {
+		t.Errorf("expected a new handshake, found %d exchanges", queried)
+		return
+	}
+	_, _, err = bobStore.GetSession(alice)
+	if err != nil {
+		t.Errorf("new session wasn't saved: %v", err)
+		return
+	}
+}
+
+func TestGetFriendName(t *testing.T) {
+	store := newTestStore(t)
+	pub := newTestIdentity(t)
+	_, err := store.GetFriendName(pub)
+	if err != ErrNoSuchFriend {
+		t.Errorf("expected ErrNoSuchFriend, found %v", err)
+		return
+	}
+	_, err = store.AddFriend(pub, "alice", false)
+	if err != nil {
+		t.Errorf("couldn't add friend: %v", err)
+		return
+	}
+	name, err := store.GetFriendName(pub)
+	if err != nil {
+		t.Errorf("couldn't get friend name: %v", err)
+		return
+	}
+	if name != "alice" {
+		t.Errorf("%s != alice", name)
+		return
+	}
+}
+
+func TestCreateGroup(t *testing.T) {
+	store := newTestStore(t)
+	id, err := NewGroupID()
+	if err != nil {
+		t.Errorf("couldn't generate group id: %v", err)
+		return
+	}
+	alice := newTestIdentity(t)
+	bob := newTestIdentity(t)
+	err = store.CreateGroup(Group{ID: id, Name: "friends", Members: []crypto.IdentityPub{alice, bob, alice}})
+	if err != nil {
+		t.Errorf("couldn't create group: %v", err)
+		return
+	}
+	err = store.CreateGroup(Group{ID: id, Name: "friends"})
+	if !errors.Is(err, ErrGroupExists) {
+		t.Errorf("expected ErrGroupExists, found %v", err)
+		return
+	}
+	_, err = store.GetGroup("enemies")
+	if !errors.Is(err, ErrNoSuchGroup) {
+		t.Errorf("expected ErrNoSuchGroup, found %v", err)
+		return
+	}
+	groups, err := store.ListGroups()
+	if err != nil {
+		t.Errorf("couldn't list groups: %v", err)
+		return
+	}
+	if len(groups) != 1 || !bytes.Equal(groups[0].ID, id) || len(groups[0].Members) != 2 {
+		t.Errorf("unexpected groups: %v", groups)
+		return
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	database := path.Join(t.TempDir(), "client.db")
+	store, err := NewEncryptedStore(database, "hunter2")
+	if err != nil {
+		t.Errorf("couldn't create store: %v", err)
+		return
+	}
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	err = store.SaveIdentity(pub, priv)
+	if err != nil {
+		t.Errorf("couldn't save identity: %v", err)
+		return
+	}
+	prekey, prekeyPriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	err = store.SavePrekey(1, prekey, prekeyPriv)
+	if err != nil {
+		t.Errorf("couldn't save prekey: %v", err)
+		return
+	}
+	var stored []byte
+	err = store.(*clientDatabase).QueryRow("SELECT private FROM identity;").Scan(&stored)
+	if err != nil {
+		t.Errorf("couldn't read identity: %v", err)
+		return
+	}
+	if bytes.Contains(stored, priv[:crypto.IdentitySeedSize]) {
+		t.Errorf("identity was stored in plaintext")
+		return
+	}
+	store.(*clientDatabase).Close()
+
+	_, err = NewStore(database)
+	if !errors.Is(err, ErrPassphraseRequired) {
+		t.Errorf("expected ErrPassphraseRequired, found %v", err)
+		return
+	}
+	_, err = NewEncryptedStore(database, "hunter3")
+	if !errors.Is(err, ErrBadPassphrase) {
+		t.Errorf("expected ErrBadPassphrase, found %v", err)
+		return
+	}
+	store, err = NewEncryptedStore(database, "hunter2")
+	if err != nil {
+		t.Errorf("couldn't reopen store: %v", err)
+		return
+	}
+	_, privAgain, err := store.GetFullIdentity()
+	if err != nil {
+		t.Errorf("couldn't get identity: %v", err)
+		return
+	}
+	if !bytes.Equal(privAgain, priv) {
+		t.Errorf("%v != %v", privAgain, priv)
+		return
+	}
+	prekeyPrivAgain, err := store.GetPrekey(1, prekey)
+	if err != nil {
+		t.Errorf("couldn't get prekey: %v", err)
+		return
+	}
+	if !bytes.Equal(prekeyPrivAgain, prekeyPriv) {
+		t.Errorf("%v != %v", prekeyPrivAgain, prekeyPriv)
+		return
+	}
+}
+
+func TestEncryptExistingStore(t *testing.T) {
+	database := path.Join(t.TempDir(), "client.db")
+	store, err := NewStore(database)
+	if err != nil {
+		t.Errorf("couldn't create store: %v", err)
+		return
+	}
+	bundle, bundlePriv, err := crypto.GenerateBundle(2)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	err = store.SaveBundle(bundle, bundlePriv)
+	if err != nil {
+		t.Errorf("couldn't save bundle: %v", err)
+		return
+	}
+	store.(*clientDatabase).Close()
+
+	store, err = NewEncryptedStore(database, "hunter2")
+	if err != nil {
+		t.Errorf("couldn't encrypt store: %v", err)
+		return
+	}
+	onetime, err := store.BurnOnetime(bundle.Get(0))
+	if err != nil {
+		t.Errorf("couldn't burn onetime key: %v", err)
+		return
+	}
+	if !bytes.Equal(onetime, bundlePriv[0]) {
+		t.Errorf("%v != %v", onetime, bundlePriv[0])
+		return
+	}
+	// Reading the keys with the wrong key should fail, instead of returning garbage
+	store.(*clientDatabase).key = crypto.KeyFromPassphrase("hunter3", make([]byte, crypto.PassphraseSaltSize))
+	_, err = store.BurnOnetime(bundle.Get(1))
+	if err == nil {
+		t.Errorf("decrypted onetime key with the wrong key")
+		return
+	}
+}
+
+func TestBurnOnetimeConcurrently(t *testing.T) {
+	database := path.Join(t.TempDir(), "client.db")
+	// Two stores on the same file act like two processes, such as a daemon and a command
+	var stores [2]ClientStore
+	for i := range stores {
+		store, err := NewStore(database)
+		if err != nil {
+			t.Errorf("couldn't create store: %v", err)
+			return
+		}
+		defer store.(*clientDatabase).Close()
+		stores[i] = store
+	}
+	bundle, bundlePriv, err := crypto.GenerateBundle(64)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	err = stores[0].SaveBundle(bundle, bundlePriv)
+	if err != nil {
+		t.Errorf("couldn't save bundle: %v", err)
+		return
+	}
+	errs := make(chan error, bundle.Len())
+	var wg sync.WaitGroup
+	for i := 0; i < bundle.Len(); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			priv, err := stores[i%2].BurnOnetime(bundle.Get(i))
+			if err != nil {
+				errs <- fmt.Errorf("couldn't burn onetime key %d: %w", i, err)
+				return
+			}
+			if !bytes.Equal(priv, bundlePriv[i]) {
+				errs <- fmt.Errorf("onetime key %d: %v != %v", i, priv, bundlePriv[i])
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func TestBurnMissingOnetime(t *testing.T) {
+	store := newTestStore(t)
+	bundle, bundlePriv, err := crypto.GenerateBundle(1)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	err = store.SaveBundle(bundle, bundlePriv)
+	if err != nil {
+		t.Errorf("couldn't save bundle: %v", err)
+		return
+	}
+	priv, err := store.BurnOnetime(bundle.Get(0))
+	if err != nil {
+		t.Errorf("couldn't burn onetime key: %v", err)
+		return
+	}
+	if !bytes.Equal(priv, bundlePriv[0]) {
+		t.Errorf("%v != %v", priv, bundlePriv[0])
+		return
+	}
+	// The key can only be used once
+	_, err = store.BurnOnetime(bundle.Get(0))
+	if err != ErrNoSuchOnetime {
+		t.Errorf("expected ErrNoSuchOnetime, found %v", err)
+		return
+	}
+	unknown, _, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate exchange: %v", err)
+		return
+	}
+	_, err = store.BurnOnetime(unknown)
+	if err != ErrNoSuchOnetime {
+		t.Errorf("expected ErrNoSuchOnetime, found %v", err)
+		return
+	}
+}
+
+func TestAcceptExchangeWithUnknownOnetime(t *testing.T) {
+	alice, _, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	bob, bobPriv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	bobStore := newTestStore(t)
+	prekey, prekeyPriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	err = bobStore.SavePrekey(1, prekey, prekeyPriv)
+	if err != nil {
+		t.Errorf("couldn't save prekey: %v", err)
+		return
+	}
+	ephemeral, _, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate ephemeral key: %v", err)
+		return
+	}
+	onetime, _, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate onetime key: %v", err)
+		return
+	}
+	_, err = acceptExchange(bobStore, bob, bobPriv, alice, &server.EndExchangePayload{
+		PrekeyID:  1,
+		Prekey:    prekey,
+		OneTime:   onetime,
+		Ephemeral: ephemeral,
+	})
+	if !errors.Is(err, ErrNoSuchOnetime) {
+		t.Errorf("expected ErrNoSuchOnetime, found %v", err)
+		return
+	}
+}
+
+func TestIdentityPassphrase(t *testing.T) {
+	store := newTestStore(t)
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	err = store.SaveIdentityEncrypted(pub, priv, "hunter2")
+	if err != nil {
+		t.Errorf("couldn't save identity: %v", err)
+		return
+	}
+	_, _, err = store.GetFullIdentity()
+	if !errors.Is(err, ErrIdentityEncrypted) {
+		t.Errorf("expected ErrIdentityEncrypted, found %v", err)
+		return
+	}
+	_, err = store.GetIdentitySeed()
+	if !errors.Is(err, ErrIdentityEncrypted) {
+		t.Errorf("expected ErrIdentityEncrypted, found %v", err)
+		return
+	}
+	_, _, err = store.GetFullIdentityDecrypted("hunter3")
+	if !errors.Is(err, ErrBadPassphrase) {
+		t.Errorf("expected ErrBadPassphrase, found %v", err)
+		return
+	}
+	pubAgain, privAgain, err := store.GetFullIdentityDecrypted("hunter2")
+	if err != nil {
+		t.Errorf("couldn't decrypt identity: %v", err)
+		return
+	}
+	if !bytes.Equal(pubAgain, pub) || !bytes.Equal(privAgain, priv) {
+		t.Errorf("decrypted a different identity")
+		return
+	}
+	seed, err := store.GetIdentitySeedDecrypted("hunter2")
+	if err != nil {
+		t.Errorf("couldn't decrypt seed: %v", err)
+		return
+	}
+	if !bytes.Equal(seed, priv[:crypto.IdentitySeedSize]) {
+		t.Errorf("decrypted a different seed")
+		return
+	}
+	// The public identity is still available without a passphrase
+	pubAgain, err = store.GetIdentity()
+	if err != nil || !bytes.Equal(pubAgain, pub) {
+		t.Errorf("couldn't get public identity: %v", err)
+		return
+	}
+}
+
+func TestMigrateIdentityWithoutSeed(t *testing.T) {
+	database := path.Join(t.TempDir(), "client.db")
+	db, err := sql.Open("sqlite", database)
+	if err != nil {
+		t.Errorf("couldn't open database: %v", err)
+		return
+	}
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	_, err = db.Exec(`
+	CREATE TABLE identity (
+		id BOOLEAN PRIMARY KEY CONSTRAINT one_row CHECK (id) NOT NULL,
+		public BLOB NOT NULL,
+		private BLOB NOT NULL
+	);
+
+	INSERT INTO identity (id, public, private) VALUES (true, $1, $2);
+	`, pub, priv)
+	if err != nil {
+		t.Errorf("couldn't create old identity table: %v", err)
+		return
+	}
+	db.Close()
+
+	store, err := NewStore(database)
+	if err != nil {
+		t.Errorf("couldn't migrate store: %v", err)
+		return
+	}
+	seed, err := store.GetIdentitySeed()
+	if err != nil {
+		t.Errorf("couldn't get identity seed: %v", err)
+		return
+	}
+	if !bytes.Equal(seed, ed25519.PrivateKey(priv).Seed()) {
+		t.Errorf("%v != %v", seed, ed25519.PrivateKey(priv).Seed())
+		return
+	}
+	newPub, newPriv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	err = store.SaveIdentity(newPub, newPriv)
+	if err != nil {
+		t.Errorf("couldn't save identity: %v", err)
+		return
+	}
+}
+
+func TestMigrateFromV0(t *testing.T) {
+	database := path.Join(t.TempDir(), "client.db")
+	db, err := sql.Open("sqlite", database)
+	if err != nil {
+		t.Errorf("couldn't open database: %v", err)
+		return
+	}
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	friendPub, _, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	prekeyPub, prekeyPriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	onetimePub, onetimePriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate onetime: %v", err)
+		return
+	}
+	_, err = db.Exec(`
+	CREATE TABLE identity (
+		id BOOLEAN PRIMARY KEY CONSTRAINT one_row CHECK (id) NOT NULL,
+		public BLOB NOT NULL,
+		private BLOB NOT NULL
+	);
+
+	CREATE TABLE friend (
+		public BLOB PRIMARY KEY NOT NULL,
+		name TEXT NOT NULL
+	);
+
+	CREATE TABLE prekey (
+		public BLOB PRIMARY KEY NOT NULL,
+		private BLOB NOT NULL
+	);
+
+	CREATE TABLE onetime (
+		public BLOB PRIMARY KEY NOT NUll,
+		private BLOB NOT NULL
+	);
+
+	INSERT INTO identity (id, public, private) VALUES (true, $1, $2);
+	INSERT INTO friend (public, name) VALUES ($3, 'alice');
+	INSERT INTO prekey (public, private) VALUES ($4, $5);
+	INSERT INTO onetime (public, private) VALUES ($6, $7);
+	`, pub, priv, friendPub, prekeyPub, prekeyPriv, onetimePub, onetimePriv)
+	if err != nil {
+		t.Errorf("couldn't create old database: %v", err)
+		return
+	}
+	db.Close()
+
+	for i := 0; i < 2; i++ {
+		store, err := newClientDatabase(database)
+		if err != nil {
+			t.Errorf("couldn't migrate store: %v", err)
+			return
+		}
+		version, err := migrate.Version(store.DB)
+		if err != nil {
+			t.Errorf("couldn't get schema version: %v", err)
+			return
+		}
+		if version != len(clientMigrations) {
+			t.Errorf("expected schema version %d, found %d", len(clientMigrations), version)
+			return
+		}
+		gotPub, gotPriv, err := store.GetFullIdentity()
+		if err != nil {
+			t.Errorf("couldn't get identity: %v", err)
+			return
+		}
+		if !bytes.Equal(gotPub, pub) || !bytes.Equal(gotPriv, priv) {
+			t.Errorf("identity changed after migration")
+			return
+		}
+		gotFriend, err := store.GetFriend("alice")
+		if err != nil {
+			t.Errorf("couldn't get friend: %v", err)
+			return
+		}
+		if !bytes.Equal(gotFriend, friendPub) {
+			t.Errorf("%v != %v", gotFriend, friendPub)
+			return
+		}
+		gotPrekey, err := store.GetPrekey(1, prekeyPub)
+		if err != nil {
+			t.Errorf("couldn't get prekey: %v", err)
+			return
+		}
+		if !bytes.Equal(gotPrekey, prekeyPriv) {
+			t.Errorf("%v != %v", gotPrekey, prekeyPriv)
+			return
+		}
+		store.Close()
+	}
+	store, err := NewStore(database)
+	if err != nil {
+		t.Errorf("couldn't open store: %v", err)
+		return
+	}
+	gotOnetime, err := store.BurnOnetime(onetimePub)
+	if err != nil {
+		t.Errorf("couldn't burn onetime: %v", err)
+		return
+	}
+	if !bytes.Equal(gotOnetime, onetimePriv) {
+		t.Errorf("%v != %v", gotOnetime, onetimePriv)
+		return
+	}
+}
+
+func TestMigrationExpiresPrekeys(t *testing.T) {
+	database := path.Join(t.TempDir(), "client.db")
+	store, err := newClientDatabase(database)
+	if err != nil {
+		t.Errorf("couldn't open store: %v", err)
+		return
+	}
+	prekeyPub, prekeyPriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	err = store.SavePrekey(1, prekeyPub, prekeyPriv)
+	if err != nil {
+		t.Errorf("couldn't save prekey: %v", err)
+		return
+	}
+	store.Close()
+
+	// Going back to the first version makes the store run the later migrations again
+	db, err := sql.Open("sqlite", database)
+	if err != nil {
+		t.Errorf("couldn't open database: %v", err)
+		return
+	}
+	_, err = db.Exec("UPDATE meta SET value = '1' WHERE name = 'schema_version';")
+	db.Close()
+	if err != nil {
+		t.Errorf("couldn't reset schema version: %v", err)
+		return
+	}
+
+	store, err = newClientDatabase(database)
+	if err != nil {
+		t.Errorf("couldn't open store: %v", err)
+		return
+	}
+	defer store.Close()
+	createdAt, present, err := store.LatestPrekeyTime()
+	if err != nil {
+		t.Errorf("couldn't get prekey time: %v", err)
+		return
+	}
+	if !present || createdAt.Unix() != 0 {
+		t.Errorf("expected an expired prekey, found %v %v", present, createdAt)
+		return
+	}
+	_, err = store.GetPrekey(1, prekeyPub)
+	if err != nil {
+		t.Errorf("couldn't get expired prekey: %v", err)
+		return
+	}
+}
+
+func TestKeyPairsMatchSplitForms(t *testing.T) {
+	current := time.Unix(1000, 0)
+	now = func() time.Time { return current }
+	defer func() { now = time.Now }()
+
+	identity, err := crypto.GenerateIdentityPair()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	prekey, err := crypto.GenerateExchangePair()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+
+	split := newTestStore(t)
+	paired := newTestStore(t)
+	err = split.SaveIdentity(identity.Pub, identity.Priv)
+	if err != nil {
+		t.Errorf("couldn't save identity: %v", err)
+		return
+	}
+	err = paired.SaveIdentityPair(identity)
+	if err != nil {
+		t.Errorf("couldn't save identity pair: %v", err)
+		return
+	}
+	err = split.SavePrekey(1, prekey.Pub, prekey.Priv)
+	if err != nil {
+		t.Errorf("couldn't save prekey: %v", err)
+		return
+	}
+	err = paired.SavePrekeyPair(1, prekey)
+	if err != nil {
+		t.Errorf("couldn't save prekey pair: %v", err)
+		return
+	}
+
+	for _, store := range []ClientStore{split, paired} {
+		pub, priv, err := store.GetFullIdentity()
+		if err != nil {
+			t.Errorf("couldn't get identity: %v", err)
+			return
+		}
+		if !bytes.Equal(pub, identity.Pub) || !bytes.Equal(priv, identity.Priv) {
+			t.Errorf("stored identity doesn't match")
+			return
+		}
+		pair, err := store.GetFullIdentityPair()
+		if err != nil {
+			t.Errorf("couldn't get identity pair: %v", err)
+			return
+		}
+		if !bytes.Equal(pair.Pub, identity.Pub) || !bytes.Equal(pair.Priv, identity.Priv) {
+			t.Errorf("stored identity pair doesn't match")
+			return
+		}
+		seed, err := store.GetIdentitySeed()
+		if err != nil {
+			t.Errorf("couldn't get seed: %v", err)
+			return
+		}
+		if !bytes.Equal(seed, ed25519.PrivateKey(identity.Priv).Seed()) {
+			t.Errorf("stored seed doesn't match")
+			return
+		}
+		prekeyPriv, err := store.GetPrekey(1, prekey.Pub)
+		if err != nil {
+			t.Errorf("couldn't get prekey: %v", err)
+			return
+		}
+		if !bytes.Equal(prekeyPriv, prekey.Priv) {
+			t.Errorf("stored prekey doesn't match")
+			return
+		}
+		createdAt, present, err := store.LatestPrekeyTime()
+		if err != nil {
+			t.Errorf("couldn't get prekey time: %v", err)
+			return
+		}
+		if !present || !createdAt.Equal(current) {
+			t.Errorf("unexpected prekey time: %v %v", createdAt, present)
+			return
+		}
+	}
+}
+
+func TestSaveBundleChecksSize(t *testing.T) {
+	store := newTestStore(t)
+	full, fullPriv, err := crypto.GenerateBundle(crypto.MaxBundleSize)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	extra, extraPriv, err := crypto.GenerateBundle(1)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	oversized := append(append(crypto.BundlePub(nil), full...), extra...)
+	oversizedPriv := append(append(crypto.BundlePriv(nil), fullPriv...), extraPriv...)
+	for _, bundle := range []struct {
+		pub  crypto.BundlePub
+		priv crypto.BundlePriv
+	}{
+		{crypto.BundlePub{}, crypto.BundlePriv{}},
+		{oversized, oversizedPriv},
+		{full, extraPriv},
+	} {
+		err = store.SaveBundle(bundle.pub, bundle.priv)
+		if err == nil {
+			t.Errorf("expected error saving bundle of %d public and %d private keys", bundle.pub.Len(), len(bundle.priv))
+			return
+		}
+	}
+	err = store.SaveBundle(full, fullPriv)
+	if err != nil {
+		t.Errorf("couldn't save bundle: %v", err)
+		return
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	store := newTestStore(t)
+	alice := newTestIdentity(t)
+	bob := newTestIdentity(t)
+	for i, body := range []string{"one", "two"} {
+		err := store.EnqueueMessage(alice, []byte{byte(i)}, body)
+		if err != nil {
+			t.Errorf("couldn't enqueue message: %v", err)
+			return
+		}
+	}
+	err := store.EnqueueMessage(bob, []byte{2}, "three")
+	if err != nil {
+		t.Errorf("couldn't enqueue message: %v", err)
+		return
+	}
+	err = store.MarkDelivered([]byte{0})
+	if err != nil {
+		t.Errorf("couldn't mark message as delivered: %v", err)
+		return
+	}
+	messages, err := store.UndeliveredMessages(alice)
+	if err != nil {
+		t.Errorf("couldn't get undelivered messages: %v", err)
+		return
+	}
+	if len(messages) != 1 || messages[0].Body != "two" || !bytes.Equal(messages[0].AckID, []byte{1}) {
+		t.Errorf("unexpected undelivered messages: %v", messages)
+		return
+	}
+	depth, err := store.QueueDepth()
+	if err != nil {
+		t.Errorf("couldn't get queue depth: %v", err)
+		return
+	}
+	if depth != 2 {
+		t.Errorf("expected 2 queued messages, found %d", depth)
+		return
+	}
+}
+
+func TestExportImportRoundtrip(t *testing.T) {
+	store := newTestStore(t)
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	err = store.SaveIdentity(pub, priv)
+	if err != nil {
+		t.Errorf("couldn't save identity: %v", err)
+		return
+	}
+	alice := newTestIdentity(t)
+	bob := newTestIdentity(t)
+	_, err = store.AddFriend(alice, "alice", false)
+	if err != nil {
+		t.Errorf("couldn't add friend: %v", err)
+		return
+	}
+	err = store.BlockFriend(bob)
+	if err != nil {
+		t.Errorf("couldn't block friend: %v", err)
+		return
+	}
+	id, err := NewGroupID()
+	if err != nil {
+		t.Errorf("couldn't generate group id: %v", err)
+		return
+	}
+	err = store.CreateGroup(Group{ID: id, Name: "friends", Members: []crypto.IdentityPub{alice, bob}})
+	if err != nil {
+		t.Errorf("couldn't create group: %v", err)
+		return
+	}
+	prekey, prekeyPriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	err = store.SavePrekey(1, prekey, prekeyPriv)
+	if err != nil {
+		t.Errorf("couldn't save prekey: %v", err)
+		return
+	}
+	bundlePub, bundlePriv, err := crypto.GenerateBundle(4)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	err = store.SaveBundle(bundlePub, bundlePriv)
+	if err != nil {
+		t.Errorf("couldn't save bundle: %v", err)
+		return
+	}
+	err = store.SaveMessage(alice, true, "hello", time.Unix(1624000000, 123456789))
+	if err != nil {
+		t.Errorf("couldn't save message: %v", err)
+		return
+	}
+	err = store.EnqueueMessage(alice, []byte("ack"), "still there?")
+	if err != nil {
+		t.Errorf("couldn't enqueue message: %v", err)
+		return
+	}
+	ratchet := crypto.DoubleRatchetFromReceiver(crypto.SharedSecret(make([]byte, crypto.SharedSecretSize)), prekey, prekeyPriv)
+	err = store.SaveSession(alice, &ratchet, []byte("additional"))
+	if err != nil {
+		t.Errorf("couldn't save session: %v", err)
+		return
+	}
+
+	archive, err := store.Export("hunter2")
+	if err != nil {
+		t.Errorf("couldn't export: %v", err)
+		return
+	}
+	// The new database is encrypted, so the private columns need to be encrypted again
+	imported, err := NewEncryptedStore(path.Join(t.TempDir(), "client.db"), "hunter3")
+	if err != nil {
+		t.Errorf("couldn't create store: %v", err)
+		return
+	}
+	err = imported.Import(archive, "hunter3", false)
+	if err != ErrBadArchive {
+		t.Errorf("expected ErrBadArchive, found %v", err)
+		return
+	}
+	err = imported.Import(archive, "hunter2", false)
+	if err != nil {
+		t.Errorf("couldn't import: %v", err)
+		return
+	}
+
+	expected, err := store.(*clientDatabase).dumpTables()
+	if err != nil {
+		t.Errorf("couldn't dump tables: %v", err)
+		return
+	}
+	found, err := imported.(*clientDatabase).dumpTables()
+	if err != nil {
+		t.Errorf("couldn't dump tables: %v", err)
+		return
+	}
+	for _, table := range archiveTables {
+		if len(expected[table].Rows) == 0 {
+			t.Errorf("table %s wasn't populated", table)
+			return
+		}
+		if !reflect.DeepEqual(expected[table], found[table]) {
+			t.Errorf("table %s differs: %v != %v", table, expected[table], found[table])
+			return
+		}
+	}
+	_, importedPriv, err := imported.GetFullIdentity()
+	if err != nil {
+		t.Errorf("couldn't get identity: %v", err)
+		return
+	}
+	if !bytes.Equal(importedPriv, priv) {
+		t.Errorf("imported identity doesn't match")
+		return
+	}
+	_, _, err = imported.GetSession(alice)
+	if err != nil {
+		t.Errorf("couldn't get session: %v", err)
+		return
+	}
+
+	err = imported.Import(archive, "hunter2", false)
+	if err != ErrIdentityExists {
+		t.Errorf("expected ErrIdentityExists, found %v", err)
+		return
+	}
+	err = imported.Import(archive, "hunter2", true)
+	if err != nil {
+		t.Errorf("couldn't import with force: %v", err)
+		return
+	}
+}
+
+// storeSuite contains the tests run against every kind of store
+var storeSuite = []struct {
+	name string
+	test func(t *testing.T, store ClientStore)
+}{
+	{"friends", testStoreFriends},
+	{"prekeys", testStorePrekeys},
+	{"bundles", testStoreBundles},
+	{"history", testStoreHistory},
+	{"sessions", testStoreSessions},
+}
+
+func TestStoreSuite(t *testing.T) {
+	for _, kind := range storeKinds {
+		for _, c := range storeSuite {
+			kind, c := kind, c
+			t.Run(kind.name+"/"+c.name, func(t *testing.T) {
+				c.test(t, kind.newStore(t))
+			})
+		}
+	}
+}
+
+func testStoreFriends(t *testing.T, store ClientStore) {
+	pub := newTestIdentity(t)
+	_, err := store.AddFriend(pub, "alice", false)
+	if err != nil {
+		t.Errorf("couldn't add friend: %v", err)
+		return
+	}
+	err = store.RenameFriend("alice", "bob")
+	if err != nil {
+		t.Errorf("couldn't rename friend: %v", err)
+		return
+	}
+	found, err := store.GetFriend("bob")
+	if err != nil {
+		t.Errorf("couldn't get friend: %v", err)
+		return
+	}
+	if !bytes.Equal(found, pub) {
+		t.Errorf("%v != %v", found, pub)
+		return
+	}
+	err = store.RemoveFriend("bob")
+	if err != nil {
+		t.Errorf("couldn't remove friend: %v", err)
+		return
+	}
+	_, err = store.GetFriendName(pub)
+	if err != ErrNoSuchFriend {
+		t.Errorf("expected ErrNoSuchFriend, found %v", err)
+		return
+	}
+}
+
+func testStorePrekeys(t *testing.T, store ClientStore) {
+	has, err := store.HasPrekey()
+	if err != nil || has {
+		t.Errorf("expected no prekey: %v", err)
+		return
+	}
+	prekey, prekeyPriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	err = store.SavePrekey(1, prekey, prekeyPriv)
+	if err != nil {
+		t.Errorf("couldn't save prekey: %v", err)
+		return
+	}
+	priv, err := store.GetPrekey(1, prekey)
+	if err != nil {
+		t.Errorf("couldn't get prekey: %v", err)
+		return
+	}
+	if !bytes.Equal(priv, prekeyPriv) {
+		t.Errorf("%v != %v", priv, prekeyPriv)
+		return
+	}
+}
+
+func testStoreBundles(t *testing.T, store ClientStore) {
+	bundle, bundlePriv, err := crypto.GenerateBundle(2)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	// A bundle which can't be saved entirely shouldn't leave any of its keys behind
+	repeated := crypto.BundlePub(append(append([]byte{}, bundle.Get(1)...), bundle.Get(1)...))
+	err = store.SaveBundle(repeated, crypto.BundlePriv{bundlePriv[1], bundlePriv[1]})
+	if err == nil {
+		t.Errorf("saved a bundle with a repeated key")
+		return
+	}
+	_, err = store.BurnOnetime(bundle.Get(1))
+	if err != ErrNoSuchOnetime {
+		t.Errorf("expected ErrNoSuchOnetime, found %v", err)
+		return
+	}
+	err = store.SaveBundle(bundle, bundlePriv)
+	if err != nil {
+		t.Errorf("couldn't save bundle: %v", err)
+		return
+	}
+	for i := 0; i < bundle.Len(); i++ {
+		priv, err := store.BurnOnetime(bundle.Get(i))
+		if err != nil {
+			t.Errorf("couldn't burn onetime key: %v", err)
+			return
+		}
+		if !bytes.Equal(priv, bundlePriv[i]) {
+			t.Errorf("%v != %v", priv, bundlePriv[i])
+			return
+		}
+		_, err = store.BurnOnetime(bundle.Get(i))
+		if err != ErrNoSuchOnetime {
+			t.Errorf("expected ErrNoSuchOnetime, found %v", err)
+			return
+		}
+	}
+
+	// Removing a bundle removes every one of its keys
+	err = store.SaveBundle(bundle, bundlePriv)
+	if err != nil {
+		t.Errorf("couldn't save bundle: %v", err)
+		return
+	}
+	err = store.RemoveBundle(bundle)
+	if err != nil {
+		t.Errorf("couldn't remove bundle: %v", err)
+		return
+	}
+	for i := 0; i < bundle.Len(); i++ {
+		_, err = store.BurnOnetime(bundle.Get(i))
+		if err != ErrNoSuchOnetime {
+			t.Errorf("expected ErrNoSuchOnetime, found %v", err)
+			return
+		}
+	}
+}
+
+func testStoreHistory(t *testing.T, store ClientStore) {
+	pub := newTestIdentity(t)
+	at := time.Unix(1000, 0)
+	err := store.SaveMessage(pub, true, "hello", at)
+	if err != nil {
+		t.Errorf("couldn't save message: %v", err)
+		return
+	}
+	err = store.SaveMessage(pub, false, "hi there", at.Add(time.Second))
+	if err != nil {
+		t.Errorf("couldn't save message: %v", err)
+		return
+	}
+	history, err := store.GetHistory(pub, 10)
+	if err != nil {
+		t.Errorf("couldn't get history: %v", err)
+		return
+	}
+	if len(history) != 2 {
+		t.Errorf("expected 2 messages, found %v", history)
+		return
+	}
+	found, err := store.SearchHistory(pub, "there", 10)
+	if err != nil {
+		t.Errorf("couldn't search history: %v", err)
+		return
+	}
+	if len(found) != 1 || found[0].Body != "hi there" {
+		t.Errorf("unexpected search results: %v", found)
+		return
+	}
+}
+
+func testStoreSessions(t *testing.T, store ClientStore) {
+	friend := newTestIdentity(t)
+	secret := crypto.SharedSecret(make([]byte, crypto.SharedSecretSize))
+	prekey, prekeyPriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	sender, err := crypto.DoubleRatchetFromInitiator(secret, prekey)
+	if err != nil {
+		t.Errorf("couldn't create ratchet: %v", err)
+		return
+	}
+	receiver := crypto.DoubleRatchetFromReceiver(secret, prekey, prekeyPriv)
+	ciphertexts := make([][]byte, 5)
+	for i := range ciphertexts {
+		ciphertexts[i], err = sender.Encrypt([]byte{byte(i)}, nil)
+		if err != nil {
+			t.Errorf("couldn't encrypt message: %v", err)
+			return
+		}
+	}
+	// The last message arrives first, so the keys of the others are skipped, and need to be saved
+	_, err = receiver.Decrypt(ciphertexts[4], nil)
+	if err != nil {
+		t.Errorf("couldn't decrypt message: %v", err)
+		return
+	}
+	err = store.SaveSession(friend, &receiver, []byte("additional"))
+	if err != nil {
+		t.Errorf("couldn't save session: %v", err)
+		return
+	}
+	restored, _, err := store.GetSession(friend)
+	if err != nil {
+		t.Errorf("couldn't get session: %v", err)
+		return
+	}
+	for i := 0; i < 4; i++ {
+		plaintext, err := restored.Decrypt(ciphertexts[i], nil)
+		if err != nil {
+			t.Errorf("couldn't decrypt late message %d after restoring: %v", i, err)
+			return
+		}
+		if !bytes.Equal(plaintext, []byte{byte(i)}) {
+			t.Errorf("late message %d: unexpected plaintext %v", i, plaintext)
+			return
+		}
+	}
+	// Skipped keys are only used once, even across saves
+	err = store.SaveSession(friend, &restored, []byte("additional"))
+	if err != nil {
+		t.Errorf("couldn't save session: %v", err)
+		return
+	}
+	restored, _, err = store.GetSession(friend)
+	if err != nil {
+		t.Errorf("couldn't get session: %v", err)
+		return
+	}
+	_, err = restored.Decrypt(ciphertexts[0], nil)
+	if err == nil {
+		t.Errorf("replayed message was decrypted")
+		return
+	}
+}
+
+func TestMemoryStoresAreSeparate(t *testing.T) {
+	first := newTestMemoryStore(t)
+	second := newTestMemoryStore(t)
+	_, err := first.AddFriend(newTestIdentity(t), "alice", false)
+	if err != nil {
+		t.Errorf("couldn't add friend: %v", err)
+		return
+	}
+	_, err = second.GetFriend("alice")
+	if err == nil {
+		t.Errorf("friend was shared between memory stores")
+		return
+	}
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/cronokirby/nuntius/internal/crypto"
+)
+
+// Notifier is told about every message a friend sends us
+//
+// For files, the body is the path where the file was saved.
+type Notifier interface {
+	Notify(from crypto.IdentityPub, name, body string)
+}
+
+// Notifiers tells every notifier it contains about each message, in order
+type Notifiers []Notifier
+
+func (notifiers Notifiers) Notify(from crypto.IdentityPub, name, body string) {
+	for _, notifier := range notifiers {
+		notifier.Notify(from, name, body)
+	}
+}
+
+// ExecNotifier runs a command for every message, with the name of the sender and the message as arguments
+type ExecNotifier struct {
+	Command string
+}
+
+func (notifier *ExecNotifier) Notify(from crypto.IdentityPub, name, body string) {
+	cmd := exec.Command(notifier.Command, name, body)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		log.Default().Printf("notification command failed: %v", err)
+	}
+}
+
+// DefaultWebhookTimeout is how long a webhook has to answer, when no client is given
+const DefaultWebhookTimeout = 10 * time.Second
+
+// WebhookNotification is the JSON body posted to a webhook for every message
+type WebhookNotification struct {
+	From string `json:"from"`
+	Name string `json:"name"`
+	Body string `json:"body"`
+}
+
+// WebhookNotifier posts every message to a URL, as a WebhookNotification
+type WebhookNotifier struct {
+	URL string
+	// Client is used to make requests, with a timeout of DefaultWebhookTimeout if left out
+	Client *http.Client
+}
+
+func (notifier *WebhookNotifier) Notify(from crypto.IdentityPub, name, body string) {
+	data, err := json.Marshal(WebhookNotification{From: from.String(), Name: name, Body: body})
+	if err != nil {
+		log.Default().Printf("couldn't encode notification: %v", err)
+		return
+	}
+	client := notifier.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultWebhookTimeout}
+	}
+	resp, err := client.Post(notifier.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Default().Printf("notification webhook failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Default().Printf("notification webhook failed: %s", resp.Status)
+	}
+}
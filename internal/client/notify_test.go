@@ -0,0 +1,62 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestExecNotifier(t *testing.T) {
+	dir := t.TempDir()
+	script := path.Join(dir, "notify.sh")
+	err := os.WriteFile(script, []byte("#!/bin/sh\nprintf '%s|%s' \"$1\" \"$2\" > \"$(dirname \"$0\")/notified\"\n"), 0700)
+	if err != nil {
+		t.Errorf("couldn't write script: %v", err)
+		return
+	}
+	notifier := &ExecNotifier{Command: script}
+	notifier.Notify(newTestIdentity(t), "alice", "hello there")
+	data, err := os.ReadFile(path.Join(dir, "notified"))
+	if err != nil {
+		t.Errorf("command didn't run: %v", err)
+		return
+	}
+	if string(data) != "alice|hello there" {
+		t.Errorf("unexpected command arguments: %q", data)
+		return
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	notifications := make(chan WebhookNotification, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		var notification WebhookNotification
+		err := json.NewDecoder(r.Body).Decode(&notification)
+		if err != nil {
+			t.Errorf("couldn't decode notification: %v", err)
+		}
+		notifications <- notification
+	}))
+	defer srv.Close()
+
+	from := newTestIdentity(t)
+	notifier := &WebhookNotifier{URL: srv.URL + "/hook"}
+	notifier.Notify(from, "alice", "hello there")
+	select {
+	case notification := <-notifications:
+		expected := WebhookNotification{From: from.String(), Name: "alice", Body: "hello there"}
+		if notification != expected {
+			t.Errorf("expected %v, found %v", expected, notification)
+			return
+		}
+	default:
+		t.Errorf("webhook wasn't called")
+		return
+	}
+}
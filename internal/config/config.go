@@ -0,0 +1,56 @@
+package config
+
+import (
+	"os"
+	"os/user"
+	"path"
+
+	"github.com/BurntSushi/toml"
+)
+
+const _DEFAULT_CONFIG_PATH = ".nuntius/config.toml"
+
+// Config holds the defaults read from a configuration file
+//
+// Fields left out of the file are empty, and flags without a value in the
+// file keep their usual defaults.
+type Config struct {
+	// Database is the path to the local database
+	Database string `toml:"database"`
+	// URL is the server used by commands needing one
+	URL string `toml:"url"`
+	// OnetimeThreshold is the number of onetime keys under which new ones get uploaded
+	OnetimeThreshold int `toml:"onetime_threshold"`
+	// OnetimeBundleSize is the number of onetime keys uploaded at once
+	OnetimeBundleSize int `toml:"onetime_bundle_size"`
+	// PassphraseFile is a file containing the passphrase for the local database
+	PassphraseFile string `toml:"passphrase_file"`
+	// Notify is the command the daemon runs for every message
+	Notify string `toml:"notify"`
+	// Webhook is the URL the daemon posts every message to
+	Webhook string `toml:"webhook"`
+}
+
+// DefaultPath returns the path of the configuration file, inside of the Home directory
+func DefaultPath() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(usr.HomeDir, _DEFAULT_CONFIG_PATH), nil
+}
+
+// Load reads a configuration file, in TOML
+//
+// A missing file isn't an error, and gives back an empty configuration.
+func Load(path string) (*Config, error) {
+	var config Config
+	_, err := toml.DecodeFile(path, &config)
+	if os.IsNotExist(err) {
+		return &config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
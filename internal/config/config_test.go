@@ -0,0 +1,57 @@
+package config
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	file := path.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(file, []byte(`
+database = "/tmp/client.db"
+url = "http://localhost:1234"
+onetime_threshold = 5
+onetime_bundle_size = 32
+`), 0600)
+	if err != nil {
+		t.Errorf("couldn't write config: %v", err)
+		return
+	}
+	config, err := Load(file)
+	if err != nil {
+		t.Errorf("couldn't load config: %v", err)
+		return
+	}
+	expected := Config{Database: "/tmp/client.db", URL: "http://localhost:1234", OnetimeThreshold: 5, OnetimeBundleSize: 32}
+	if *config != expected {
+		t.Errorf("%+v != %+v", *config, expected)
+		return
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	config, err := Load(path.Join(t.TempDir(), "config.toml"))
+	if err != nil {
+		t.Errorf("missing config returned error: %v", err)
+		return
+	}
+	if *config != (Config{}) {
+		t.Errorf("expected empty config, found %+v", *config)
+		return
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	file := path.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(file, []byte(`url = `), 0600)
+	if err != nil {
+		t.Errorf("couldn't write config: %v", err)
+		return
+	}
+	_, err = Load(file)
+	if err == nil {
+		t.Errorf("expected error loading invalid config")
+		return
+	}
+}
@@ -0,0 +1,119 @@
+package crypto
+
+import (
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// base58Alphabet is the alphabet used by Bitcoin, which leaves out characters that look alike
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// crockfordAlphabet is Crockford's base32 alphabet, which leaves out I, L, O, and U
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var crockfordEncoding = base32.NewEncoding(crockfordAlphabet).WithPadding(base32.NoPadding)
+
+// encodeBase58 encodes bytes in base58, keeping leading zeros as leading 1s
+func encodeBase58(data []byte) string {
+	zeros := 0
+	for zeros < len(data) && data[zeros] == 0 {
+		zeros++
+	}
+	n := new(big.Int).SetBytes(data)
+	base := big.NewInt(58)
+	mod := new(big.Int)
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, base, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for i := 0; i < zeros; i++ {
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+// decodeBase58 decodes a base58 string, failing on characters outside of the alphabet
+func decodeBase58(s string) ([]byte, error) {
+	zeros := 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	n := new(big.Int)
+	base := big.NewInt(58)
+	for _, r := range s[zeros:] {
+		digit := strings.IndexRune(base58Alphabet, r)
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid base58 character: %q", r)
+		}
+		n.Mul(n, base)
+		n.Add(n, big.NewInt(int64(digit)))
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+// Base58 returns the base58 representation of an identity, which is easier to type than hex
+func (pub IdentityPub) Base58() string {
+	return encodeBase58(pub)
+}
+
+// IdentityPubFromBase58 attempts to parse an identity from base58, potentially failing
+func IdentityPubFromBase58(s string) (IdentityPub, error) {
+	data, err := decodeBase58(s)
+	if err != nil {
+		return nil, err
+	}
+	pub := IdentityPub(data)
+	err = pub.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// Base32 returns the Crockford base32 representation of an identity, which is easy to read aloud
+func (pub IdentityPub) Base32() string {
+	return crockfordEncoding.EncodeToString(pub)
+}
+
+// IdentityPubFromBase32 attempts to parse an identity from Crockford base32, potentially failing
+//
+// Like Crockford's specification says, this ignores case and hyphens, and reads O as 0,
+// and I or L as 1.
+func IdentityPubFromBase32(s string) (IdentityPub, error) {
+	s = strings.ToUpper(strings.ReplaceAll(s, "-", ""))
+	s = strings.NewReplacer("O", "0", "I", "1", "L", "1").Replace(s)
+	data, err := crockfordEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	pub := IdentityPub(data)
+	err = pub.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// ParseIdentityPub parses an identity from any of its string representations
+//
+// The hex representation is recognized by its header, and base58 and base32 identities
+// have different lengths, so they can't be confused.
+func ParseIdentityPub(s string) (IdentityPub, error) {
+	if strings.HasPrefix(s, identityPubHeader) {
+		return IdentityPubFromString(s)
+	}
+	if pub, err := IdentityPubFromBase58(s); err == nil {
+		return pub, nil
+	}
+	if pub, err := IdentityPubFromBase32(s); err == nil {
+		return pub, nil
+	}
+	return nil, errors.New("identity isn't in hex, base58, or base32")
+}
@@ -0,0 +1,103 @@
+package crypto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func testIdentities(t *testing.T) []IdentityPub {
+	pub, _, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("couldn't generate identity: %v", err)
+	}
+	// Leading zeros need special care in base58, and about half of the keys they give are still valid points
+	var zeros IdentityPub
+	for zeros == nil || zeros.Validate() != nil {
+		other, _, err := GenerateIdentity()
+		if err != nil {
+			t.Fatalf("couldn't generate identity: %v", err)
+		}
+		zeros = other
+		zeros[0], zeros[1] = 0, 0
+	}
+	return []IdentityPub{pub, zeros}
+}
+
+func TestIdentityEncodingsRoundtrip(t *testing.T) {
+	for _, pub := range testIdentities(t) {
+		encodings := []struct {
+			name   string
+			encode func(IdentityPub) string
+			decode func(string) (IdentityPub, error)
+		}{
+			{"hex", IdentityPub.String, IdentityPubFromString},
+			{"base58", IdentityPub.Base58, IdentityPubFromBase58},
+			{"base32", IdentityPub.Base32, IdentityPubFromBase32},
+		}
+		for _, encoding := range encodings {
+			s := encoding.encode(pub)
+			decoded, err := encoding.decode(s)
+			if err != nil {
+				t.Errorf("couldn't decode %s: %v", encoding.name, err)
+				return
+			}
+			if !bytes.Equal(decoded, pub) {
+				t.Errorf("%s: %v != %v", encoding.name, decoded, pub)
+				return
+			}
+			parsed, err := ParseIdentityPub(s)
+			if err != nil {
+				t.Errorf("couldn't parse %s: %v", encoding.name, err)
+				return
+			}
+			if !bytes.Equal(parsed, pub) {
+				t.Errorf("parsed %s: %v != %v", encoding.name, parsed, pub)
+				return
+			}
+		}
+	}
+}
+
+func TestBase32IsForgiving(t *testing.T) {
+	pub := testIdentities(t)[0]
+	s := strings.ToLower(pub.Base32())
+	s = strings.ReplaceAll(s, "0", "o")
+	s = strings.ReplaceAll(s, "1", "l")
+	s = s[:4] + "-" + s[4:]
+	decoded, err := IdentityPubFromBase32(s)
+	if err != nil {
+		t.Errorf("couldn't decode base32: %v", err)
+		return
+	}
+	if !bytes.Equal(decoded, pub) {
+		t.Errorf("%v != %v", decoded, pub)
+		return
+	}
+}
+
+func TestCorruptedIdentityEncodings(t *testing.T) {
+	pub := testIdentities(t)[0]
+	base58 := pub.Base58()
+	base32 := pub.Base32()
+	corrupted := []struct {
+		name   string
+		input  string
+		decode func(string) (IdentityPub, error)
+	}{
+		{"base58 with an invalid character", "0" + base58[1:], IdentityPubFromBase58},
+		{"truncated base58", base58[:len(base58)-2], IdentityPubFromBase58},
+		{"extended base58", base58 + "zz", IdentityPubFromBase58},
+		{"base32 with an invalid character", "U" + base32[1:], IdentityPubFromBase32},
+		{"truncated base32", base32[:len(base32)-8], IdentityPubFromBase32},
+		{"extended base32", base32 + "00000000", IdentityPubFromBase32},
+		{"garbage", "not an identity", ParseIdentityPub},
+	}
+	for _, c := range corrupted {
+		_, err := c.decode(c.input)
+		if err == nil {
+			t.Errorf("%s was accepted", c.name)
+			return
+		}
+	}
+}
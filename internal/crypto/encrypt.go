@@ -5,43 +5,85 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
-func newAEAD(key MessageKey) (cipher.AEAD, error) {
-	blockCipher, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-	aead, err := cipher.NewGCM(blockCipher)
-	if err != nil {
-		return nil, err
+// AEADSuite identifies the authenticated encryption scheme used for a ciphertext
+//
+// The suite is stored as the first byte of each ciphertext, allowing decryption
+// to use the right scheme.
+type AEADSuite byte
+
+const (
+	// SuiteAESGCM uses AES-256 in GCM mode
+	SuiteAESGCM AEADSuite = 1
+	// SuiteChaCha20Poly1305 uses ChaCha20 with Poly1305
+	//
+	// This is preferable on platforms without hardware acceleration for AES.
+	SuiteChaCha20Poly1305 AEADSuite = 2
+)
+
+// DefaultSuite is the suite used by Encrypt
+const DefaultSuite = SuiteAESGCM
+
+func newAEAD(suite AEADSuite, key MessageKey) (cipher.AEAD, error) {
+	switch suite {
+	case SuiteAESGCM:
+		blockCipher, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(blockCipher)
+		if err != nil {
+			return nil, err
+		}
+		return aead, nil
+	case SuiteChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("unknown AEAD suite: %d", suite)
 	}
-	return aead, nil
 }
 
+// Encrypt encrypts plaintext, authenticating additional data, using the default suite
 func (key MessageKey) Encrypt(plaintext, additional []byte) ([]byte, error) {
-	aead, err := newAEAD(key)
+	return key.EncryptWith(DefaultSuite, plaintext, additional)
+}
+
+// EncryptWith encrypts plaintext, authenticating additional data, using a specific suite
+func (key MessageKey) EncryptWith(suite AEADSuite, plaintext, additional []byte) ([]byte, error) {
+	aead, err := newAEAD(suite, key)
 	if err != nil {
 		return nil, err
 	}
 
 	nonceSize := aead.NonceSize()
-	out := make([]byte, nonceSize)
-	_, err = rand.Read(out)
+	out := make([]byte, 1+nonceSize)
+	out[0] = byte(suite)
+	_, err = rand.Read(out[1:])
 	if err != nil {
 		return nil, err
 	}
 
-	out = aead.Seal(out, out, plaintext, additional)
+	out = aead.Seal(out, out[1:], plaintext, additional)
 
 	return out, nil
 }
 
+// Decrypt decrypts a ciphertext, checking the additional data
+//
+// The suite used for decryption is taken from the ciphertext itself.
 func (key MessageKey) Decrypt(ciphertext, additional []byte) ([]byte, error) {
-	aead, err := newAEAD(key)
+	if len(ciphertext) < 1 {
+		return nil, errors.New("ciphertext doesn't contain suite")
+	}
+	aead, err := newAEAD(AEADSuite(ciphertext[0]), key)
 	if err != nil {
 		return nil, err
 	}
+	ciphertext = ciphertext[1:]
 
 	nonceSize := aead.NonceSize()
 	if len(ciphertext) < nonceSize {
@@ -54,3 +96,58 @@ func (key MessageKey) Decrypt(ciphertext, additional []byte) ([]byte, error) {
 	}
 	return out, nil
 }
+
+// EncryptDetached encrypts plaintext like Encrypt, but returns the nonce apart from the ciphertext
+//
+// This lets callers store nonces separately. The ciphertext still starts with the suite,
+// and putting the nonce right after the suite gives the output of Encrypt.
+func (key MessageKey) EncryptDetached(plaintext, additional []byte) (nonce, ciphertext []byte, err error) {
+	return key.EncryptDetachedWith(DefaultSuite, plaintext, additional)
+}
+
+// EncryptDetachedWith encrypts plaintext like EncryptWith, but returns the nonce apart from the ciphertext
+func (key MessageKey) EncryptDetachedWith(suite AEADSuite, plaintext, additional []byte) (nonce, ciphertext []byte, err error) {
+	aead, err := newAEAD(suite, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce = make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	ciphertext, err = key.encryptWithNonce(suite, nonce, plaintext, additional)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nonce, ciphertext, nil
+}
+
+// encryptWithNonce encrypts plaintext with a given nonce, returning the suite followed by the sealed data
+func (key MessageKey) encryptWithNonce(suite AEADSuite, nonce, plaintext, additional []byte) ([]byte, error) {
+	aead, err := newAEAD(suite, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("nonce has %d bytes instead of %d", len(nonce), aead.NonceSize())
+	}
+	return aead.Seal([]byte{byte(suite)}, nonce, plaintext, additional), nil
+}
+
+// DecryptDetached decrypts a ciphertext produced by EncryptDetached, checking the additional data
+//
+// The suite used for decryption is taken from the ciphertext itself.
+func (key MessageKey) DecryptDetached(nonce, ciphertext, additional []byte) ([]byte, error) {
+	if len(ciphertext) < 1 {
+		return nil, errors.New("ciphertext doesn't contain suite")
+	}
+	aead, err := newAEAD(AEADSuite(ciphertext[0]), key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("nonce has %d bytes instead of %d", len(nonce), aead.NonceSize())
+	}
+	return aead.Open(nil, nonce, ciphertext[1:], additional)
+}
@@ -33,3 +33,158 @@ func TestEncryptionRoundtrip(t *testing.T) {
 		return
 	}
 }
+
+func TestEncryptionSuitesRoundtrip(t *testing.T) {
+	key := MessageKey(make([]byte, MessageKeySize))
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Errorf("couldn't generate key: %v", err)
+		return
+	}
+	plaintext := []byte("Hello There!")
+	additional := []byte("Additional")
+
+	for _, suite := range []AEADSuite{SuiteAESGCM, SuiteChaCha20Poly1305} {
+		ciphertext, err := key.EncryptWith(suite, plaintext, additional)
+		if err != nil {
+			t.Errorf("couldn't encrypt data with suite %d: %v", suite, err)
+			return
+		}
+		if ciphertext[0] != byte(suite) {
+			t.Errorf("ciphertext has suite %d, expected %d", ciphertext[0], suite)
+			return
+		}
+
+		plaintextAgain, err := key.Decrypt(ciphertext, additional)
+		if err != nil {
+			t.Errorf("couldn't decrypt data with suite %d: %v", suite, err)
+			return
+		}
+
+		if !bytes.Equal(plaintext, plaintextAgain) {
+			t.Errorf("decryption with suite %d returned a different result", suite)
+			return
+		}
+	}
+}
+
+func TestEncryptionCrossSuiteFails(t *testing.T) {
+	key := MessageKey(make([]byte, MessageKeySize))
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Errorf("couldn't generate key: %v", err)
+		return
+	}
+	plaintext := []byte("Hello There!")
+	additional := []byte("Additional")
+
+	ciphertext, err := key.EncryptWith(SuiteAESGCM, plaintext, additional)
+	if err != nil {
+		t.Errorf("couldn't encrypt data: %v", err)
+		return
+	}
+	ciphertext[0] = byte(SuiteChaCha20Poly1305)
+	_, err = key.Decrypt(ciphertext, additional)
+	if err == nil {
+		t.Error("decrypting with the wrong suite succeeded")
+		return
+	}
+
+	ciphertext[0] = 0
+	_, err = key.Decrypt(ciphertext, additional)
+	if err == nil {
+		t.Error("decrypting with an unknown suite succeeded")
+		return
+	}
+}
+
+func TestDetachedEncryptionRoundtrip(t *testing.T) {
+	key := MessageKey(make([]byte, MessageKeySize))
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Errorf("couldn't generate key: %v", err)
+		return
+	}
+	plaintext := []byte("Hello There!")
+	additional := []byte("Additional")
+
+	for _, suite := range []AEADSuite{SuiteAESGCM, SuiteChaCha20Poly1305} {
+		nonce, ciphertext, err := key.EncryptDetachedWith(suite, plaintext, additional)
+		if err != nil {
+			t.Errorf("couldn't encrypt data with suite %d: %v", suite, err)
+			return
+		}
+
+		plaintextAgain, err := key.DecryptDetached(nonce, ciphertext, additional)
+		if err != nil {
+			t.Errorf("couldn't decrypt data with suite %d: %v", suite, err)
+			return
+		}
+		if !bytes.Equal(plaintext, plaintextAgain) {
+			t.Errorf("decryption with suite %d returned a different result", suite)
+			return
+		}
+
+		nonce[0] ^= 1
+		_, err = key.DecryptDetached(nonce, ciphertext, additional)
+		if err == nil {
+			t.Errorf("decryption with suite %d succeeded with the wrong nonce", suite)
+			return
+		}
+	}
+}
+
+func TestDetachedEncryptionMatchesCombined(t *testing.T) {
+	key := MessageKey(make([]byte, MessageKeySize))
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Errorf("couldn't generate key: %v", err)
+		return
+	}
+	plaintext := []byte("Hello There!")
+	additional := []byte("Additional")
+
+	combined, err := key.Encrypt(plaintext, additional)
+	if err != nil {
+		t.Errorf("couldn't encrypt data: %v", err)
+		return
+	}
+	aead, err := newAEAD(DefaultSuite, key)
+	if err != nil {
+		t.Errorf("couldn't create AEAD: %v", err)
+		return
+	}
+	nonce := combined[1 : 1+aead.NonceSize()]
+	detached, err := key.encryptWithNonce(DefaultSuite, nonce, plaintext, additional)
+	if err != nil {
+		t.Errorf("couldn't encrypt data: %v", err)
+		return
+	}
+	var joined []byte
+	joined = append(joined, detached[0])
+	joined = append(joined, nonce...)
+	joined = append(joined, detached[1:]...)
+	if !bytes.Equal(joined, combined) {
+		t.Errorf("detached ciphertext doesn't match combined ciphertext with the same nonce")
+		return
+	}
+
+	nonce, ciphertext, err := key.EncryptDetached(plaintext, additional)
+	if err != nil {
+		t.Errorf("couldn't encrypt data: %v", err)
+		return
+	}
+	joined = nil
+	joined = append(joined, ciphertext[0])
+	joined = append(joined, nonce...)
+	joined = append(joined, ciphertext[1:]...)
+	plaintextAgain, err := key.Decrypt(joined, additional)
+	if err != nil {
+		t.Errorf("couldn't decrypt joined ciphertext: %v", err)
+		return
+	}
+	if !bytes.Equal(plaintext, plaintextAgain) {
+		t.Error("decryption returned a different result")
+		return
+	}
+}
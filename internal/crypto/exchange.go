@@ -1,16 +1,20 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"runtime"
 	"strings"
+	"sync"
 
 	"filippo.io/edwards25519"
 	"golang.org/x/crypto/curve25519"
@@ -29,14 +33,37 @@ type ExchangePriv []byte
 // ExchangedSecret is the result of exchanging between key pairs
 type exchangedSecret []byte
 
+// wipe overwrites some secret data with zeros
+func wipe(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+// Wipe overwrites this private key with zeros.
+//
+// Callers own the keys they hold, and are responsible for wiping them once
+// they're no longer needed. The key can't be used after being wiped.
+func (priv ExchangePriv) Wipe() {
+	wipe(priv)
+}
+
 // GenerateExchange creates a new exchange key-pair
 //
 // This will use a secure source of randomness.
 //
 // An error may be returned if generation fails.
 func GenerateExchange() (ExchangePub, ExchangePriv, error) {
+	return GenerateExchangeFrom(rand.Reader)
+}
+
+// GenerateExchangeFrom creates a new exchange key-pair, reading its randomness from r
+//
+// The same bytes always produce the same key-pair, which makes tests reproducible.
+// Outside of tests, r should be a secure source of randomness, like crypto/rand.Reader.
+func GenerateExchangeFrom(r io.Reader) (ExchangePub, ExchangePriv, error) {
 	scalar := make([]byte, curve25519.ScalarSize)
-	_, err := rand.Read(scalar)
+	_, err := io.ReadFull(r, scalar)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -68,6 +95,25 @@ type Signature []byte
 
 const IdentityPubSize = ed25519.PublicKeySize
 
+// ErrInvalidIdentity is returned when the bytes of an identity aren't a canonical encoding of a point
+var ErrInvalidIdentity = errors.New("identity isn't a valid public key")
+
+// Validate checks that an identity has the right length, and is the canonical encoding of a point
+//
+// Non-canonical encodings decode to the same point as another identity, but aren't equal
+// to it byte for byte, so they're rejected rather than treated as a different identity.
+func (pub IdentityPub) Validate() error {
+	if len(pub) != IdentityPubSize {
+		return fmt.Errorf("incorrect IdentityPub length %d", len(pub))
+	}
+	// SetBytes accepts non-canonical encodings, which encode back to different bytes
+	p, err := new(edwards25519.Point).SetBytes(pub)
+	if err != nil || !bytes.Equal(p.Bytes(), pub) {
+		return ErrInvalidIdentity
+	}
+	return nil
+}
+
 // IdentityPub is the public component of an identity key
 //
 // This can be used to verify signatures from an identity.
@@ -78,19 +124,52 @@ type IdentityPub ed25519.PublicKey
 // This can be used to generate signatures for an identity.
 type IdentityPriv ed25519.PrivateKey
 
+// Wipe overwrites this private key with zeros.
+//
+// Callers own the keys they hold, and are responsible for wiping them once
+// they're no longer needed. The key can't be used after being wiped.
+func (priv IdentityPriv) Wipe() {
+	wipe(priv)
+}
+
 // GenerateIdentity creates a new identity key-pair.
 //
 // This generates a new key, using a secure source of randomness.
 //
 // An error may be returned if generation fails.
 func GenerateIdentity() (IdentityPub, IdentityPriv, error) {
-	pub, priv, err := ed25519.GenerateKey(nil)
+	return GenerateIdentityFrom(rand.Reader)
+}
+
+// GenerateIdentityFrom creates a new identity key-pair, reading its randomness from r
+//
+// Like with GenerateExchangeFrom, r should be a secure source of randomness outside of tests.
+func GenerateIdentityFrom(r io.Reader) (IdentityPub, IdentityPriv, error) {
+	pub, priv, err := ed25519.GenerateKey(r)
 	if err != nil {
 		return nil, nil, err
 	}
 	return IdentityPub(pub), IdentityPriv(priv), nil
 }
 
+// IdentitySeedSize is the number of bytes in the seed for an identity
+const IdentitySeedSize = ed25519.SeedSize
+
+// IdentityFromSeed deterministically derives an identity key-pair from a seed.
+//
+// The same seed will always produce the same identity, which makes it possible
+// to backup and restore an identity.
+//
+// An error is returned if the seed doesn't have exactly IdentitySeedSize bytes.
+func IdentityFromSeed(seed []byte) (IdentityPub, IdentityPriv, error) {
+	if len(seed) != IdentitySeedSize {
+		return nil, nil, fmt.Errorf("incorrect identity seed size: %d", len(seed))
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	pub := priv.Public().(ed25519.PublicKey)
+	return IdentityPub(pub), IdentityPriv(priv), nil
+}
+
 const identityPubHeader = "nuntiusの公開鍵"
 
 // String returns the string representation of an identity
@@ -104,29 +183,32 @@ func IdentityPubFromString(s string) (IdentityPub, error) {
 		return nil, errors.New("identity has incorrect header")
 	}
 	hexString := strings.TrimPrefix(s, identityPubHeader)
-	bytes, err := hex.DecodeString(hexString)
+	data, err := hex.DecodeString(hexString)
 	if err != nil {
 		return nil, err
 	}
-	if len(bytes) != IdentityPubSize {
-		return nil, fmt.Errorf("decoded identity has incorrect length: %d", len(bytes))
+	pub := IdentityPub(data)
+	err = pub.Validate()
+	if err != nil {
+		return nil, err
 	}
-	return IdentityPub(bytes), nil
+	return pub, nil
 }
 
 // IdentityPubFromBase64 attempts to convert URL-safe Base64 into a public identity key
 //
-// This will return an error if decoding fails, or if the number of bytes doesn't
-// match the size of a public key.
+// This will return an error if decoding fails, or if the bytes aren't a valid public key.
 func IdentityPubFromBase64(data string) (IdentityPub, error) {
 	idBytes, err := base64.URLEncoding.DecodeString(data)
 	if err != nil {
 		return nil, err
 	}
-	if len(idBytes) != IdentityPubSize {
-		return nil, fmt.Errorf("incorrect IdentityPub length %d", len(idBytes))
+	pub := IdentityPub(idBytes)
+	err = pub.Validate()
+	if err != nil {
+		return nil, err
 	}
-	return IdentityPub(idBytes), nil
+	return pub, nil
 }
 
 // Sign uses an identity to generate signature for some data
@@ -142,6 +224,69 @@ func (pub IdentityPub) Verify(data []byte, sig Signature) bool {
 	return ed25519.Verify(ed25519.PublicKey(pub), data, sig)
 }
 
+// The contexts prepended to the data we sign, so that a signature for one purpose can't be used for another
+const (
+	prekeyContext = "nuntius-prekey"
+	bundleContext = "nuntius-bundle"
+	uploadContext = "nuntius-prekey-upload"
+	nameContext   = "nuntius-name"
+)
+
+// withContext prepends a signing context to some data
+func withContext(context string, data []byte) []byte {
+	out := make([]byte, 0, len(context)+len(data))
+	out = append(out, context...)
+	out = append(out, data...)
+	return out
+}
+
+// SignPrekey uses an identity key to sign a prekey
+func (priv IdentityPriv) SignPrekey(prekey ExchangePub) Signature {
+	return priv.Sign(withContext(prekeyContext, prekey))
+}
+
+// VerifyPrekey verifies a signature generated over a prekey
+func (pub IdentityPub) VerifyPrekey(prekey ExchangePub, sig Signature) bool {
+	return pub.Verify(withContext(prekeyContext, prekey), sig)
+}
+
+// prekeyUpload is the data signed when uploading a prekey, binding it to its id and counter
+func prekeyUpload(counter uint64, keyID uint32, prekey ExchangePub) []byte {
+	data := make([]byte, 12, 12+len(prekey))
+	binary.BigEndian.PutUint64(data, counter)
+	binary.BigEndian.PutUint32(data[8:], keyID)
+	return withContext(uploadContext, append(data, prekey...))
+}
+
+// SignPrekeyUpload signs the upload of a prekey, so that the server can reject replayed uploads
+//
+// The counter needs to increase with every upload.
+func (priv IdentityPriv) SignPrekeyUpload(counter uint64, keyID uint32, prekey ExchangePub) Signature {
+	return priv.Sign(prekeyUpload(counter, keyID, prekey))
+}
+
+// VerifyPrekeyUpload verifies a signature generated over the upload of a prekey
+func (pub IdentityPub) VerifyPrekeyUpload(counter uint64, keyID uint32, prekey ExchangePub, sig Signature) bool {
+	return pub.Verify(prekeyUpload(counter, keyID, prekey), sig)
+}
+
+// nameRecord is the data signed when publishing a name, binding it to a counter
+func nameRecord(counter uint64, name string) []byte {
+	data := make([]byte, 8, 8+len(name))
+	binary.BigEndian.PutUint64(data, counter)
+	return withContext(nameContext, append(data, name...))
+}
+
+// SignName signs a name to publish in a server's directory, along with a counter increasing with every name
+func (priv IdentityPriv) SignName(counter uint64, name string) Signature {
+	return priv.Sign(nameRecord(counter, name))
+}
+
+// VerifyName verifies a signature generated over a published name
+func (pub IdentityPub) VerifyName(counter uint64, name string, sig Signature) bool {
+	return pub.Verify(nameRecord(counter, name), sig)
+}
+
 func (priv IdentityPriv) toExchange() ExchangePriv {
 	hash := sha512.New()
 	hash.Write(priv[:32])
@@ -164,30 +309,91 @@ type BundlePub []byte
 // BundlePriv is a collection of the private counterparts to single-use exchange keys
 type BundlePriv []ExchangePriv
 
-const bundleSize = 64
+// DefaultBundleSize is the number of exchange keys in a bundle, unless specified otherwise
+const DefaultBundleSize = 64
+
+// MaxBundleSize is the largest number of exchange keys a bundle can contain
+const MaxBundleSize = 1024
 
-// GenerateBundle generates a new bundle of exchange keys, possibly failing
-func GenerateBundle() (BundlePub, BundlePriv, error) {
-	publicBundle := make([]byte, bundleSize*ExchangePubSize)
-	privateBundle := make([]ExchangePriv, bundleSize)
-	for i := 0; i < bundleSize; i++ {
-		pub, priv, err := GenerateExchange()
+// CheckBundleSize returns an error if a bundle can't contain count exchange keys
+//
+// Bundles contain between 1 and MaxBundleSize keys.
+func CheckBundleSize(count int) error {
+	if count <= 0 || count > MaxBundleSize {
+		return fmt.Errorf("bundle size %d is not between 1 and %d", count, MaxBundleSize)
+	}
+	return nil
+}
+
+// GenerateBundle generates a new bundle of count exchange keys, possibly failing
+//
+// The count needs to be between 1 and MaxBundleSize. The keys are computed on every CPU.
+func GenerateBundle(count int) (BundlePub, BundlePriv, error) {
+	return generateBundle(count, runtime.NumCPU())
+}
+
+// generateBundle generates a bundle, splitting the work between a number of goroutines
+//
+// The keys are in the same order regardless of the number of workers.
+func generateBundle(count int, workers int) (BundlePub, BundlePriv, error) {
+	err := CheckBundleSize(count)
+	if err != nil {
+		return nil, nil, err
+	}
+	if workers > count {
+		workers = count
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	// The randomness is read up front, so that the workers never share the source
+	privateBundle := make([]ExchangePriv, count)
+	for i := range privateBundle {
+		privateBundle[i] = make(ExchangePriv, curve25519.ScalarSize)
+		_, err := rand.Read(privateBundle[i])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	publicBundle := make([]byte, count*ExchangePubSize)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// Each worker fills in its own keys, so they don't need to coordinate
+			for i := w; i < count; i += workers {
+				point, err := curve25519.X25519(privateBundle[i], curve25519.Basepoint)
+				if err != nil {
+					errs[w] = err
+					return
+				}
+				copy(publicBundle[i*ExchangePubSize:], point)
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range errs {
 		if err != nil {
 			return nil, nil, err
 		}
-		copy(publicBundle[i*ExchangePubSize:], pub)
-		privateBundle[i] = priv
 	}
 	return publicBundle, privateBundle, nil
 }
 
 // BundleFromBytes converts a slice of bytes into a public bundle.
 //
-// This will fail if the length of the data doesn't match an expected length for a bundle.
+// This will fail if the length of the data doesn't match an expected length for a bundle,
+// or if the bundle has too few or too many keys.
 func BundleFromBytes(data []byte) (BundlePub, error) {
 	if len(data)%ExchangePubSize != 0 {
 		return nil, errors.New("data is not a multiple of exchange key size")
 	}
+	err := CheckBundleSize(len(data) / ExchangePubSize)
+	if err != nil {
+		return nil, err
+	}
 	return BundlePub(data), nil
 }
 
@@ -207,12 +413,12 @@ func (bundle BundlePub) Len() int {
 
 // SignBundle uses an identity key to sign a bundle of exchange keys
 func (priv IdentityPriv) SignBundle(bundle BundlePub) Signature {
-	return priv.Sign(bundle)
+	return priv.Sign(withContext(bundleContext, bundle))
 }
 
 // VerifyBundle verifies a signature generated over a bundle of exchange keys
 func (pub IdentityPub) VerifyBundle(bundle BundlePub, sig Signature) bool {
-	return pub.Verify(bundle, sig)
+	return pub.Verify(withContext(bundleContext, bundle), sig)
 }
 
 // SharedSecret is derived between two parties, exchanging only public information
@@ -221,21 +427,72 @@ type SharedSecret []byte
 // SharedSecretSize is the number of bytes in a shared secret
 const SharedSecretSize = 32
 
+// Wipe overwrites this secret with zeros.
+//
+// The double ratchet keeps its own copy of the secret, so this can be called
+// as soon as the ratchet has been created.
+func (secret SharedSecret) Wipe() {
+	wipe(secret)
+}
+
+// fingerprintContext separates the hash of a fingerprint from any other use of the secret
+const fingerprintContext = "nuntius-fingerprint"
+
+// FingerprintSize is the number of bytes of the hash shown in a fingerprint
+const FingerprintSize = 16
+
+// Fingerprint summarizes this secret, so that two people can check that they share it
+//
+// This is a truncated SHA-256 hash, in groups of 4 hex digits. Since the secret can't be
+// recovered from it, the fingerprint can be compared out of band, over the phone for example.
+// Someone in the middle of an exchange ends up with a different secret on each side.
+func (secret SharedSecret) Fingerprint() string {
+	hash := sha256.Sum256(withContext(fingerprintContext, secret))
+	digits := hex.EncodeToString(hash[:FingerprintSize])
+	groups := make([]string, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
 // ForwardExchangeParams is the information to do an exchange, from a person initiating the exchange
 type ForwardExchangeParams struct {
-	// The private identity key for the initiator
+	// Me is the private identity key of the initiator
 	Me IdentityPriv
-	// The private part of an Ephemeral exchange key
+	// Ephemeral is the private part of an exchange key, generated for this exchange only
 	Ephemeral ExchangePriv
-	// The public Identity key for the recipient
+	// Identity is the public identity key of the recipient
 	Identity IdentityPub
-	// The signed Prekey for the recipient
+	// Prekey is the signed prekey of the recipient, whose signature needs to be checked beforehand
 	Prekey ExchangePub
-	// The OneTime key for the recipient
+	// OneTime is one of the onetime keys of the recipient, or nil if they had none left
 	OneTime ExchangePub
+	// Info separates the secrets of different applications, with DefaultExchangeInfo if left out
+	//
+	// Both sides of an exchange need to use the same Info and Salt to derive the same secret.
+	Info []byte
+	// Salt is passed to the key derivation along with Info, and can be left out
+	Salt []byte
 }
 
-var exchangeInfo = []byte("Nuntius X3DH KDF 2021-06-06")
+// DefaultExchangeInfo is the info used to derive the secret of an exchange, unless another one is given
+var DefaultExchangeInfo = []byte("Nuntius X3DH KDF 2021-06-06")
+
+// deriveExchangeSecret derives a shared secret from the concatenated outputs of an exchange, wiping them
+func deriveExchangeSecret(secret []byte, salt []byte, info []byte) (SharedSecret, error) {
+	if info == nil {
+		info = DefaultExchangeInfo
+	}
+	kdf := hkdf.New(sha256.New, secret, salt, info)
+	out := make([]byte, SharedSecretSize)
+	_, err := io.ReadFull(kdf, out)
+	wipe(secret)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
 
 // ForwardExchange performs an exchange with the parameters, deriving a shared secret.
 //
@@ -277,28 +534,24 @@ func ForwardExchange(params *ForwardExchangeParams) (SharedSecret, error) {
 		copy(secret[3*ExchangeSecretSize:], dh4)
 	}
 
-	kdf := hkdf.New(sha256.New, secret, nil, exchangeInfo)
-	out := make([]byte, SharedSecretSize)
-	_, err = io.ReadFull(kdf, out)
-	if err != nil {
-		return nil, err
-	}
-
-	return out, nil
+	return deriveExchangeSecret(secret, params.Salt, params.Info)
 }
 
 // BackwardExchangeParams contains the parameters for an exchange from a recipient
 type BackwardExchangeParams struct {
-	// The public identity of the initiator
+	// Them is the public identity key of the initiator
 	Them IdentityPub
-	// The Ephemeral key used by the initiator
+	// Ephemeral is the public part of the exchange key the initiator generated
 	Ephemeral ExchangePub
-	// The private Identity of the recipient
+	// Identity is the private identity key of the recipient
 	Identity IdentityPriv
-	// The private Prekey of the recipient
+	// Prekey is the private part of the prekey the initiator used
 	Prekey ExchangePriv
-	// The private OneTime key of the recipient
+	// OneTime is the private part of the onetime key the initiator used, or nil if they used none
 	OneTime ExchangePriv
+	// Info and Salt need to match the ones the initiator used, like in ForwardExchangeParams
+	Info []byte
+	Salt []byte
 }
 
 // BackwardExchange derives a shared secret, using the initiators public information
@@ -343,12 +596,5 @@ func BackwardExchange(params *BackwardExchangeParams) (SharedSecret, error) {
 		copy(secret[3*ExchangeSecretSize:], dh4)
 	}
 
-	kdf := hkdf.New(sha256.New, secret, nil, exchangeInfo)
-	out := make([]byte, SharedSecretSize)
-	_, err = io.ReadFull(kdf, out)
-	if err != nil {
-		return nil, err
-	}
-
-	return out, nil
+	return deriveExchangeSecret(secret, params.Salt, params.Info)
 }
@@ -2,7 +2,13 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"runtime"
 	"testing"
+
+	"golang.org/x/crypto/curve25519"
 )
 
 func TestExchangeSymmetry(t *testing.T) {
@@ -28,21 +34,21 @@ func TestExchangeSymmetry(t *testing.T) {
 	}
 
 	exchangeForward, err := ForwardExchange(&ForwardExchangeParams{
-		privA,
-		ephemeralPriv,
-		pubB,
-		prekeyPub,
-		onetimePub,
+		Me:        privA,
+		Ephemeral: ephemeralPriv,
+		Identity:  pubB,
+		Prekey:    prekeyPub,
+		OneTime:   onetimePub,
 	})
 	if err != nil {
 		t.Error(err)
 	}
 	exchangeBackward, err := BackwardExchange(&BackwardExchangeParams{
-		pubA,
-		ephemeralPub,
-		privB,
-		prekeyPriv,
-		onetimePriv,
+		Them:      pubA,
+		Ephemeral: ephemeralPub,
+		Identity:  privB,
+		Prekey:    prekeyPriv,
+		OneTime:   onetimePriv,
 	})
 	if err != nil {
 		t.Error(err)
@@ -52,21 +58,21 @@ func TestExchangeSymmetry(t *testing.T) {
 	}
 
 	exchangeForward, err = ForwardExchange(&ForwardExchangeParams{
-		privA,
-		ephemeralPriv,
-		pubB,
-		prekeyPub,
-		nil,
+		Me:        privA,
+		Ephemeral: ephemeralPriv,
+		Identity:  pubB,
+		Prekey:    prekeyPub,
+		OneTime:   nil,
 	})
 	if err != nil {
 		t.Error(err)
 	}
 	exchangeBackward, err = BackwardExchange(&BackwardExchangeParams{
-		pubA,
-		ephemeralPub,
-		privB,
-		prekeyPriv,
-		nil,
+		Them:      pubA,
+		Ephemeral: ephemeralPub,
+		Identity:  privB,
+		Prekey:    prekeyPriv,
+		OneTime:   nil,
 	})
 	if err != nil {
 		t.Error(err)
@@ -75,3 +81,410 @@ func TestExchangeSymmetry(t *testing.T) {
 		t.Error("exchange wasn't symmetric:", exchangeForward, exchangeBackward)
 	}
 }
+
+func TestExchangeInfoSeparatesSecrets(t *testing.T) {
+	pubA, privA, err := GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	pubB, privB, err := GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	ephemeralPub, ephemeralPriv, err := GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate ephemeral key: %v", err)
+		return
+	}
+	prekeyPub, prekeyPriv, err := GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	exchange := func(forwardInfo, forwardSalt, backwardInfo, backwardSalt []byte) (SharedSecret, SharedSecret) {
+		forward, err := ForwardExchange(&ForwardExchangeParams{Me: privA, Ephemeral: ephemeralPriv, Identity: pubB, Prekey: prekeyPub, Info: forwardInfo, Salt: forwardSalt})
+		if err != nil {
+			t.Fatalf("couldn't run forward exchange: %v", err)
+		}
+		backward, err := BackwardExchange(&BackwardExchangeParams{Them: pubA, Ephemeral: ephemeralPub, Identity: privB, Prekey: prekeyPriv, Info: backwardInfo, Salt: backwardSalt})
+		if err != nil {
+			t.Fatalf("couldn't run backward exchange: %v", err)
+		}
+		return forward, backward
+	}
+
+	test, prod := []byte("Nuntius test network"), []byte("Nuntius prod network")
+	forward, backward := exchange(test, nil, test, nil)
+	if !bytes.Equal(forward, backward) {
+		t.Errorf("the same info derived different secrets")
+		return
+	}
+	defaultForward, _ := exchange(nil, nil, nil, nil)
+	explicitForward, _ := exchange(DefaultExchangeInfo, nil, DefaultExchangeInfo, nil)
+	if !bytes.Equal(defaultForward, explicitForward) {
+		t.Errorf("leaving out the info didn't use DefaultExchangeInfo")
+		return
+	}
+	if bytes.Equal(forward, defaultForward) {
+		t.Errorf("different info derived the same secret")
+		return
+	}
+	forward, backward = exchange(test, nil, prod, nil)
+	if bytes.Equal(forward, backward) {
+		t.Errorf("different info derived the same secret")
+		return
+	}
+	forward, backward = exchange(test, []byte("salt"), test, []byte("salt"))
+	if !bytes.Equal(forward, backward) {
+		t.Errorf("the same info and salt derived different secrets")
+		return
+	}
+	forward, backward = exchange(test, []byte("salt"), test, []byte("other salt"))
+	if bytes.Equal(forward, backward) {
+		t.Errorf("different salts derived the same secret")
+		return
+	}
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestWipe(t *testing.T) {
+	_, identityPriv, err := GenerateIdentity()
+	if err != nil {
+		t.Error(err)
+	}
+	identityPriv.Wipe()
+	if !isZero(identityPriv) {
+		t.Error("identity key wasn't wiped:", identityPriv)
+	}
+
+	_, exchangePriv, err := GenerateExchange()
+	if err != nil {
+		t.Error(err)
+	}
+	exchangePriv.Wipe()
+	if !isZero(exchangePriv) {
+		t.Error("exchange key wasn't wiped:", exchangePriv)
+	}
+
+	secret := SharedSecret(bytes.Repeat([]byte{0xFF}, SharedSecretSize))
+	secret.Wipe()
+	if !isZero(secret) {
+		t.Error("shared secret wasn't wiped:", secret)
+	}
+
+	rk := rootKey(bytes.Repeat([]byte{0xFF}, rootKeySize))
+	rk.Wipe()
+	if !isZero(rk) {
+		t.Error("root key wasn't wiped:", rk)
+	}
+
+	ck := chainKey(bytes.Repeat([]byte{0xFF}, chainKeySize))
+	ck.Wipe()
+	if !isZero(ck) {
+		t.Error("chain key wasn't wiped:", ck)
+	}
+}
+
+func TestRatchetSurvivesWipedSecret(t *testing.T) {
+	secret := SharedSecret(bytes.Repeat([]byte{0xAB}, SharedSecretSize))
+	pub, priv, err := GenerateExchange()
+	if err != nil {
+		t.Error(err)
+	}
+	ratchet := DoubleRatchetFromReceiver(secret, pub, priv)
+	secret.Wipe()
+	if isZero(ratchet.rootKey) {
+		t.Error("wiping the secret wiped the ratchet's root key")
+	}
+}
+
+func TestIdentityFromSeed(t *testing.T) {
+	seed := bytes.Repeat([]byte{1}, IdentitySeedSize)
+	pub1, priv1, err := IdentityFromSeed(seed)
+	if err != nil {
+		t.Error(err)
+	}
+	pub2, priv2, err := IdentityFromSeed(seed)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(pub1, pub2) || !bytes.Equal(priv1, priv2) {
+		t.Error("same seed produced different identities")
+	}
+
+	otherSeed := bytes.Repeat([]byte{2}, IdentitySeedSize)
+	pub3, priv3, err := IdentityFromSeed(otherSeed)
+	if err != nil {
+		t.Error(err)
+	}
+	if bytes.Equal(pub1, pub3) || bytes.Equal(priv1, priv3) {
+		t.Error("different seeds produced the same identity")
+	}
+
+	_, _, err = IdentityFromSeed(seed[1:])
+	if err == nil {
+		t.Error("seed with the wrong length was accepted")
+	}
+}
+
+func TestValidateIdentity(t *testing.T) {
+	pub, _, err := GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	if err := pub.Validate(); err != nil {
+		t.Errorf("generated identity is invalid: %v", err)
+		return
+	}
+	// y = 2 isn't the y coordinate of any point on the curve
+	notOnCurve := make([]byte, IdentityPubSize)
+	notOnCurve[0] = 2
+	// y = p + 1 decodes to the same point as y = 1, but isn't its canonical encoding
+	nonCanonical := bytes.Repeat([]byte{0xff}, IdentityPubSize)
+	nonCanonical[0] = 0xee
+	nonCanonical[IdentityPubSize-1] = 0x7f
+	for _, invalid := range [][]byte{notOnCurve, nonCanonical, pub[1:]} {
+		if IdentityPub(invalid).Validate() == nil {
+			t.Errorf("invalid identity %x was accepted", invalid)
+			return
+		}
+		parsers := map[string]func(string) (IdentityPub, error){
+			"hex":    IdentityPubFromString,
+			"base64": IdentityPubFromBase64,
+			"base58": IdentityPubFromBase58,
+			"base32": IdentityPubFromBase32,
+		}
+		encoded := map[string]string{
+			"hex":    IdentityPub(invalid).String(),
+			"base64": base64.URLEncoding.EncodeToString(invalid),
+			"base58": IdentityPub(invalid).Base58(),
+			"base32": IdentityPub(invalid).Base32(),
+		}
+		for name, parse := range parsers {
+			_, err := parse(encoded[name])
+			if err == nil {
+				t.Errorf("%s: invalid identity %x was parsed", name, invalid)
+				return
+			}
+		}
+	}
+}
+
+func TestSignaturesAreSeparated(t *testing.T) {
+	pub, priv, err := GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	prekey, _, err := GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	sig := priv.SignPrekey(prekey)
+	if !pub.VerifyPrekey(prekey, sig) {
+		t.Errorf("prekey signature doesn't verify")
+		return
+	}
+	// A single prekey has the same bytes as a bundle with one key
+	if pub.VerifyBundle(BundlePub(prekey), sig) {
+		t.Errorf("prekey signature verifies as a bundle signature")
+		return
+	}
+	if pub.Verify(prekey, sig) {
+		t.Errorf("prekey signature verifies without its context")
+		return
+	}
+	if pub.VerifyPrekey(prekey, priv.SignBundle(BundlePub(prekey))) {
+		t.Errorf("bundle signature verifies as a prekey signature")
+		return
+	}
+}
+
+func TestGenerateBundleSize(t *testing.T) {
+	bundle, priv, err := GenerateBundle(3)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	if bundle.Len() != 3 || len(priv) != 3 {
+		t.Errorf("expected 3 keys, found %d public and %d private", bundle.Len(), len(priv))
+		return
+	}
+	for _, count := range []int{0, -1, MaxBundleSize + 1} {
+		_, _, err := GenerateBundle(count)
+		if err == nil {
+			t.Errorf("expected error generating bundle of size %d", count)
+			return
+		}
+	}
+}
+
+func TestGenerateBundleInParallel(t *testing.T) {
+	bundle, priv, err := generateBundle(DefaultBundleSize, 4)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	decoded, err := BundleFromBytes([]byte(bundle))
+	if err != nil {
+		t.Errorf("couldn't decode bundle: %v", err)
+		return
+	}
+	if decoded.Len() != DefaultBundleSize || len(priv) != DefaultBundleSize {
+		t.Errorf("expected %d keys, found %d public and %d private", DefaultBundleSize, decoded.Len(), len(priv))
+		return
+	}
+	// Each public key should still line up with its private key
+	for i := 0; i < decoded.Len(); i++ {
+		expected, err := curve25519.X25519(priv[i], curve25519.Basepoint)
+		if err != nil {
+			t.Errorf("couldn't compute public key: %v", err)
+			return
+		}
+		if !bytes.Equal(decoded.Get(i), expected) {
+			t.Errorf("key %d: %v != %v", i, decoded.Get(i), expected)
+			return
+		}
+	}
+}
+
+func BenchmarkGenerateBundleSerial(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_, _, err := generateBundle(DefaultBundleSize, 1)
+		if err != nil {
+			b.Fatalf("couldn't generate bundle: %v", err)
+		}
+	}
+}
+
+func BenchmarkGenerateBundleParallel(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_, _, err := generateBundle(DefaultBundleSize, runtime.NumCPU())
+		if err != nil {
+			b.Fatalf("couldn't generate bundle: %v", err)
+		}
+	}
+}
+
+func TestFingerprintsMatch(t *testing.T) {
+	pubA, privA, err := GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	pubB, privB, err := GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	ephemeralPub, ephemeralPriv, err := GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate ephemeral key: %v", err)
+		return
+	}
+	prekeyPub, prekeyPriv, err := GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	forward, err := ForwardExchange(&ForwardExchangeParams{Me: privA, Ephemeral: ephemeralPriv, Identity: pubB, Prekey: prekeyPub})
+	if err != nil {
+		t.Errorf("couldn't exchange forward: %v", err)
+		return
+	}
+	backward, err := BackwardExchange(&BackwardExchangeParams{Them: pubA, Ephemeral: ephemeralPub, Identity: privB, Prekey: prekeyPriv})
+	if err != nil {
+		t.Errorf("couldn't exchange backward: %v", err)
+		return
+	}
+	if forward.Fingerprint() != backward.Fingerprint() {
+		t.Errorf("fingerprints don't match: %s != %s", forward.Fingerprint(), backward.Fingerprint())
+		return
+	}
+	if len(forward.Fingerprint()) != FingerprintSize*2+FingerprintSize/2-1 {
+		t.Errorf("unexpected fingerprint: %q", forward.Fingerprint())
+		return
+	}
+
+	// Someone in the middle substitutes their own prekey
+	fakePub, _, err := GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	tampered, err := ForwardExchange(&ForwardExchangeParams{Me: privA, Ephemeral: ephemeralPriv, Identity: pubB, Prekey: fakePub})
+	if err != nil {
+		t.Errorf("couldn't exchange forward: %v", err)
+		return
+	}
+	if tampered.Fingerprint() == backward.Fingerprint() {
+		t.Errorf("tampered exchange has the same fingerprint")
+		return
+	}
+}
+
+// seededReader deterministically produces a stream of bytes from a seed
+type seededReader struct {
+	seed    []byte
+	counter uint64
+	buf     []byte
+}
+
+func (r *seededReader) Read(p []byte) (int, error) {
+	for len(r.buf) < len(p) {
+		block := sha256.Sum256(append(r.seed, byte(r.counter>>8), byte(r.counter)))
+		r.buf = append(r.buf, block[:]...)
+		r.counter++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func TestGenerateFromSeededReader(t *testing.T) {
+	generate := func(seed string) (IdentityPub, ExchangePub, ExchangePriv) {
+		r := &seededReader{seed: []byte(seed)}
+		identity, _, err := GenerateIdentityFrom(r)
+		if err != nil {
+			t.Fatalf("couldn't generate identity: %v", err)
+		}
+		pub, priv, err := GenerateExchangeFrom(r)
+		if err != nil {
+			t.Fatalf("couldn't generate exchange: %v", err)
+		}
+		return identity, pub, priv
+	}
+	identity1, pub1, priv1 := generate("fixed seed")
+	// The keys must also be the same from one run to the next
+	if hex.EncodeToString(pub1) != "f368decc4096903e75e2e9bbcf51ae08dc3ab72cdc63d3b7c022fa8694229409" {
+		t.Errorf("unexpected key from a fixed seed: %x", pub1)
+		return
+	}
+	identity2, pub2, priv2 := generate("fixed seed")
+	if !bytes.Equal(identity1, identity2) || !bytes.Equal(pub1, pub2) || !bytes.Equal(priv1, priv2) {
+		t.Errorf("the same seed gave different keys")
+		return
+	}
+	identity3, pub3, _ := generate("other seed")
+	if bytes.Equal(identity1, identity3) || bytes.Equal(pub1, pub3) {
+		t.Errorf("different seeds gave the same keys")
+		return
+	}
+	_, _, err := GenerateExchangeFrom(bytes.NewReader(make([]byte, 8)))
+	if err == nil {
+		t.Errorf("a short reader didn't fail")
+		return
+	}
+}
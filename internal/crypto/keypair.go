@@ -0,0 +1,56 @@
+package crypto
+
+// IdentityKeyPair holds both components of an identity key
+type IdentityKeyPair struct {
+	Pub  IdentityPub
+	Priv IdentityPriv
+}
+
+// GenerateIdentityPair creates a new identity key-pair, like GenerateIdentity
+func GenerateIdentityPair() (IdentityKeyPair, error) {
+	pub, priv, err := GenerateIdentity()
+	if err != nil {
+		return IdentityKeyPair{}, err
+	}
+	return IdentityKeyPair{pub, priv}, nil
+}
+
+// Split returns the public and private components of this pair
+func (pair IdentityKeyPair) Split() (IdentityPub, IdentityPriv) {
+	return pair.Pub, pair.Priv
+}
+
+// Sign uses the private component of this pair to sign some data
+func (pair IdentityKeyPair) Sign(data []byte) Signature {
+	return pair.Priv.Sign(data)
+}
+
+// Wipe overwrites the private component of this pair with zeros
+func (pair IdentityKeyPair) Wipe() {
+	pair.Priv.Wipe()
+}
+
+// ExchangeKeyPair holds both components of an exchange key
+type ExchangeKeyPair struct {
+	Pub  ExchangePub
+	Priv ExchangePriv
+}
+
+// GenerateExchangePair creates a new exchange key-pair, like GenerateExchange
+func GenerateExchangePair() (ExchangeKeyPair, error) {
+	pub, priv, err := GenerateExchange()
+	if err != nil {
+		return ExchangeKeyPair{}, err
+	}
+	return ExchangeKeyPair{pub, priv}, nil
+}
+
+// Split returns the public and private components of this pair
+func (pair ExchangeKeyPair) Split() (ExchangePub, ExchangePriv) {
+	return pair.Pub, pair.Priv
+}
+
+// Wipe overwrites the private component of this pair with zeros
+func (pair ExchangeKeyPair) Wipe() {
+	pair.Priv.Wipe()
+}
@@ -0,0 +1,51 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIdentityKeyPair(t *testing.T) {
+	pair, err := GenerateIdentityPair()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	pub, priv := pair.Split()
+	if !bytes.Equal(pub, pair.Pub) || !bytes.Equal(priv, pair.Priv) {
+		t.Errorf("split doesn't match pair")
+		return
+	}
+	data := []byte("data")
+	if !pair.Pub.Verify(data, pair.Sign(data)) {
+		t.Errorf("signature from pair doesn't verify")
+		return
+	}
+	pair.Wipe()
+	if !bytes.Equal(priv, make([]byte, len(priv))) {
+		t.Errorf("private key wasn't wiped")
+		return
+	}
+}
+
+func TestExchangeKeyPair(t *testing.T) {
+	pair, err := GenerateExchangePair()
+	if err != nil {
+		t.Errorf("couldn't generate exchange: %v", err)
+		return
+	}
+	pub, priv := pair.Split()
+	if !bytes.Equal(pub, pair.Pub) || !bytes.Equal(priv, pair.Priv) {
+		t.Errorf("split doesn't match pair")
+		return
+	}
+	if len(pub) != ExchangePubSize {
+		t.Errorf("unexpected public key size: %d", len(pub))
+		return
+	}
+	pair.Wipe()
+	if !bytes.Equal(priv, make([]byte, len(priv))) {
+		t.Errorf("private key wasn't wiped")
+		return
+	}
+}
@@ -0,0 +1,42 @@
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tyler-smith/go-bip39"
+)
+
+// mnemonicWords is the number of words in the mnemonic for an identity seed
+const mnemonicWords = 24
+
+// MnemonicFromSeed encodes an identity seed as a 24 word BIP39 mnemonic.
+//
+// This mnemonic can be written down as a backup, and later turned back
+// into the same seed with SeedFromMnemonic.
+func MnemonicFromSeed(seed []byte) (string, error) {
+	if len(seed) != IdentitySeedSize {
+		return "", fmt.Errorf("incorrect identity seed size: %d", len(seed))
+	}
+	return bip39.NewMnemonic(seed)
+}
+
+// SeedFromMnemonic decodes a BIP39 mnemonic back into an identity seed.
+//
+// This will return an error if the mnemonic contains unknown words, has the
+// wrong number of words, or if the checksum doesn't match.
+func SeedFromMnemonic(mnemonic string) ([]byte, error) {
+	words := strings.Fields(strings.ToLower(mnemonic))
+	if len(words) != mnemonicWords {
+		return nil, fmt.Errorf("mnemonic has %d words instead of %d", len(words), mnemonicWords)
+	}
+	seed, err := bip39.EntropyFromMnemonic(strings.Join(words, " "))
+	if errors.Is(err, bip39.ErrChecksumIncorrect) {
+		return nil, errors.New("mnemonic checksum doesn't match, check for typos")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return seed, nil
+}
@@ -0,0 +1,56 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func TestMnemonicRoundtrip(t *testing.T) {
+	seed := make([]byte, IdentitySeedSize)
+	_, err := rand.Read(seed)
+	if err != nil {
+		t.Errorf("couldn't generate seed: %v", err)
+		return
+	}
+	mnemonic, err := MnemonicFromSeed(seed)
+	if err != nil {
+		t.Errorf("couldn't create mnemonic: %v", err)
+		return
+	}
+	if len(strings.Fields(mnemonic)) != 24 {
+		t.Errorf("mnemonic doesn't have 24 words: %s", mnemonic)
+		return
+	}
+	seedAgain, err := SeedFromMnemonic(mnemonic)
+	if err != nil {
+		t.Errorf("couldn't decode mnemonic: %v", err)
+		return
+	}
+	if !bytes.Equal(seed, seedAgain) {
+		t.Error("mnemonic returned a different seed")
+		return
+	}
+}
+
+func TestMnemonicBadChecksum(t *testing.T) {
+	seed := make([]byte, IdentitySeedSize)
+	mnemonic, err := MnemonicFromSeed(seed)
+	if err != nil {
+		t.Errorf("couldn't create mnemonic: %v", err)
+		return
+	}
+	words := strings.Fields(mnemonic)
+	// The last word contains the checksum, so changing it should be detected
+	if words[len(words)-1] == "zoo" {
+		words[len(words)-1] = "abandon"
+	} else {
+		words[len(words)-1] = "zoo"
+	}
+	_, err = SeedFromMnemonic(strings.Join(words, " "))
+	if err == nil {
+		t.Error("mnemonic with a bad checksum was accepted")
+		return
+	}
+}
@@ -0,0 +1,34 @@
+package crypto
+
+import (
+	"crypto/rand"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// PassphraseSaltSize is the number of bytes in the salt used to derive a key from a passphrase
+const PassphraseSaltSize = 16
+
+// The Argon2id parameters, following the recommendations of RFC 9106
+const (
+	argonTime    = 1
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+)
+
+// GeneratePassphraseSalt creates a new random salt, for use with KeyFromPassphrase
+func GeneratePassphraseSalt() ([]byte, error) {
+	salt := make([]byte, PassphraseSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// KeyFromPassphrase derives an encryption key from a passphrase, using Argon2id
+//
+// The same passphrase and salt always produce the same key.
+func KeyFromPassphrase(passphrase string, salt []byte) MessageKey {
+	return argon2.IDKey([]byte(passphrase), salt, argonTime, argonMemory, argonThreads, MessageKeySize)
+}
@@ -0,0 +1,36 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyFromPassphrase(t *testing.T) {
+	salt, err := GeneratePassphraseSalt()
+	if err != nil {
+		t.Errorf("couldn't generate salt: %v", err)
+		return
+	}
+	key := KeyFromPassphrase("correct horse", salt)
+	if len(key) != MessageKeySize {
+		t.Errorf("incorrect key size: %d", len(key))
+		return
+	}
+	if !bytes.Equal(key, KeyFromPassphrase("correct horse", salt)) {
+		t.Error("same passphrase and salt produced different keys")
+		return
+	}
+	if bytes.Equal(key, KeyFromPassphrase("battery staple", salt)) {
+		t.Error("different passphrases produced the same key")
+		return
+	}
+	otherSalt, err := GeneratePassphraseSalt()
+	if err != nil {
+		t.Errorf("couldn't generate salt: %v", err)
+		return
+	}
+	if bytes.Equal(key, KeyFromPassphrase("correct horse", otherSalt)) {
+		t.Error("different salts produced the same key")
+		return
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 
 	"golang.org/x/crypto/hkdf"
@@ -19,6 +21,11 @@ type rootKey []byte
 // rootKeySize is the number of bytes in a root key
 const rootKeySize = 32
 
+// Wipe overwrites this key with zeros
+func (rk rootKey) Wipe() {
+	wipe(rk)
+}
+
 // chainKey represents a chain key used for deriving message keys
 //
 // Chain keys are used to generate message keys with a ratchet.
@@ -27,6 +34,11 @@ type chainKey []byte
 // chainKeySize is the number of bytes in a chain key
 const chainKeySize = 32
 
+// Wipe overwrites this key with zeros
+func (ck chainKey) Wipe() {
+	wipe(ck)
+}
+
 var kdfRootKeyInfo = []byte("Nuntius Root Key KDF 2021-06-20")
 
 // kdfRootKey uses a root key, and a shared secret, to derive a new root key, and a chain key
@@ -47,7 +59,10 @@ func kdfRootKey(rk rootKey, dhOut exchangedSecret) (rootKey, chainKey, error) {
 	return rootKey, chainKey, nil
 }
 
-// messageKey represents a key used for encrypting messages
+// MessageKey is the key used for all authenticated encryption, through Encrypt and Decrypt
+//
+// Besides the keys the ratchet derives for each message, keys derived from passphrases
+// also have this type, as do the keys of encrypted streams.
 type MessageKey []byte
 
 // MessageKeySize is the number of bytes in a message key
@@ -74,6 +89,31 @@ func kdfChainKey(ck chainKey) (chainKey, MessageKey, error) {
 	return ck, mk, nil
 }
 
+// MaxSkip is the maximum number of message keys we'll skip in a single chain.
+//
+// This bounds the amount of work, and memory, a malicious correspondant can
+// make us spend by claiming to have sent a large number of messages.
+const MaxSkip = 1000
+
+// MaxSkippedKeys is the maximum number of skipped message keys we hold, across all chains.
+//
+// MaxSkip only bounds a single chain, so a correspondant switching ratchet keys
+// could otherwise make us hold on to an unbounded number of keys. Once we hold
+// more than this, the oldest keys are dropped.
+const MaxSkippedKeys = 2 * MaxSkip
+
+// skippedKey identifies a message key we've skipped over, but not yet used.
+type skippedKey struct {
+	pub string
+	n   uint32
+}
+
+// skippedMessage is a message key we've skipped over, along with its identifier
+type skippedMessage struct {
+	id  skippedKey
+	key MessageKey
+}
+
 // DoubleRatchet holds the state used for the Diffie Hellman double ratchet.
 //
 // This will be setup based on the exchange to derive a secret, and then
@@ -91,6 +131,16 @@ type DoubleRatchet struct {
 	sendingKey chainKey
 	// receivingKey is the current chain key for the receiving ratchet
 	receivingKey chainKey
+	// sendingN is the number of messages sent in the current sending chain
+	sendingN uint32
+	// receivingN is the number of messages received in the current receiving chain
+	receivingN uint32
+	// previousN is the number of messages sent in the previous sending chain
+	previousN uint32
+	// skipped holds the message keys we've skipped over, for messages arriving out of order
+	skipped map[skippedKey]MessageKey
+	// skippedOrder holds the identifiers in skipped, from oldest to newest
+	skippedOrder []skippedKey
 }
 
 // DoubleRatchetFromInitiator creates a double ratchet, with information by the initiator of an exchange.
@@ -118,11 +168,13 @@ func DoubleRatchetFromInitiator(secret SharedSecret, receivingPub ExchangePub) (
 // DoubleRatchetFromReceiver creates a double ratchet, with information from the receiver of an exchange.
 //
 // We use the shared secret we've derived from an exchange, as well as our signed prekey.
+//
+// The ratchet keeps its own copy of the secret and private key, so the caller can wipe them afterwards.
 func DoubleRatchetFromReceiver(secret SharedSecret, pub ExchangePub, priv ExchangePriv) DoubleRatchet {
 	var ratchet DoubleRatchet
 	ratchet.sendingPub = pub
-	ratchet.sendingPriv = priv
-	ratchet.rootKey = rootKey(secret)
+	ratchet.sendingPriv = ExchangePriv(append([]byte(nil), priv...))
+	ratchet.rootKey = rootKey(append([]byte(nil), secret...))
 	return ratchet
 }
 
@@ -133,66 +185,403 @@ func concat(a, b []byte) []byte {
 	return out
 }
 
+// headerVersion is the first byte of every header, identifying the message format.
+//
+// Ciphertexts with a different version are rejected, rather than being misinterpreted.
+// Version 2 started mixing messageContext into the additional data.
+const headerVersion = 2
+
+// messageContext is mixed into the additional data of every message encrypted by the ratchet
+//
+// This separates these messages from anything else encrypted with the same keys and additional data.
+const messageContext = "nuntius-msg-v1"
+
+// messageAdditional builds the additional data authenticated along with a message
+func messageAdditional(context string, header, additional []byte) []byte {
+	out := make([]byte, 0, len(context)+len(header)+len(additional))
+	out = append(out, context...)
+	out = append(out, header...)
+	out = append(out, additional...)
+	return out
+}
+
+// headerSize is the number of bytes in the header attached to each message
+const headerSize = 1 + ExchangePubSize + 4 + 4
+
+// Header is the information attached to each message encrypted by the ratchet.
+//
+// The header is sent in the clear, but authenticated as part of the additional data.
+type Header struct {
+	// Pub is the current exchange public key of the sender
+	Pub ExchangePub
+	// PN is the number of messages in the previous sending chain
+	PN uint32
+	// N is the number of this message in the current sending chain
+	N uint32
+}
+
+func (header *Header) encode() []byte {
+	out := make([]byte, headerSize)
+	out[0] = headerVersion
+	copy(out[1:], header.Pub)
+	binary.BigEndian.PutUint32(out[1+ExchangePubSize:], header.PN)
+	binary.BigEndian.PutUint32(out[1+ExchangePubSize+4:], header.N)
+	return out
+}
+
+// ParseHeader extracts the header attached to a ciphertext produced by the ratchet.
+//
+// This will fail if the ciphertext is too short, or uses a different version.
+func ParseHeader(ciphertext []byte) (Header, error) {
+	var header Header
+	if len(ciphertext) < headerSize {
+		return header, errors.New("ciphertext does not contain header")
+	}
+	if ciphertext[0] != headerVersion {
+		return header, fmt.Errorf("unknown header version: %d", ciphertext[0])
+	}
+	header.Pub = ExchangePub(ciphertext[1 : 1+ExchangePubSize])
+	header.PN = binary.BigEndian.Uint32(ciphertext[1+ExchangePubSize:])
+	header.N = binary.BigEndian.Uint32(ciphertext[1+ExchangePubSize+4:])
+	return header, nil
+}
+
+// Header returns the header that will be attached to the next message we encrypt.
+func (ratchet *DoubleRatchet) Header() Header {
+	return Header{Pub: ratchet.sendingPub, PN: ratchet.previousN, N: ratchet.sendingN}
+}
+
 // Encrypt uses the current state of the ratchet to encrypt a piece of data.
 func (ratchet *DoubleRatchet) Encrypt(plaintext, additional []byte) ([]byte, error) {
+	return ratchet.encryptIn(messageContext, plaintext, additional)
+}
+
+// encryptIn encrypts a piece of data, separating it from other contexts
+func (ratchet *DoubleRatchet) encryptIn(context string, plaintext, additional []byte) ([]byte, error) {
 	newSendingKey, messageKey, err := kdfChainKey(ratchet.sendingKey)
 	if err != nil {
 		return nil, err
 	}
+	defer wipe(messageKey)
+	ratchet.sendingKey.Wipe()
 	ratchet.sendingKey = newSendingKey
 
-	header := []byte(ratchet.sendingPub)
+	header := ratchet.Header()
+	encodedHeader := header.encode()
+	ratchet.sendingN++
 
-	ciphertext, err := messageKey.Encrypt(plaintext, concat(header, additional))
+	ciphertext, err := messageKey.Encrypt(plaintext, messageAdditional(context, encodedHeader, additional))
 	if err != nil {
 		return nil, err
 	}
-	return concat(header, ciphertext), nil
+	return concat(encodedHeader, ciphertext), nil
+}
+
+// skipMessageKeys advances the receiving chain until a given message number.
+//
+// The message keys we skip over are appended to skipped, so that we can decrypt
+// these messages if they arrive later.
+func (ratchet *DoubleRatchet) skipMessageKeys(until uint32, skipped *[]skippedMessage) error {
+	if until <= ratchet.receivingN {
+		return nil
+	}
+	if until-ratchet.receivingN > MaxSkip {
+		return fmt.Errorf("too many skipped messages: %d", until-ratchet.receivingN)
+	}
+	if ratchet.receivingKey == nil {
+		return nil
+	}
+	for ratchet.receivingN < until {
+		newReceivingKey, messageKey, err := kdfChainKey(ratchet.receivingKey)
+		if err != nil {
+			return err
+		}
+		ratchet.receivingKey.Wipe()
+		ratchet.receivingKey = newReceivingKey
+		*skipped = append(*skipped, skippedMessage{skippedKey{string(ratchet.receivingPub), ratchet.receivingN}, messageKey})
+		ratchet.receivingN++
+	}
+	return nil
+}
+
+// dhRatchet advances the root chain, after seeing a new public key from our correspondant.
+func (ratchet *DoubleRatchet) dhRatchet(receivingPub ExchangePub) error {
+	ratchet.previousN = ratchet.sendingN
+	ratchet.sendingN = 0
+	ratchet.receivingN = 0
+	ratchet.receivingPub = receivingPub
+	receivingExchange, err := ratchet.sendingPriv.exchange(ratchet.receivingPub)
+	if err != nil {
+		return err
+	}
+	newRootKey, newReceivingKey, err := kdfRootKey(ratchet.rootKey, receivingExchange)
+	if err != nil {
+		return err
+	}
+	ratchet.rootKey.Wipe()
+	ratchet.receivingKey.Wipe()
+	ratchet.rootKey, ratchet.receivingKey = newRootKey, newReceivingKey
+	sendingPub, sendingPriv, err := GenerateExchange()
+	if err != nil {
+		return err
+	}
+	ratchet.sendingPriv.Wipe()
+	ratchet.sendingPub, ratchet.sendingPriv = sendingPub, sendingPriv
+	sendingExchange, err := ratchet.sendingPriv.exchange(ratchet.receivingPub)
+	if err != nil {
+		return err
+	}
+	newRootKey, newSendingKey, err := kdfRootKey(ratchet.rootKey, sendingExchange)
+	if err != nil {
+		return err
+	}
+	ratchet.rootKey.Wipe()
+	ratchet.sendingKey.Wipe()
+	ratchet.rootKey, ratchet.sendingKey = newRootKey, newSendingKey
+	return nil
+}
+
+// clone copies the secret state of this ratchet, so that it can be wiped independently.
+//
+// The skipped message keys are shared with the original ratchet.
+func (ratchet *DoubleRatchet) clone() DoubleRatchet {
+	next := *ratchet
+	next.rootKey = rootKey(append([]byte(nil), ratchet.rootKey...))
+	next.sendingKey = chainKey(append([]byte(nil), ratchet.sendingKey...))
+	next.receivingKey = chainKey(append([]byte(nil), ratchet.receivingKey...))
+	next.sendingPriv = ExchangePriv(append([]byte(nil), ratchet.sendingPriv...))
+	return next
+}
+
+// wipeKeys overwrites the secret state of this ratchet with zeros.
+func (ratchet *DoubleRatchet) wipeKeys() {
+	ratchet.rootKey.Wipe()
+	ratchet.sendingKey.Wipe()
+	ratchet.receivingKey.Wipe()
+	ratchet.sendingPriv.Wipe()
 }
 
 // Decrypt uses the current state of the ratchet to decrypt a piece of data.
 //
 // The ciphertext will contain the necessary headers.
 //
-// This will also advance the state of the ratchet accordingly.
+// This will also advance the state of the ratchet accordingly. Messages arriving
+// out of order can still be decrypted, as long as we haven't skipped over more
+// than MaxSkip messages in a single chain.
 func (ratchet *DoubleRatchet) Decrypt(ciphertext, additional []byte) ([]byte, error) {
-	if len(ciphertext) < ExchangePubSize {
-		return nil, errors.New("ciphertext does not contain public key")
-	}
-	header := ciphertext[:ExchangePubSize]
-	attachedPub := ExchangePub(header[:ExchangePubSize])
-	if !bytes.Equal(attachedPub, ratchet.receivingPub) {
-		ratchet.receivingPub = attachedPub
-		receivingExchange, err := ratchet.sendingPriv.exchange(ratchet.receivingPub)
-		if err != nil {
-			return nil, err
-		}
-		ratchet.rootKey, ratchet.receivingKey, err = kdfRootKey(ratchet.rootKey, receivingExchange)
+	return ratchet.decryptIn(messageContext, ciphertext, additional)
+}
+
+// decryptIn decrypts a piece of data, which must have been encrypted in the same context
+func (ratchet *DoubleRatchet) decryptIn(context string, ciphertext, additional []byte) ([]byte, error) {
+	parsed, err := ParseHeader(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	header := ciphertext[:headerSize]
+	ciphertext = ciphertext[headerSize:]
+
+	id := skippedKey{string(parsed.Pub), parsed.N}
+	if messageKey, ok := ratchet.skipped[id]; ok {
+		plaintext, err := messageKey.Decrypt(ciphertext, messageAdditional(context, header, additional))
 		if err != nil {
 			return nil, err
 		}
-		ratchet.sendingPub, ratchet.sendingPriv, err = GenerateExchange()
-		if err != nil {
-			return nil, err
+		wipe(messageKey)
+		ratchet.removeSkipped(id)
+		return plaintext, nil
+	}
+
+	// We work on a copy of the state, so that a message failing to decrypt
+	// doesn't leave the ratchet in a corrupted state.
+	next := ratchet.clone()
+	var skipped []skippedMessage
+	plaintext, err := next.decryptNext(parsed, messageAdditional(context, header, additional), ciphertext, &skipped)
+	if err != nil {
+		next.wipeKeys()
+		for _, message := range skipped {
+			wipe(message.key)
 		}
-		sendingExchange, err := ratchet.sendingPriv.exchange(ratchet.receivingPub)
+		return nil, err
+	}
+
+	next.saveSkipped(skipped)
+	ratchet.wipeKeys()
+	*ratchet = next
+	return plaintext, nil
+}
+
+// decryptNext advances the ratchet to decrypt a message we haven't skipped over.
+func (ratchet *DoubleRatchet) decryptNext(parsed Header, additional, ciphertext []byte, skipped *[]skippedMessage) ([]byte, error) {
+	if !bytes.Equal(parsed.Pub, ratchet.receivingPub) {
+		err := ratchet.skipMessageKeys(parsed.PN, skipped)
 		if err != nil {
 			return nil, err
 		}
-		ratchet.rootKey, ratchet.sendingKey, err = kdfRootKey(ratchet.rootKey, sendingExchange)
+		err = ratchet.dhRatchet(ExchangePub(append([]byte(nil), parsed.Pub...)))
 		if err != nil {
 			return nil, err
 		}
 	}
-	ciphertext = ciphertext[ExchangePubSize:]
-	newReceivingKey, messageKey, err := kdfChainKey(ratchet.receivingKey)
+	err := ratchet.skipMessageKeys(parsed.N, skipped)
 	if err != nil {
 		return nil, err
 	}
-	ratchet.receivingKey = newReceivingKey
-	plaintext, err := MessageKey(messageKey).Decrypt(ciphertext, concat(header, additional))
+	newReceivingKey, messageKey, err := kdfChainKey(ratchet.receivingKey)
 	if err != nil {
 		return nil, err
 	}
-	return plaintext, nil
+	defer wipe(messageKey)
+	ratchet.receivingKey.Wipe()
+	ratchet.receivingKey = newReceivingKey
+	ratchet.receivingN++
+	return messageKey.Decrypt(ciphertext, additional)
+}
+
+// saveSkipped remembers message keys we've skipped over, dropping the oldest keys if we hold too many
+func (ratchet *DoubleRatchet) saveSkipped(skipped []skippedMessage) {
+	if len(skipped) == 0 {
+		return
+	}
+	if ratchet.skipped == nil {
+		ratchet.skipped = make(map[skippedKey]MessageKey)
+	}
+	for _, message := range skipped {
+		ratchet.skipped[message.id] = message.key
+		ratchet.skippedOrder = append(ratchet.skippedOrder, message.id)
+	}
+	for len(ratchet.skippedOrder) > MaxSkippedKeys {
+		wipe(ratchet.skipped[ratchet.skippedOrder[0]])
+		delete(ratchet.skipped, ratchet.skippedOrder[0])
+		ratchet.skippedOrder = ratchet.skippedOrder[1:]
+	}
+}
+
+// removeSkipped forgets a skipped message key, once it's been used
+func (ratchet *DoubleRatchet) removeSkipped(id skippedKey) {
+	delete(ratchet.skipped, id)
+	for i, other := range ratchet.skippedOrder {
+		if other == id {
+			ratchet.skippedOrder = append(ratchet.skippedOrder[:i:i], ratchet.skippedOrder[i+1:]...)
+			return
+		}
+	}
+}
+
+// stateVersion is the first byte of an encoded ratchet, identifying the format of its state.
+const stateVersion = 1
+
+// errTruncatedState is returned when decoding a ratchet whose state ends too early
+var errTruncatedState = errors.New("truncated ratchet state")
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var scratch [4]byte
+	binary.BigEndian.PutUint32(scratch[:], v)
+	return append(buf, scratch[:]...)
+}
+
+// appendField appends a piece of data to a buffer, prefixed with its length
+func appendField(buf []byte, data []byte) []byte {
+	buf = appendUint32(buf, uint32(len(data)))
+	return append(buf, data...)
+}
+
+// stateReader reads the fields of an encoded ratchet, remembering the first error
+type stateReader struct {
+	data []byte
+	err  error
+}
+
+func (r *stateReader) uint32() uint32 {
+	if r.err != nil || len(r.data) < 4 {
+		r.err = errTruncatedState
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+// field reads a length prefixed piece of data, returning nil if it's empty
+func (r *stateReader) field() []byte {
+	length := r.uint32()
+	if r.err != nil || uint64(length) > uint64(len(r.data)) {
+		r.err = errTruncatedState
+		return nil
+	}
+	var out []byte
+	if length > 0 {
+		out = append([]byte(nil), r.data[:length]...)
+	}
+	r.data = r.data[length:]
+	return out
+}
+
+// MarshalBinary encodes the full state of the ratchet, so that a session can be resumed later.
+//
+// This includes secret keys, so the result needs to be protected like them.
+func (ratchet *DoubleRatchet) MarshalBinary() ([]byte, error) {
+	out := []byte{stateVersion}
+	out = appendField(out, ratchet.sendingPub)
+	out = appendField(out, ratchet.sendingPriv)
+	out = appendField(out, ratchet.receivingPub)
+	out = appendField(out, ratchet.rootKey)
+	out = appendField(out, ratchet.sendingKey)
+	out = appendField(out, ratchet.receivingKey)
+	out = appendUint32(out, ratchet.sendingN)
+	out = appendUint32(out, ratchet.receivingN)
+	out = appendUint32(out, ratchet.previousN)
+	out = appendUint32(out, uint32(len(ratchet.skippedOrder)))
+	for _, id := range ratchet.skippedOrder {
+		out = appendField(out, []byte(id.pub))
+		out = appendUint32(out, id.n)
+		out = appendField(out, ratchet.skipped[id])
+	}
+	return out, nil
+}
+
+// UnmarshalBinary restores the state of a ratchet encoded with MarshalBinary.
+func (ratchet *DoubleRatchet) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return errTruncatedState
+	}
+	if data[0] != stateVersion {
+		return fmt.Errorf("unknown ratchet state version: %d", data[0])
+	}
+	r := stateReader{data: data[1:]}
+	var next DoubleRatchet
+	next.sendingPub = r.field()
+	next.sendingPriv = r.field()
+	next.receivingPub = r.field()
+	next.rootKey = r.field()
+	next.sendingKey = r.field()
+	next.receivingKey = r.field()
+	next.sendingN = r.uint32()
+	next.receivingN = r.uint32()
+	next.previousN = r.uint32()
+	count := r.uint32()
+	if r.err == nil && count > MaxSkippedKeys {
+		return fmt.Errorf("too many skipped keys in ratchet state: %d", count)
+	}
+	var skipped []skippedMessage
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		var message skippedMessage
+		message.id.pub = string(r.field())
+		message.id.n = r.uint32()
+		message.key = r.field()
+		skipped = append(skipped, message)
+	}
+	if r.err == nil && len(r.data) > 0 {
+		r.err = errors.New("trailing data after ratchet state")
+	}
+	if r.err != nil {
+		next.wipeKeys()
+		for _, message := range skipped {
+			wipe(message.key)
+		}
+		return r.err
+	}
+	next.saveSkipped(skipped)
+	*ratchet = next
+	return nil
 }
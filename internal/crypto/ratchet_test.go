@@ -6,6 +6,25 @@ import (
 	"testing"
 )
 
+// newTestRatchets creates a sender and receiver ratchet sharing a fresh secret
+func newTestRatchets(t *testing.T) (*DoubleRatchet, *DoubleRatchet) {
+	secret := SharedSecret(make([]byte, SharedSecretSize))
+	_, err := rand.Read(secret)
+	if err != nil {
+		t.Fatalf("couldn't generate shared secret: %v", err)
+	}
+	receiverPub, receiverPriv, err := GenerateExchange()
+	if err != nil {
+		t.Fatalf("couldn't generate receiver key pair: %v", err)
+	}
+	sender, err := DoubleRatchetFromInitiator(secret, receiverPub)
+	if err != nil {
+		t.Fatalf("couldn't generate sender ratchet: %v", err)
+	}
+	receiver := DoubleRatchetFromReceiver(secret, receiverPub, receiverPriv)
+	return &sender, &receiver
+}
+
 func TestKDFRootKey(t *testing.T) {
 	rk := make([]byte, rootKeySize)
 	_, err := rand.Read(rk)
@@ -57,6 +76,271 @@ func TestKDFChainKey(t *testing.T) {
 }
 
 func TestRatchetEncryption(t *testing.T) {
+	senderRatchet, receiverRatchet := newTestRatchets(t)
+	for i := byte(0); i < 100; i++ {
+		plaintext := []byte{i, i}
+		additional := []byte{i}
+		sender, receiver := senderRatchet, receiverRatchet
+		if i&0b11 >= 2 {
+			sender, receiver = receiver, sender
+		}
+		ciphertext, err := sender.Encrypt(plaintext, additional)
+		if err != nil {
+			t.Errorf("couldn't encrypt message: %v", err)
+			return
+		}
+		actual, err := receiver.Decrypt(ciphertext, additional)
+		if err != nil {
+			t.Errorf("couldn't decrypt message: %v", err)
+			return
+		}
+		if !bytes.Equal(actual, plaintext) {
+			t.Errorf("decrypted doesn't match plaintext: %v %v", actual, plaintext)
+			return
+		}
+	}
+}
+
+func TestRatchetStepsOnEveryTurn(t *testing.T) {
+	alice, bob := newTestRatchets(t)
+	seen := make(map[string]bool)
+	for turn := 0; turn < 20; turn++ {
+		sender, receiver := alice, bob
+		if turn%2 == 1 {
+			sender, receiver = bob, alice
+		}
+		rootKey := append([]byte(nil), receiver.rootKey...)
+		// Each turn has a few messages, which all advertise the same sending key
+		for i := 0; i <= turn%3; i++ {
+			plaintext := []byte{byte(turn), byte(i)}
+			ciphertext, err := sender.Encrypt(plaintext, nil)
+			if err != nil {
+				t.Errorf("couldn't encrypt message: %v", err)
+				return
+			}
+			actual, err := receiver.Decrypt(ciphertext, nil)
+			if err != nil {
+				t.Errorf("turn %d: couldn't decrypt message: %v", turn, err)
+				return
+			}
+			if !bytes.Equal(actual, plaintext) {
+				t.Errorf("decrypted doesn't match plaintext: %v %v", actual, plaintext)
+				return
+			}
+		}
+		pub := string(sender.Header().Pub)
+		// Every turn switches to a new key, which the receiver steps its root chain with
+		if seen[pub] {
+			t.Errorf("turn %d: sending key was reused", turn)
+			return
+		}
+		seen[pub] = true
+		if !bytes.Equal(receiver.receivingPub, sender.sendingPub) {
+			t.Errorf("turn %d: receiver didn't pick up the new sending key", turn)
+			return
+		}
+		if bytes.Equal(receiver.rootKey, rootKey) {
+			t.Errorf("turn %d: receiver didn't advance its root key", turn)
+			return
+		}
+	}
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+	sender, receiver := newTestRatchets(t)
+	additional := []byte("additional")
+	ciphertexts := make([][]byte, 10)
+	for i := range ciphertexts {
+		var err error
+		ciphertexts[i], err = sender.Encrypt([]byte{byte(i)}, additional)
+		if err != nil {
+			t.Errorf("couldn't encrypt message: %v", err)
+			return
+		}
+	}
+	for _, i := range []int{3, 1, 0, 2, 9, 4, 8, 5, 7, 6} {
+		actual, err := receiver.Decrypt(ciphertexts[i], additional)
+		if err != nil {
+			t.Errorf("couldn't decrypt message %d: %v", i, err)
+			return
+		}
+		if !bytes.Equal(actual, []byte{byte(i)}) {
+			t.Errorf("decrypted doesn't match plaintext: %v %v", actual, []byte{byte(i)})
+			return
+		}
+	}
+	if len(receiver.skipped) != 0 {
+		t.Errorf("skipped keys weren't consumed: %d remaining", len(receiver.skipped))
+		return
+	}
+	_, err := receiver.Decrypt(ciphertexts[0], additional)
+	if err == nil {
+		t.Error("decrypting a message twice succeeded")
+		return
+	}
+}
+
+func TestRatchetTooManySkipped(t *testing.T) {
+	sender, receiver := newTestRatchets(t)
+	var ciphertext []byte
+	var err error
+	for i := 0; i < MaxSkip+2; i++ {
+		ciphertext, err = sender.Encrypt(nil, nil)
+		if err != nil {
+			t.Errorf("couldn't encrypt message: %v", err)
+			return
+		}
+	}
+	_, err = receiver.Decrypt(ciphertext, nil)
+	if err == nil {
+		t.Error("decrypting after skipping too many messages succeeded")
+		return
+	}
+}
+
+func TestRatchetHeader(t *testing.T) {
+	sender, receiver := newTestRatchets(t)
+	for i := uint32(0); i < 3; i++ {
+		expected := sender.Header()
+		ciphertext, err := sender.Encrypt(nil, nil)
+		if err != nil {
+			t.Errorf("couldn't encrypt message: %v", err)
+			return
+		}
+		header, err := ParseHeader(ciphertext)
+		if err != nil {
+			t.Errorf("couldn't parse header: %v", err)
+			return
+		}
+		if !bytes.Equal(header.Pub, expected.Pub) || header.PN != 0 || header.N != i {
+			t.Errorf("unexpected header: %v", header)
+			return
+		}
+		_, err = receiver.Decrypt(ciphertext, nil)
+		if err != nil {
+			t.Errorf("couldn't decrypt message: %v", err)
+			return
+		}
+	}
+	ciphertext, err := receiver.Encrypt(nil, nil)
+	if err != nil {
+		t.Errorf("couldn't encrypt message: %v", err)
+		return
+	}
+	_, err = sender.Decrypt(ciphertext, nil)
+	if err != nil {
+		t.Errorf("couldn't decrypt message: %v", err)
+		return
+	}
+	header := sender.Header()
+	if header.PN != 3 || header.N != 0 {
+		t.Errorf("unexpected header after ratchet step: %v", header)
+		return
+	}
+}
+
+func TestRatchetRejectsUnknownVersion(t *testing.T) {
+	sender, receiver := newTestRatchets(t)
+	ciphertext, err := sender.Encrypt(nil, nil)
+	if err != nil {
+		t.Errorf("couldn't encrypt message: %v", err)
+		return
+	}
+	ciphertext[0] = headerVersion + 1
+	_, err = receiver.Decrypt(ciphertext, nil)
+	if err == nil {
+		t.Error("decrypting a message with an unknown version succeeded")
+		return
+	}
+}
+
+func TestRatchetSeparatesContexts(t *testing.T) {
+	sender, receiver := newTestRatchets(t)
+	ciphertext, err := sender.encryptIn("other-context", []byte("hello"), []byte("additional"))
+	if err != nil {
+		t.Errorf("couldn't encrypt message: %v", err)
+		return
+	}
+	_, err = receiver.Decrypt(ciphertext, []byte("additional"))
+	if err == nil {
+		t.Error("decrypting a message from another context succeeded")
+		return
+	}
+	// A failed decryption leaves the ratchet as it was
+	plaintext, err := receiver.decryptIn("other-context", ciphertext, []byte("additional"))
+	if err != nil {
+		t.Errorf("couldn't decrypt message in its own context: %v", err)
+		return
+	}
+	if !bytes.Equal(plaintext, []byte("hello")) {
+		t.Errorf("decrypted doesn't match plaintext: %v", plaintext)
+		return
+	}
+
+	// Both ends use the same context for their replies
+	ciphertext, err = receiver.Encrypt([]byte("hi"), nil)
+	if err != nil {
+		t.Errorf("couldn't encrypt reply: %v", err)
+		return
+	}
+	_, err = sender.decryptIn("other-context", ciphertext, nil)
+	if err == nil {
+		t.Error("decrypting a reply in another context succeeded")
+		return
+	}
+	_, err = sender.Decrypt(ciphertext, nil)
+	if err != nil {
+		t.Errorf("couldn't decrypt reply: %v", err)
+		return
+	}
+}
+
+func TestRatchetCapsSkippedKeys(t *testing.T) {
+	alice, bob := newTestRatchets(t)
+	additional := []byte("additional")
+	var first []byte
+	// Each round skips MaxSkip / 2 of alice's messages, before a reply makes her switch keys.
+	for round := 0; round < 2*MaxSkippedKeys/MaxSkip+1; round++ {
+		var last []byte
+		for i := 0; i <= MaxSkip/2; i++ {
+			ciphertext, err := alice.Encrypt([]byte{byte(i)}, additional)
+			if err != nil {
+				t.Errorf("couldn't encrypt message: %v", err)
+				return
+			}
+			if first == nil {
+				first = ciphertext
+			}
+			last = ciphertext
+		}
+		_, err := bob.Decrypt(last, additional)
+		if err != nil {
+			t.Errorf("couldn't decrypt message: %v", err)
+			return
+		}
+		reply, err := bob.Encrypt(nil, additional)
+		if err != nil {
+			t.Errorf("couldn't encrypt reply: %v", err)
+			return
+		}
+		_, err = alice.Decrypt(reply, additional)
+		if err != nil {
+			t.Errorf("couldn't decrypt reply: %v", err)
+			return
+		}
+	}
+	if len(bob.skipped) > MaxSkippedKeys || len(bob.skippedOrder) > MaxSkippedKeys {
+		t.Errorf("too many skipped keys: %d", len(bob.skipped))
+		return
+	}
+	_, err := bob.Decrypt(first, additional)
+	if err == nil {
+		t.Error("decrypting the oldest skipped message succeeded")
+		return
+	}
+}
+
+func TestRatchetWipesReplacedKeys(t *testing.T) {
 	secret := SharedSecret(make([]byte, SharedSecretSize))
 	_, err := rand.Read(secret)
 	if err != nil {
@@ -68,32 +352,93 @@ func TestRatchetEncryption(t *testing.T) {
 		t.Errorf("couldn't generate receiver key pair: %v", err)
 		return
 	}
-	senderRatchet, err := DoubleRatchetFromInitiator(secret, receiverPub)
+	sender, err := DoubleRatchetFromInitiator(secret, receiverPub)
 	if err != nil {
 		t.Errorf("couldn't generate sender ratchet: %v", err)
 		return
 	}
-	receiverRatchet := DoubleRatchetFromReceiver(secret, receiverPub, receiverPriv)
-	for i := byte(0); i < 100; i++ {
-		plaintext := []byte{i, i}
-		additional := []byte{i}
-		sender, receiver := senderRatchet, receiverRatchet
-		if i&0b11 >= 2 {
-			sender, receiver = receiver, sender
-		}
-		ciphertext, err := sender.Encrypt(plaintext, additional)
+	receiver := DoubleRatchetFromReceiver(secret, receiverPub, receiverPriv)
+	oldSendingKey := sender.sendingKey
+	ciphertext, err := sender.Encrypt(nil, nil)
+	if err != nil {
+		t.Errorf("couldn't encrypt message: %v", err)
+		return
+	}
+	if !isZero(oldSendingKey) {
+		t.Error("old sending key wasn't wiped")
+		return
+	}
+	oldRootKey := receiver.rootKey
+	oldSendingPriv := receiver.sendingPriv
+	_, err = receiver.Decrypt(ciphertext, nil)
+	if err != nil {
+		t.Errorf("couldn't decrypt message: %v", err)
+		return
+	}
+	if !isZero(oldRootKey) || !isZero(oldSendingPriv) {
+		t.Error("old root key or private key wasn't wiped")
+		return
+	}
+	if isZero(receiverPriv) {
+		t.Error("ratchet wiped the caller's private key")
+		return
+	}
+}
+
+func TestRatchetMarshalRoundtrip(t *testing.T) {
+	sender, receiver := newTestRatchets(t)
+	additional := []byte("additional")
+	ciphertexts := make([][]byte, 3)
+	for i := range ciphertexts {
+		var err error
+		ciphertexts[i], err = sender.Encrypt([]byte{byte(i)}, additional)
 		if err != nil {
 			t.Errorf("couldn't encrypt message: %v", err)
 			return
 		}
-		actual, err := receiver.Decrypt(ciphertext, additional)
+	}
+	// Skipping over the first message leaves a key to save along with the rest of the state
+	_, err := receiver.Decrypt(ciphertexts[1], additional)
+	if err != nil {
+		t.Errorf("couldn't decrypt message: %v", err)
+		return
+	}
+	data, err := receiver.MarshalBinary()
+	if err != nil {
+		t.Errorf("couldn't marshal ratchet: %v", err)
+		return
+	}
+	var restored DoubleRatchet
+	err = restored.UnmarshalBinary(data)
+	if err != nil {
+		t.Errorf("couldn't unmarshal ratchet: %v", err)
+		return
+	}
+	for _, i := range []int{0, 2} {
+		actual, err := restored.Decrypt(ciphertexts[i], additional)
 		if err != nil {
-			t.Errorf("couldn't decrypt message: %v", err)
+			t.Errorf("couldn't decrypt message %d after restoring: %v", i, err)
 			return
 		}
-		if !bytes.Equal(actual, plaintext) {
-			t.Errorf("decrypted doesn't match plaintext: %v %v", actual, plaintext)
+		if !bytes.Equal(actual, []byte{byte(i)}) {
+			t.Errorf("decrypted doesn't match plaintext: %v %v", actual, []byte{byte(i)})
 			return
 		}
 	}
+	reply, err := restored.Encrypt([]byte("reply"), additional)
+	if err != nil {
+		t.Errorf("couldn't encrypt reply: %v", err)
+		return
+	}
+	actual, err := sender.Decrypt(reply, additional)
+	if err != nil || !bytes.Equal(actual, []byte("reply")) {
+		t.Errorf("couldn't decrypt reply: %v %v", actual, err)
+		return
+	}
+
+	err = restored.UnmarshalBinary(data[:len(data)-1])
+	if err == nil {
+		t.Errorf("unmarshalling truncated state succeeded")
+		return
+	}
 }
@@ -0,0 +1,43 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"strings"
+)
+
+// safetyNumberGroups is the number of 5 digit groups in a safety number
+const safetyNumberGroups = 12
+
+// safetyNumberGroupBytes is the number of bytes of the hash used for each group
+const safetyNumberGroupBytes = 5
+
+var safetyNumberInfo = []byte("Nuntius Safety Number 2021-06-27")
+
+// SafetyNumber derives a human-verifiable fingerprint for a pair of identities.
+//
+// This is a 60 digit decimal number, split into groups of 5 digits. The number
+// doesn't depend on the order of the identities, so both parties will see the
+// same number, and can compare it out of band, to check that they have the right keys.
+func SafetyNumber(a, b IdentityPub) string {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	hash := sha512.New()
+	hash.Write(safetyNumberInfo)
+	hash.Write(a)
+	hash.Write(b)
+	digest := hash.Sum(nil)
+
+	groups := make([]string, safetyNumberGroups)
+	for i := range groups {
+		chunk := digest[i*safetyNumberGroupBytes : (i+1)*safetyNumberGroupBytes]
+		var value uint64
+		for _, b := range chunk {
+			value = (value << 8) | uint64(b)
+		}
+		groups[i] = fmt.Sprintf("%05d", value%100000)
+	}
+	return strings.Join(groups, " ")
+}
@@ -0,0 +1,50 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSafetyNumberSymmetric(t *testing.T) {
+	a, _, err := GenerateIdentity()
+	if err != nil {
+		t.Error(err)
+	}
+	b, _, err := GenerateIdentity()
+	if err != nil {
+		t.Error(err)
+	}
+	ab := SafetyNumber(a, b)
+	ba := SafetyNumber(b, a)
+	if ab != ba {
+		t.Error("safety number wasn't symmetric:", ab, ba)
+	}
+	digits := strings.ReplaceAll(ab, " ", "")
+	if len(digits) != 60 {
+		t.Error("safety number doesn't have 60 digits:", ab)
+	}
+}
+
+func TestSafetyNumberChangesWithKeys(t *testing.T) {
+	a, _, err := GenerateIdentity()
+	if err != nil {
+		t.Error(err)
+	}
+	b, _, err := GenerateIdentity()
+	if err != nil {
+		t.Error(err)
+	}
+	original := SafetyNumber(a, b)
+
+	flippedA := append(IdentityPub(nil), a...)
+	flippedA[0] ^= 1
+	if SafetyNumber(flippedA, b) == original {
+		t.Error("flipping a bit of the first key didn't change the safety number")
+	}
+
+	flippedB := append(IdentityPub(nil), b...)
+	flippedB[IdentityPubSize-1] ^= 0x80
+	if SafetyNumber(a, flippedB) == original {
+		t.Error("flipping a bit of the second key didn't change the safety number")
+	}
+}
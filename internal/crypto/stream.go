@@ -0,0 +1,176 @@
+package crypto
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// StreamChunkSize is the number of bytes of plaintext in each chunk of an encrypted stream
+//
+// Every chunk but the last one has exactly this size. The last chunk is shorter, and
+// can be empty, so that the end of the stream can't be cut off without being noticed.
+const StreamChunkSize = 64 << 10
+
+// ErrStreamTruncated is returned when an encrypted stream ends before its last chunk
+var ErrStreamTruncated = errors.New("encrypted stream was truncated")
+
+// chunkAdditional binds a chunk to its position in the stream, and to whether or not it's the last one
+func chunkAdditional(additional []byte, counter uint64, last bool) []byte {
+	out := make([]byte, len(additional)+9)
+	copy(out, additional)
+	binary.BigEndian.PutUint64(out[len(additional):], counter)
+	if last {
+		out[len(out)-1] = 1
+	}
+	return out
+}
+
+type encryptWriter struct {
+	w          io.Writer
+	aead       cipher.AEAD
+	additional []byte
+	counter    uint64
+	buf        []byte
+	closed     bool
+}
+
+// NewEncryptWriter encrypts everything written to it, in chunks, writing the result to w
+//
+// The stream starts with the suite, followed by each chunk, as a nonce and the sealed chunk.
+// The additional data of each chunk includes its position, so chunks can't be reordered.
+// Close must be called to write the last chunk, but doesn't close w.
+func NewEncryptWriter(key MessageKey, additional []byte, w io.Writer) (io.WriteCloser, error) {
+	aead, err := newAEAD(DefaultSuite, key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write([]byte{byte(DefaultSuite)})
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, additional: additional}, nil
+}
+
+func (e *encryptWriter) writeChunk(plaintext []byte, last bool) error {
+	nonce := make([]byte, e.aead.NonceSize(), e.aead.NonceSize()+len(plaintext)+e.aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	out := e.aead.Seal(nonce, nonce, plaintext, chunkAdditional(e.additional, e.counter, last))
+	e.counter++
+	_, err = e.w.Write(out)
+	return err
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed encrypted stream")
+	}
+	e.buf = append(e.buf, p...)
+	// A full chunk is only written once more data arrives, since the last chunk needs to be shorter
+	for len(e.buf) > StreamChunkSize {
+		err := e.writeChunk(e.buf[:StreamChunkSize], false)
+		if err != nil {
+			return 0, err
+		}
+		e.buf = e.buf[StreamChunkSize:]
+	}
+	return len(p), nil
+}
+
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	if len(e.buf) == StreamChunkSize {
+		err := e.writeChunk(e.buf, false)
+		if err != nil {
+			return err
+		}
+		e.buf = nil
+	}
+	return e.writeChunk(e.buf, true)
+}
+
+type decryptReader struct {
+	r          *bufio.Reader
+	aead       cipher.AEAD
+	additional []byte
+	counter    uint64
+	buf        []byte
+	done       bool
+	err        error
+}
+
+// NewDecryptReader decrypts a stream written through NewEncryptWriter, checking the additional data
+//
+// Reads fail if a chunk was tampered with, reordered, or if the stream was cut off,
+// in which case ErrStreamTruncated is returned. The suite is taken from the stream itself.
+func NewDecryptReader(key MessageKey, additional []byte, r io.Reader) (io.Reader, error) {
+	reader := bufio.NewReader(r)
+	suite, err := reader.ReadByte()
+	if err == io.EOF {
+		return nil, ErrStreamTruncated
+	}
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(AEADSuite(suite), key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: reader, aead: aead, additional: additional}, nil
+}
+
+// readChunk decrypts the next chunk into the buffer
+func (d *decryptReader) readChunk() error {
+	nonceSize := d.aead.NonceSize()
+	frame := make([]byte, nonceSize+StreamChunkSize+d.aead.Overhead())
+	n, err := io.ReadFull(d.r, frame)
+	// Only the last chunk is shorter than the others
+	last := err == io.ErrUnexpectedEOF || err == io.EOF
+	if last {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if n < nonceSize+d.aead.Overhead() {
+		return ErrStreamTruncated
+	}
+	frame = frame[:n]
+	plaintext, err := d.aead.Open(nil, frame[:nonceSize], frame[nonceSize:], chunkAdditional(d.additional, d.counter, last))
+	if err != nil {
+		// A short chunk which doesn't decrypt was most likely cut off partway through
+		if last {
+			return ErrStreamTruncated
+		}
+		return fmt.Errorf("couldn't decrypt chunk %d: %w", d.counter, err)
+	}
+	d.counter++
+	d.buf = plaintext
+	d.done = last
+	return nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.readChunk()
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,126 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+func newStreamTestKey(t *testing.T) MessageKey {
+	key := MessageKey(make([]byte, MessageKeySize))
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %v", err)
+	}
+	return key
+}
+
+// encryptStream encrypts plaintext with a stream, writing it in pieces of a given size
+func encryptStream(t *testing.T, key MessageKey, additional []byte, plaintext []byte, piece int) []byte {
+	var out bytes.Buffer
+	w, err := NewEncryptWriter(key, additional, &out)
+	if err != nil {
+		t.Fatalf("couldn't create stream: %v", err)
+	}
+	for len(plaintext) > 0 {
+		n := piece
+		if n > len(plaintext) {
+			n = len(plaintext)
+		}
+		_, err = w.Write(plaintext[:n])
+		if err != nil {
+			t.Fatalf("couldn't write to stream: %v", err)
+		}
+		plaintext = plaintext[n:]
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("couldn't close stream: %v", err)
+	}
+	return out.Bytes()
+}
+
+func TestStreamRoundtrip(t *testing.T) {
+	key := newStreamTestKey(t)
+	additional := []byte("Additional")
+	// Exact multiples of the chunk size end with an empty chunk, and the others with a ragged one
+	for _, size := range []int{0, 1, StreamChunkSize, 2 * StreamChunkSize, 2*StreamChunkSize + 1234} {
+		plaintext := make([]byte, size)
+		_, err := rand.Read(plaintext)
+		if err != nil {
+			t.Errorf("couldn't generate plaintext: %v", err)
+			return
+		}
+		for _, piece := range []int{1000, StreamChunkSize, 3 * StreamChunkSize} {
+			ciphertext := encryptStream(t, key, additional, plaintext, piece)
+			r, err := NewDecryptReader(key, additional, bytes.NewReader(ciphertext))
+			if err != nil {
+				t.Errorf("couldn't create stream: %v", err)
+				return
+			}
+			plaintextAgain, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Errorf("%d bytes: couldn't decrypt stream: %v", size, err)
+				return
+			}
+			if !bytes.Equal(plaintext, plaintextAgain) {
+				t.Errorf("%d bytes: decryption returned a different result", size)
+				return
+			}
+		}
+	}
+}
+
+func TestStreamDetectsTruncation(t *testing.T) {
+	key := newStreamTestKey(t)
+	additional := []byte("Additional")
+	plaintext := make([]byte, 2*StreamChunkSize+1234)
+	ciphertext := encryptStream(t, key, additional, plaintext, len(plaintext))
+	frame := 12 + StreamChunkSize + 16
+	// Cutting the stream after a chunk, or inside of one, must both be noticed
+	for _, length := range []int{1, 1 + frame, 1 + 2*frame, 1 + frame + 100, len(ciphertext) - 1} {
+		r, err := NewDecryptReader(key, additional, bytes.NewReader(ciphertext[:length]))
+		if err != nil {
+			t.Errorf("couldn't create stream: %v", err)
+			return
+		}
+		_, err = ioutil.ReadAll(r)
+		if err != ErrStreamTruncated {
+			t.Errorf("cut at %d: expected ErrStreamTruncated, found %v", length, err)
+			return
+		}
+	}
+}
+
+func TestStreamDetectsReordering(t *testing.T) {
+	key := newStreamTestKey(t)
+	additional := []byte("Additional")
+	plaintext := make([]byte, 3*StreamChunkSize)
+	ciphertext := encryptStream(t, key, additional, plaintext, len(plaintext))
+	frame := 12 + StreamChunkSize + 16
+	swapped := append([]byte{}, ciphertext[:1]...)
+	swapped = append(swapped, ciphertext[1+frame:1+2*frame]...)
+	swapped = append(swapped, ciphertext[1:1+frame]...)
+	swapped = append(swapped, ciphertext[1+2*frame:]...)
+	r, err := NewDecryptReader(key, additional, bytes.NewReader(swapped))
+	if err != nil {
+		t.Errorf("couldn't create stream: %v", err)
+		return
+	}
+	_, err = ioutil.ReadAll(r)
+	if err == nil {
+		t.Errorf("reordered chunks were accepted")
+		return
+	}
+	r, err = NewDecryptReader(key, []byte("Other"), bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Errorf("couldn't create stream: %v", err)
+		return
+	}
+	_, err = ioutil.ReadAll(r)
+	if err == nil {
+		t.Errorf("wrong additional data was accepted")
+		return
+	}
+}
@@ -0,0 +1,73 @@
+// Package migrate keeps the schema of a database up to date, by applying numbered migrations.
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+)
+
+// Step is a single migration, run inside of a transaction
+type Step func(*sql.Tx) error
+
+// versionName is the name of the row in the meta table holding the schema version
+const versionName = "schema_version"
+
+// Version returns the schema version of a database, which is 0 if no migrations have been applied
+func Version(db *sql.DB) (int, error) {
+	var value []byte
+	err := db.QueryRow("SELECT value FROM meta WHERE name = $1;", versionName).Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(value))
+}
+
+// Run applies the steps a database hasn't seen yet, in order
+//
+// The database needs a meta table, with a name and a value column, where the schema version
+// is stored as the number of steps applied so far. Each step is applied in its own transaction,
+// along with the new version, so a step that fails leaves the database as it was.
+func Run(db *sql.DB, steps []Step) error {
+	version, err := Version(db)
+	if err != nil {
+		return err
+	}
+	if version > len(steps) {
+		return fmt.Errorf("database has schema version %d, but only %d versions are known", version, len(steps))
+	}
+	for i := version; i < len(steps); i++ {
+		err = apply(db, steps[i], i+1)
+		if err != nil {
+			return fmt.Errorf("couldn't migrate to schema version %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// apply runs a single step, bringing the database to a new version
+func apply(db *sql.DB, step Step, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = step(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM meta WHERE name = $1;", versionName)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO meta (name, value) VALUES ($1, $2);", versionName, []byte(strconv.Itoa(version)))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,117 @@
+package migrate
+
+import (
+	"database/sql"
+	"errors"
+	"path"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func newTestDatabase(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", path.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("couldn't open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec("CREATE TABLE meta (name TEXT PRIMARY KEY NOT NULL, value BLOB NOT NULL);")
+	if err != nil {
+		t.Fatalf("couldn't create meta table: %v", err)
+	}
+	return db
+}
+
+func TestRunAppliesStepsOnce(t *testing.T) {
+	db := newTestDatabase(t)
+	applied := 0
+	steps := []Step{
+		func(tx *sql.Tx) error {
+			applied++
+			_, err := tx.Exec("CREATE TABLE thing (id INTEGER PRIMARY KEY, name TEXT NOT NULL);")
+			return err
+		},
+		func(tx *sql.Tx) error {
+			applied++
+			_, err := tx.Exec("ALTER TABLE thing ADD COLUMN color TEXT NOT NULL DEFAULT 'red';")
+			return err
+		},
+	}
+	for i := 0; i < 2; i++ {
+		err := Run(db, steps)
+		if err != nil {
+			t.Errorf("couldn't run migrations: %v", err)
+			return
+		}
+	}
+	if applied != 2 {
+		t.Errorf("expected 2 steps to be applied, found %d", applied)
+		return
+	}
+	version, err := Version(db)
+	if err != nil {
+		t.Errorf("couldn't get version: %v", err)
+		return
+	}
+	if version != 2 {
+		t.Errorf("expected version 2, found %d", version)
+		return
+	}
+	_, err = db.Exec("INSERT INTO thing (name, color) VALUES ('a', 'blue');")
+	if err != nil {
+		t.Errorf("migrated table is missing columns: %v", err)
+		return
+	}
+}
+
+func TestRunRollsBackFailedStep(t *testing.T) {
+	db := newTestDatabase(t)
+	steps := []Step{
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec("CREATE TABLE thing (id INTEGER PRIMARY KEY);")
+			return err
+		},
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec("CREATE TABLE other (id INTEGER PRIMARY KEY);")
+			if err != nil {
+				return err
+			}
+			return errors.New("step failed")
+		},
+	}
+	err := Run(db, steps)
+	if err == nil {
+		t.Errorf("expected the failing step to fail")
+		return
+	}
+	version, err := Version(db)
+	if err != nil {
+		t.Errorf("couldn't get version: %v", err)
+		return
+	}
+	if version != 1 {
+		t.Errorf("expected version 1, found %d", version)
+		return
+	}
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'other';").Scan(&count)
+	if err != nil || count != 0 {
+		t.Errorf("failed step wasn't rolled back: %d %v", count, err)
+		return
+	}
+}
+
+func TestRunRejectsNewerDatabase(t *testing.T) {
+	db := newTestDatabase(t)
+	step := func(tx *sql.Tx) error { return nil }
+	err := Run(db, []Step{step, step})
+	if err != nil {
+		t.Errorf("couldn't run migrations: %v", err)
+		return
+	}
+	err = Run(db, []Step{step})
+	if err == nil {
+		t.Errorf("expected an error for a database newer than the migrations")
+		return
+	}
+}
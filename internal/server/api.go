@@ -5,29 +5,120 @@ import (
 	"fmt"
 )
 
+// ProtocolVersion is the version of the protocol clients use to upload their keys
+//
+// Version 2 started signing prekeys and bundles with a context, so that these signatures
+// can't be confused with each other. Signatures from older clients don't verify anymore.
+// Version 3 started signing prekey uploads with a counter, so that they can't be replayed.
+const ProtocolVersion = 3
+
+// checkVersion rejects requests from clients using an older protocol
+func checkVersion(version int) error {
+	if version < ProtocolVersion {
+		return fmt.Errorf("protocol version %d is too old, clients need to upgrade to version %d", version, ProtocolVersion)
+	}
+	return nil
+}
+
 type PrekeyRequest struct {
+	// KeyID is chosen by the client, to find the right prekey when a session is started
+	KeyID  uint32 `json:"key_id"`
 	Prekey []byte `json:"prekey"`
 	Sig    []byte `json:"sig"`
+	// Counter needs to increase with every upload, and is covered by UploadSig, along with the key
+	Counter   uint64 `json:"counter"`
+	UploadSig []byte `json:"upload_sig"`
+	// Version is the ProtocolVersion of the client, which older clients leave out
+	Version int `json:"version"`
 }
 
 type CountOnetimeResponse struct {
 	Count int `json:"count"`
+	// Max is the most onetime keys the server stores for an identity, which older servers leave out
+	Max int `json:"max"`
+}
+
+// PresenceResponse tells whether an identity is currently connected to the server
+type PresenceResponse struct {
+	Online bool `json:"online"`
 }
 
 type SendBundleRequest struct {
 	Bundle []byte `json:"bundle"`
 	Sig    []byte `json:"sig"`
+	// Version is the ProtocolVersion of the client, which older clients leave out
+	Version int `json:"version"`
 }
 
 type SessionResponse struct {
+	KeyID   uint32 `json:"key_id"`
 	Prekey  []byte `json:"prekey"`
 	Sig     []byte `json:"sig"`
 	OneTime []byte `json:"onetime,omitempty"`
+	// OneTimes holds the onetime keys handed out when asking for several of them, instead of OneTime
+	OneTimes [][]byte `json:"onetimes,omitempty"`
+}
+
+// MaxSessionOnetimes is the largest number of onetime keys a single session request can ask for
+const MaxSessionOnetimes = 16
+
+// PublishNameRequest publishes a name for an identity, on servers with a directory
+type PublishNameRequest struct {
+	Name string `json:"name"`
+	// Counter needs to increase with every name published, and is covered by Sig, along with the name
+	Counter uint64 `json:"counter"`
+	Sig     []byte `json:"sig"`
 }
 
+// LookupResponse is the identity which published a name, along with what it signed
+//
+// Clients need to check the signature themselves, instead of trusting the server.
+type LookupResponse struct {
+	Identity []byte `json:"identity"`
+	Counter  uint64 `json:"counter"`
+	Sig      []byte `json:"sig"`
+}
+
+// MaxNameLength is the longest name an identity can publish, in bytes
+const MaxNameLength = 64
+
+// AuthChallenge is sent by the server as soon as a client connects over a websocket
+//
+// The client needs to sign this nonce, to prove that they own the identity they're
+// connecting as.
+type AuthChallenge struct {
+	Nonce []byte `json:"nonce"`
+}
+
+// AuthResponse is sent by the client in response to an AuthChallenge
+type AuthResponse struct {
+	Sig []byte `json:"sig"`
+}
+
+var authContext = []byte("Nuntius Websocket Auth 2021-06-27")
+
+// AuthData returns the data that should be signed in response to an authentication challenge.
+//
+// We include a fixed context, so that a server can't trick clients into signing
+// other kinds of data, like prekeys.
+func AuthData(nonce []byte) []byte {
+	out := make([]byte, 0, len(authContext)+len(nonce))
+	out = append(out, authContext...)
+	out = append(out, nonce...)
+	return out
+}
+
+// MessageVersion is the version of the messages clients send over a websocket
+//
+// This changes whenever the meaning of payloads does, and the server closes the connection of
+// clients sending messages with any other version, instead of relaying messages they'd misread.
+const MessageVersion = 1
+
 type Message struct {
-	From    []byte  `json:"from,omitempty"`
-	To      []byte  `json:"to"`
+	From []byte `json:"from,omitempty"`
+	To   []byte `json:"to"`
+	// Version is the MessageVersion of the sender, which older clients leave out
+	Version int     `json:"version,omitempty"`
 	Payload Payload `json:"payload"`
 }
 
@@ -40,7 +131,9 @@ func (payload Payload) MarshalJSON() ([]byte, error) {
 }
 
 type MessagePayload struct {
-	Data []byte `json:"data"`
+	// MessageID is chosen at random by the sender, and acknowledged by the recipient
+	MessageID []byte `json:"message_id,omitempty"`
+	Data      []byte `json:"data"`
 }
 
 func (payload *MessagePayload) MarshalJSON() ([]byte, error) {
@@ -54,6 +147,99 @@ func (payload *MessagePayload) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// FilePayload carries a file, whose data is encrypted
+//
+// The name and mime type aren't encrypted, but are authenticated with the data.
+type FilePayload struct {
+	Name     string `json:"name"`
+	MimeType string `json:"mime_type"`
+	Data     []byte `json:"data"`
+}
+
+func (payload *FilePayload) MarshalJSON() ([]byte, error) {
+	type Alias FilePayload
+	return json.Marshal(&struct {
+		Type string `json:"type"`
+		*Alias
+	}{
+		Type:  "file",
+		Alias: (*Alias)(payload),
+	})
+}
+
+// GroupMessagePayload is a message sent to a group, encrypted for one of its members
+type GroupMessagePayload struct {
+	GroupID []byte `json:"group_id"`
+	Data    []byte `json:"data"`
+}
+
+func (payload *GroupMessagePayload) MarshalJSON() ([]byte, error) {
+	type Alias GroupMessagePayload
+	return json.Marshal(&struct {
+		Type string `json:"type"`
+		*Alias
+	}{
+		Type:  "group_message",
+		Alias: (*Alias)(payload),
+	})
+}
+
+// TypingPayload lets a friend know that we've started typing
+//
+// Data authenticates this payload, using the session's ratchet.
+type TypingPayload struct {
+	Data []byte `json:"data"`
+}
+
+func (payload *TypingPayload) MarshalJSON() ([]byte, error) {
+	type Alias TypingPayload
+	return json.Marshal(&struct {
+		Type string `json:"type"`
+		*Alias
+	}{
+		Type:  "typing",
+		Alias: (*Alias)(payload),
+	})
+}
+
+// ReceiptPayload lets a friend know that we've read one of their messages
+//
+// Data authenticates this payload, using the session's ratchet.
+type ReceiptPayload struct {
+	MessageID []byte `json:"message_id"`
+	Data      []byte `json:"data"`
+}
+
+func (payload *ReceiptPayload) MarshalJSON() ([]byte, error) {
+	type Alias ReceiptPayload
+	return json.Marshal(&struct {
+		Type string `json:"type"`
+		*Alias
+	}{
+		Type:  "receipt",
+		Alias: (*Alias)(payload),
+	})
+}
+
+// AckPayload lets a friend know that we've received and decrypted one of their messages
+//
+// Data authenticates this payload, using the session's ratchet.
+type AckPayload struct {
+	MessageID []byte `json:"message_id"`
+	Data      []byte `json:"data"`
+}
+
+func (payload *AckPayload) MarshalJSON() ([]byte, error) {
+	type Alias AckPayload
+	return json.Marshal(&struct {
+		Type string `json:"type"`
+		*Alias
+	}{
+		Type:  "ack",
+		Alias: (*Alias)(payload),
+	})
+}
+
 type QueryExchangePayload struct{}
 
 func (payload *QueryExchangePayload) MarshalJSON() ([]byte, error) {
@@ -68,6 +254,7 @@ func (payload *QueryExchangePayload) MarshalJSON() ([]byte, error) {
 }
 
 type StartExchangePayload struct {
+	KeyID   uint32 `json:"key_id"`
 	Prekey  []byte `json:"prekey"`
 	Sig     []byte `json:"sig"`
 	OneTime []byte `json:"onetime,omitempty"`
@@ -85,6 +272,8 @@ func (payload *StartExchangePayload) MarshalJSON() ([]byte, error) {
 }
 
 type EndExchangePayload struct {
+	// PrekeyID identifies which of the recipient's prekeys was used
+	PrekeyID    uint32 `json:"prekey_id"`
 	Prekey      []byte `json:"prekey"`
 	OneTime     []byte `json:"onetime,omitempty"`
 	Ephemeral   []byte `json:"ephemeral"`
@@ -112,6 +301,16 @@ func (payload *Payload) UnmarshalJSON(data []byte) error {
 	switch typ.Type {
 	case "message":
 		payload.Variant = new(MessagePayload)
+	case "file":
+		payload.Variant = new(FilePayload)
+	case "group_message":
+		payload.Variant = new(GroupMessagePayload)
+	case "typing":
+		payload.Variant = new(TypingPayload)
+	case "receipt":
+		payload.Variant = new(ReceiptPayload)
+	case "ack":
+		payload.Variant = new(AckPayload)
 	case "query_exchange":
 		payload.Variant = new(QueryExchangePayload)
 	case "start_exchange":
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// LogLevel is the least severe kind of event the server logs
+type LogLevel int
+
+const (
+	// LogDebug logs everything, including requests, connections, and relayed messages
+	LogDebug LogLevel = -1
+	// LogInfo logs the events worth knowing about when running a server, and is the default
+	LogInfo LogLevel = 0
+	// LogError only logs errors
+	LogError LogLevel = 1
+)
+
+func (level LogLevel) String() string {
+	switch level {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(level))
+	}
+}
+
+// ParseLogLevel parses the name of a level, as used in the --log-level flag
+func ParseLogLevel(s string) (LogLevel, error) {
+	for _, level := range []LogLevel{LogDebug, LogInfo, LogError} {
+		if s == level.String() {
+			return level, nil
+		}
+	}
+	return LogInfo, fmt.Errorf("unknown log level: %q", s)
+}
+
+// logger writes a line for each event at or above a level
+//
+// Each line has the level and a message, followed by key value pairs describing the event.
+type logger struct {
+	level LogLevel
+	out   *log.Logger
+}
+
+func newLogger(w io.Writer, level LogLevel) *logger {
+	return &logger{level, log.New(w, "", log.LstdFlags)}
+}
+
+// formatLogValue writes a value, quoting it if it would be ambiguous otherwise
+func formatLogValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \"=\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func (l *logger) log(level LogLevel, msg string, keyvals ...interface{}) {
+	if level < l.level {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "level=%s msg=%s", level, formatLogValue(msg))
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fmt.Fprintf(&b, " %v=%s", keyvals[i], formatLogValue(keyvals[i+1]))
+	}
+	l.out.Println(b.String())
+}
+
+func (l *logger) debug(msg string, keyvals ...interface{}) {
+	l.log(LogDebug, msg, keyvals...)
+}
+
+func (l *logger) info(msg string, keyvals ...interface{}) {
+	l.log(LogInfo, msg, keyvals...)
+}
+
+func (l *logger) error(msg string, keyvals ...interface{}) {
+	l.log(LogError, msg, keyvals...)
+}
+
+// requestIDKey is the context key holding the id of a request
+type requestIDKey struct{}
+
+// requestIDSize is the number of random bytes in a request id
+const requestIDSize = 8
+
+// requestID returns the id the middleware gave a request, or "-" if it has none
+func requestID(ctx context.Context) string {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	if !ok {
+		return "-"
+	}
+	return id
+}
+
+// middleware gives each request a random id, which is logged alongside everything the request does
+//
+// The id is also sent back in the X-Request-ID header, to match up a client's problems with the logs.
+// Websocket connections keep the id of the request that opened them.
+func (l *logger) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := make([]byte, requestIDSize)
+		_, err := rand.Read(data)
+		if err != nil {
+			l.error("couldn't generate request id", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		id := hex.EncodeToString(data)
+		w.Header().Set("X-Request-ID", id)
+		l.debug("handling request", "request", id, "method", r.Method, "path", r.URL.Path)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
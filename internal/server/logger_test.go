@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// syncBuffer is a buffer that several goroutines can log to at once
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for _, level := range []LogLevel{LogDebug, LogInfo, LogError} {
+		parsed, err := ParseLogLevel(level.String())
+		if err != nil {
+			t.Errorf("couldn't parse %s: %v", level, err)
+			return
+		}
+		if parsed != level {
+			t.Errorf("%s != %s", parsed, level)
+			return
+		}
+	}
+	_, err := ParseLogLevel("verbose")
+	if err == nil {
+		t.Errorf("expected unknown level to fail")
+		return
+	}
+}
+
+func TestLoggerFiltersLevels(t *testing.T) {
+	var buf bytes.Buffer
+	log := newLogger(&buf, LogInfo)
+	log.debug("hidden")
+	log.info("shown", "key", "some value")
+	log.error("failed", "err", errors.New("bad"))
+	out := buf.String()
+	if strings.Contains(out, "hidden") {
+		t.Errorf("debug line was logged: %q", out)
+		return
+	}
+	if !strings.Contains(out, `level=info msg=shown key="some value"`) {
+		t.Errorf("info line is missing: %q", out)
+		return
+	}
+	if !strings.Contains(out, "level=error msg=failed err=bad") {
+		t.Errorf("error line is missing: %q", out)
+		return
+	}
+}
+
+func TestRelayIsLogged(t *testing.T) {
+	router, srv := newTestRouter(t)
+	var logs syncBuffer
+	router.server.log = newLogger(&logs, LogDebug)
+	alice, alicePriv := newTestIdentity(t)
+	bob, bobPriv := newTestIdentity(t)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/rtc/" + base64.URLEncoding.EncodeToString(alice)
+	aliceConn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Errorf("couldn't dial router: %v", err)
+		return
+	}
+	defer aliceConn.Close()
+	connID := resp.Header.Get("X-Request-ID")
+	if connID == "" {
+		t.Errorf("connection has no request id")
+		return
+	}
+	var challenge AuthChallenge
+	err = aliceConn.ReadJSON(&challenge)
+	if err != nil {
+		t.Errorf("couldn't read challenge: %v", err)
+		return
+	}
+	err = aliceConn.WriteJSON(AuthResponse{Sig: alicePriv.Sign(AuthData(challenge.Nonce))})
+	if err != nil {
+		t.Errorf("couldn't respond to challenge: %v", err)
+		return
+	}
+	bobConn := dialTestRouter(t, srv.URL, bob, bobPriv)
+	defer bobConn.Close()
+	if !waitFor(func() bool { return router.online(alice) && router.online(bob) }) {
+		t.Errorf("clients never connected")
+		return
+	}
+
+	err = aliceConn.WriteJSON(Message{To: bob, Version: MessageVersion, Payload: Payload{Variant: &MessagePayload{Data: []byte{1}}}})
+	if err != nil {
+		t.Errorf("couldn't send message: %v", err)
+		return
+	}
+	bobConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var message Message
+	err = bobConn.ReadJSON(&message)
+	if err != nil {
+		t.Errorf("couldn't receive message: %v", err)
+		return
+	}
+	expected := `level=debug msg="relayed message" conn=` + connID
+	if !waitFor(func() bool { return strings.Contains(logs.String(), expected) }) {
+		t.Errorf("relay wasn't logged with the connection id %s: %q", connID, logs.String())
+		return
+	}
+}
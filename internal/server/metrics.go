@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the statistics a server exposes to operators
+//
+// Each server has its own registry, rather than using the global one.
+type metrics struct {
+	registry *prometheus.Registry
+	// connections is the number of clients currently connected over websockets
+	connections prometheus.Gauge
+	// relayed counts the messages forwarded to a connected client
+	relayed prometheus.Counter
+	// queued counts the messages saved for a client that wasn't connected
+	queued prometheus.Counter
+	// expired counts the queued messages removed because their recipient didn't connect in time
+	expired prometheus.Counter
+	// onetimesServed counts the onetime keys handed out for sessions
+	onetimesServed prometheus.Counter
+	// onetimesUploaded counts the onetime keys clients have sent us
+	onetimesUploaded prometheus.Counter
+	// prekeyUploads counts the prekeys clients have registered
+	prekeyUploads prometheus.Counter
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "nuntius_active_connections",
+			Help: "Number of clients currently connected.",
+		}),
+		relayed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "nuntius_messages_relayed_total",
+			Help: "Number of messages forwarded to connected clients.",
+		}),
+		queued: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "nuntius_messages_queued_total",
+			Help: "Number of messages queued for offline clients.",
+		}),
+		expired: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "nuntius_messages_expired_total",
+			Help: "Number of queued messages purged after expiring.",
+		}),
+		onetimesServed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "nuntius_onetime_keys_served_total",
+			Help: "Number of onetime keys handed out for sessions.",
+		}),
+		onetimesUploaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "nuntius_onetime_keys_uploaded_total",
+			Help: "Number of onetime keys uploaded by clients.",
+		}),
+		prekeyUploads: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "nuntius_prekey_uploads_total",
+			Help: "Number of prekeys registered by clients.",
+		}),
+	}
+	m.registry.MustRegister(m.connections, m.relayed, m.queued, m.expired, m.onetimesServed, m.onetimesUploaded, m.prekeyUploads)
+	return m
+}
+
+// handler serves the metrics in the Prometheus text format
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrapeMetrics fetches the metrics exposed by a server, in the Prometheus text format
+func scrapeMetrics(t *testing.T, root string) string {
+	resp, err := http.Get(root + "/metrics")
+	if err != nil {
+		t.Fatalf("couldn't scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status scraping metrics: %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("couldn't read metrics: %v", err)
+	}
+	return string(data)
+}
+
+func TestMetricsCountRelayedMessages(t *testing.T) {
+	router, srv := newTestRouter(t)
+	alice, alicePriv := newTestIdentity(t)
+	bob, bobPriv := newTestIdentity(t)
+
+	if !strings.Contains(scrapeMetrics(t, srv.URL), "nuntius_messages_relayed_total 0") {
+		t.Errorf("expected no relayed messages")
+		return
+	}
+
+	bobConn := dialTestRouter(t, srv.URL, bob, bobPriv)
+	defer bobConn.Close()
+	if !waitFor(func() bool { return router.online(bob) }) {
+		t.Errorf("bob never connected")
+		return
+	}
+	aliceConn := dialTestRouter(t, srv.URL, alice, alicePriv)
+	defer aliceConn.Close()
+	err := aliceConn.WriteJSON(Message{To: bob, Version: MessageVersion, Payload: Payload{Variant: &MessagePayload{Data: []byte{1}}}})
+	if err != nil {
+		t.Errorf("couldn't send message: %v", err)
+		return
+	}
+	bobConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var message Message
+	err = bobConn.ReadJSON(&message)
+	if err != nil {
+		t.Errorf("couldn't receive message: %v", err)
+		return
+	}
+
+	if !waitFor(func() bool { return strings.Contains(scrapeMetrics(t, srv.URL), "nuntius_messages_relayed_total 1") }) {
+		t.Errorf("relayed message wasn't counted")
+		return
+	}
+	if !strings.Contains(scrapeMetrics(t, srv.URL), "nuntius_active_connections 2") {
+		t.Errorf("expected 2 active connections")
+		return
+	}
+}
@@ -0,0 +1,151 @@
+//go:build postgres
+// +build postgres
+
+package server
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/cronokirby/nuntius/internal/crypto"
+	_ "github.com/lib/pq"
+)
+
+// These tests need a Postgres database, whose connection string is in NUNTIUS_TEST_POSTGRES.
+//
+// They're run with `go test -tags postgres ./internal/server`.
+
+func newPostgresServer(t *testing.T) *server {
+	dsn := os.Getenv("NUNTIUS_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("NUNTIUS_TEST_POSTGRES isn't set")
+	}
+	server, err := newServer(DriverPostgres, dsn)
+	if err != nil {
+		t.Fatalf("couldn't create server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func TestPostgresPrekeys(t *testing.T) {
+	server := newPostgresServer(t)
+	id, priv := newTestIdentity(t)
+	var prekeys []crypto.ExchangePub
+	for i := 0; i < 2; i++ {
+		prekey, _, err := crypto.GenerateExchange()
+		if err != nil {
+			t.Errorf("couldn't generate prekey: %v", err)
+			return
+		}
+		prekeys = append(prekeys, prekey)
+	}
+	for i, keyID := range []uint32{1, 2} {
+		err := server.savePrekey(id, keyID, prekeys[i], priv.SignPrekey(prekeys[i]), int64(keyID))
+		if err != nil {
+			t.Errorf("couldn't save prekey: %v", err)
+			return
+		}
+	}
+	// Replacing the first prekey makes it the newest
+	err := server.savePrekey(id, 1, prekeys[0], priv.SignPrekey(prekeys[0]), 3)
+	if err != nil {
+		t.Errorf("couldn't replace prekey: %v", err)
+		return
+	}
+	keyID, prekey, _, err := server.getPrekey(id)
+	if err != nil {
+		t.Errorf("couldn't get prekey: %v", err)
+		return
+	}
+	if keyID != 1 || !bytes.Equal(prekey, prekeys[0]) {
+		t.Errorf("unexpected prekey %d: %v", keyID, prekey)
+		return
+	}
+}
+
+func TestPostgresOnetimes(t *testing.T) {
+	server := newPostgresServer(t)
+	id, _ := newTestIdentity(t)
+	bundle, _, err := crypto.GenerateBundle(crypto.DefaultBundleSize)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	for i := 0; i < 2; i++ {
+		err = server.saveBundle(id, bundle)
+		if err != nil {
+			t.Errorf("couldn't save bundle: %v", err)
+			return
+		}
+	}
+	count, err := server.countOnetimes(id)
+	if err != nil {
+		t.Errorf("couldn't count onetime keys: %v", err)
+		return
+	}
+	if count != bundle.Len() {
+		t.Errorf("expected %d onetime keys, found %d", bundle.Len(), count)
+		return
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	seen := make(map[string]bool)
+	for i := 0; i < bundle.Len(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			onetime, err := server.getOnetime(id)
+			if err != nil {
+				t.Errorf("couldn't get onetime key: %v", err)
+				return
+			}
+			if onetime == nil {
+				t.Errorf("session fell back to the prekey, while onetime keys were left")
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if seen[string(onetime)] {
+				t.Errorf("onetime key handed out twice: %v", onetime)
+			}
+			seen[string(onetime)] = true
+		}()
+	}
+	wg.Wait()
+	if len(seen) != bundle.Len() {
+		t.Errorf("expected %d onetime keys handed out, found %d", bundle.Len(), len(seen))
+	}
+}
+
+func TestPostgresQueue(t *testing.T) {
+	server := newPostgresServer(t)
+	bob, _ := newTestIdentity(t)
+	err := server.queueMessage(bob, Message{To: bob, Payload: Payload{Variant: &MessagePayload{Data: []byte{1}}}})
+	if err != nil {
+		t.Errorf("couldn't queue message: %v", err)
+		return
+	}
+	queued, err := server.queuedMessages(bob)
+	if err != nil {
+		t.Errorf("couldn't get queued messages: %v", err)
+		return
+	}
+	if len(queued) != 1 {
+		t.Errorf("expected 1 queued message, found %d", len(queued))
+		return
+	}
+	err = server.deleteQueuedMessage(queued[0].id)
+	if err != nil {
+		t.Errorf("couldn't delete queued message: %v", err)
+		return
+	}
+	queued, err = server.queuedMessages(bob)
+	if err != nil || len(queued) != 0 {
+		t.Errorf("message wasn't deleted: %v %v", queued, err)
+		return
+	}
+}
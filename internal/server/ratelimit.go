@@ -0,0 +1,122 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DefaultRateLimit is the default number of requests per second a client can make to the key endpoints
+const DefaultRateLimit = 1
+
+// DefaultRateBurst is the default number of requests a client can make at once to the key endpoints
+const DefaultRateBurst = 20
+
+// maxIdleBuckets is the number of buckets we hold before forgetting the ones that have refilled
+const maxIdleBuckets = 10000
+
+// bucket holds the tokens left for a single client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the rate of requests made by each client, using token buckets
+//
+// Each bucket refills at a steady rate, up to the burst size, and every request takes a token.
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	// now returns the current time, and can be replaced in tests
+	now func() time.Time
+}
+
+func newRateLimiter(config Config) *rateLimiter {
+	rate := config.RateLimit
+	if rate <= 0 {
+		rate = DefaultRateLimit
+	}
+	burst := config.RateBurst
+	if burst <= 0 {
+		burst = DefaultRateBurst
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// refill adds the tokens a bucket has earned since it was last used
+func (limiter *rateLimiter) refill(b *bucket, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * limiter.rate
+	if b.tokens > limiter.burst {
+		b.tokens = limiter.burst
+	}
+	b.last = now
+}
+
+// allow takes a token from the bucket of every key, returning false if one of them is empty
+//
+// Tokens are only taken if every bucket has one left.
+func (limiter *rateLimiter) allow(keys ...string) bool {
+	limiter.Lock()
+	defer limiter.Unlock()
+	now := limiter.now()
+	if len(limiter.buckets) > maxIdleBuckets {
+		limiter.forgetIdle(now)
+	}
+	buckets := make([]*bucket, len(keys))
+	for i, key := range keys {
+		b, present := limiter.buckets[key]
+		if !present {
+			b = &bucket{tokens: limiter.burst, last: now}
+			limiter.buckets[key] = b
+		}
+		limiter.refill(b, now)
+		if b.tokens < 1 {
+			return false
+		}
+		buckets[i] = b
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true
+}
+
+// forgetIdle removes the buckets which have refilled, since they're the same as new ones
+func (limiter *rateLimiter) forgetIdle(now time.Time) {
+	for key, b := range limiter.buckets {
+		limiter.refill(b, now)
+		if b.tokens >= limiter.burst {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// middleware rejects requests with 429 once the identity in their path, or their address,
+// has made too many requests
+func (limiter *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		keys := []string{"ip:" + host}
+		if id, ok := mux.Vars(r)["id"]; ok {
+			keys = append(keys, "id:"+id)
+		}
+		if !limiter.allow(keys...) {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
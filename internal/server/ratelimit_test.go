@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefills(t *testing.T) {
+	limiter := newRateLimiter(Config{RateLimit: 2, RateBurst: 2})
+	current := time.Unix(0, 0)
+	limiter.now = func() time.Time { return current }
+
+	for i := 0; i < 2; i++ {
+		if !limiter.allow("alice") {
+			t.Errorf("request %d was limited within the burst", i)
+			return
+		}
+	}
+	if limiter.allow("alice") {
+		t.Errorf("request beyond the burst was allowed")
+		return
+	}
+	if !limiter.allow("bob") {
+		t.Errorf("bob was limited by alice's requests")
+		return
+	}
+	current = current.Add(500 * time.Millisecond)
+	if !limiter.allow("alice") {
+		t.Errorf("bucket didn't refill")
+		return
+	}
+	if limiter.allow("alice") {
+		t.Errorf("bucket refilled too quickly")
+		return
+	}
+}
+
+func TestSessionRateLimited(t *testing.T) {
+	server := newTestServer(t)
+	limiter := newRateLimiter(Config{RateLimit: 1, RateBurst: 3})
+	srv := httptest.NewServer(newMux(server, newRouter(server, Config{}), limiter))
+	defer srv.Close()
+
+	bob, _ := newTestIdentity(t)
+	idBase64 := base64.URLEncoding.EncodeToString(bob)
+	for i := 0; i < 10; i++ {
+		resp, err := http.Post(fmt.Sprintf("%s/session/%s", srv.URL, idBase64), "application/json", nil)
+		if err != nil {
+			t.Errorf("couldn't create session: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return
+		}
+	}
+	t.Errorf("repeated session requests were never limited")
+}
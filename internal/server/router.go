@@ -1,129 +1,507 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/cronokirby/nuntius/internal/crypto"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
 
-func forwardMessages(messages <-chan Message, conn *websocket.Conn) {
+// maxDecodeErrors is the number of consecutive malformed messages we tolerate on a connection
+const maxDecodeErrors = 10
+
+// connection represents a client connected to the router
+type connection struct {
+	// conn is the underlying websocket connection
+	conn *websocket.Conn
+	// format is the wire format this client wants messages in
+	format WireFormat
+	// messages is used to send messages to this client
+	messages chan Message
+	// done is closed once the client has disconnected
+	done chan struct{}
+	// id identifies this connection in the logs, and is the id of the request that opened it
+	id string
+}
+
+func newConnection(conn *websocket.Conn, format WireFormat, id string) *connection {
+	return &connection{conn: conn, format: format, messages: make(chan Message), done: make(chan struct{}), id: id}
+}
+
+// send forwards a message to this client, returning false if the client has disconnected
+func (c *connection) send(message Message) bool {
+	select {
+	case c.messages <- message:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func forwardMessages(log *logger, c *connection, conn *websocket.Conn) {
 	for {
-		message, open := <-messages
-		if !open {
+		select {
+		case message := <-c.messages:
+			messageType, data, err := EncodeMessage(c.format, message)
+			if err != nil {
+				log.error("couldn't encode message", "conn", c.id, "err", err)
+				continue
+			}
+			err = conn.WriteMessage(messageType, data)
+			if err != nil {
+				log.error("couldn't write message", "conn", c.id, "err", err)
+			}
+		case <-c.done:
 			return
 		}
-		err := conn.WriteJSON(message)
-		if err != nil {
-			log.Default().Println(err)
-		}
 	}
 }
 
 type router struct {
-	channels     map[string]chan Message
+	// channels holds the connections of each identity, which can have several devices connected at once
+	channels     map[string]map[*connection]struct{}
 	channelsLock sync.RWMutex
-	upgrader     websocket.Upgrader
-	server       *server
+	// closed is set once the router is shutting down, preventing new connections
+	closed bool
+	// active tracks the handlers currently running
+	active          sync.WaitGroup
+	upgrader        websocket.Upgrader
+	server          *server
+	maxMessageBytes int64
+	// open counts the websocket connections, including the ones still authenticating, overall and by identity
+	open                      int
+	openByIdentity            map[string]int
+	openLock                  sync.Mutex
+	maxConnections            int
+	maxConnectionsPerIdentity int
 }
 
-func newRouter(server *server) *router {
+// checkOrigin returns a check accepting websocket connections from the server's own origin, or an allowed one
+//
+// Requests without an Origin header don't come from browsers, like the ones our client makes, so they're accepted.
+func checkOrigin(config Config) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || config.AllowAllOrigins {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		if strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		for _, allowed := range config.AllowedOrigins {
+			if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func newRouter(server *server, config Config) *router {
 	var router router
-	router.channels = make(map[string]chan Message)
+	router.channels = make(map[string]map[*connection]struct{})
 	router.server = server
+	router.upgrader.CheckOrigin = checkOrigin(config)
+	router.upgrader.ReadBufferSize = config.ReadBufferSize
+	if router.upgrader.ReadBufferSize <= 0 {
+		router.upgrader.ReadBufferSize = DefaultBufferSize
+	}
+	router.upgrader.WriteBufferSize = config.WriteBufferSize
+	if router.upgrader.WriteBufferSize <= 0 {
+		router.upgrader.WriteBufferSize = DefaultBufferSize
+	}
+	router.maxMessageBytes = config.MaxMessageBytes
+	if router.maxMessageBytes <= 0 {
+		router.maxMessageBytes = DefaultMaxMessageBytes
+	}
+	router.openByIdentity = make(map[string]int)
+	router.maxConnections = config.MaxConnections
+	if router.maxConnections <= 0 {
+		router.maxConnections = DefaultMaxConnections
+	}
+	router.maxConnectionsPerIdentity = config.MaxConnectionsPerIdentity
+	if router.maxConnectionsPerIdentity <= 0 {
+		router.maxConnectionsPerIdentity = DefaultMaxConnectionsPerIdentity
+	}
 	return &router
 }
 
-func (router *router) setChannel(id crypto.IdentityPub, ch chan Message) {
+// reserve counts a new connection for an identity, returning false if that would go over a limit
+func (router *router) reserve(id crypto.IdentityPub) bool {
+	router.openLock.Lock()
+	defer router.openLock.Unlock()
+	if router.open >= router.maxConnections || router.openByIdentity[string(id)] >= router.maxConnectionsPerIdentity {
+		return false
+	}
+	router.open++
+	router.openByIdentity[string(id)]++
+	return true
+}
+
+// release stops counting a connection, once it's been closed
+func (router *router) release(id crypto.IdentityPub) {
+	router.openLock.Lock()
+	defer router.openLock.Unlock()
+	router.open--
+	router.openByIdentity[string(id)]--
+	if router.openByIdentity[string(id)] <= 0 {
+		delete(router.openByIdentity, string(id))
+	}
+}
+
+// addChannel registers a connection, returning false if the router has been closed
+//
+// The other connections of the same identity are kept, since they belong to other devices.
+func (router *router) addChannel(id crypto.IdentityPub, c *connection) bool {
 	router.channelsLock.Lock()
 	defer router.channelsLock.Unlock()
-	router.channels[string(id)] = ch
+	if router.closed {
+		return false
+	}
+	connections, present := router.channels[string(id)]
+	if !present {
+		connections = make(map[*connection]struct{})
+		router.channels[string(id)] = connections
+	}
+	connections[c] = struct{}{}
+	return true
 }
 
-func (router *router) getChannel(id crypto.IdentityPub) (chan Message, bool) {
+// getChannels returns the connections of an identity, one for each of its devices
+func (router *router) getChannels(id crypto.IdentityPub) []*connection {
 	router.channelsLock.RLock()
 	defer router.channelsLock.RUnlock()
-	ch, present := router.channels[string(id)]
-	return ch, present
+	connections := make([]*connection, 0, len(router.channels[string(id)]))
+	for c := range router.channels[string(id)] {
+		connections = append(connections, c)
+	}
+	return connections
 }
 
-func (router *router) removeChannel(id crypto.IdentityPub) {
+// online checks if an identity has at least one connection
+func (router *router) online(id crypto.IdentityPub) bool {
+	router.channelsLock.RLock()
+	defer router.channelsLock.RUnlock()
+	return len(router.channels[string(id)]) > 0
+}
+
+func (router *router) removeChannel(id crypto.IdentityPub, c *connection) {
 	router.channelsLock.Lock()
 	defer router.channelsLock.Unlock()
-	delete(router.channels, string(id))
+	connections := router.channels[string(id)]
+	delete(connections, c)
+	if len(connections) == 0 {
+		delete(router.channels, string(id))
+	}
 }
 
-func (router *router) listen(id crypto.IdentityPub, conn *websocket.Conn) error {
-	ch := make(chan Message)
-	router.setChannel(id, ch)
-	defer router.removeChannel(id)
-	go forwardMessages(ch, conn)
+// presenceHandler tells whether an identity currently has a connection to this server
+func (router *router) presenceHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := crypto.IdentityPubFromBase64(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PresenceResponse{router.online(id)})
+}
+
+// isClosed checks if an error from reading a connection means that it was closed
+func isClosed(err error) bool {
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+		return true
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// listen relays the messages sent by a client, until that client disconnects
+//
+// Messages are sent to the client using its wire format, but can be received in any format.
+//
+// The connection id is used to tell this connection apart in the logs.
+func (router *router) listen(id crypto.IdentityPub, conn *websocket.Conn, format WireFormat, connID string) error {
+	c := newConnection(conn, format, connID)
+	if !router.addChannel(id, c) {
+		return nil
+	}
+	log := router.server.log
+	metrics := router.server.metrics
+	metrics.connections.Inc()
+	log.debug("connection opened", "conn", c.id, "identity", id, "format", format)
+	defer func() {
+		router.removeChannel(id, c)
+		close(c.done)
+		metrics.connections.Dec()
+		log.debug("connection closed", "conn", c.id, "identity", id)
+	}()
+	err := router.deliverQueue(id, c)
+	if err != nil {
+		log.error("couldn't deliver queued messages", "conn", c.id, "err", err)
+	}
+	go forwardMessages(log, c, conn)
+	decodeErrors := 0
 	for {
-		var message Message
-		err := conn.ReadJSON(&message)
+		messageType, data, err := conn.ReadMessage()
 		if err != nil {
-			log.Default().Println(err)
-			continue
+			// Reading from a websocket fails permanently, so there's no point in retrying
+			if isClosed(err) {
+				return nil
+			}
+			return err
 		}
-		data, _ := json.Marshal(message)
-		fmt.Println(string(data))
-		if len(message.To) != crypto.IdentityPubSize {
-			log.Default().Printf("incorrect recipient identity len: %d\n", len(message.To))
+		message, err := DecodeMessage(messageType, data)
+		if err != nil {
+			log.info("malformed message", "conn", c.id, "err", err)
+			decodeErrors++
+			if decodeErrors > maxDecodeErrors {
+				return fmt.Errorf("too many malformed messages: %w", err)
+			}
 			continue
 		}
+		decodeErrors = 0
+		// Relaying a message the recipient would misread is worse than dropping the sender
+		if message.Version != MessageVersion {
+			log.info("unsupported message version", "conn", c.id, "version", message.Version)
+			closeMessage := websocket.FormatCloseMessage(websocket.CloseUnsupportedData, fmt.Sprintf("unsupported message version %d, expected %d", message.Version, MessageVersion))
+			conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+			return nil
+		}
 		idTo := crypto.IdentityPub(message.To)
-		toChan, present := router.getChannel(idTo)
+		if err := idTo.Validate(); err != nil {
+			log.info("invalid recipient identity", "conn", c.id, "err", err)
+			continue
+		}
+		toConns := router.getChannels(idTo)
 		switch message.Payload.Variant.(type) {
 		case *QueryExchangePayload:
-			if !present {
+			if len(toConns) == 0 {
 				continue
 			}
-			prekey, sig, err := router.server.getPrekey(idTo)
+			keyID, prekey, sig, err := router.server.getPrekey(idTo)
 			if err != nil {
-				log.Default().Println(err)
+				log.error("couldn't get prekey", "conn", c.id, "to", idTo, "err", err)
 				continue
 			}
-			fmt.Println("prekey", prekey)
 			onetime, err := router.server.getOnetime(idTo)
 			if err != nil {
-				log.Default().Println(err)
+				log.error("couldn't get onetime key", "conn", c.id, "to", idTo, "err", err)
 				continue
 			}
-			fmt.Println("onetime", onetime)
-			ch <- Message{From: nil, To: id, Payload: Payload{
+			// Running out of onetime keys leaves the field empty, and the initiator does without
+			if onetime != nil {
+				metrics.onetimesServed.Inc()
+			}
+			// The exchange comes from the identity whose keys we're handing out
+			c.send(Message{From: idTo, To: id, Version: MessageVersion, Payload: Payload{
 				Variant: &StartExchangePayload{
+					KeyID:   keyID,
 					Prekey:  prekey,
 					Sig:     sig,
 					OneTime: onetime,
 				},
-			}}
+			}})
 		default:
 			message.From = id
-			toChan <- message
+			// Every device of the recipient gets the message, which is only queued if none are connected
+			sent := false
+			for _, toConn := range toConns {
+				if toConn.send(message) {
+					sent = true
+				}
+			}
+			if sent {
+				metrics.relayed.Inc()
+				log.debug("relayed message", "conn", c.id, "from", id, "to", idTo)
+				continue
+			}
+			if isEphemeral(message.Payload) {
+				log.debug("dropped ephemeral message", "conn", c.id, "from", id, "to", idTo)
+				continue
+			}
+			err := router.server.queueMessage(idTo, message)
+			if err != nil {
+				log.error("couldn't queue message", "conn", c.id, "to", idTo, "err", err)
+				continue
+			}
+			metrics.queued.Inc()
+			log.debug("queued message", "conn", c.id, "from", id, "to", idTo)
+		}
+	}
+}
+
+// isEphemeral checks if a payload is only useful to a recipient who's online
+//
+// These payloads are dropped instead of being queued.
+func isEphemeral(payload Payload) bool {
+	switch payload.Variant.(type) {
+	case *TypingPayload, *ReceiptPayload, *AckPayload:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliverQueue writes the messages queued for a client that just connected
+//
+// This happens before anything else is written to the connection. Each message
+// is only removed from the queue once it's been written, so that messages
+// aren't lost if the client disconnects in the meantime.
+func (router *router) deliverQueue(id crypto.IdentityPub, c *connection) error {
+	queued, err := router.server.queuedMessages(id)
+	if err != nil {
+		return err
+	}
+	for _, q := range queued {
+		messageType, data, err := EncodeMessage(c.format, q.message)
+		if err == nil {
+			err = c.conn.WriteMessage(messageType, data)
+			if err != nil {
+				return err
+			}
+		} else {
+			// This message can never be delivered, so there's no point in keeping it
+			router.server.log.error("couldn't encode queued message", "conn", c.id, "err", err)
+		}
+		err = router.server.deleteQueuedMessage(q.id)
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// authNonceSize is the number of bytes in the nonce used to authenticate clients
+const authNonceSize = 32
+
+// authTimeout is how long we wait for a client to respond to an authentication challenge
+const authTimeout = 10 * time.Second
+
+// authenticate checks that the client on the other end of a connection owns an identity
+func authenticate(id crypto.IdentityPub, conn *websocket.Conn) error {
+	nonce := make([]byte, authNonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	err = conn.WriteJSON(AuthChallenge{Nonce: nonce})
+	if err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	var response AuthResponse
+	err = conn.ReadJSON(&response)
+	if err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	if !id.Verify(AuthData(nonce), response.Sig) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+// shutdownCloseTimeout is how long we take to send close messages to clients when shutting down
+const shutdownCloseTimeout = time.Second
+
+// close disconnects all clients, waiting for their handlers to finish
+//
+// This waits until either all the handlers have finished, or the context expires.
+func (router *router) close(ctx context.Context) error {
+	router.channelsLock.Lock()
+	router.closed = true
+	var connections []*connection
+	for _, devices := range router.channels {
+		for c := range devices {
+			connections = append(connections, c)
+		}
+	}
+	router.channelsLock.Unlock()
+
+	// Slow clients shouldn't hold the lock, blocking the handlers trying to remove themselves
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	for _, c := range connections {
+		c.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(shutdownCloseTimeout))
+		c.conn.Close()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		router.active.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (router *router) rtcHandler(w http.ResponseWriter, r *http.Request) {
+	router.active.Add(1)
+	defer router.active.Done()
 	vars := mux.Vars(r)
 	id, err := crypto.IdentityPubFromBase64(vars["id"])
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	conn, err := router.upgrader.Upgrade(w, r, nil)
+	// Older clients don't ask for a format, and expect JSON
+	format, err := ParseWireFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	connID := requestID(r.Context())
+	// Connections are limited before upgrading, so that rejecting them is cheap
+	if !router.reserve(id) {
+		router.server.log.info("too many connections", "conn", connID, "identity", id)
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer router.release(id)
+	// The upgrade writes its own response, so the id of the connection needs to be passed along
+	// A failed upgrade has already responded, with 403 Forbidden for origins we don't allow
+	conn, err := router.upgrader.Upgrade(w, r, http.Header{"X-Request-Id": {connID}})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		router.server.log.info("couldn't upgrade connection", "conn", connID, "origin", r.Header.Get("Origin"), "err", err)
 		return
 	}
-	err = router.listen(id, conn)
+	// Oversized messages make reads fail, closing the connection with CloseMessageTooBig
+	conn.SetReadLimit(router.maxMessageBytes)
+	err = authenticate(id, conn)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		router.server.log.info("authentication failed", "conn", connID, "identity", id, "err", err)
+		closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "authentication failed")
+		conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+		conn.Close()
 		return
 	}
+	err = router.listen(id, conn, format, connID)
+	if err != nil {
+		router.server.log.error("connection failed", "conn", connID, "err", err)
+	}
+	conn.Close()
 }
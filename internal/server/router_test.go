@@ -0,0 +1,802 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cronokirby/nuntius/internal/crypto"
+	"github.com/gorilla/websocket"
+	_ "modernc.org/sqlite"
+)
+
+func newTestServer(t *testing.T) *server {
+	server, err := newServer(DriverSQLite, path.Join(t.TempDir(), "server.db"))
+	if err != nil {
+		t.Fatalf("couldn't create server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func newTestRouter(t *testing.T) (*router, *httptest.Server) {
+	router := newRouter(newTestServer(t), Config{})
+	srv := httptest.NewServer(newMux(router.server, router, newRateLimiter(Config{})))
+	t.Cleanup(srv.Close)
+	return router, srv
+}
+
+func dialTestRouterUnauthenticated(t *testing.T, root string, id crypto.IdentityPub) (*websocket.Conn, []byte) {
+	return dialTestRouterInFormat(t, root, id, "")
+}
+
+// dialTestRouterInFormat connects to a router without authenticating, asking for a wire format if one is given
+func dialTestRouterInFormat(t *testing.T, root string, id crypto.IdentityPub, format WireFormat) (*websocket.Conn, []byte) {
+	url := "ws" + strings.TrimPrefix(root, "http") + "/rtc/" + base64.URLEncoding.EncodeToString(id)
+	if format != "" {
+		url += "?format=" + string(format)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("couldn't dial router: %v", err)
+	}
+	var challenge AuthChallenge
+	err = conn.ReadJSON(&challenge)
+	if err != nil {
+		t.Fatalf("couldn't read challenge: %v", err)
+	}
+	return conn, challenge.Nonce
+}
+
+func dialTestRouter(t *testing.T, root string, id crypto.IdentityPub, priv crypto.IdentityPriv) *websocket.Conn {
+	conn, nonce := dialTestRouterUnauthenticated(t, root, id)
+	err := conn.WriteJSON(AuthResponse{Sig: priv.Sign(AuthData(nonce))})
+	if err != nil {
+		t.Fatalf("couldn't respond to challenge: %v", err)
+	}
+	return conn
+}
+
+func newTestIdentity(t *testing.T) (crypto.IdentityPub, crypto.IdentityPriv) {
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("couldn't generate identity: %v", err)
+	}
+	return pub, priv
+}
+
+// waitFor polls a condition until it's true, or a timeout expires
+func waitFor(condition func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestListenReturnsOnClose(t *testing.T) {
+	router, srv := newTestRouter(t)
+	id, priv := newTestIdentity(t)
+	conn := dialTestRouter(t, srv.URL, id, priv)
+
+	present := func() bool {
+		return router.online(id)
+	}
+	if !waitFor(present) {
+		t.Error("channel was never registered")
+		return
+	}
+
+	conn.Close()
+	if !waitFor(func() bool { return !present() }) {
+		t.Error("channel wasn't removed after the client disconnected")
+		return
+	}
+}
+
+func TestListenToleratesMalformedMessages(t *testing.T) {
+	router, srv := newTestRouter(t)
+	id, priv := newTestIdentity(t)
+	conn := dialTestRouter(t, srv.URL, id, priv)
+	defer conn.Close()
+
+	present := func() bool {
+		return router.online(id)
+	}
+	for i := 0; i < maxDecodeErrors; i++ {
+		err := conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+		if err != nil {
+			t.Errorf("couldn't write message: %v", err)
+			return
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !present() {
+		t.Error("connection was dropped before reaching the error limit")
+		return
+	}
+	err := conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+	if err != nil {
+		t.Errorf("couldn't write message: %v", err)
+		return
+	}
+	if !waitFor(func() bool { return !present() }) {
+		t.Error("connection wasn't dropped after too many malformed messages")
+		return
+	}
+}
+
+func TestAuthenticationSucceeds(t *testing.T) {
+	router, srv := newTestRouter(t)
+	id, priv := newTestIdentity(t)
+	conn := dialTestRouter(t, srv.URL, id, priv)
+	defer conn.Close()
+
+	if !waitFor(func() bool {
+		return router.online(id)
+	}) {
+		t.Error("authenticated connection was never registered")
+		return
+	}
+}
+
+func TestAuthenticationRejectsForgery(t *testing.T) {
+	router, srv := newTestRouter(t)
+	id, _ := newTestIdentity(t)
+	_, forger := newTestIdentity(t)
+	conn, nonce := dialTestRouterUnauthenticated(t, srv.URL, id)
+	defer conn.Close()
+
+	err := conn.WriteJSON(AuthResponse{Sig: forger.Sign(AuthData(nonce))})
+	if err != nil {
+		t.Errorf("couldn't respond to challenge: %v", err)
+		return
+	}
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("expected policy violation close, found %v", err)
+		return
+	}
+	if router.online(id) {
+		t.Error("forged connection was registered")
+		return
+	}
+}
+
+func TestQueueOfflineMessages(t *testing.T) {
+	router, srv := newTestRouter(t)
+	alice, alicePriv := newTestIdentity(t)
+	bob, bobPriv := newTestIdentity(t)
+
+	aliceConn := dialTestRouter(t, srv.URL, alice, alicePriv)
+	defer aliceConn.Close()
+	for i := byte(0); i < 2; i++ {
+		err := aliceConn.WriteJSON(Message{To: bob, Version: MessageVersion, Payload: Payload{Variant: &MessagePayload{Data: []byte{i}}}})
+		if err != nil {
+			t.Errorf("couldn't send message: %v", err)
+			return
+		}
+	}
+	queued := func() int {
+		var count int
+		err := router.server.QueryRow("SELECT COUNT(*) FROM queued_message WHERE recipient = $1;", bob).Scan(&count)
+		if err != nil {
+			t.Errorf("couldn't count queued messages: %v", err)
+		}
+		return count
+	}
+	if !waitFor(func() bool { return queued() == 2 }) {
+		t.Errorf("expected 2 queued messages, found %d", queued())
+		return
+	}
+
+	bobConn := dialTestRouter(t, srv.URL, bob, bobPriv)
+	defer bobConn.Close()
+	bobConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := byte(0); i < 2; i++ {
+		var message Message
+		err := bobConn.ReadJSON(&message)
+		if err != nil {
+			t.Errorf("couldn't receive queued message: %v", err)
+			return
+		}
+		payload, ok := message.Payload.Variant.(*MessagePayload)
+		if !ok || !bytes.Equal(payload.Data, []byte{i}) || !bytes.Equal(message.From, alice) {
+			t.Errorf("unexpected queued message: %v", message)
+			return
+		}
+	}
+	if queued() != 0 {
+		t.Errorf("queue wasn't drained, %d messages remaining", queued())
+		return
+	}
+}
+
+func TestQueueIsCapped(t *testing.T) {
+	server := newTestServer(t)
+	bob, _ := newTestIdentity(t)
+	message := Message{To: bob, Payload: Payload{Variant: &MessagePayload{Data: []byte{1}}}}
+	for i := 0; i < maxQueuedMessages; i++ {
+		err := server.queueMessage(bob, message)
+		if err != nil {
+			t.Errorf("couldn't queue message: %v", err)
+			return
+		}
+	}
+	err := server.queueMessage(bob, message)
+	if err != errQueueFull {
+		t.Errorf("expected errQueueFull, found %v", err)
+		return
+	}
+}
+
+func TestQueuedMessagesStayUntilDeleted(t *testing.T) {
+	server := newTestServer(t)
+	bob, _ := newTestIdentity(t)
+	err := server.queueMessage(bob, Message{To: bob, Payload: Payload{Variant: &MessagePayload{Data: []byte{1}}}})
+	if err != nil {
+		t.Errorf("couldn't queue message: %v", err)
+		return
+	}
+	for i := 0; i < 2; i++ {
+		queued, err := server.queuedMessages(bob)
+		if err != nil {
+			t.Errorf("couldn't get queued messages: %v", err)
+			return
+		}
+		if len(queued) != 1 {
+			t.Errorf("expected 1 queued message, found %d", len(queued))
+			return
+		}
+	}
+	queued, err := server.queuedMessages(bob)
+	if err != nil {
+		t.Errorf("couldn't get queued messages: %v", err)
+		return
+	}
+	err = server.deleteQueuedMessage(queued[0].id)
+	if err != nil {
+		t.Errorf("couldn't delete queued message: %v", err)
+		return
+	}
+	queued, err = server.queuedMessages(bob)
+	if err != nil {
+		t.Errorf("couldn't get queued messages: %v", err)
+		return
+	}
+	if len(queued) != 0 {
+		t.Errorf("expected no queued messages, found %d", len(queued))
+		return
+	}
+}
+
+func TestExpiredMessagesArePurged(t *testing.T) {
+	server := newTestServer(t)
+	srv := httptest.NewServer(newMux(server, newRouter(server, Config{}), newRateLimiter(Config{})))
+	defer srv.Close()
+	alice, _ := newTestIdentity(t)
+	bob, _ := newTestIdentity(t)
+	for _, id := range []crypto.IdentityPub{alice, bob} {
+		err := server.queueMessage(id, Message{To: id, Payload: Payload{Variant: &MessagePayload{Data: []byte{1}}}})
+		if err != nil {
+			t.Errorf("couldn't queue message: %v", err)
+			return
+		}
+	}
+	age := func(id crypto.IdentityPub) error {
+		_, err := server.Exec("UPDATE queued_message SET created_at = $1 WHERE recipient = $2;", time.Now().Add(-server.queueTTL-time.Minute).Unix(), id)
+		return err
+	}
+	count := func() int {
+		var count int
+		err := server.QueryRow("SELECT COUNT(*) FROM queued_message;").Scan(&count)
+		if err != nil {
+			t.Fatalf("couldn't count queued messages: %v", err)
+		}
+		return count
+	}
+
+	err := age(alice)
+	if err != nil {
+		t.Errorf("couldn't age message: %v", err)
+		return
+	}
+	purged, err := server.purgeExpiredMessages()
+	if err != nil {
+		t.Errorf("couldn't purge messages: %v", err)
+		return
+	}
+	if purged != 1 {
+		t.Errorf("expected 1 purged message, found %d", purged)
+		return
+	}
+	queued, err := server.queuedMessages(bob)
+	if err != nil {
+		t.Errorf("couldn't get queued messages: %v", err)
+		return
+	}
+	if count() != 1 || len(queued) != 1 {
+		t.Errorf("the fresh message wasn't kept")
+		return
+	}
+	if !strings.Contains(scrapeMetrics(t, srv.URL), "nuntius_messages_expired_total 1") {
+		t.Errorf("purged message wasn't counted")
+		return
+	}
+
+	// The sweeper purges messages on its own
+	err = age(bob)
+	if err != nil {
+		t.Errorf("couldn't age message: %v", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.sweep(ctx, 10*time.Millisecond)
+	if !waitFor(func() bool { return count() == 0 }) {
+		t.Errorf("sweeper didn't purge the expired message")
+		return
+	}
+}
+
+func TestEphemeralMessagesArentQueued(t *testing.T) {
+	router, srv := newTestRouter(t)
+	alice, alicePriv := newTestIdentity(t)
+	bob, _ := newTestIdentity(t)
+
+	aliceConn := dialTestRouter(t, srv.URL, alice, alicePriv)
+	defer aliceConn.Close()
+	for _, variant := range []interface{}{&TypingPayload{}, &ReceiptPayload{}, &MessagePayload{Data: []byte{1}}} {
+		err := aliceConn.WriteJSON(Message{To: bob, Version: MessageVersion, Payload: Payload{Variant: variant}})
+		if err != nil {
+			t.Errorf("couldn't send message: %v", err)
+			return
+		}
+	}
+	queued := func() int {
+		var count int
+		err := router.server.QueryRow("SELECT COUNT(*) FROM queued_message WHERE recipient = $1;", bob).Scan(&count)
+		if err != nil {
+			t.Errorf("couldn't count queued messages: %v", err)
+		}
+		return count
+	}
+	// Messages are handled in order, so the typing and receipt payloads have been dropped by now
+	if !waitFor(func() bool { return queued() >= 1 }) || queued() != 1 {
+		t.Errorf("expected 1 queued message, found %d", queued())
+		return
+	}
+}
+
+func TestOversizedMessageClosesConnection(t *testing.T) {
+	router, srv := newTestRouter(t)
+	alice, alicePriv := newTestIdentity(t)
+	bob, bobPriv := newTestIdentity(t)
+
+	bobConn := dialTestRouter(t, srv.URL, bob, bobPriv)
+	defer bobConn.Close()
+	if !waitFor(func() bool { return router.online(bob) }) {
+		t.Errorf("bob never connected")
+		return
+	}
+
+	aliceConn := dialTestRouter(t, srv.URL, alice, alicePriv)
+	defer aliceConn.Close()
+	data := make([]byte, DefaultMaxMessageBytes)
+	err := aliceConn.WriteJSON(Message{To: bob, Version: MessageVersion, Payload: Payload{Variant: &MessagePayload{Data: data}}})
+	if err != nil {
+		t.Errorf("couldn't send message: %v", err)
+		return
+	}
+	aliceConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = aliceConn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("expected connection to be closed, found %v", err)
+		return
+	}
+
+	bobConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	var message Message
+	err = bobConn.ReadJSON(&message)
+	if err == nil {
+		t.Errorf("oversized message was relayed: %v", message)
+		return
+	}
+}
+
+func TestUnsupportedMessageVersion(t *testing.T) {
+	router, srv := newTestRouter(t)
+	alice, alicePriv := newTestIdentity(t)
+	bob, bobPriv := newTestIdentity(t)
+
+	bobConn := dialTestRouter(t, srv.URL, bob, bobPriv)
+	defer bobConn.Close()
+	if !waitFor(func() bool { return router.online(bob) }) {
+		t.Errorf("bob never connected")
+		return
+	}
+
+	// Older clients don't send a version at all
+	for _, version := range []int{0, MessageVersion + 1} {
+		aliceConn := dialTestRouter(t, srv.URL, alice, alicePriv)
+		defer aliceConn.Close()
+		err := aliceConn.WriteJSON(Message{To: bob, Version: version, Payload: Payload{Variant: &MessagePayload{Data: []byte{1}}}})
+		if err != nil {
+			t.Errorf("couldn't send message: %v", err)
+			return
+		}
+		aliceConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err = aliceConn.ReadMessage()
+		if !websocket.IsCloseError(err, websocket.CloseUnsupportedData) {
+			t.Errorf("version %d: expected connection to be closed, found %v", version, err)
+			return
+		}
+	}
+
+	bobConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	var message Message
+	err := bobConn.ReadJSON(&message)
+	if err == nil {
+		t.Errorf("message with unsupported version was relayed: %v", message)
+		return
+	}
+}
+
+func TestExchangeWithoutOnetimeKeys(t *testing.T) {
+	router, srv := newTestRouter(t)
+	alice, alicePriv := newTestIdentity(t)
+	bob, bobPriv := newTestIdentity(t)
+	prekey, prekeyPriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	// Bob has a prekey, but every one of his onetime keys has been used up
+	err = router.server.savePrekey(bob, 1, prekey, bobPriv.SignPrekey(prekey), 1)
+	if err != nil {
+		t.Errorf("couldn't save prekey: %v", err)
+		return
+	}
+
+	bobConn := dialTestRouter(t, srv.URL, bob, bobPriv)
+	defer bobConn.Close()
+	aliceConn := dialTestRouter(t, srv.URL, alice, alicePriv)
+	defer aliceConn.Close()
+	if !waitFor(func() bool { return getPresence(t, srv.URL, bob) }) {
+		t.Errorf("bob isn't online")
+		return
+	}
+	err = aliceConn.WriteJSON(Message{To: bob, Version: MessageVersion, Payload: Payload{Variant: &QueryExchangePayload{}}})
+	if err != nil {
+		t.Errorf("couldn't query exchange: %v", err)
+		return
+	}
+	aliceConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var message Message
+	err = aliceConn.ReadJSON(&message)
+	if err != nil {
+		t.Errorf("couldn't receive exchange: %v", err)
+		return
+	}
+	start, ok := message.Payload.Variant.(*StartExchangePayload)
+	if !ok {
+		t.Errorf("expected a StartExchangePayload, found %v", message.Payload.Variant)
+		return
+	}
+	if len(start.OneTime) != 0 {
+		t.Errorf("expected no onetime key, found %x", start.OneTime)
+		return
+	}
+
+	ephemeral, ephemeralPriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate ephemeral key: %v", err)
+		return
+	}
+	aliceSecret, err := crypto.ForwardExchange(&crypto.ForwardExchangeParams{
+		Me:        alicePriv,
+		Ephemeral: ephemeralPriv,
+		Identity:  bob,
+		Prekey:    start.Prekey,
+		OneTime:   nil,
+	})
+	if err != nil {
+		t.Errorf("couldn't run forward exchange: %v", err)
+		return
+	}
+	err = aliceConn.WriteJSON(Message{To: bob, Version: MessageVersion, Payload: Payload{Variant: &EndExchangePayload{
+		PrekeyID:  start.KeyID,
+		Prekey:    start.Prekey,
+		Ephemeral: ephemeral,
+	}}})
+	if err != nil {
+		t.Errorf("couldn't end exchange: %v", err)
+		return
+	}
+	bobConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err = bobConn.ReadJSON(&message)
+	if err != nil {
+		t.Errorf("couldn't receive exchange: %v", err)
+		return
+	}
+	end, ok := message.Payload.Variant.(*EndExchangePayload)
+	if !ok {
+		t.Errorf("expected an EndExchangePayload, found %v", message.Payload.Variant)
+		return
+	}
+	bobSecret, err := crypto.BackwardExchange(&crypto.BackwardExchangeParams{
+		Them:      alice,
+		Ephemeral: end.Ephemeral,
+		Identity:  bobPriv,
+		Prekey:    prekeyPriv,
+		OneTime:   nil,
+	})
+	if err != nil {
+		t.Errorf("couldn't run backward exchange: %v", err)
+		return
+	}
+	if !bytes.Equal(aliceSecret, bobSecret) {
+		t.Errorf("exchange without onetime keys derived different secrets")
+		return
+	}
+}
+
+func TestMixedWireFormats(t *testing.T) {
+	_, srv := newTestRouter(t)
+	alice, alicePriv := newTestIdentity(t)
+	bob, bobPriv := newTestIdentity(t)
+
+	aliceConn, nonce := dialTestRouterInFormat(t, srv.URL, alice, WireProtobuf)
+	defer aliceConn.Close()
+	err := aliceConn.WriteJSON(AuthResponse{Sig: alicePriv.Sign(AuthData(nonce))})
+	if err != nil {
+		t.Errorf("couldn't respond to challenge: %v", err)
+		return
+	}
+	// Bob is an older client, using JSON
+	bobConn := dialTestRouter(t, srv.URL, bob, bobPriv)
+	defer bobConn.Close()
+
+	messageType, data, err := EncodeMessage(WireProtobuf, Message{To: bob, Version: MessageVersion, Payload: Payload{Variant: &MessagePayload{Data: []byte{1}}}})
+	if err != nil {
+		t.Errorf("couldn't encode message: %v", err)
+		return
+	}
+	err = aliceConn.WriteMessage(messageType, data)
+	if err != nil {
+		t.Errorf("couldn't send message: %v", err)
+		return
+	}
+	bobConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messageType, data, err = bobConn.ReadMessage()
+	if err != nil {
+		t.Errorf("couldn't receive message: %v", err)
+		return
+	}
+	if messageType != websocket.TextMessage {
+		t.Errorf("expected JSON message, found type %d", messageType)
+		return
+	}
+
+	err = bobConn.WriteJSON(Message{To: alice, Version: MessageVersion, Payload: Payload{Variant: &MessagePayload{Data: []byte{2}}}})
+	if err != nil {
+		t.Errorf("couldn't send message: %v", err)
+		return
+	}
+	aliceConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messageType, data, err = aliceConn.ReadMessage()
+	if err != nil {
+		t.Errorf("couldn't receive message: %v", err)
+		return
+	}
+	if messageType != websocket.BinaryMessage {
+		t.Errorf("expected protobuf message, found type %d", messageType)
+		return
+	}
+	message, err := DecodeMessage(messageType, data)
+	if err != nil {
+		t.Errorf("couldn't decode message: %v", err)
+		return
+	}
+	payload, ok := message.Payload.Variant.(*MessagePayload)
+	if !ok || !bytes.Equal(payload.Data, []byte{2}) || !bytes.Equal(message.From, bob) {
+		t.Errorf("unexpected message: %v", message)
+		return
+	}
+}
+
+// getPresence asks a server whether an identity is online
+func getPresence(t *testing.T, root string, id crypto.IdentityPub) bool {
+	resp, err := http.Get(root + "/presence/" + base64.URLEncoding.EncodeToString(id))
+	if err != nil {
+		t.Fatalf("couldn't query presence: %v", err)
+	}
+	defer resp.Body.Close()
+	var presence PresenceResponse
+	err = json.NewDecoder(resp.Body).Decode(&presence)
+	if err != nil {
+		t.Fatalf("couldn't decode presence: %v", err)
+	}
+	return presence.Online
+}
+
+func TestPresence(t *testing.T) {
+	_, srv := newTestRouter(t)
+	id, priv := newTestIdentity(t)
+	if getPresence(t, srv.URL, id) {
+		t.Error("identity is online before connecting")
+		return
+	}
+
+	conn := dialTestRouter(t, srv.URL, id, priv)
+	if !waitFor(func() bool { return getPresence(t, srv.URL, id) }) {
+		t.Error("identity isn't online while connected")
+		return
+	}
+
+	conn.Close()
+	if !waitFor(func() bool { return !getPresence(t, srv.URL, id) }) {
+		t.Error("identity is still online after disconnecting")
+		return
+	}
+}
+
+func TestMultipleDevices(t *testing.T) {
+	router, srv := newTestRouter(t)
+	alice, alicePriv := newTestIdentity(t)
+	bob, bobPriv := newTestIdentity(t)
+	aliceConn := dialTestRouter(t, srv.URL, alice, alicePriv)
+	defer aliceConn.Close()
+	laptop := dialTestRouter(t, srv.URL, bob, bobPriv)
+	defer laptop.Close()
+	phone := dialTestRouter(t, srv.URL, bob, bobPriv)
+	defer phone.Close()
+	if !waitFor(func() bool { return len(router.getChannels(bob)) == 2 }) {
+		t.Errorf("both devices were never registered")
+		return
+	}
+
+	err := aliceConn.WriteJSON(Message{To: bob, Version: MessageVersion, Payload: Payload{Variant: &MessagePayload{Data: []byte{1}}}})
+	if err != nil {
+		t.Errorf("couldn't send message: %v", err)
+		return
+	}
+	for _, conn := range []*websocket.Conn{laptop, phone} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var message Message
+		err = conn.ReadJSON(&message)
+		if err != nil {
+			t.Errorf("couldn't receive message: %v", err)
+			return
+		}
+		payload, ok := message.Payload.Variant.(*MessagePayload)
+		if !ok || !bytes.Equal(payload.Data, []byte{1}) || !bytes.Equal(message.From, alice) {
+			t.Errorf("unexpected message: %v", message)
+			return
+		}
+	}
+
+	// Disconnecting one device leaves the other one connected
+	laptop.Close()
+	if !waitFor(func() bool { return len(router.getChannels(bob)) == 1 }) {
+		t.Errorf("disconnected device was never removed")
+		return
+	}
+	if !router.online(bob) {
+		t.Errorf("bob should still be online")
+		return
+	}
+}
+
+func TestWebsocketOrigins(t *testing.T) {
+	server := newTestServer(t)
+	config := Config{AllowedOrigins: []string{"https://chat.example.com"}}
+	srv := httptest.NewServer(newMux(server, newRouter(server, config), newRateLimiter(config)))
+	defer srv.Close()
+	id, _ := newTestIdentity(t)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/rtc/" + base64.URLEncoding.EncodeToString(id)
+
+	cases := []struct {
+		origin string
+		status int
+	}{
+		{"", http.StatusSwitchingProtocols},
+		{srv.URL, http.StatusSwitchingProtocols},
+		{"https://chat.example.com", http.StatusSwitchingProtocols},
+		{"https://evil.example.com", http.StatusForbidden},
+		{"http://chat.example.com", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		header := http.Header{}
+		if c.origin != "" {
+			header.Set("Origin", c.origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Errorf("%q: couldn't dial router: %v", c.origin, err)
+			return
+		}
+		if resp.StatusCode != c.status {
+			t.Errorf("%q: expected status %d, found %d", c.origin, c.status, resp.StatusCode)
+			return
+		}
+	}
+
+	config = Config{AllowAllOrigins: true}
+	allowAll := httptest.NewServer(newMux(server, newRouter(server, config), newRateLimiter(config)))
+	defer allowAll.Close()
+	url = "ws" + strings.TrimPrefix(allowAll.URL, "http") + "/rtc/" + base64.URLEncoding.EncodeToString(id)
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example.com"}})
+	if err != nil {
+		t.Errorf("every origin should be allowed: %v", err)
+		return
+	}
+	conn.Close()
+}
+
+func TestConnectionLimits(t *testing.T) {
+	server := newTestServer(t)
+	config := Config{MaxConnections: 3, MaxConnectionsPerIdentity: 2}
+	router := newRouter(server, config)
+	srv := httptest.NewServer(newMux(server, router, newRateLimiter(config)))
+	defer srv.Close()
+	alice, alicePriv := newTestIdentity(t)
+	bob, bobPriv := newTestIdentity(t)
+	carol, _ := newTestIdentity(t)
+	rtcURL := func(id crypto.IdentityPub) string {
+		return "ws" + strings.TrimPrefix(srv.URL, "http") + "/rtc/" + base64.URLEncoding.EncodeToString(id)
+	}
+	expectRejected := func(id crypto.IdentityPub) bool {
+		conn, resp, err := websocket.DefaultDialer.Dial(rtcURL(id), nil)
+		if err == nil {
+			conn.Close()
+			t.Errorf("connection over the limit was accepted")
+			return false
+		}
+		if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected 503, found %v %v", resp, err)
+			return false
+		}
+		return true
+	}
+
+	first := dialTestRouter(t, srv.URL, alice, alicePriv)
+	defer first.Close()
+	second := dialTestRouter(t, srv.URL, alice, alicePriv)
+	if !expectRejected(alice) {
+		return
+	}
+	bobConn := dialTestRouter(t, srv.URL, bob, bobPriv)
+	defer bobConn.Close()
+	// The server is now full, even for identities without any connection
+	if !expectRejected(carol) {
+		return
+	}
+
+	// Closing a connection makes room for a new one, once the server notices
+	second.Close()
+	if !waitFor(func() bool {
+		conn, _, err := websocket.DefaultDialer.Dial(rtcURL(alice), nil)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}) {
+		t.Errorf("closed connection wasn't released")
+		return
+	}
+}
@@ -1,63 +1,421 @@
 package server
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
 	"path"
+	"strconv"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/cronokirby/nuntius/internal/crypto"
+	"github.com/cronokirby/nuntius/internal/migrate"
 	"github.com/gorilla/mux"
 )
 
 type server struct {
 	*sql.DB
+	metrics *metrics
+	log     *logger
+	// queueTTL is how long we keep queued messages around for
+	queueTTL time.Duration
+	// keyTTL is how long we keep prekeys, and the onetime keys of inactive identities, around for
+	keyTTL time.Duration
+	// directory is whether identities can publish names, for others to look up
+	directory bool
 }
 
 const _DEFAULT_DATABASE_PATH = ".nuntius/server.db"
 
-func newServer(database string) (*server, error) {
-	if database == "" {
+// The database drivers a server can use
+const (
+	// DriverSQLite stores everything in a local SQLite database, and is the default
+	DriverSQLite = "sqlite"
+	// DriverPostgres stores everything in a Postgres database, which several servers can share
+	DriverPostgres = "postgres"
+)
+
+// metaTables holds the table storing the schema version of a server's database, for each driver
+var metaTables = map[string]string{
+	DriverSQLite: `
+	CREATE TABLE IF NOT EXISTS meta (
+		name TEXT PRIMARY KEY NOT NULL,
+		value BLOB NOT NULL
+	);
+	`,
+	DriverPostgres: `
+	CREATE TABLE IF NOT EXISTS meta (
+		name TEXT PRIMARY KEY NOT NULL,
+		value BYTEA NOT NULL
+	);
+	`,
+}
+
+// schemas holds the tables of a server's database, for each driver
+var schemas = map[string]string{
+	DriverSQLite: `
+	CREATE TABLE IF NOT EXISTS prekey (
+		id INTEGER PRIMARY KEY,
+		identity BLOB NOT NULL,
+		key_id INTEGER NOT NULL,
+		prekey BLOB NOT NULL,
+		signature BLOB NOT NULL,
+		UNIQUE (identity, key_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS onetime (
+		id INTEGER PRIMARY KEY,
+		identity BLOB NOT NULL,
+		onetime BLOB NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS queued_message (
+		id INTEGER PRIMARY KEY,
+		recipient BLOB NOT NULL,
+		message BLOB NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+	`,
+	DriverPostgres: `
+	CREATE TABLE IF NOT EXISTS prekey (
+		id BIGSERIAL PRIMARY KEY,
+		identity BYTEA NOT NULL,
+		key_id BIGINT NOT NULL,
+		prekey BYTEA NOT NULL,
+		signature BYTEA NOT NULL,
+		UNIQUE (identity, key_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS onetime (
+		id BIGSERIAL PRIMARY KEY,
+		identity BYTEA NOT NULL,
+		onetime BYTEA NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS queued_message (
+		id BIGSERIAL PRIMARY KEY,
+		recipient BYTEA NOT NULL,
+		message BYTEA NOT NULL,
+		created_at BIGINT NOT NULL
+	);
+	`,
+}
+
+// newServer opens the database of a server, creating its tables as necessary
+//
+// With SQLite, the source is the path to the database, and an empty path uses
+// a default path in the current Home directory. With Postgres, the source is
+// a connection string, and can't be empty.
+func newServer(driver string, source string) (*server, error) {
+	if driver == "" {
+		driver = DriverSQLite
+	}
+	meta, ok := metaTables[driver]
+	if !ok {
+		return nil, fmt.Errorf("unknown database driver: %s", driver)
+	}
+	if driver == DriverSQLite && source == "" {
 		usr, err := user.Current()
 		if err != nil {
 			return nil, err
 		}
-		database = path.Join(usr.HomeDir, _DEFAULT_DATABASE_PATH)
+		source = path.Join(usr.HomeDir, _DEFAULT_DATABASE_PATH)
+	}
+	if source == "" {
+		return nil, fmt.Errorf("the %s driver needs a connection string", driver)
+	}
+	if driver == DriverSQLite {
+		os.MkdirAll(path.Dir(source), os.ModePerm)
+	}
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return nil, err
+	}
+	if driver == DriverSQLite {
+		// SQLite only has one writer at a time, and concurrent transactions can deadlock the driver
+		db.SetMaxOpenConns(1)
+		// WAL lets readers and a writer work at once, and other processes wait for locks instead of failing
+		_, err = db.Exec("PRAGMA journal_mode=WAL; PRAGMA busy_timeout=5000;")
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
-	os.MkdirAll(path.Dir(database), os.ModePerm)
-	db, err := sql.Open("sqlite", database)
+	_, err = db.Exec(meta)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS prekey (
-		identity BLOB PRIMARY KEY NOT NULL,
-		prekey BLOB NOT NULL,
+	err = migrate.Run(db, serverMigrations(driver))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &server{DB: db, metrics: newMetrics(), log: newLogger(os.Stderr, LogInfo), queueTTL: DefaultQueueTTL, keyTTL: DefaultKeyTTL}, nil
+}
+
+// prekeyCounterSchemas holds the table of prekey upload counters, for each driver
+var prekeyCounterSchemas = map[string]string{
+	DriverSQLite: `
+	CREATE TABLE IF NOT EXISTS prekey_counter (
+		identity BLOB PRIMARY KEY,
+		counter INTEGER NOT NULL
+	);
+	`,
+	DriverPostgres: `
+	CREATE TABLE IF NOT EXISTS prekey_counter (
+		identity BYTEA PRIMARY KEY,
+		counter BIGINT NOT NULL
+	);
+	`,
+}
+
+// keyTimestampSchemas adds the time each key was uploaded at, as a Unix timestamp, for each driver
+var keyTimestampSchemas = map[string]string{
+	DriverSQLite: `
+	ALTER TABLE prekey ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE onetime ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+	`,
+	DriverPostgres: `
+	ALTER TABLE prekey ADD COLUMN created_at BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE onetime ADD COLUMN created_at BIGINT NOT NULL DEFAULT 0;
+	`,
+}
+
+// directorySchemas holds the table of names published by identities, for each driver
+var directorySchemas = map[string]string{
+	DriverSQLite: `
+	CREATE TABLE IF NOT EXISTS directory (
+		identity BLOB PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		counter INTEGER NOT NULL,
 		signature BLOB NOT NULL
 	);
+	`,
+	DriverPostgres: `
+	CREATE TABLE IF NOT EXISTS directory (
+		identity BYTEA PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		counter BIGINT NOT NULL,
+		signature BYTEA NOT NULL
+	);
+	`,
+}
 
-	CREATE TABLE IF NOT EXISTS onetime (
+// serverMigrations returns the steps bringing the schema of a server's database up to date
+//
+// New migrations go at the end, and existing ones shouldn't change.
+func serverMigrations(driver string) []migrate.Step {
+	return []migrate.Step{
+		func(tx *sql.Tx) error {
+			// Only SQLite databases can be old enough to need this
+			if driver == DriverSQLite {
+				err := migratePrekeys(tx)
+				if err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(schemas[driver])
+			return err
+		},
+		// Keys signed before version 2 of the protocol can't be verified by newer clients,
+		// so they need to be uploaded again
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec("DELETE FROM prekey; DELETE FROM onetime;")
+			return err
+		},
+		// The last counter accepted with a prekey upload, to reject replayed uploads
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec(prekeyCounterSchemas[driver])
+			return err
+		},
+		// Keys are timestamped so that stale ones can be removed, starting with the existing keys
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec(keyTimestampSchemas[driver])
+			if err != nil {
+				return err
+			}
+			now := time.Now().Unix()
+			_, err = tx.Exec("UPDATE prekey SET created_at = $1;", now)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("UPDATE onetime SET created_at = $1;", now)
+			return err
+		},
+		// The names identities publish, when the directory is enabled
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec(directorySchemas[driver])
+			return err
+		},
+	}
+}
+
+// migratePrekeys moves prekeys from the old table, which only allowed one prekey per identity
+//
+// These old prekeys are given an id of 0.
+func migratePrekeys(tx *sql.Tx) error {
+	var count int
+	err := tx.QueryRow(`
+	SELECT COUNT(*) FROM pragma_table_info('prekey') WHERE name = 'key_id';
+	`).Scan(&count)
+	if err != nil {
+		return err
+	}
+	var exists int
+	err = tx.QueryRow(`
+	SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'prekey';
+	`).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 || count > 0 {
+		return nil
+	}
+	_, err = tx.Exec(`
+	ALTER TABLE prekey RENAME TO old_prekey;
+
+	CREATE TABLE prekey (
 		id INTEGER PRIMARY KEY,
 		identity BLOB NOT NULL,
-		onetime BLOB NOT NULL
+		key_id INTEGER NOT NULL,
+		prekey BLOB NOT NULL,
+		signature BLOB NOT NULL,
+		UNIQUE (identity, key_id)
 	);
+
+	INSERT INTO prekey (identity, key_id, prekey, signature)
+	SELECT identity, 0, prekey, signature FROM old_prekey;
+
+	DROP TABLE old_prekey;
 	`)
+	return err
+}
+
+// savePrekey registers a new prekey for an identity, which becomes the prekey handed out in sessions
+//
+// Saving a prekey with the same id as an existing one replaces it. The counter needs to be
+// larger than that of the last prekey saved for this identity, otherwise errStalePrekey is returned.
+func (server *server) savePrekey(identity crypto.IdentityPub, keyID uint32, prekey crypto.ExchangePub, signature []byte, counter int64) error {
+	tx, err := server.Begin()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	result, err := tx.Exec(`
+	INSERT INTO prekey_counter (identity, counter) VALUES ($1, $2)
+	ON CONFLICT (identity) DO UPDATE SET counter = excluded.counter
+	WHERE prekey_counter.counter < excluded.counter;
+	`, identity, counter)
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
-	return &server{db}, nil
+	advanced, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if advanced == 0 {
+		tx.Rollback()
+		return errStalePrekey
+	}
+	// Deleting the old prekey, rather than updating it, makes the new one the newest
+	_, err = tx.Exec(`
+	DELETE FROM prekey WHERE identity = $1 AND key_id = $2;
+	`, identity, keyID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`
+	INSERT INTO prekey (identity, key_id, prekey, signature, created_at) VALUES ($1, $2, $3, $4, $5);
+	`, identity, keyID, prekey, signature, time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
-func (server *server) savePrekey(identity crypto.IdentityPub, prekey crypto.ExchangePub, signature []byte) error {
-	_, err := server.Exec(`
-	INSERT OR REPLACE INTO prekey (identity, prekey, signature) VALUES ($1, $2, $3);
-	`, identity, prekey, signature)
-	return err
+// errStalePrekey is returned when a prekey upload doesn't advance the counter, e.g. because it was replayed
+var errStalePrekey = errors.New("prekey upload counter didn't increase")
+
+// publishName saves the name an identity publishes in the directory, replacing its previous name
+//
+// The counter needs to be larger than that of the last name this identity published,
+// otherwise errStaleName is returned. Names already published by other identities give errNameTaken.
+func (server *server) publishName(identity crypto.IdentityPub, name string, counter int64, signature []byte) error {
+	tx, err := server.Begin()
+	if err != nil {
+		return err
+	}
+	var taken int
+	err = tx.QueryRow(`
+	SELECT COUNT(*) FROM directory WHERE name = $1 AND identity != $2;
+	`, name, identity).Scan(&taken)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if taken > 0 {
+		tx.Rollback()
+		return errNameTaken
+	}
+	result, err := tx.Exec(`
+	INSERT INTO directory (identity, name, counter, signature) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (identity) DO UPDATE SET name = excluded.name, counter = excluded.counter, signature = excluded.signature
+	WHERE directory.counter < excluded.counter;
+	`, identity, name, counter, signature)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	advanced, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if advanced == 0 {
+		tx.Rollback()
+		return errStaleName
+	}
+	return tx.Commit()
+}
+
+// errNameTaken is returned when publishing a name which another identity already published
+var errNameTaken = errors.New("name already published by another identity")
+
+// errStaleName is returned when publishing a name doesn't advance the counter, e.g. because it was replayed
+var errStaleName = errors.New("name counter didn't increase")
+
+// errNoName is returned when looking up a name nobody published
+var errNoName = errors.New("no identity published this name")
+
+// lookupName finds the identity which published a name, along with the counter and signature it published
+func (server *server) lookupName(name string) (crypto.IdentityPub, int64, []byte, error) {
+	var identity []byte
+	var counter int64
+	var signature []byte
+	err := server.QueryRow(`
+	SELECT identity, counter, signature FROM directory WHERE name = $1;
+	`, name).Scan(&identity, &counter, &signature)
+	if err == sql.ErrNoRows {
+		return nil, 0, nil, errNoName
+	}
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return identity, counter, signature, nil
 }
 
 func (server *server) countOnetimes(identity crypto.IdentityPub) (int, error) {
@@ -71,57 +429,322 @@ func (server *server) countOnetimes(identity crypto.IdentityPub) (int, error) {
 	return count, nil
 }
 
+// maxOnetimes is the maximum number of onetime keys we store for an identity
+const maxOnetimes = 128
+
+var errTooManyOnetimes = errors.New("too many onetime keys")
+
+// saveBundle stores the onetime keys in a bundle, skipping keys we already have
+//
+// If this would leave the identity with more than maxOnetimes keys, nothing is saved,
+// and errTooManyOnetimes is returned.
 func (server *server) saveBundle(identity crypto.IdentityPub, bundle crypto.BundlePub) error {
 	tx, err := server.Begin()
 	if err != nil {
 		return err
 	}
 	for i := 0; i < bundle.Len(); i++ {
-		_, err := tx.Exec(`
-		INSERT INTO onetime (identity, onetime) VALUES ($1, $2);
-		`, identity, bundle.Get(i))
+		var exists int
+		err := tx.QueryRow(`
+		SELECT COUNT(*) FROM onetime WHERE identity = $1 AND onetime = $2;
+		`, identity, bundle.Get(i)).Scan(&exists)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if exists > 0 {
+			continue
+		}
+		_, err = tx.Exec(`
+		INSERT INTO onetime (identity, onetime, created_at) VALUES ($1, $2, $3);
+		`, identity, bundle.Get(i), time.Now().Unix())
 		if err != nil {
 			tx.Rollback()
 			return err
 		}
 	}
+	var count int
+	err = tx.QueryRow(`
+	SELECT COUNT(*) FROM onetime WHERE identity = $1;
+	`, identity).Scan(&count)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if count > maxOnetimes {
+		tx.Rollback()
+		return errTooManyOnetimes
+	}
 	return tx.Commit()
 }
 
-func (server *server) getPrekey(pub crypto.IdentityPub) (crypto.ExchangePub, crypto.Signature, error) {
+// getPrekey returns the newest prekey for an identity, along with its id
+func (server *server) getPrekey(pub crypto.IdentityPub) (uint32, crypto.ExchangePub, crypto.Signature, error) {
+	var keyID uint32
 	var prekey crypto.ExchangePub
 	var sig crypto.Signature
 	err := server.QueryRow(`
-	SELECT prekey, signature FROM prekey WHERE identity = $1;
-	`, pub).Scan(&prekey, &sig)
+	SELECT key_id, prekey, signature FROM prekey WHERE identity = $1 ORDER BY id DESC LIMIT 1;
+	`, pub).Scan(&keyID, &prekey, &sig)
+	if err == sql.ErrNoRows {
+		return 0, nil, nil, errNoPrekey
+	}
 	if err != nil {
-		return nil, nil, err
+		return 0, nil, nil, err
 	}
-	return prekey, sig, nil
+	return keyID, prekey, sig, nil
 }
 
+// errNoPrekey is returned when an identity hasn't registered a prekey with this server
+var errNoPrekey = errors.New("identity has no prekey")
+
+var errOnetimeTaken = errors.New("onetime key was taken concurrently")
+
+// deleteOnetime removes the onetime key takeOnetime picked, returning how many rows were removed
+//
+// Tests replace this to lose the race for a key.
+var deleteOnetime = func(tx *sql.Tx, id int64) (int64, error) {
+	result, err := tx.Exec("DELETE FROM onetime WHERE id = $1;", id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// getOnetime removes a onetime key for an identity, returning it.
+//
+// If no onetime keys are left, this returns nil, without an error, and the session
+// only uses the prekey. If another session takes the key we try to hand out, we try
+// again with another key, up to maxOnetimes times, since every attempt we lose means
+// that one less key is left. Only then is errOnetimeTaken returned.
 func (server *server) getOnetime(pub crypto.IdentityPub) (crypto.ExchangePub, error) {
+	for attempt := 0; attempt < maxOnetimes; attempt++ {
+		onetime, err := server.takeOnetime(pub)
+		if err != errOnetimeTaken {
+			return onetime, err
+		}
+	}
+	return nil, errOnetimeTaken
+}
+
+// takeOnetime tries to remove a onetime key for an identity, returning it.
+//
+// This returns errOnetimeTaken if another session removed the same key in the meantime.
+func (server *server) takeOnetime(pub crypto.IdentityPub) (crypto.ExchangePub, error) {
 	tx, err := server.Begin()
 	if err != nil {
 		return nil, err
 	}
+	var id int64
 	var onetime crypto.ExchangePub
 	err = tx.QueryRow(`
-	SELECT onetime FROM onetime WHERE identity = $1 LIMIT 1;
-	`, pub).Scan(&onetime)
+	SELECT id, onetime FROM onetime WHERE identity = $1 LIMIT 1;
+	`, pub).Scan(&id, &onetime)
+	// Running out of onetime keys is fine, since sessions can be created without them
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil, nil
+	}
 	if err != nil {
 		tx.Rollback()
 		return nil, err
 	}
-	_, err = tx.Exec("DELETE FROM onetime WHERE onetime = $1;", onetime)
+	affected, err := deleteOnetime(tx, id)
 	if err != nil {
 		tx.Rollback()
 		return nil, err
 	}
-	tx.Commit()
+	// If another session deleted this key in the meantime, we can't hand it out again
+	if affected != 1 {
+		tx.Rollback()
+		return nil, errOnetimeTaken
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
 	return onetime, nil
 }
 
+// maxQueuedMessages is the maximum number of messages we'll queue for an offline identity
+const maxQueuedMessages = 256
+
+// DefaultQueueTTL is how long queued messages are kept around for by default
+const DefaultQueueTTL = 7 * 24 * time.Hour
+
+// DefaultKeyTTL is how long prekeys, and the onetime keys of inactive identities, are kept around for by default
+const DefaultKeyTTL = 90 * 24 * time.Hour
+
+// DefaultPurgeInterval is how often expired messages and stale keys are removed by default
+const DefaultPurgeInterval = time.Hour
+
+var errQueueFull = errors.New("message queue is full")
+
+// queueMessage saves a message for an identity that isn't currently connected
+func (server *server) queueMessage(recipient crypto.IdentityPub, message Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	tx, err := server.Begin()
+	if err != nil {
+		return err
+	}
+	var count int
+	err = tx.QueryRow(`
+	SELECT COUNT(*) FROM queued_message WHERE recipient = $1;
+	`, recipient).Scan(&count)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if count >= maxQueuedMessages {
+		tx.Rollback()
+		return errQueueFull
+	}
+	_, err = tx.Exec(`
+	INSERT INTO queued_message (recipient, message, created_at) VALUES ($1, $2, $3);
+	`, recipient, data, time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// queuedMessage is a message waiting for its recipient to connect, along with its row in the queue
+type queuedMessage struct {
+	id      int64
+	message Message
+}
+
+// queuedMessages returns the messages queued for an identity, removing those that have expired
+//
+// The messages stay in the queue until deleteQueuedMessage is called, once they've been delivered.
+func (server *server) queuedMessages(recipient crypto.IdentityPub) ([]queuedMessage, error) {
+	cutoff := time.Now().Add(-server.queueTTL).Unix()
+	result, err := server.Exec(`
+	DELETE FROM queued_message WHERE recipient = $1 AND created_at <= $2;
+	`, recipient, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	server.metrics.expired.Add(float64(purged))
+	rows, err := server.Query(`
+	SELECT id, message FROM queued_message WHERE recipient = $1 ORDER BY id;
+	`, recipient)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var messages []queuedMessage
+	for rows.Next() {
+		var queued queuedMessage
+		var data []byte
+		err = rows.Scan(&queued.id, &data)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, &queued.message)
+		if err != nil {
+			server.log.error("couldn't decode queued message", "id", queued.id, "err", err)
+			continue
+		}
+		messages = append(messages, queued)
+	}
+	return messages, rows.Err()
+}
+
+// purgeExpiredMessages removes the queued messages of every identity which have expired, returning how many there were
+func (server *server) purgeExpiredMessages() (int64, error) {
+	cutoff := time.Now().Add(-server.queueTTL).Unix()
+	result, err := server.Exec("DELETE FROM queued_message WHERE created_at <= $1;", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	server.metrics.expired.Add(float64(purged))
+	return purged, nil
+}
+
+// purgeStaleKeys removes the prekeys which have expired, and the onetime keys of inactive identities
+//
+// An identity is inactive if it hasn't uploaded any keys for as long as keys are kept.
+// Clients rotate their prekeys regularly, so the newest prekey of an active identity never expires.
+// This returns the number of prekeys and onetime keys removed.
+func (server *server) purgeStaleKeys() (int64, int64, error) {
+	cutoff := time.Now().Add(-server.keyTTL).Unix()
+	tx, err := server.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	result, err := tx.Exec("DELETE FROM prekey WHERE created_at <= $1;", cutoff)
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+	prekeys, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+	result, err = tx.Exec(`
+	DELETE FROM onetime
+	WHERE identity NOT IN (SELECT identity FROM prekey WHERE created_at > $1)
+	AND identity NOT IN (SELECT identity FROM onetime WHERE created_at > $1);
+	`, cutoff)
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+	onetimes, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+	return prekeys, onetimes, tx.Commit()
+}
+
+// sweep purges expired messages and stale keys on an interval, until the context is cancelled
+//
+// Messages and keys for identities that never connect again would otherwise stay around forever.
+func (server *server) sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := server.purgeExpiredMessages()
+			if err != nil {
+				server.log.error("couldn't purge expired messages", "err", err)
+			} else if purged > 0 {
+				server.log.info("purged expired messages", "count", purged)
+			}
+			prekeys, onetimes, err := server.purgeStaleKeys()
+			if err != nil {
+				server.log.error("couldn't purge stale keys", "err", err)
+			} else if prekeys > 0 || onetimes > 0 {
+				server.log.info("purged stale keys", "prekeys", prekeys, "onetimes", onetimes)
+			}
+		}
+	}
+}
+
+// deleteQueuedMessage removes a message from the queue, once it's been delivered
+func (server *server) deleteQueuedMessage(id int64) error {
+	_, err := server.Exec("DELETE FROM queued_message WHERE id = $1;", id)
+	return err
+}
+
 func (server *server) prekeyHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := crypto.IdentityPubFromBase64(vars["id"])
@@ -135,21 +758,35 @@ func (server *server) prekeyHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	err = checkVersion(request.Version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	prekey, err := crypto.ExchangePubFromBytes(request.Prekey)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if !id.Verify(prekey, request.Sig) {
+	if !id.VerifyPrekey(prekey, request.Sig) {
 		http.Error(w, "bad signature", http.StatusBadRequest)
 		return
 	}
+	if request.Counter > math.MaxInt64 || !id.VerifyPrekeyUpload(request.Counter, request.KeyID, prekey, request.UploadSig) {
+		http.Error(w, "bad upload signature", http.StatusBadRequest)
+		return
+	}
 
-	err = server.savePrekey(id, request.Prekey, request.Sig)
+	err = server.savePrekey(id, request.KeyID, request.Prekey, request.Sig, int64(request.Counter))
+	if err == errStalePrekey {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	server.metrics.prekeyUploads.Inc()
 	w.WriteHeader(http.StatusAccepted)
 }
 
@@ -167,7 +804,7 @@ func (server *server) onetimeCountHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	response := CountOnetimeResponse{count}
+	response := CountOnetimeResponse{count, maxOnetimes}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
@@ -188,76 +825,351 @@ func (server *server) onetimeHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	err = checkVersion(request.Version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	bundle, err := crypto.BundleFromBytes(request.Bundle)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	// Bundles this large could never be stored, so they're malformed rather than conflicting
+	if bundle.Len() > maxOnetimes {
+		http.Error(w, fmt.Sprintf("bundle size %d is more than the %d keys an identity can store", bundle.Len(), maxOnetimes), http.StatusBadRequest)
+		return
+	}
 	if !id.VerifyBundle(bundle, request.Sig) {
 		http.Error(w, "bad signature", http.StatusBadRequest)
 		return
 	}
 
 	err = server.saveBundle(id, bundle)
+	if err == errTooManyOnetimes {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	server.metrics.onetimesUploaded.Add(float64(bundle.Len()))
 
 	w.WriteHeader(http.StatusAccepted)
 }
 
-func (server *server) sessionHandler(w http.ResponseWriter, r *http.Request) {
+func (server *server) publishNameHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id, err := crypto.IdentityPubFromBase64(vars["id"])
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	var request PublishNameRequest
+	err = json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Name == "" || len(request.Name) > MaxNameLength || !utf8.ValidString(request.Name) {
+		http.Error(w, fmt.Sprintf("names must be valid UTF-8, between 1 and %d bytes", MaxNameLength), http.StatusBadRequest)
+		return
+	}
+	if request.Counter > math.MaxInt64 || !id.VerifyName(request.Counter, request.Name, request.Sig) {
+		http.Error(w, "bad signature", http.StatusBadRequest)
+		return
+	}
 
-	prekey, sig, err := server.getPrekey(id)
+	err = server.publishName(id, request.Name, int64(request.Counter), request.Sig)
+	if err == errNameTaken || err == errStaleName {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.WriteHeader(http.StatusAccepted)
+}
 
-	onetime, err := server.getOnetime(id)
+func (server *server) lookupHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	identity, counter, sig, err := server.lookupName(vars["name"])
+	if err == errNoName {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	response := SessionResponse{
-		prekey,
-		sig,
-		onetime,
+	response := LookupResponse{Identity: identity, Counter: uint64(counter), Sig: sig}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (server *server) sessionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := crypto.IdentityPubFromBase64(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Asking for a count of onetime keys returns them all at once, saving round trips
+	count := 0
+	if param := r.URL.Query().Get("count"); param != "" {
+		count, err = strconv.Atoi(param)
+		if err != nil || count < 1 || count > MaxSessionOnetimes {
+			http.Error(w, fmt.Sprintf("count must be between 1 and %d", MaxSessionOnetimes), http.StatusBadRequest)
+			return
+		}
+	}
+
+	keyID, prekey, sig, err := server.getPrekey(id)
+	if err == errNoPrekey {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := SessionResponse{KeyID: keyID, Prekey: prekey, Sig: sig}
+	if count == 0 {
+		response.OneTime, err = server.getOnetime(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if response.OneTime != nil {
+			server.metrics.onetimesServed.Inc()
+		}
+	}
+	// Each key is removed on its own, and we stop once there are none left
+	for i := 0; i < count; i++ {
+		onetime, err := server.getOnetime(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if onetime == nil {
+			break
+		}
+		server.metrics.onetimesServed.Inc()
+		response.OneTimes = append(response.OneTimes, onetime)
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(response)
 }
 
-func Run(database string, port int) {
-	server, err := newServer(database)
+// healthHandler answers as long as the process is up, for liveness probes
+func (server *server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// readyHandler answers once the database can be reached, for readiness probes
+func (server *server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	err := server.PingContext(r.Context())
 	if err != nil {
-		log.Fatal(err)
+		server.log.error("database isn't ready", "request", requestID(r.Context()), "err", err)
+		http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+		return
 	}
-	router := newRouter(server)
+	w.WriteHeader(http.StatusOK)
+}
+
+func newMux(server *server, router *router, limiter *rateLimiter) *mux.Router {
 	r := mux.NewRouter()
+	r.Use(server.log.middleware)
 
-	r.HandleFunc("/prekey/{id}", server.prekeyHandler).Methods("POST")
-	r.HandleFunc("/onetime/{id}", server.onetimeHandler).Methods("POST")
+	// The endpoints handling keys are rate limited, so that clients can't spam or drain them
+	r.Handle("/prekey/{id}", limiter.middleware(http.HandlerFunc(server.prekeyHandler))).Methods("POST")
+	r.Handle("/onetime/{id}", limiter.middleware(http.HandlerFunc(server.onetimeHandler))).Methods("POST")
 	r.HandleFunc("/onetime/count/{id}", server.onetimeCountHandler).Methods("GET")
-	r.HandleFunc("/session/{id}", server.sessionHandler).Methods("POST")
+	r.Handle("/session/{id}", limiter.middleware(http.HandlerFunc(server.sessionHandler))).Methods("POST")
 	r.HandleFunc("/rtc/{id}", router.rtcHandler)
+	r.HandleFunc("/presence/{id}", router.presenceHandler).Methods("GET")
+	if server.directory {
+		r.Handle("/name/{id}", limiter.middleware(http.HandlerFunc(server.publishNameHandler))).Methods("POST")
+		r.HandleFunc("/lookup/{name}", server.lookupHandler).Methods("GET")
+	}
+	r.Handle("/metrics", server.metrics.handler()).Methods("GET")
+	r.HandleFunc("/healthz", server.healthHandler).Methods("GET")
+	r.HandleFunc("/readyz", server.readyHandler).Methods("GET")
+
+	return r
+}
+
+// DefaultMaxMessageBytes is the default limit on the size of websocket messages
+const DefaultMaxMessageBytes = 64 << 10
+
+// DefaultBufferSize is the default size of the read and write buffers of each websocket connection
+const DefaultBufferSize = 4096
+
+// DefaultMaxConnections is the default limit on the number of websocket connections to a server
+const DefaultMaxConnections = 10000
+
+// DefaultMaxConnectionsPerIdentity is the default limit on the number of websocket connections of each identity
+const DefaultMaxConnectionsPerIdentity = 16
+
+// Config contains the settings used to run a server
+type Config struct {
+	// Driver is the database driver the server uses, either DriverSQLite or DriverPostgres
+	//
+	// If this is empty, DriverSQLite is used.
+	Driver string
+	// Database is the path to the server's database, or its connection string with Postgres
+	Database string
+	// Port is the port the server listens on
+	Port int
+	// MaxMessageBytes is the largest websocket message a client can send
+	//
+	// Clients sending larger messages are disconnected. If this is 0,
+	// DefaultMaxMessageBytes is used instead.
+	MaxMessageBytes int64
+	// CertFile is the path to a TLS certificate
+	//
+	// When both CertFile and KeyFile are set, the server uses TLS.
+	CertFile string
+	// KeyFile is the path to the private key for CertFile
+	KeyFile string
+	// RateLimit is the number of requests per second each client can make to the key endpoints
+	//
+	// Clients are limited both by identity, and by address. If this is 0,
+	// DefaultRateLimit is used instead.
+	RateLimit float64
+	// RateBurst is the number of requests each client can make at once to the key endpoints
+	//
+	// If this is 0, DefaultRateBurst is used instead.
+	RateBurst int
+	// LogLevel is the least severe kind of event logged, LogInfo by default
+	LogLevel LogLevel
+	// AllowedOrigins are the origins, besides the server's own, whose pages can open websocket connections
+	//
+	// Origins look like https://example.com, with a port if it isn't the default one.
+	// Connections without an origin, which don't come from browsers, are always allowed.
+	AllowedOrigins []string
+	// AllowAllOrigins lets pages from every origin open websocket connections, which is handy for local development
+	AllowAllOrigins bool
+	// ReadBufferSize is the size of the read buffer of each websocket connection, in bytes
+	//
+	// If this is 0, DefaultBufferSize is used instead.
+	ReadBufferSize int
+	// WriteBufferSize is the size of the write buffer of each websocket connection, in bytes
+	//
+	// If this is 0, DefaultBufferSize is used instead.
+	WriteBufferSize int
+	// MaxConnections is the number of websocket connections the server accepts at once
+	//
+	// Connections over the limit are rejected with 503 Service Unavailable. If this is 0,
+	// DefaultMaxConnections is used instead.
+	MaxConnections int
+	// MaxConnectionsPerIdentity is the number of websocket connections each identity can have at once
+	//
+	// Each device of an identity has its own connection. If this is 0,
+	// DefaultMaxConnectionsPerIdentity is used instead.
+	MaxConnectionsPerIdentity int
+	// QueueTTL is how long messages for offline identities are kept around for
+	//
+	// If this is 0, DefaultQueueTTL is used instead.
+	QueueTTL time.Duration
+	// KeyTTL is how long prekeys, and the onetime keys of identities that stopped uploading keys, are kept around for
+	//
+	// If this is 0, DefaultKeyTTL is used instead.
+	KeyTTL time.Duration
+	// PurgeInterval is how often expired messages and stale keys are removed
+	//
+	// If this is 0, DefaultPurgeInterval is used instead.
+	PurgeInterval time.Duration
+	// Directory lets identities publish names, which anyone can then look up
+	Directory bool
+}
+
+// shutdownTimeout is how long we wait for connections to finish when shutting down
+const shutdownTimeout = 10 * time.Second
+
+// Run starts a server, stopping gracefully on SIGINT or SIGTERM
+func Run(config Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", config.Port))
+	if err != nil {
+		return err
+	}
+	return Serve(ctx, config, listener)
+}
+
+// Serve serves requests on a listener, until the context is cancelled
+func Serve(ctx context.Context, config Config, listener net.Listener) error {
+	server, err := newServer(config.Driver, config.Database)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	defer server.Close()
+	server.log.level = config.LogLevel
+	if config.QueueTTL > 0 {
+		server.queueTTL = config.QueueTTL
+	}
+	if config.KeyTTL > 0 {
+		server.keyTTL = config.KeyTTL
+	}
+	server.directory = config.Directory
+	purgeInterval := config.PurgeInterval
+	if purgeInterval <= 0 {
+		purgeInterval = DefaultPurgeInterval
+	}
+	// The sweeper needs to stop before the database gets closed
+	sweepCtx, stopSweeping := context.WithCancel(ctx)
+	swept := make(chan struct{})
+	go func() {
+		server.sweep(sweepCtx, purgeInterval)
+		close(swept)
+	}()
+	defer func() {
+		stopSweeping()
+		<-swept
+	}()
+	router := newRouter(server, config)
+	r := newMux(server, router, newRateLimiter(config))
 
 	srv := &http.Server{
 		Handler:      r,
-		Addr:         fmt.Sprintf("localhost:%d", port),
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
 
-	log.Fatal(srv.ListenAndServe())
+	serveErr := make(chan error, 1)
+	go func() {
+		if config.CertFile != "" && config.KeyFile != "" {
+			serveErr <- srv.ServeTLS(listener, config.CertFile, config.KeyFile)
+		} else {
+			serveErr <- srv.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// Shutdown doesn't track websocket connections, so the router needs to close those itself
+	err = srv.Shutdown(shutdownCtx)
+	// Even if the server didn't shut down cleanly, the websocket clients still need to be closed
+	closeErr := router.close(shutdownCtx)
+	if err != nil {
+		return err
+	}
+	return closeErr
 }
@@ -0,0 +1,1067 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cronokirby/nuntius/internal/crypto"
+	"github.com/cronokirby/nuntius/internal/migrate"
+	"github.com/gorilla/websocket"
+)
+
+func TestGetOnetimeConcurrently(t *testing.T) {
+	server := newTestServer(t)
+	id, _ := newTestIdentity(t)
+	bundle, _, err := crypto.GenerateBundle(crypto.DefaultBundleSize)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	err = server.saveBundle(id, bundle)
+	if err != nil {
+		t.Errorf("couldn't save bundle: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	seen := make(map[string]bool)
+	for i := 0; i < bundle.Len(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			onetime, err := server.getOnetime(id)
+			if err != nil {
+				t.Errorf("couldn't get onetime key: %v", err)
+				return
+			}
+			// There are as many keys as sessions, so losing a race still leaves a key to hand out
+			if onetime == nil {
+				t.Errorf("session fell back to the prekey, while onetime keys were left")
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if seen[string(onetime)] {
+				t.Errorf("onetime key was returned twice: %v", onetime)
+			}
+			seen[string(onetime)] = true
+		}()
+	}
+	wg.Wait()
+
+	remaining, err := server.countOnetimes(id)
+	if err != nil {
+		t.Errorf("couldn't count onetime keys: %v", err)
+		return
+	}
+	if remaining != 0 || len(seen) != bundle.Len() {
+		t.Errorf("%d keys were handed out, but %d remain out of %d", len(seen), remaining, bundle.Len())
+		return
+	}
+}
+
+func TestGetOnetimeRetriesWhenTaken(t *testing.T) {
+	server := newTestServer(t)
+	id, _ := newTestIdentity(t)
+	bundle, _, err := crypto.GenerateBundle(3)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	err = server.saveBundle(id, bundle)
+	if err != nil {
+		t.Errorf("couldn't save bundle: %v", err)
+		return
+	}
+	oldDelete := deleteOnetime
+	defer func() { deleteOnetime = oldDelete }()
+	// Another session takes the first two keys we pick, right before we remove them
+	attempts := 0
+	deleteOnetime = func(tx *sql.Tx, id int64) (int64, error) {
+		attempts++
+		if attempts <= 2 {
+			return 0, nil
+		}
+		return oldDelete(tx, id)
+	}
+	onetime, err := server.getOnetime(id)
+	if err != nil {
+		t.Errorf("couldn't get onetime key: %v", err)
+		return
+	}
+	if onetime == nil {
+		t.Errorf("session fell back to the prekey, while onetime keys were left")
+		return
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, found %d", attempts)
+		return
+	}
+	remaining, err := server.countOnetimes(id)
+	if err != nil {
+		t.Errorf("couldn't count onetime keys: %v", err)
+		return
+	}
+	if remaining != 2 {
+		t.Errorf("expected 2 onetime keys left, found %d", remaining)
+		return
+	}
+
+	// Once the keys run out, the session only uses the prekey
+	deleteOnetime = oldDelete
+	for i := 0; i < remaining; i++ {
+		_, err := server.getOnetime(id)
+		if err != nil {
+			t.Errorf("couldn't get onetime key: %v", err)
+			return
+		}
+	}
+	onetime, err = server.getOnetime(id)
+	if err != nil || onetime != nil {
+		t.Errorf("expected no onetime key, found %v, %v", onetime, err)
+		return
+	}
+}
+
+func TestSessionWithoutPrekey(t *testing.T) {
+	server := newTestServer(t)
+	srv := httptest.NewServer(newMux(server, newRouter(server, Config{}), newRateLimiter(Config{})))
+	defer srv.Close()
+
+	bob, _ := newTestIdentity(t)
+	_, _, _, err := server.getPrekey(bob)
+	if err != errNoPrekey {
+		t.Errorf("expected errNoPrekey, found %v", err)
+		return
+	}
+	idBase64 := base64.URLEncoding.EncodeToString(bob)
+	resp, err := http.Post(fmt.Sprintf("%s/session/%s", srv.URL, idBase64), "application/json", nil)
+	if err != nil {
+		t.Errorf("couldn't create session: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status: %d", resp.StatusCode)
+		return
+	}
+}
+
+func TestSessionDatabaseErrors(t *testing.T) {
+	for _, table := range []string{"prekey", "onetime"} {
+		server := newTestServer(t)
+		srv := httptest.NewServer(newMux(server, newRouter(server, Config{}), newRateLimiter(Config{})))
+		defer srv.Close()
+
+		bob, bobPriv := newTestIdentity(t)
+		prekey, _, err := crypto.GenerateExchange()
+		if err != nil {
+			t.Errorf("couldn't generate prekey: %v", err)
+			return
+		}
+		err = server.savePrekey(bob, 1, prekey, bobPriv.SignPrekey(prekey), 1)
+		if err != nil {
+			t.Errorf("couldn't save prekey: %v", err)
+			return
+		}
+		// Without the table, looking up the keys fails with an actual database error
+		_, err = server.Exec(fmt.Sprintf("DROP TABLE %s;", table))
+		if err != nil {
+			t.Errorf("couldn't drop table: %v", err)
+			return
+		}
+
+		idBase64 := base64.URLEncoding.EncodeToString(bob)
+		resp, err := http.Post(fmt.Sprintf("%s/session/%s", srv.URL, idBase64), "application/json", nil)
+		if err != nil {
+			t.Errorf("couldn't create session: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("without %s table: unexpected status: %d", table, resp.StatusCode)
+			return
+		}
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	server := newTestServer(t)
+	srv := httptest.NewServer(newMux(server, newRouter(server, Config{}), newRateLimiter(Config{})))
+	defer srv.Close()
+
+	status := func(path string) int {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("couldn't get %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := status("/healthz"); code != http.StatusOK {
+		t.Errorf("unexpected health status: %d", code)
+		return
+	}
+	if code := status("/readyz"); code != http.StatusOK {
+		t.Errorf("unexpected readiness status: %d", code)
+		return
+	}
+
+	server.Close()
+	if code := status("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected readiness status with a closed database: %d", code)
+		return
+	}
+	if code := status("/healthz"); code != http.StatusOK {
+		t.Errorf("unexpected health status with a closed database: %d", code)
+		return
+	}
+}
+
+func TestSessionWithoutOnetime(t *testing.T) {
+	server := newTestServer(t)
+	srv := httptest.NewServer(newMux(server, newRouter(server, Config{}), newRateLimiter(Config{})))
+	defer srv.Close()
+
+	bob, bobPriv := newTestIdentity(t)
+	prekey, prekeyPriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	err = server.savePrekey(bob, 1, prekey, bobPriv.SignPrekey(prekey), 1)
+	if err != nil {
+		t.Errorf("couldn't save prekey: %v", err)
+		return
+	}
+	bundle, _, err := crypto.GenerateBundle(crypto.DefaultBundleSize)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	err = server.saveBundle(bob, bundle)
+	if err != nil {
+		t.Errorf("couldn't save bundle: %v", err)
+		return
+	}
+	for i := 0; i < bundle.Len(); i++ {
+		_, err := server.getOnetime(bob)
+		if err != nil {
+			t.Errorf("couldn't drain onetime keys: %v", err)
+			return
+		}
+	}
+
+	idBase64 := base64.URLEncoding.EncodeToString(bob)
+	resp, err := http.Post(fmt.Sprintf("%s/session/%s", srv.URL, idBase64), "application/json", nil)
+	if err != nil {
+		t.Errorf("couldn't create session: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("unexpected status: %d", resp.StatusCode)
+		return
+	}
+	var data SessionResponse
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		t.Errorf("couldn't decode session: %v", err)
+		return
+	}
+	if len(data.OneTime) != 0 {
+		t.Errorf("expected no onetime key, got %v", data.OneTime)
+		return
+	}
+	if !bytes.Equal(data.Prekey, prekey) {
+		t.Errorf("prekey %v != %v", data.Prekey, prekey)
+		return
+	}
+
+	alice, alicePriv := newTestIdentity(t)
+	ephemeral, ephemeralPriv, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate ephemeral key: %v", err)
+		return
+	}
+	forward, err := crypto.ForwardExchange(&crypto.ForwardExchangeParams{
+		Me:        alicePriv,
+		Ephemeral: ephemeralPriv,
+		Identity:  bob,
+		Prekey:    crypto.ExchangePub(data.Prekey),
+	})
+	if err != nil {
+		t.Errorf("forward exchange failed: %v", err)
+		return
+	}
+	backward, err := crypto.BackwardExchange(&crypto.BackwardExchangeParams{
+		Them:      alice,
+		Ephemeral: ephemeral,
+		Identity:  bobPriv,
+		Prekey:    prekeyPriv,
+	})
+	if err != nil {
+		t.Errorf("backward exchange failed: %v", err)
+		return
+	}
+	if !bytes.Equal(forward, backward) {
+		t.Errorf("shared secrets don't match")
+		return
+	}
+}
+
+func TestSessionWithSeveralOnetimes(t *testing.T) {
+	server := newTestServer(t)
+	srv := httptest.NewServer(newMux(server, newRouter(server, Config{}), newRateLimiter(Config{})))
+	defer srv.Close()
+
+	bob, bobPriv := newTestIdentity(t)
+	prekey, _, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	err = server.savePrekey(bob, 1, prekey, bobPriv.SignPrekey(prekey), 1)
+	if err != nil {
+		t.Errorf("couldn't save prekey: %v", err)
+		return
+	}
+	bundle, _, err := crypto.GenerateBundle(5)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	err = server.saveBundle(bob, bundle)
+	if err != nil {
+		t.Errorf("couldn't save bundle: %v", err)
+		return
+	}
+
+	idBase64 := base64.URLEncoding.EncodeToString(bob)
+	for _, count := range []string{"0", "17", "three"} {
+		resp, err := http.Post(fmt.Sprintf("%s/session/%s?count=%s", srv.URL, idBase64, count), "application/json", nil)
+		if err != nil {
+			t.Errorf("couldn't create session: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("count %s: unexpected status: %d", count, resp.StatusCode)
+			return
+		}
+	}
+
+	resp, err := http.Post(fmt.Sprintf("%s/session/%s?count=3", srv.URL, idBase64), "application/json", nil)
+	if err != nil {
+		t.Errorf("couldn't create session: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("unexpected status: %d", resp.StatusCode)
+		return
+	}
+	var data SessionResponse
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		t.Errorf("couldn't decode session: %v", err)
+		return
+	}
+	if len(data.OneTimes) != 3 || len(data.OneTime) != 0 {
+		t.Errorf("expected 3 onetime keys, found %d", len(data.OneTimes))
+		return
+	}
+	seen := make(map[string]bool)
+	for _, onetime := range data.OneTimes {
+		if seen[string(onetime)] {
+			t.Errorf("onetime key was handed out twice")
+			return
+		}
+		seen[string(onetime)] = true
+	}
+	count, err := server.countOnetimes(bob)
+	if err != nil {
+		t.Errorf("couldn't count onetime keys: %v", err)
+		return
+	}
+	if count != 2 {
+		t.Errorf("expected 2 onetime keys left, found %d", count)
+		return
+	}
+	for i := 0; i < 2; i++ {
+		onetime, err := server.getOnetime(bob)
+		if err != nil {
+			t.Errorf("couldn't get onetime key: %v", err)
+			return
+		}
+		if seen[string(onetime)] {
+			t.Errorf("handed out onetime key wasn't removed")
+			return
+		}
+	}
+}
+
+func TestShutdownClosesConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("couldn't listen: %v", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(ctx, Config{Database: path.Join(t.TempDir(), "server.db")}, listener)
+	}()
+
+	alice, alicePriv := newTestIdentity(t)
+	conn := dialTestRouter(t, "http://"+listener.Addr().String(), alice, alicePriv)
+	defer conn.Close()
+	// A round trip through the router ensures that our connection has been registered
+	err = conn.WriteJSON(Message{To: alice, Version: MessageVersion, Payload: Payload{Variant: &MessagePayload{Data: []byte{1}}}})
+	if err != nil {
+		t.Errorf("couldn't send message: %v", err)
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var message Message
+	err = conn.ReadJSON(&message)
+	if err != nil {
+		t.Errorf("couldn't receive message: %v", err)
+		return
+	}
+
+	cancel()
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected connection to be closed, found %v", err)
+		return
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("shutdown failed: %v", err)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("server didn't shut down")
+		return
+	}
+}
+
+func TestRunRelaysMessages(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("couldn't listen: %v", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(ctx, Config{Database: path.Join(t.TempDir(), "server.db")}, listener)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	root := "http://" + listener.Addr().String()
+
+	alice, alicePriv := newTestIdentity(t)
+	bob, bobPriv := newTestIdentity(t)
+	aliceConn := dialTestRouter(t, root, alice, alicePriv)
+	defer aliceConn.Close()
+	bobConn := dialTestRouter(t, root, bob, bobPriv)
+	defer bobConn.Close()
+	// Otherwise, the message would be queued instead of relayed
+	if !waitFor(func() bool { return getPresence(t, root, bob) }) {
+		t.Errorf("bob never came online")
+		return
+	}
+
+	err = aliceConn.WriteJSON(Message{To: bob, Version: MessageVersion, Payload: Payload{Variant: &MessagePayload{Data: []byte{1}}}})
+	if err != nil {
+		t.Errorf("couldn't send message: %v", err)
+		return
+	}
+	bobConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var message Message
+	err = bobConn.ReadJSON(&message)
+	if err != nil {
+		t.Errorf("couldn't receive message: %v", err)
+		return
+	}
+	payload, ok := message.Payload.Variant.(*MessagePayload)
+	if !ok || !bytes.Equal(payload.Data, []byte{1}) || !bytes.Equal(message.From, alice) {
+		t.Errorf("unexpected message: %v", message)
+		return
+	}
+}
+
+func TestPrekeysCoexist(t *testing.T) {
+	server := newTestServer(t)
+	id, priv := newTestIdentity(t)
+	var prekeys []crypto.ExchangePub
+	for keyID := uint32(1); keyID <= 2; keyID++ {
+		prekey, _, err := crypto.GenerateExchange()
+		if err != nil {
+			t.Errorf("couldn't generate prekey: %v", err)
+			return
+		}
+		err = server.savePrekey(id, keyID, prekey, priv.SignPrekey(prekey), int64(keyID))
+		if err != nil {
+			t.Errorf("couldn't save prekey: %v", err)
+			return
+		}
+		prekeys = append(prekeys, prekey)
+	}
+
+	keyID, prekey, _, err := server.getPrekey(id)
+	if err != nil {
+		t.Errorf("couldn't get prekey: %v", err)
+		return
+	}
+	if keyID != 2 || !bytes.Equal(prekey, prekeys[1]) {
+		t.Errorf("expected newest prekey, found %d %v", keyID, prekey)
+		return
+	}
+	var old crypto.ExchangePub
+	err = server.QueryRow("SELECT prekey FROM prekey WHERE identity = $1 AND key_id = 1;", id).Scan(&old)
+	if err != nil {
+		t.Errorf("couldn't find older prekey: %v", err)
+		return
+	}
+	if !bytes.Equal(old, prekeys[0]) {
+		t.Errorf("older prekey %v != %v", old, prekeys[0])
+		return
+	}
+}
+
+// saveTestKeys saves a prekey, and a bundle of onetime keys, uploaded at a given time
+func saveTestKeys(t *testing.T, server *server, id crypto.IdentityPub, priv crypto.IdentityPriv, keyID uint32, onetimes int, at time.Time) {
+	prekey, _, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Fatalf("couldn't generate prekey: %v", err)
+	}
+	err = server.savePrekey(id, keyID, prekey, priv.SignPrekey(prekey), int64(keyID))
+	if err != nil {
+		t.Fatalf("couldn't save prekey: %v", err)
+	}
+	_, err = server.Exec("UPDATE prekey SET created_at = $1 WHERE identity = $2 AND key_id = $3;", at.Unix(), id, keyID)
+	if err != nil {
+		t.Fatalf("couldn't change prekey time: %v", err)
+	}
+	if onetimes == 0 {
+		return
+	}
+	bundle, _, err := crypto.GenerateBundle(onetimes)
+	if err != nil {
+		t.Fatalf("couldn't generate bundle: %v", err)
+	}
+	err = server.saveBundle(id, bundle)
+	if err != nil {
+		t.Fatalf("couldn't save bundle: %v", err)
+	}
+	_, err = server.Exec("UPDATE onetime SET created_at = $1 WHERE identity = $2;", at.Unix(), id)
+	if err != nil {
+		t.Fatalf("couldn't change onetime time: %v", err)
+	}
+}
+
+func TestStaleKeysArePurged(t *testing.T) {
+	server := newTestServer(t)
+	stale := time.Now().Add(-server.keyTTL - time.Hour)
+	fresh := time.Now()
+	// Alice stopped using the server, while Bob still renews his prekey
+	alice, alicePriv := newTestIdentity(t)
+	saveTestKeys(t, server, alice, alicePriv, 1, 3, stale)
+	bob, bobPriv := newTestIdentity(t)
+	saveTestKeys(t, server, bob, bobPriv, 1, 2, stale)
+	saveTestKeys(t, server, bob, bobPriv, 2, 0, fresh)
+	// Carol's prekey is about to expire, but sessions can still use it
+	carol, carolPriv := newTestIdentity(t)
+	saveTestKeys(t, server, carol, carolPriv, 1, 0, time.Now().Add(-server.keyTTL+time.Hour))
+
+	prekeys, onetimes, err := server.purgeStaleKeys()
+	if err != nil {
+		t.Errorf("couldn't purge stale keys: %v", err)
+		return
+	}
+	if prekeys != 2 || onetimes != 3 {
+		t.Errorf("expected to purge 2 prekeys and 3 onetime keys, found %d and %d", prekeys, onetimes)
+		return
+	}
+
+	srv := httptest.NewServer(newMux(server, newRouter(server, Config{}), newRateLimiter(Config{})))
+	defer srv.Close()
+	for _, c := range []struct {
+		id      crypto.IdentityPub
+		status  int
+		keyID   uint32
+		onetime bool
+	}{
+		{alice, http.StatusNotFound, 0, false},
+		{bob, http.StatusAccepted, 2, true},
+		{carol, http.StatusAccepted, 1, false},
+	} {
+		resp, err := http.Post(fmt.Sprintf("%s/session/%s", srv.URL, base64.URLEncoding.EncodeToString(c.id)), "application/json", nil)
+		if err != nil {
+			t.Errorf("couldn't create session: %v", err)
+			return
+		}
+		var data SessionResponse
+		json.NewDecoder(resp.Body).Decode(&data)
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("expected status %d, found %d", c.status, resp.StatusCode)
+			return
+		}
+		if c.status == http.StatusAccepted && (data.KeyID != c.keyID || (data.OneTime != nil) != c.onetime) {
+			t.Errorf("unexpected session: %+v", data)
+			return
+		}
+	}
+}
+
+func TestMigratePrekeys(t *testing.T) {
+	database := path.Join(t.TempDir(), "server.db")
+	db, err := sql.Open("sqlite", database)
+	if err != nil {
+		t.Errorf("couldn't open database: %v", err)
+		return
+	}
+	id, priv := newTestIdentity(t)
+	prekey, _, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	_, err = db.Exec(`
+	CREATE TABLE prekey (
+		identity BLOB PRIMARY KEY NOT NULL,
+		prekey BLOB NOT NULL,
+		signature BLOB NOT NULL
+	);
+	INSERT INTO prekey (identity, prekey, signature) VALUES ($1, $2, $3);
+	`, id, prekey, priv.Sign(prekey))
+	if err != nil {
+		db.Close()
+		t.Errorf("couldn't create old table: %v", err)
+		return
+	}
+
+	// The first migration moves the old prekeys over
+	_, err = db.Exec(metaTables[DriverSQLite])
+	if err == nil {
+		err = migrate.Run(db, serverMigrations(DriverSQLite)[:1])
+	}
+	if err != nil {
+		db.Close()
+		t.Errorf("couldn't run first migration: %v", err)
+		return
+	}
+	keyID, actual, _, err := (&server{DB: db}).getPrekey(id)
+	db.Close()
+	if err != nil {
+		t.Errorf("couldn't get migrated prekey: %v", err)
+		return
+	}
+	if keyID != 0 || !bytes.Equal(actual, prekey) {
+		t.Errorf("unexpected migrated prekey: %d %v", keyID, actual)
+		return
+	}
+
+	// Its signature is from before version 2 of the protocol, so it gets dropped afterwards
+	server, err := newServer(DriverSQLite, database)
+	if err != nil {
+		t.Errorf("couldn't migrate server: %v", err)
+		return
+	}
+	defer server.Close()
+	_, _, _, err = server.getPrekey(id)
+	if err != errNoPrekey {
+		t.Errorf("expected errNoPrekey, found %v", err)
+		return
+	}
+}
+
+func TestOutdatedClientsAreRejected(t *testing.T) {
+	server := newTestServer(t)
+	srv := httptest.NewServer(newMux(server, newRouter(server, Config{}), newRateLimiter(Config{})))
+	defer srv.Close()
+
+	id, priv := newTestIdentity(t)
+	prekey, _, err := crypto.GenerateExchange()
+	if err != nil {
+		t.Errorf("couldn't generate prekey: %v", err)
+		return
+	}
+	idBase64 := base64.URLEncoding.EncodeToString(id)
+	for _, request := range []PrekeyRequest{
+		// Older clients don't send a version, and sign prekeys without a context
+		{KeyID: 1, Prekey: prekey, Sig: priv.Sign(prekey)},
+		{KeyID: 1, Prekey: prekey, Sig: priv.Sign(prekey), Version: ProtocolVersion},
+	} {
+		body, err := json.Marshal(request)
+		if err != nil {
+			t.Errorf("couldn't encode request: %v", err)
+			return
+		}
+		resp, err := http.Post(fmt.Sprintf("%s/prekey/%s", srv.URL, idBase64), "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Errorf("couldn't send prekey: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400, found %d", resp.StatusCode)
+			return
+		}
+	}
+	_, _, _, err = server.getPrekey(id)
+	if err != errNoPrekey {
+		t.Errorf("expected errNoPrekey, found %v", err)
+		return
+	}
+}
+
+func TestReplayedPrekeyIsRejected(t *testing.T) {
+	server := newTestServer(t)
+	srv := httptest.NewServer(newMux(server, newRouter(server, Config{}), newRateLimiter(Config{})))
+	defer srv.Close()
+
+	id, priv := newTestIdentity(t)
+	idBase64 := base64.URLEncoding.EncodeToString(id)
+	var bodies [][]byte
+	for i, counter := range []uint64{10, 20} {
+		prekey, _, err := crypto.GenerateExchange()
+		if err != nil {
+			t.Errorf("couldn't generate prekey: %v", err)
+			return
+		}
+		keyID := uint32(i + 1)
+		body, err := json.Marshal(PrekeyRequest{
+			KeyID:     keyID,
+			Prekey:    prekey,
+			Sig:       priv.SignPrekey(prekey),
+			Counter:   counter,
+			UploadSig: priv.SignPrekeyUpload(counter, keyID, prekey),
+			Version:   ProtocolVersion,
+		})
+		if err != nil {
+			t.Errorf("couldn't encode request: %v", err)
+			return
+		}
+		bodies = append(bodies, body)
+	}
+
+	post := func(body []byte) int {
+		resp, err := http.Post(fmt.Sprintf("%s/prekey/%s", srv.URL, idBase64), "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("couldn't send prekey: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, body := range bodies {
+		if status := post(body); status != http.StatusAccepted {
+			t.Errorf("expected status 202, found %d", status)
+			return
+		}
+	}
+	// Both the older upload, and the newest one, have been captured and are sent again
+	for _, body := range bodies {
+		if status := post(body); status != http.StatusConflict {
+			t.Errorf("expected status 409, found %d", status)
+			return
+		}
+	}
+	keyID, _, _, err := server.getPrekey(id)
+	if err != nil {
+		t.Errorf("couldn't get prekey: %v", err)
+		return
+	}
+	if keyID != 2 {
+		t.Errorf("replayed prekey %d replaced the newest one", keyID)
+		return
+	}
+}
+
+func TestBundleSizeIsChecked(t *testing.T) {
+	server := newTestServer(t)
+	srv := httptest.NewServer(newMux(server, newRouter(server, Config{}), newRateLimiter(Config{})))
+	defer srv.Close()
+
+	id, priv := newTestIdentity(t)
+	full, _, err := crypto.GenerateBundle(crypto.MaxBundleSize)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	extra, _, err := crypto.GenerateBundle(1)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	oversized := append(append(crypto.BundlePub(nil), full...), extra...)
+	// A bundle with more keys than the server stores is rejected too, even if it's not oversized
+	overflowing := full[:(maxOnetimes+1)*crypto.ExchangePubSize]
+	idBase64 := base64.URLEncoding.EncodeToString(id)
+	for _, bundle := range []crypto.BundlePub{{}, oversized, overflowing} {
+		body, err := json.Marshal(SendBundleRequest{Bundle: bundle, Sig: priv.SignBundle(bundle), Version: ProtocolVersion})
+		if err != nil {
+			t.Errorf("couldn't encode request: %v", err)
+			return
+		}
+		resp, err := http.Post(fmt.Sprintf("%s/onetime/%s", srv.URL, idBase64), "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Errorf("couldn't send bundle: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400 for %d keys, found %d", bundle.Len(), resp.StatusCode)
+			return
+		}
+	}
+	count, err := server.countOnetimes(id)
+	if err != nil {
+		t.Errorf("couldn't count onetime keys: %v", err)
+		return
+	}
+	if count != 0 {
+		t.Errorf("expected no onetime keys, found %d", count)
+		return
+	}
+}
+
+func TestCountOnetimesIncludesMax(t *testing.T) {
+	server := newTestServer(t)
+	srv := httptest.NewServer(newMux(server, newRouter(server, Config{}), newRateLimiter(Config{})))
+	defer srv.Close()
+
+	id, _ := newTestIdentity(t)
+	bundle, _, err := crypto.GenerateBundle(3)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	err = server.saveBundle(id, bundle)
+	if err != nil {
+		t.Errorf("couldn't save bundle: %v", err)
+		return
+	}
+	resp, err := http.Get(srv.URL + "/onetime/count/" + base64.URLEncoding.EncodeToString(id))
+	if err != nil {
+		t.Errorf("couldn't count onetime keys: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	var response CountOnetimeResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		t.Errorf("couldn't decode response: %v", err)
+		return
+	}
+	if response != (CountOnetimeResponse{Count: 3, Max: maxOnetimes}) {
+		t.Errorf("unexpected response: %+v", response)
+		return
+	}
+}
+
+func TestSaveBundleDeduplicatesAndCaps(t *testing.T) {
+	server := newTestServer(t)
+	id, priv := newTestIdentity(t)
+	first, _, err := crypto.GenerateBundle(maxOnetimes / 2)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	fresh, _, err := crypto.GenerateBundle(maxOnetimes / 4)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	// Half of this bundle overlaps with the first one
+	overlapping := append(append(crypto.BundlePub(nil), first[:len(fresh)]...), fresh...)
+	for _, bundle := range []crypto.BundlePub{first, overlapping} {
+		err = server.saveBundle(id, bundle)
+		if err != nil {
+			t.Errorf("couldn't save bundle: %v", err)
+			return
+		}
+	}
+	expected := first.Len() + fresh.Len()
+	count, err := server.countOnetimes(id)
+	if err != nil {
+		t.Errorf("couldn't count onetime keys: %v", err)
+		return
+	}
+	if count != expected {
+		t.Errorf("expected %d onetime keys, found %d", expected, count)
+		return
+	}
+
+	overflowing, _, err := crypto.GenerateBundle(maxOnetimes - expected + 1)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	srv := httptest.NewServer(newMux(server, newRouter(server, Config{}), newRateLimiter(Config{})))
+	defer srv.Close()
+	body, err := json.Marshal(SendBundleRequest{Bundle: overflowing, Sig: priv.SignBundle(overflowing), Version: ProtocolVersion})
+	if err != nil {
+		t.Errorf("couldn't encode request: %v", err)
+		return
+	}
+	idBase64 := base64.URLEncoding.EncodeToString(id)
+	resp, err := http.Post(fmt.Sprintf("%s/onetime/%s", srv.URL, idBase64), "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Errorf("couldn't send bundle: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected status 409, found %d", resp.StatusCode)
+		return
+	}
+	count, err = server.countOnetimes(id)
+	if err != nil {
+		t.Errorf("couldn't count onetime keys: %v", err)
+		return
+	}
+	if count != expected {
+		t.Errorf("overflowing bundle was partially saved, found %d keys", count)
+		return
+	}
+}
+
+// newDirectoryServer starts a server with its directory enabled
+func newDirectoryServer(t *testing.T) *httptest.Server {
+	server := newTestServer(t)
+	server.directory = true
+	srv := httptest.NewServer(newMux(server, newRouter(server, Config{}), newRateLimiter(Config{})))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// publishName publishes a name for an identity, returning the status of the response
+func publishName(t *testing.T, root string, id crypto.IdentityPub, request PublishNameRequest) int {
+	body, err := json.Marshal(request)
+	if err != nil {
+		t.Fatalf("couldn't encode request: %v", err)
+	}
+	resp, err := http.Post(root+"/name/"+base64.URLEncoding.EncodeToString(id), "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("couldn't publish name: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestPublishAndLookupName(t *testing.T) {
+	srv := newDirectoryServer(t)
+	alice, alicePriv := newTestIdentity(t)
+	bob, bobPriv := newTestIdentity(t)
+
+	status := publishName(t, srv.URL, alice, PublishNameRequest{Name: "alice", Counter: 1, Sig: alicePriv.SignName(1, "alice")})
+	if status != http.StatusAccepted {
+		t.Errorf("expected status 202, found %d", status)
+		return
+	}
+	resp, err := http.Get(srv.URL + "/lookup/alice")
+	if err != nil {
+		t.Errorf("couldn't look up name: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	var response LookupResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		t.Errorf("couldn't decode response: %v", err)
+		return
+	}
+	if !bytes.Equal(response.Identity, alice) || !alice.VerifyName(response.Counter, "alice", response.Sig) {
+		t.Errorf("unexpected lookup: %v", response)
+		return
+	}
+
+	// Names belong to whoever published them first, and replayed names can't roll back a newer one
+	status = publishName(t, srv.URL, bob, PublishNameRequest{Name: "alice", Counter: 1, Sig: bobPriv.SignName(1, "alice")})
+	if status != http.StatusConflict {
+		t.Errorf("expected status 409 for a taken name, found %d", status)
+		return
+	}
+	status = publishName(t, srv.URL, alice, PublishNameRequest{Name: "alicia", Counter: 2, Sig: alicePriv.SignName(2, "alicia")})
+	if status != http.StatusAccepted {
+		t.Errorf("expected status 202, found %d", status)
+		return
+	}
+	status = publishName(t, srv.URL, alice, PublishNameRequest{Name: "alice", Counter: 1, Sig: alicePriv.SignName(1, "alice")})
+	if status != http.StatusConflict {
+		t.Errorf("expected status 409 for a replayed name, found %d", status)
+		return
+	}
+	resp, err = http.Get(srv.URL + "/lookup/alice")
+	if err != nil {
+		t.Errorf("couldn't look up name: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status 404 for a replaced name, found %d", resp.StatusCode)
+		return
+	}
+}
+
+func TestPublishNameRejectsForgeries(t *testing.T) {
+	srv := newDirectoryServer(t)
+	alice, _ := newTestIdentity(t)
+	_, malloryPriv := newTestIdentity(t)
+
+	for _, request := range []PublishNameRequest{
+		{Name: "alice", Counter: 1},
+		{Name: "alice", Counter: 1, Sig: malloryPriv.SignName(1, "alice")},
+		{Name: strings.Repeat("a", MaxNameLength+1), Counter: 1, Sig: malloryPriv.SignName(1, strings.Repeat("a", MaxNameLength+1))},
+	} {
+		status := publishName(t, srv.URL, alice, request)
+		if status != http.StatusBadRequest {
+			t.Errorf("expected status 400, found %d", status)
+			return
+		}
+	}
+	resp, err := http.Get(srv.URL + "/lookup/alice")
+	if err != nil {
+		t.Errorf("couldn't look up name: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status 404, found %d", resp.StatusCode)
+		return
+	}
+}
+
+func TestDirectoryIsOptIn(t *testing.T) {
+	server := newTestServer(t)
+	srv := httptest.NewServer(newMux(server, newRouter(server, Config{}), newRateLimiter(Config{})))
+	defer srv.Close()
+	alice, alicePriv := newTestIdentity(t)
+	status := publishName(t, srv.URL, alice, PublishNameRequest{Name: "alice", Counter: 1, Sig: alicePriv.SignName(1, "alice")})
+	if status != http.StatusNotFound {
+		t.Errorf("expected status 404 without a directory, found %d", status)
+		return
+	}
+}
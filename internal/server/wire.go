@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/cronokirby/nuntius/internal/server/wirepb"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative wirepb/wire.proto
+
+// WireFormat is the encoding used for messages sent over a websocket
+type WireFormat string
+
+const (
+	// WireJSON encodes messages as JSON, in text messages
+	//
+	// This is the format used by older clients and servers.
+	WireJSON WireFormat = "json"
+	// WireProtobuf encodes messages as protobuf, described in wirepb/wire.proto, in binary messages
+	WireProtobuf WireFormat = "protobuf"
+)
+
+// ParseWireFormat parses the name of a wire format
+//
+// An empty name means that the client doesn't know about wire formats, and uses JSON.
+func ParseWireFormat(name string) (WireFormat, error) {
+	switch WireFormat(name) {
+	case "", WireJSON:
+		return WireJSON, nil
+	case WireProtobuf:
+		return WireProtobuf, nil
+	default:
+		return "", fmt.Errorf("unknown wire format: %s", name)
+	}
+}
+
+// EncodeMessage encodes a message, returning the type of websocket message to send it with
+func EncodeMessage(format WireFormat, message Message) (int, []byte, error) {
+	switch format {
+	case WireJSON:
+		data, err := json.Marshal(message)
+		return websocket.TextMessage, data, err
+	case WireProtobuf:
+		data, err := message.MarshalBinary()
+		return websocket.BinaryMessage, data, err
+	default:
+		return 0, nil, fmt.Errorf("unknown wire format: %s", format)
+	}
+}
+
+// DecodeMessage decodes a message, using the type of websocket message to pick the format
+func DecodeMessage(messageType int, data []byte) (Message, error) {
+	var message Message
+	var err error
+	switch messageType {
+	case websocket.TextMessage:
+		err = json.Unmarshal(data, &message)
+	case websocket.BinaryMessage:
+		err = message.UnmarshalBinary(data)
+	default:
+		err = fmt.Errorf("unexpected websocket message type: %d", messageType)
+	}
+	return message, err
+}
+
+// toWire converts a message into its protobuf representation
+func toWire(message Message) (*wirepb.Message, error) {
+	out := &wirepb.Message{From: message.From, To: message.To, Version: uint32(message.Version)}
+	switch v := message.Payload.Variant.(type) {
+	case *MessagePayload:
+		out.Payload = &wirepb.Message_Message{Message: &wirepb.MessagePayload{MessageId: v.MessageID, Data: v.Data}}
+	case *QueryExchangePayload:
+		out.Payload = &wirepb.Message_QueryExchange{QueryExchange: &wirepb.QueryExchangePayload{}}
+	case *StartExchangePayload:
+		out.Payload = &wirepb.Message_StartExchange{StartExchange: &wirepb.StartExchangePayload{
+			KeyId:   v.KeyID,
+			Prekey:  v.Prekey,
+			Sig:     v.Sig,
+			Onetime: v.OneTime,
+		}}
+	case *EndExchangePayload:
+		out.Payload = &wirepb.Message_EndExchange{EndExchange: &wirepb.EndExchangePayload{
+			PrekeyId:    v.PrekeyID,
+			Prekey:      v.Prekey,
+			Onetime:     v.OneTime,
+			Ephemeral:   v.Ephemeral,
+			InitialData: v.InitialData,
+		}}
+	case *FilePayload:
+		out.Payload = &wirepb.Message_File{File: &wirepb.FilePayload{
+			Name:     v.Name,
+			MimeType: v.MimeType,
+			Data:     v.Data,
+		}}
+	case *TypingPayload:
+		out.Payload = &wirepb.Message_Typing{Typing: &wirepb.TypingPayload{Data: v.Data}}
+	case *ReceiptPayload:
+		out.Payload = &wirepb.Message_Receipt{Receipt: &wirepb.ReceiptPayload{MessageId: v.MessageID, Data: v.Data}}
+	case *AckPayload:
+		out.Payload = &wirepb.Message_Ack{Ack: &wirepb.AckPayload{MessageId: v.MessageID, Data: v.Data}}
+	case *GroupMessagePayload:
+		out.Payload = &wirepb.Message_GroupMessage{GroupMessage: &wirepb.GroupMessagePayload{GroupId: v.GroupID, Data: v.Data}}
+	default:
+		return nil, fmt.Errorf("unknown variant: %T", message.Payload.Variant)
+	}
+	return out, nil
+}
+
+// fromWire converts the protobuf representation of a message back into a message
+func fromWire(in *wirepb.Message) (Message, error) {
+	message := Message{From: in.From, To: in.To, Version: int(in.Version)}
+	switch v := in.Payload.(type) {
+	case *wirepb.Message_Message:
+		message.Payload.Variant = &MessagePayload{MessageID: v.Message.MessageId, Data: v.Message.Data}
+	case *wirepb.Message_QueryExchange:
+		message.Payload.Variant = &QueryExchangePayload{}
+	case *wirepb.Message_StartExchange:
+		message.Payload.Variant = &StartExchangePayload{
+			KeyID:   v.StartExchange.KeyId,
+			Prekey:  v.StartExchange.Prekey,
+			Sig:     v.StartExchange.Sig,
+			OneTime: v.StartExchange.Onetime,
+		}
+	case *wirepb.Message_EndExchange:
+		message.Payload.Variant = &EndExchangePayload{
+			PrekeyID:    v.EndExchange.PrekeyId,
+			Prekey:      v.EndExchange.Prekey,
+			OneTime:     v.EndExchange.Onetime,
+			Ephemeral:   v.EndExchange.Ephemeral,
+			InitialData: v.EndExchange.InitialData,
+		}
+	case *wirepb.Message_File:
+		message.Payload.Variant = &FilePayload{
+			Name:     v.File.Name,
+			MimeType: v.File.MimeType,
+			Data:     v.File.Data,
+		}
+	case *wirepb.Message_Typing:
+		message.Payload.Variant = &TypingPayload{Data: v.Typing.Data}
+	case *wirepb.Message_Receipt:
+		message.Payload.Variant = &ReceiptPayload{MessageID: v.Receipt.MessageId, Data: v.Receipt.Data}
+	case *wirepb.Message_Ack:
+		message.Payload.Variant = &AckPayload{MessageID: v.Ack.MessageId, Data: v.Ack.Data}
+	case *wirepb.Message_GroupMessage:
+		message.Payload.Variant = &GroupMessagePayload{GroupID: v.GroupMessage.GroupId, Data: v.GroupMessage.Data}
+	default:
+		return Message{}, errors.New("message has no payload")
+	}
+	return message, nil
+}
+
+// MarshalBinary encodes a message as protobuf
+func (message Message) MarshalBinary() ([]byte, error) {
+	out, err := toWire(message)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(out)
+}
+
+// UnmarshalBinary decodes a message encoded as protobuf
+func (message *Message) UnmarshalBinary(data []byte) error {
+	var in wirepb.Message
+	err := proto.Unmarshal(data, &in)
+	if err != nil {
+		return err
+	}
+	*message, err = fromWire(&in)
+	return err
+}
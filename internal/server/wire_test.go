@@ -0,0 +1,77 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testPayloads has an example of every payload variant
+var testPayloads = []interface{}{
+	&MessagePayload{Data: []byte{1, 2, 3}},
+	&MessagePayload{MessageID: []byte{18, 19}, Data: []byte{1, 2, 3}},
+	&QueryExchangePayload{},
+	&StartExchangePayload{KeyID: 300, Prekey: []byte{4, 5}, Sig: []byte{6}, OneTime: []byte{7}},
+	&StartExchangePayload{Prekey: []byte{4, 5}, Sig: []byte{6}},
+	&EndExchangePayload{PrekeyID: 1, Prekey: []byte{8}, OneTime: []byte{9}, Ephemeral: []byte{10}, InitialData: []byte{11}},
+	&FilePayload{Name: "notes.txt", MimeType: "text/plain", Data: []byte("hello")},
+	&TypingPayload{Data: []byte{12}},
+	&ReceiptPayload{MessageID: []byte{13, 14}, Data: []byte{15}},
+	&GroupMessagePayload{GroupID: []byte{16}, Data: []byte{17}},
+	&AckPayload{MessageID: []byte{20, 21}, Data: []byte{22}},
+}
+
+func TestWireRoundtrip(t *testing.T) {
+	for _, format := range []WireFormat{WireJSON, WireProtobuf} {
+		for _, variant := range testPayloads {
+			message := Message{From: []byte{0xAA}, To: []byte{0xBB}, Version: MessageVersion, Payload: Payload{Variant: variant}}
+			messageType, data, err := EncodeMessage(format, message)
+			if err != nil {
+				t.Errorf("couldn't encode %T as %s: %v", variant, format, err)
+				return
+			}
+			decoded, err := DecodeMessage(messageType, data)
+			if err != nil {
+				t.Errorf("couldn't decode %T as %s: %v", variant, format, err)
+				return
+			}
+			if !reflect.DeepEqual(decoded, message) {
+				t.Errorf("%s: %+v != %+v", format, decoded.Payload.Variant, variant)
+				return
+			}
+		}
+	}
+}
+
+func TestUnmarshalBinaryRejectsMalformed(t *testing.T) {
+	data, err := Message{To: []byte{1, 2, 3}, Payload: Payload{Variant: &MessagePayload{Data: []byte{4, 5}}}}.MarshalBinary()
+	if err != nil {
+		t.Errorf("couldn't encode message: %v", err)
+		return
+	}
+	for i := 1; i < len(data); i++ {
+		var message Message
+		if message.UnmarshalBinary(data[:i]) == nil {
+			t.Errorf("decoded message truncated to %d bytes", i)
+			return
+		}
+	}
+	var message Message
+	// Only the recipient, without a payload
+	if message.UnmarshalBinary([]byte{0x12, 0x01, 0x01}) == nil {
+		t.Errorf("decoded message without a payload")
+		return
+	}
+}
+
+func TestParseWireFormat(t *testing.T) {
+	format, err := ParseWireFormat("")
+	if err != nil || format != WireJSON {
+		t.Errorf("expected missing format to mean JSON, found %q, %v", format, err)
+		return
+	}
+	_, err = ParseWireFormat("xml")
+	if err == nil {
+		t.Errorf("expected error for unknown format")
+		return
+	}
+}
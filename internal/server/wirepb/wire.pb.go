@@ -0,0 +1,1036 @@
+// This describes the protobuf wire format for messages.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.27.1
+// 	protoc        (unknown)
+// source: wirepb/wire.proto
+
+package wirepb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Message struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	From    []byte `protobuf:"bytes,1,opt,name=from,proto3" json:"from,omitempty"`
+	To      []byte `protobuf:"bytes,2,opt,name=to,proto3" json:"to,omitempty"`
+	Version uint32 `protobuf:"varint,12,opt,name=version,proto3" json:"version,omitempty"`
+	// Types that are assignable to Payload:
+	//	*Message_Message
+	//	*Message_QueryExchange
+	//	*Message_StartExchange
+	//	*Message_EndExchange
+	//	*Message_File
+	//	*Message_Typing
+	//	*Message_Receipt
+	//	*Message_GroupMessage
+	//	*Message_Ack
+	Payload isMessage_Payload `protobuf_oneof:"payload"`
+}
+
+func (x *Message) Reset() {
+	*x = Message{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_wirepb_wire_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Message) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Message) ProtoMessage() {}
+
+func (x *Message) ProtoReflect() protoreflect.Message {
+	mi := &file_wirepb_wire_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Message.ProtoReflect.Descriptor instead.
+func (*Message) Descriptor() ([]byte, []int) {
+	return file_wirepb_wire_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Message) GetFrom() []byte {
+	if x != nil {
+		return x.From
+	}
+	return nil
+}
+
+func (x *Message) GetTo() []byte {
+	if x != nil {
+		return x.To
+	}
+	return nil
+}
+
+func (x *Message) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (m *Message) GetPayload() isMessage_Payload {
+	if m != nil {
+		return m.Payload
+	}
+	return nil
+}
+
+func (x *Message) GetMessage() *MessagePayload {
+	if x, ok := x.GetPayload().(*Message_Message); ok {
+		return x.Message
+	}
+	return nil
+}
+
+func (x *Message) GetQueryExchange() *QueryExchangePayload {
+	if x, ok := x.GetPayload().(*Message_QueryExchange); ok {
+		return x.QueryExchange
+	}
+	return nil
+}
+
+func (x *Message) GetStartExchange() *StartExchangePayload {
+	if x, ok := x.GetPayload().(*Message_StartExchange); ok {
+		return x.StartExchange
+	}
+	return nil
+}
+
+func (x *Message) GetEndExchange() *EndExchangePayload {
+	if x, ok := x.GetPayload().(*Message_EndExchange); ok {
+		return x.EndExchange
+	}
+	return nil
+}
+
+func (x *Message) GetFile() *FilePayload {
+	if x, ok := x.GetPayload().(*Message_File); ok {
+		return x.File
+	}
+	return nil
+}
+
+func (x *Message) GetTyping() *TypingPayload {
+	if x, ok := x.GetPayload().(*Message_Typing); ok {
+		return x.Typing
+	}
+	return nil
+}
+
+func (x *Message) GetReceipt() *ReceiptPayload {
+	if x, ok := x.GetPayload().(*Message_Receipt); ok {
+		return x.Receipt
+	}
+	return nil
+}
+
+func (x *Message) GetGroupMessage() *GroupMessagePayload {
+	if x, ok := x.GetPayload().(*Message_GroupMessage); ok {
+		return x.GroupMessage
+	}
+	return nil
+}
+
+func (x *Message) GetAck() *AckPayload {
+	if x, ok := x.GetPayload().(*Message_Ack); ok {
+		return x.Ack
+	}
+	return nil
+}
+
+type isMessage_Payload interface {
+	isMessage_Payload()
+}
+
+type Message_Message struct {
+	Message *MessagePayload `protobuf:"bytes,3,opt,name=message,proto3,oneof"`
+}
+
+type Message_QueryExchange struct {
+	QueryExchange *QueryExchangePayload `protobuf:"bytes,4,opt,name=query_exchange,json=queryExchange,proto3,oneof"`
+}
+
+type Message_StartExchange struct {
+	StartExchange *StartExchangePayload `protobuf:"bytes,5,opt,name=start_exchange,json=startExchange,proto3,oneof"`
+}
+
+type Message_EndExchange struct {
+	EndExchange *EndExchangePayload `protobuf:"bytes,6,opt,name=end_exchange,json=endExchange,proto3,oneof"`
+}
+
+type Message_File struct {
+	File *FilePayload `protobuf:"bytes,7,opt,name=file,proto3,oneof"`
+}
+
+type Message_Typing struct {
+	Typing *TypingPayload `protobuf:"bytes,8,opt,name=typing,proto3,oneof"`
+}
+
+type Message_Receipt struct {
+	Receipt *ReceiptPayload `protobuf:"bytes,9,opt,name=receipt,proto3,oneof"`
+}
+
+type Message_GroupMessage struct {
+	GroupMessage *GroupMessagePayload `protobuf:"bytes,10,opt,name=group_message,json=groupMessage,proto3,oneof"`
+}
+
+type Message_Ack struct {
+	Ack *AckPayload `protobuf:"bytes,11,opt,name=ack,proto3,oneof"`
+}
+
+func (*Message_Message) isMessage_Payload() {}
+
+func (*Message_QueryExchange) isMessage_Payload() {}
+
+func (*Message_StartExchange) isMessage_Payload() {}
+
+func (*Message_EndExchange) isMessage_Payload() {}
+
+func (*Message_File) isMessage_Payload() {}
+
+func (*Message_Typing) isMessage_Payload() {}
+
+func (*Message_Receipt) isMessage_Payload() {}
+
+func (*Message_GroupMessage) isMessage_Payload() {}
+
+func (*Message_Ack) isMessage_Payload() {}
+
+type MessagePayload struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Data      []byte `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	MessageId []byte `protobuf:"bytes,2,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+}
+
+func (x *MessagePayload) Reset() {
+	*x = MessagePayload{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_wirepb_wire_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *MessagePayload) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MessagePayload) ProtoMessage() {}
+
+func (x *MessagePayload) ProtoReflect() protoreflect.Message {
+	mi := &file_wirepb_wire_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MessagePayload.ProtoReflect.Descriptor instead.
+func (*MessagePayload) Descriptor() ([]byte, []int) {
+	return file_wirepb_wire_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *MessagePayload) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *MessagePayload) GetMessageId() []byte {
+	if x != nil {
+		return x.MessageId
+	}
+	return nil
+}
+
+type QueryExchangePayload struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *QueryExchangePayload) Reset() {
+	*x = QueryExchangePayload{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_wirepb_wire_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *QueryExchangePayload) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QueryExchangePayload) ProtoMessage() {}
+
+func (x *QueryExchangePayload) ProtoReflect() protoreflect.Message {
+	mi := &file_wirepb_wire_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QueryExchangePayload.ProtoReflect.Descriptor instead.
+func (*QueryExchangePayload) Descriptor() ([]byte, []int) {
+	return file_wirepb_wire_proto_rawDescGZIP(), []int{2}
+}
+
+type StartExchangePayload struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	KeyId   uint32 `protobuf:"varint,1,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`
+	Prekey  []byte `protobuf:"bytes,2,opt,name=prekey,proto3" json:"prekey,omitempty"`
+	Sig     []byte `protobuf:"bytes,3,opt,name=sig,proto3" json:"sig,omitempty"`
+	Onetime []byte `protobuf:"bytes,4,opt,name=onetime,proto3" json:"onetime,omitempty"`
+}
+
+func (x *StartExchangePayload) Reset() {
+	*x = StartExchangePayload{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_wirepb_wire_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *StartExchangePayload) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StartExchangePayload) ProtoMessage() {}
+
+func (x *StartExchangePayload) ProtoReflect() protoreflect.Message {
+	mi := &file_wirepb_wire_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StartExchangePayload.ProtoReflect.Descriptor instead.
+func (*StartExchangePayload) Descriptor() ([]byte, []int) {
+	return file_wirepb_wire_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *StartExchangePayload) GetKeyId() uint32 {
+	if x != nil {
+		return x.KeyId
+	}
+	return 0
+}
+
+func (x *StartExchangePayload) GetPrekey() []byte {
+	if x != nil {
+		return x.Prekey
+	}
+	return nil
+}
+
+func (x *StartExchangePayload) GetSig() []byte {
+	if x != nil {
+		return x.Sig
+	}
+	return nil
+}
+
+func (x *StartExchangePayload) GetOnetime() []byte {
+	if x != nil {
+		return x.Onetime
+	}
+	return nil
+}
+
+type EndExchangePayload struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	PrekeyId    uint32 `protobuf:"varint,1,opt,name=prekey_id,json=prekeyId,proto3" json:"prekey_id,omitempty"`
+	Prekey      []byte `protobuf:"bytes,2,opt,name=prekey,proto3" json:"prekey,omitempty"`
+	Onetime     []byte `protobuf:"bytes,3,opt,name=onetime,proto3" json:"onetime,omitempty"`
+	Ephemeral   []byte `protobuf:"bytes,4,opt,name=ephemeral,proto3" json:"ephemeral,omitempty"`
+	InitialData []byte `protobuf:"bytes,5,opt,name=initial_data,json=initialData,proto3" json:"initial_data,omitempty"`
+}
+
+func (x *EndExchangePayload) Reset() {
+	*x = EndExchangePayload{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_wirepb_wire_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *EndExchangePayload) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EndExchangePayload) ProtoMessage() {}
+
+func (x *EndExchangePayload) ProtoReflect() protoreflect.Message {
+	mi := &file_wirepb_wire_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EndExchangePayload.ProtoReflect.Descriptor instead.
+func (*EndExchangePayload) Descriptor() ([]byte, []int) {
+	return file_wirepb_wire_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *EndExchangePayload) GetPrekeyId() uint32 {
+	if x != nil {
+		return x.PrekeyId
+	}
+	return 0
+}
+
+func (x *EndExchangePayload) GetPrekey() []byte {
+	if x != nil {
+		return x.Prekey
+	}
+	return nil
+}
+
+func (x *EndExchangePayload) GetOnetime() []byte {
+	if x != nil {
+		return x.Onetime
+	}
+	return nil
+}
+
+func (x *EndExchangePayload) GetEphemeral() []byte {
+	if x != nil {
+		return x.Ephemeral
+	}
+	return nil
+}
+
+func (x *EndExchangePayload) GetInitialData() []byte {
+	if x != nil {
+		return x.InitialData
+	}
+	return nil
+}
+
+type FilePayload struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Name     string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	MimeType string `protobuf:"bytes,2,opt,name=mime_type,json=mimeType,proto3" json:"mime_type,omitempty"`
+	Data     []byte `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+}
+
+func (x *FilePayload) Reset() {
+	*x = FilePayload{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_wirepb_wire_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *FilePayload) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FilePayload) ProtoMessage() {}
+
+func (x *FilePayload) ProtoReflect() protoreflect.Message {
+	mi := &file_wirepb_wire_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FilePayload.ProtoReflect.Descriptor instead.
+func (*FilePayload) Descriptor() ([]byte, []int) {
+	return file_wirepb_wire_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *FilePayload) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *FilePayload) GetMimeType() string {
+	if x != nil {
+		return x.MimeType
+	}
+	return ""
+}
+
+func (x *FilePayload) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+type TypingPayload struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Data []byte `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+}
+
+func (x *TypingPayload) Reset() {
+	*x = TypingPayload{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_wirepb_wire_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *TypingPayload) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TypingPayload) ProtoMessage() {}
+
+func (x *TypingPayload) ProtoReflect() protoreflect.Message {
+	mi := &file_wirepb_wire_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TypingPayload.ProtoReflect.Descriptor instead.
+func (*TypingPayload) Descriptor() ([]byte, []int) {
+	return file_wirepb_wire_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *TypingPayload) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+type ReceiptPayload struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	MessageId []byte `protobuf:"bytes,1,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	Data      []byte `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+}
+
+func (x *ReceiptPayload) Reset() {
+	*x = ReceiptPayload{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_wirepb_wire_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ReceiptPayload) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReceiptPayload) ProtoMessage() {}
+
+func (x *ReceiptPayload) ProtoReflect() protoreflect.Message {
+	mi := &file_wirepb_wire_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReceiptPayload.ProtoReflect.Descriptor instead.
+func (*ReceiptPayload) Descriptor() ([]byte, []int) {
+	return file_wirepb_wire_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ReceiptPayload) GetMessageId() []byte {
+	if x != nil {
+		return x.MessageId
+	}
+	return nil
+}
+
+func (x *ReceiptPayload) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+type GroupMessagePayload struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	GroupId []byte `protobuf:"bytes,1,opt,name=group_id,json=groupId,proto3" json:"group_id,omitempty"`
+	Data    []byte `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+}
+
+func (x *GroupMessagePayload) Reset() {
+	*x = GroupMessagePayload{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_wirepb_wire_proto_msgTypes[8]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GroupMessagePayload) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GroupMessagePayload) ProtoMessage() {}
+
+func (x *GroupMessagePayload) ProtoReflect() protoreflect.Message {
+	mi := &file_wirepb_wire_proto_msgTypes[8]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GroupMessagePayload.ProtoReflect.Descriptor instead.
+func (*GroupMessagePayload) Descriptor() ([]byte, []int) {
+	return file_wirepb_wire_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *GroupMessagePayload) GetGroupId() []byte {
+	if x != nil {
+		return x.GroupId
+	}
+	return nil
+}
+
+func (x *GroupMessagePayload) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+type AckPayload struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	MessageId []byte `protobuf:"bytes,1,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	Data      []byte `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+}
+
+func (x *AckPayload) Reset() {
+	*x = AckPayload{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_wirepb_wire_proto_msgTypes[9]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AckPayload) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AckPayload) ProtoMessage() {}
+
+func (x *AckPayload) ProtoReflect() protoreflect.Message {
+	mi := &file_wirepb_wire_proto_msgTypes[9]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AckPayload.ProtoReflect.Descriptor instead.
+func (*AckPayload) Descriptor() ([]byte, []int) {
+	return file_wirepb_wire_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *AckPayload) GetMessageId() []byte {
+	if x != nil {
+		return x.MessageId
+	}
+	return nil
+}
+
+func (x *AckPayload) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+var File_wirepb_wire_proto protoreflect.FileDescriptor
+
+var file_wirepb_wire_proto_rawDesc = []byte{
+	0x0a, 0x11, 0x77, 0x69, 0x72, 0x65, 0x70, 0x62, 0x2f, 0x77, 0x69, 0x72, 0x65, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x12, 0x07, 0x6e, 0x75, 0x6e, 0x74, 0x69, 0x75, 0x73, 0x22, 0xda, 0x04, 0x0a,
+	0x07, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x66, 0x72, 0x6f, 0x6d,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x12, 0x0e, 0x0a, 0x02,
+	0x74, 0x6f, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x02, 0x74, 0x6f, 0x12, 0x18, 0x0a, 0x07,
+	0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x07, 0x76,
+	0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x33, 0x0a, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67,
+	0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x6e, 0x75, 0x6e, 0x74, 0x69, 0x75,
+	0x73, 0x2e, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64,
+	0x48, 0x00, 0x52, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12, 0x46, 0x0a, 0x0e, 0x71,
+	0x75, 0x65, 0x72, 0x79, 0x5f, 0x65, 0x78, 0x63, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x18, 0x04, 0x20,
+	0x01, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x6e, 0x75, 0x6e, 0x74, 0x69, 0x75, 0x73, 0x2e, 0x51, 0x75,
+	0x65, 0x72, 0x79, 0x45, 0x78, 0x63, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x50, 0x61, 0x79, 0x6c, 0x6f,
+	0x61, 0x64, 0x48, 0x00, 0x52, 0x0d, 0x71, 0x75, 0x65, 0x72, 0x79, 0x45, 0x78, 0x63, 0x68, 0x61,
+	0x6e, 0x67, 0x65, 0x12, 0x46, 0x0a, 0x0e, 0x73, 0x74, 0x61, 0x72, 0x74, 0x5f, 0x65, 0x78, 0x63,
+	0x68, 0x61, 0x6e, 0x67, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1d, 0x2e, 0x6e, 0x75,
+	0x6e, 0x74, 0x69, 0x75, 0x73, 0x2e, 0x53, 0x74, 0x61, 0x72, 0x74, 0x45, 0x78, 0x63, 0x68, 0x61,
+	0x6e, 0x67, 0x65, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x48, 0x00, 0x52, 0x0d, 0x73, 0x74,
+	0x61, 0x72, 0x74, 0x45, 0x78, 0x63, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x12, 0x40, 0x0a, 0x0c, 0x65,
+	0x6e, 0x64, 0x5f, 0x65, 0x78, 0x63, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x18, 0x06, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x1b, 0x2e, 0x6e, 0x75, 0x6e, 0x74, 0x69, 0x75, 0x73, 0x2e, 0x45, 0x6e, 0x64, 0x45,
+	0x78, 0x63, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x48, 0x00,
+	0x52, 0x0b, 0x65, 0x6e, 0x64, 0x45, 0x78, 0x63, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x12, 0x2a, 0x0a,
+	0x04, 0x66, 0x69, 0x6c, 0x65, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x14, 0x2e, 0x6e, 0x75,
+	0x6e, 0x74, 0x69, 0x75, 0x73, 0x2e, 0x46, 0x69, 0x6c, 0x65, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61,
+	0x64, 0x48, 0x00, 0x52, 0x04, 0x66, 0x69, 0x6c, 0x65, 0x12, 0x30, 0x0a, 0x06, 0x74, 0x79, 0x70,
+	0x69, 0x6e, 0x67, 0x18, 0x08, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x6e, 0x75, 0x6e, 0x74,
+	0x69, 0x75, 0x73, 0x2e, 0x54, 0x79, 0x70, 0x69, 0x6e, 0x67, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61,
+	0x64, 0x48, 0x00, 0x52, 0x06, 0x74, 0x79, 0x70, 0x69, 0x6e, 0x67, 0x12, 0x33, 0x0a, 0x07, 0x72,
+	0x65, 0x63, 0x65, 0x69, 0x70, 0x74, 0x18, 0x09, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x6e,
+	0x75, 0x6e, 0x74, 0x69, 0x75, 0x73, 0x2e, 0x52, 0x65, 0x63, 0x65, 0x69, 0x70, 0x74, 0x50, 0x61,
+	0x79, 0x6c, 0x6f, 0x61, 0x64, 0x48, 0x00, 0x52, 0x07, 0x72, 0x65, 0x63, 0x65, 0x69, 0x70, 0x74,
+	0x12, 0x43, 0x0a, 0x0d, 0x67, 0x72, 0x6f, 0x75, 0x70, 0x5f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67,
+	0x65, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1c, 0x2e, 0x6e, 0x75, 0x6e, 0x74, 0x69, 0x75,
+	0x73, 0x2e, 0x47, 0x72, 0x6f, 0x75, 0x70, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x50, 0x61,
+	0x79, 0x6c, 0x6f, 0x61, 0x64, 0x48, 0x00, 0x52, 0x0c, 0x67, 0x72, 0x6f, 0x75, 0x70, 0x4d, 0x65,
+	0x73, 0x73, 0x61, 0x67, 0x65, 0x12, 0x27, 0x0a, 0x03, 0x61, 0x63, 0x6b, 0x18, 0x0b, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x13, 0x2e, 0x6e, 0x75, 0x6e, 0x74, 0x69, 0x75, 0x73, 0x2e, 0x41, 0x63, 0x6b,
+	0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x48, 0x00, 0x52, 0x03, 0x61, 0x63, 0x6b, 0x42, 0x09,
+	0x0a, 0x07, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x22, 0x43, 0x0a, 0x0e, 0x4d, 0x65, 0x73,
+	0x73, 0x61, 0x67, 0x65, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x64,
+	0x61, 0x74, 0x61, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x12,
+	0x1d, 0x0a, 0x0a, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x0c, 0x52, 0x09, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x49, 0x64, 0x22, 0x16,
+	0x0a, 0x14, 0x51, 0x75, 0x65, 0x72, 0x79, 0x45, 0x78, 0x63, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x50,
+	0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x22, 0x71, 0x0a, 0x14, 0x53, 0x74, 0x61, 0x72, 0x74, 0x45,
+	0x78, 0x63, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x12, 0x15,
+	0x0a, 0x06, 0x6b, 0x65, 0x79, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x05,
+	0x6b, 0x65, 0x79, 0x49, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x70, 0x72, 0x65, 0x6b, 0x65, 0x79, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x06, 0x70, 0x72, 0x65, 0x6b, 0x65, 0x79, 0x12, 0x10, 0x0a,
+	0x03, 0x73, 0x69, 0x67, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x03, 0x73, 0x69, 0x67, 0x12,
+	0x18, 0x0a, 0x07, 0x6f, 0x6e, 0x65, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0c,
+	0x52, 0x07, 0x6f, 0x6e, 0x65, 0x74, 0x69, 0x6d, 0x65, 0x22, 0xa4, 0x01, 0x0a, 0x12, 0x45, 0x6e,
+	0x64, 0x45, 0x78, 0x63, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64,
+	0x12, 0x1b, 0x0a, 0x09, 0x70, 0x72, 0x65, 0x6b, 0x65, 0x79, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x0d, 0x52, 0x08, 0x70, 0x72, 0x65, 0x6b, 0x65, 0x79, 0x49, 0x64, 0x12, 0x16, 0x0a,
+	0x06, 0x70, 0x72, 0x65, 0x6b, 0x65, 0x79, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x06, 0x70,
+	0x72, 0x65, 0x6b, 0x65, 0x79, 0x12, 0x18, 0x0a, 0x07, 0x6f, 0x6e, 0x65, 0x74, 0x69, 0x6d, 0x65,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07, 0x6f, 0x6e, 0x65, 0x74, 0x69, 0x6d, 0x65, 0x12,
+	0x1c, 0x0a, 0x09, 0x65, 0x70, 0x68, 0x65, 0x6d, 0x65, 0x72, 0x61, 0x6c, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x0c, 0x52, 0x09, 0x65, 0x70, 0x68, 0x65, 0x6d, 0x65, 0x72, 0x61, 0x6c, 0x12, 0x21, 0x0a,
+	0x0c, 0x69, 0x6e, 0x69, 0x74, 0x69, 0x61, 0x6c, 0x5f, 0x64, 0x61, 0x74, 0x61, 0x18, 0x05, 0x20,
+	0x01, 0x28, 0x0c, 0x52, 0x0b, 0x69, 0x6e, 0x69, 0x74, 0x69, 0x61, 0x6c, 0x44, 0x61, 0x74, 0x61,
+	0x22, 0x52, 0x0a, 0x0b, 0x46, 0x69, 0x6c, 0x65, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x12,
+	0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e,
+	0x61, 0x6d, 0x65, 0x12, 0x1b, 0x0a, 0x09, 0x6d, 0x69, 0x6d, 0x65, 0x5f, 0x74, 0x79, 0x70, 0x65,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x6d, 0x69, 0x6d, 0x65, 0x54, 0x79, 0x70, 0x65,
+	0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04,
+	0x64, 0x61, 0x74, 0x61, 0x22, 0x23, 0x0a, 0x0d, 0x54, 0x79, 0x70, 0x69, 0x6e, 0x67, 0x50, 0x61,
+	0x79, 0x6c, 0x6f, 0x61, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x22, 0x43, 0x0a, 0x0e, 0x52, 0x65, 0x63,
+	0x65, 0x69, 0x70, 0x74, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x12, 0x1d, 0x0a, 0x0a, 0x6d,
+	0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52,
+	0x09, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x49, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61,
+	0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x22, 0x44,
+	0x0a, 0x13, 0x47, 0x72, 0x6f, 0x75, 0x70, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x50, 0x61,
+	0x79, 0x6c, 0x6f, 0x61, 0x64, 0x12, 0x19, 0x0a, 0x08, 0x67, 0x72, 0x6f, 0x75, 0x70, 0x5f, 0x69,
+	0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07, 0x67, 0x72, 0x6f, 0x75, 0x70, 0x49, 0x64,
+	0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04,
+	0x64, 0x61, 0x74, 0x61, 0x22, 0x3f, 0x0a, 0x0a, 0x41, 0x63, 0x6b, 0x50, 0x61, 0x79, 0x6c, 0x6f,
+	0x61, 0x64, 0x12, 0x1d, 0x0a, 0x0a, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x5f, 0x69, 0x64,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x09, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x49,
+	0x64, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52,
+	0x04, 0x64, 0x61, 0x74, 0x61, 0x42, 0x36, 0x5a, 0x34, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e,
+	0x63, 0x6f, 0x6d, 0x2f, 0x63, 0x72, 0x6f, 0x6e, 0x6f, 0x6b, 0x69, 0x72, 0x62, 0x79, 0x2f, 0x6e,
+	0x75, 0x6e, 0x74, 0x69, 0x75, 0x73, 0x2f, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f,
+	0x73, 0x65, 0x72, 0x76, 0x65, 0x72, 0x2f, 0x77, 0x69, 0x72, 0x65, 0x70, 0x62, 0x62, 0x06, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_wirepb_wire_proto_rawDescOnce sync.Once
+	file_wirepb_wire_proto_rawDescData = file_wirepb_wire_proto_rawDesc
+)
+
+func file_wirepb_wire_proto_rawDescGZIP() []byte {
+	file_wirepb_wire_proto_rawDescOnce.Do(func() {
+		file_wirepb_wire_proto_rawDescData = protoimpl.X.CompressGZIP(file_wirepb_wire_proto_rawDescData)
+	})
+	return file_wirepb_wire_proto_rawDescData
+}
+
+var file_wirepb_wire_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
+var file_wirepb_wire_proto_goTypes = []interface{}{
+	(*Message)(nil),              // 0: nuntius.Message
+	(*MessagePayload)(nil),       // 1: nuntius.MessagePayload
+	(*QueryExchangePayload)(nil), // 2: nuntius.QueryExchangePayload
+	(*StartExchangePayload)(nil), // 3: nuntius.StartExchangePayload
+	(*EndExchangePayload)(nil),   // 4: nuntius.EndExchangePayload
+	(*FilePayload)(nil),          // 5: nuntius.FilePayload
+	(*TypingPayload)(nil),        // 6: nuntius.TypingPayload
+	(*ReceiptPayload)(nil),       // 7: nuntius.ReceiptPayload
+	(*GroupMessagePayload)(nil),  // 8: nuntius.GroupMessagePayload
+	(*AckPayload)(nil),           // 9: nuntius.AckPayload
+}
+var file_wirepb_wire_proto_depIdxs = []int32{
+	1, // 0: nuntius.Message.message:type_name -> nuntius.MessagePayload
+	2, // 1: nuntius.Message.query_exchange:type_name -> nuntius.QueryExchangePayload
+	3, // 2: nuntius.Message.start_exchange:type_name -> nuntius.StartExchangePayload
+	4, // 3: nuntius.Message.end_exchange:type_name -> nuntius.EndExchangePayload
+	5, // 4: nuntius.Message.file:type_name -> nuntius.FilePayload
+	6, // 5: nuntius.Message.typing:type_name -> nuntius.TypingPayload
+	7, // 6: nuntius.Message.receipt:type_name -> nuntius.ReceiptPayload
+	8, // 7: nuntius.Message.group_message:type_name -> nuntius.GroupMessagePayload
+	9, // 8: nuntius.Message.ack:type_name -> nuntius.AckPayload
+	9, // [9:9] is the sub-list for method output_type
+	9, // [9:9] is the sub-list for method input_type
+	9, // [9:9] is the sub-list for extension type_name
+	9, // [9:9] is the sub-list for extension extendee
+	0, // [0:9] is the sub-list for field type_name
+}
+
+func init() { file_wirepb_wire_proto_init() }
+func file_wirepb_wire_proto_init() {
+	if File_wirepb_wire_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_wirepb_wire_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Message); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_wirepb_wire_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MessagePayload); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_wirepb_wire_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*QueryExchangePayload); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_wirepb_wire_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*StartExchangePayload); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_wirepb_wire_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*EndExchangePayload); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_wirepb_wire_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*FilePayload); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_wirepb_wire_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*TypingPayload); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_wirepb_wire_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ReceiptPayload); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_wirepb_wire_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*GroupMessagePayload); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_wirepb_wire_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*AckPayload); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	file_wirepb_wire_proto_msgTypes[0].OneofWrappers = []interface{}{
+		(*Message_Message)(nil),
+		(*Message_QueryExchange)(nil),
+		(*Message_StartExchange)(nil),
+		(*Message_EndExchange)(nil),
+		(*Message_File)(nil),
+		(*Message_Typing)(nil),
+		(*Message_Receipt)(nil),
+		(*Message_GroupMessage)(nil),
+		(*Message_Ack)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_wirepb_wire_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   10,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_wirepb_wire_proto_goTypes,
+		DependencyIndexes: file_wirepb_wire_proto_depIdxs,
+		MessageInfos:      file_wirepb_wire_proto_msgTypes,
+	}.Build()
+	File_wirepb_wire_proto = out.File
+	file_wirepb_wire_proto_rawDesc = nil
+	file_wirepb_wire_proto_goTypes = nil
+	file_wirepb_wire_proto_depIdxs = nil
+}
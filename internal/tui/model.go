@@ -0,0 +1,181 @@
+// Package tui implements a full screen chat with a friend, in the terminal.
+package tui
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cronokirby/nuntius/internal/client"
+)
+
+// Key is a single keypress, either a printable rune, or one of the special keys
+type Key rune
+
+const (
+	// KeyEnter submits the current input
+	KeyEnter Key = -1 - iota
+	// KeyBackspace removes the last rune of the input
+	KeyBackspace
+	// KeyQuit leaves the chat, and is sent by Ctrl-C or Ctrl-D
+	KeyQuit
+)
+
+// Action is what the chat should do after a keypress
+type Action int
+
+const (
+	// ActionNone means there's nothing to do besides redrawing the screen
+	ActionNone Action = iota
+	// ActionTyping means that we should tell our friend we've started typing
+	ActionTyping
+	// ActionSend means that we should send a message to our friend
+	ActionSend
+	// ActionQuit means that we should leave the chat
+	ActionQuit
+)
+
+// timeFormat is how the time of each line is shown
+const timeFormat = "15:04"
+
+// The colors distinguishing the kinds of lines in the scrollback
+const (
+	colorOutgoing = "\x1b[36m"
+	colorNotice   = "\x1b[2m"
+	colorReset    = "\x1b[0m"
+)
+
+// line is an entry in the scrollback
+type line struct {
+	at    time.Time
+	color string
+	text  string
+}
+
+// Model is the state of the chat screen
+//
+// The model is updated with keypresses and chat events, and is drawn with View.
+// It doesn't touch the terminal, so that it can be driven without one.
+type Model struct {
+	friend string
+	lines  []line
+	input  []rune
+	typing bool
+	now    func() time.Time
+}
+
+// NewModel creates the screen for a chat with a friend
+func NewModel(friend string) *Model {
+	return &Model{friend: friend, now: time.Now}
+}
+
+func (m *Model) add(color string, text string) {
+	m.lines = append(m.lines, line{m.now(), color, text})
+}
+
+// Key updates the model with a keypress
+//
+// When the action is ActionSend, this also returns the message to send.
+func (m *Model) Key(key Key) (Action, string) {
+	switch key {
+	case KeyQuit:
+		return ActionQuit, ""
+	case KeyEnter:
+		if len(m.input) == 0 {
+			return ActionNone, ""
+		}
+		text := string(m.input)
+		m.input = nil
+		// Commands aren't sent to our friend, so they don't belong in the scrollback
+		if text != client.FingerprintCommand {
+			m.add(colorOutgoing, "me> "+text)
+		}
+		return ActionSend, text
+	case KeyBackspace:
+		if len(m.input) > 0 {
+			m.input = m.input[:len(m.input)-1]
+		}
+		return ActionNone, ""
+	default:
+		if key < 0 {
+			return ActionNone, ""
+		}
+		m.input = append(m.input, rune(key))
+		if len(m.input) == 1 {
+			return ActionTyping, ""
+		}
+		return ActionNone, ""
+	}
+}
+
+// Event updates the model with something that happened in the chat
+func (m *Model) Event(event client.ChatEvent) {
+	if event.Kind != client.EventTyping {
+		m.typing = false
+	}
+	switch event.Kind {
+	case client.EventMessage:
+		m.add("", fmt.Sprintf("%s> %s", m.friend, event.Text))
+	case client.EventFile:
+		m.add(colorNotice, fmt.Sprintf("%s sent a file, saved to %s", m.friend, event.Text))
+	case client.EventTyping:
+		m.typing = true
+	case client.EventReceipt:
+		m.add(colorNotice, fmt.Sprintf("%s read: %s", m.friend, event.Text))
+	case client.EventDelivered:
+		m.add(colorNotice, fmt.Sprintf("%s received: %s", m.friend, event.Text))
+	case client.EventUndelivered:
+		m.add(colorNotice, fmt.Sprintf("%s didn't acknowledge: %s", m.friend, event.Text))
+	case client.EventFingerprint:
+		m.add(colorNotice, "session fingerprint: "+event.Text)
+	case client.EventStalled:
+		m.add(colorNotice, "connection stalled, couldn't send: "+event.Text)
+	}
+}
+
+// truncate cuts a string down to at most width runes
+func truncate(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	return string([]rune(s)[:width])
+}
+
+// View draws the model on a screen of a given size
+//
+// The newest lines of the scrollback fill the screen, above a status line, and the input box.
+func (m *Model) View(width int, height int) string {
+	if width < 1 || height < 2 {
+		return ""
+	}
+	var b strings.Builder
+	scrollback := height - 2
+	start := len(m.lines) - scrollback
+	if start < 0 {
+		start = 0
+	}
+	for i := 0; i < scrollback-(len(m.lines)-start); i++ {
+		b.WriteString("\r\n")
+	}
+	for _, l := range m.lines[start:] {
+		text := truncate(l.at.Format(timeFormat)+" "+l.text, width)
+		if l.color != "" {
+			text = l.color + text + colorReset
+		}
+		b.WriteString(text)
+		b.WriteString("\r\n")
+	}
+	status := strings.Repeat("-", width)
+	if m.typing {
+		status = truncate(fmt.Sprintf("-- %s is typing... %s", m.friend, status), width)
+	}
+	b.WriteString(colorNotice + status + colorReset + "\r\n")
+	// The end of the input stays visible as it grows past the width of the screen
+	input := "> " + string(m.input)
+	if runes := []rune(input); len(runes) >= width {
+		input = string(runes[len(runes)-width+1:])
+	}
+	b.WriteString(input)
+	return b.String()
+}
@@ -0,0 +1,142 @@
+package tui
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cronokirby/nuntius/internal/client"
+)
+
+func newTestModel() *Model {
+	model := NewModel("alice")
+	model.now = func() time.Time { return time.Date(2021, 6, 1, 12, 34, 0, 0, time.UTC) }
+	return model
+}
+
+func TestModelSendsInput(t *testing.T) {
+	model := newTestModel()
+	var actions []Action
+	var sent []string
+	for _, key := range []Key{'h', 'i', 'x', KeyBackspace, '!', KeyEnter} {
+		action, text := model.Key(key)
+		actions = append(actions, action)
+		if action == ActionSend {
+			sent = append(sent, text)
+		}
+	}
+	if actions[0] != ActionTyping {
+		t.Errorf("expected the first keypress to start typing, found %v", actions[0])
+		return
+	}
+	if len(sent) != 1 || sent[0] != "hi!" {
+		t.Errorf("unexpected messages sent: %q", sent)
+		return
+	}
+	view := model.View(40, 5)
+	if !strings.Contains(view, "12:34 me> hi!") {
+		t.Errorf("sent message isn't shown: %q", view)
+		return
+	}
+	if !strings.HasSuffix(view, "> ") {
+		t.Errorf("input wasn't cleared: %q", view)
+		return
+	}
+	action, _ := model.Key(KeyEnter)
+	if action != ActionNone {
+		t.Errorf("expected empty input not to be sent, found %v", action)
+		return
+	}
+	action, _ = model.Key(KeyQuit)
+	if action != ActionQuit {
+		t.Errorf("expected to quit, found %v", action)
+		return
+	}
+}
+
+func TestModelShowsEvents(t *testing.T) {
+	model := newTestModel()
+	model.Event(client.ChatEvent{Kind: client.EventTyping})
+	view := model.View(40, 5)
+	if !strings.Contains(view, "alice is typing...") {
+		t.Errorf("typing isn't shown: %q", view)
+		return
+	}
+	model.Event(client.ChatEvent{Kind: client.EventMessage, Text: "hello"})
+	model.Event(client.ChatEvent{Kind: client.EventReceipt, Text: "hi!"})
+	view = model.View(40, 5)
+	if strings.Contains(view, "typing") {
+		t.Errorf("typing is still shown after a message: %q", view)
+		return
+	}
+	if !strings.Contains(view, "12:34 alice> hello\r\n") {
+		t.Errorf("incoming message isn't shown: %q", view)
+		return
+	}
+	if !strings.Contains(view, colorNotice+"12:34 alice read: hi!"+colorReset) {
+		t.Errorf("receipt isn't shown as a notice: %q", view)
+		return
+	}
+}
+
+func TestModelScrolls(t *testing.T) {
+	model := newTestModel()
+	for _, text := range []string{"one", "two", "three", "four"} {
+		model.Event(client.ChatEvent{Kind: client.EventMessage, Text: text})
+	}
+	view := model.View(40, 4)
+	if strings.Contains(view, "one") || strings.Contains(view, "two") {
+		t.Errorf("older lines are still shown: %q", view)
+		return
+	}
+	if !strings.Contains(view, "three") || !strings.Contains(view, "four") {
+		t.Errorf("newer lines aren't shown: %q", view)
+		return
+	}
+	if lines := strings.Count(view, "\r\n") + 1; lines != 4 {
+		t.Errorf("expected 4 lines, found %d", lines)
+		return
+	}
+}
+
+func TestReadKeys(t *testing.T) {
+	keys := make(chan Key)
+	go readKeys(strings.NewReader("hé\x1b[A\x7f\r\x03"), keys)
+	var read []Key
+	for key := range keys {
+		read = append(read, key)
+	}
+	expected := []Key{'h', 'é', KeyBackspace, KeyEnter, KeyQuit}
+	if len(read) != len(expected) {
+		t.Errorf("expected %v, found %v", expected, read)
+		return
+	}
+	for i := range expected {
+		if read[i] != expected[i] {
+			t.Errorf("expected %v, found %v", expected, read)
+			return
+		}
+	}
+}
+
+func TestModelShowsFingerprint(t *testing.T) {
+	model := newTestModel()
+	for _, key := range client.FingerprintCommand {
+		model.Key(Key(key))
+	}
+	action, text := model.Key(KeyEnter)
+	if action != ActionSend || text != client.FingerprintCommand {
+		t.Errorf("command wasn't sent to the chat: %v %q", action, text)
+		return
+	}
+	model.Event(client.ChatEvent{Kind: client.EventFingerprint, Text: "0123 4567"})
+	view := model.View(60, 5)
+	if strings.Contains(view, "me> ") {
+		t.Errorf("command is shown as a message: %q", view)
+		return
+	}
+	if !strings.Contains(view, "session fingerprint: 0123 4567") {
+		t.Errorf("fingerprint isn't shown: %q", view)
+		return
+	}
+}
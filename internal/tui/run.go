@@ -0,0 +1,105 @@
+package tui
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"unicode"
+
+	"github.com/cronokirby/nuntius/internal/client"
+)
+
+// readKeys decodes the keypresses coming from a terminal in raw mode, until the input ends
+//
+// Escape sequences, like the ones sent by the arrow keys, are skipped.
+func readKeys(r io.Reader, keys chan<- Key) {
+	defer close(keys)
+	reader := bufio.NewReader(r)
+	for {
+		c, _, err := reader.ReadRune()
+		if err != nil {
+			return
+		}
+		switch {
+		case c == '\r' || c == '\n':
+			keys <- KeyEnter
+		case c == 0x7f || c == '\b':
+			keys <- KeyBackspace
+		case c == 0x03 || c == 0x04:
+			keys <- KeyQuit
+		case c == 0x1b:
+			skipEscape(reader)
+		case unicode.IsPrint(c):
+			keys <- Key(c)
+		}
+	}
+}
+
+// skipEscape reads the rest of an escape sequence, whose first byte was already read
+func skipEscape(reader *bufio.Reader) {
+	c, err := reader.ReadByte()
+	if err != nil || (c != '[' && c != 'O') {
+		return
+	}
+	// The sequence ends with its first byte in the range @ to ~
+	for {
+		c, err := reader.ReadByte()
+		if err != nil || (c >= 0x40 && c <= 0x7e) {
+			return
+		}
+	}
+}
+
+// Run shows a chat with a friend on the terminal, until the user quits, or ctx is cancelled
+//
+// Events come from out, and messages are sent over in, like with client.StartChat.
+func Run(ctx context.Context, friend string, out <-chan client.ChatEvent, in chan<- string, typing chan<- struct{}) error {
+	fd := int(os.Stdin.Fd())
+	restore, err := makeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	// The alternate screen leaves the shell as it was once we're done
+	os.Stdout.WriteString("\x1b[?1049h")
+	defer os.Stdout.WriteString("\x1b[?1049l")
+
+	model := NewModel(friend)
+	keys := make(chan Key)
+	go readKeys(os.Stdin, keys)
+	for {
+		width, height := size(fd)
+		os.Stdout.WriteString("\x1b[H\x1b[2J" + model.View(width, height))
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-out:
+			if !ok {
+				return nil
+			}
+			model.Event(event)
+		case key, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			action, text := model.Key(key)
+			switch action {
+			case ActionQuit:
+				return nil
+			case ActionTyping:
+				select {
+				case typing <- struct{}{}:
+				case <-ctx.Done():
+					return nil
+				}
+			case ActionSend:
+				select {
+				case in <- text:
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}
+	}
+}
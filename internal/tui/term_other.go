@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package tui
+
+import "errors"
+
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("the terminal interface isn't supported on this platform")
+}
+
+func size(fd int) (int, int) {
+	return 80, 24
+}
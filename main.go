@@ -2,24 +2,181 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/alecthomas/kong"
+	"github.com/cronokirby/nuntius/internal/buildinfo"
 	"github.com/cronokirby/nuntius/internal/client"
+	"github.com/cronokirby/nuntius/internal/config"
 	"github.com/cronokirby/nuntius/internal/crypto"
 	"github.com/cronokirby/nuntius/internal/server"
+	"github.com/cronokirby/nuntius/internal/tui"
+	_ "github.com/lib/pq"
+	"github.com/skip2/go-qrcode"
 	_ "modernc.org/sqlite"
 )
 
+// passphrase is used to encrypt the private keys in the local database, if it isn't empty
+type passphrase string
+
+// openStore opens the local database, using a passphrase if one was given
+func openStore(database string, pass passphrase) (client.ClientStore, error) {
+	if pass == "" {
+		return client.NewStore(database)
+	}
+	return client.NewEncryptedStore(database, string(pass))
+}
+
+// identityPassphraseEnv can hold the passphrase protecting an identity, instead of asking for it
+const identityPassphraseEnv = "NUNTIUS_IDENTITY_PASSPHRASE"
+
+// readLine reads a single line from the standard input
+//
+// This reads one byte at a time, so that nothing after the line gets buffered.
+func readLine() (string, error) {
+	var line []byte
+	var b [1]byte
+	for {
+		n, err := os.Stdin.Read(b[:])
+		if n > 0 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSuffix(string(line), "\r"), nil
+}
+
+// readPassphrase asks for the passphrase protecting our identity
+func readPassphrase() (string, error) {
+	if pass, ok := os.LookupEnv(identityPassphraseEnv); ok {
+		return pass, nil
+	}
+	fmt.Fprint(os.Stderr, "Identity passphrase: ")
+	return readLine()
+}
+
+// readNewPassphrase asks for a new passphrase to protect our identity, making sure it wasn't mistyped
+func readNewPassphrase() (string, error) {
+	if pass, ok := os.LookupEnv(identityPassphraseEnv); ok {
+		return pass, nil
+	}
+	fmt.Fprint(os.Stderr, "New identity passphrase: ")
+	pass, err := readLine()
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+	again, err := readLine()
+	if err != nil {
+		return "", err
+	}
+	if pass != again {
+		return "", errors.New("passphrases don't match")
+	}
+	return pass, nil
+}
+
+// archivePassphraseEnv can hold the passphrase protecting an archive, instead of asking for it
+const archivePassphraseEnv = "NUNTIUS_ARCHIVE_PASSPHRASE"
+
+// readArchivePassphrase asks for the passphrase protecting an archive, twice if it's a new one
+func readArchivePassphrase(confirm bool) (string, error) {
+	if pass, ok := os.LookupEnv(archivePassphraseEnv); ok {
+		return pass, nil
+	}
+	fmt.Fprint(os.Stderr, "Archive passphrase: ")
+	pass, err := readLine()
+	if err != nil || !confirm {
+		return pass, err
+	}
+	fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+	again, err := readLine()
+	if err != nil {
+		return "", err
+	}
+	if pass != again {
+		return "", errors.New("passphrases don't match")
+	}
+	return pass, nil
+}
+
+// loadIdentity returns our full identity, asking for a passphrase if it's protected by one
+func loadIdentity(store client.ClientStore) (crypto.IdentityPub, crypto.IdentityPriv, error) {
+	pub, priv, err := store.GetFullIdentity()
+	if errors.Is(err, client.ErrIdentityEncrypted) {
+		pass, err := readPassphrase()
+		if err != nil {
+			return nil, nil, err
+		}
+		return store.GetFullIdentityDecrypted(pass)
+	}
+	return pub, priv, err
+}
+
+// saveIdentity saves our identity, protecting it with a passphrase if necessary
+func saveIdentity(store client.ClientStore, pub crypto.IdentityPub, priv crypto.IdentityPriv, encrypt bool) error {
+	if !encrypt {
+		return store.SaveIdentity(pub, priv)
+	}
+	pass, err := readNewPassphrase()
+	if err != nil {
+		return err
+	}
+	return store.SaveIdentityEncrypted(pub, priv, pass)
+}
+
 type GenerateCommand struct {
-	Force bool `help:"Overwrite existing identity"`
+	Force   bool `help:"Overwrite existing identity"`
+	Encrypt bool `help:"Protect the identity with a passphrase"`
+}
+
+// identityOutput is the JSON output of commands printing an identity
+type identityOutput struct {
+	Identity *string `json:"identity"`
+}
+
+func newIdentityOutput(pub crypto.IdentityPub, format string) identityOutput {
+	if pub == nil {
+		return identityOutput{}
+	}
+	s := formatIdentity(pub, format)
+	return identityOutput{&s}
+}
+
+// formatIdentity encodes an identity as hex, base58, or base32, defaulting to hex
+func formatIdentity(pub crypto.IdentityPub, format string) string {
+	switch format {
+	case "base58":
+		return pub.Base58()
+	case "base32":
+		return pub.Base32()
+	default:
+		return pub.String()
+	}
 }
 
-func (cmd *GenerateCommand) Run(database string) error {
-	store, err := client.NewStore(database)
+func (cmd *GenerateCommand) Run(database string, pass passphrase, out *output) error {
+	store, err := openStore(database, pass)
 	if err != nil {
 		return fmt.Errorf("couldn't open database: %w", err)
 	}
@@ -28,6 +185,9 @@ func (cmd *GenerateCommand) Run(database string) error {
 		return err
 	}
 	if existingPub != nil && !cmd.Force {
+		if out.json {
+			return errors.New("an identity already exists, use `--force` to overwrite it")
+		}
 		fmt.Println("An existing identity exists:")
 		fmt.Println(existingPub.String())
 		fmt.Println("Use `--force` if you want to overwrite this identity.")
@@ -37,19 +197,51 @@ func (cmd *GenerateCommand) Run(database string) error {
 	if err != nil {
 		return fmt.Errorf("couldn't generate identity pair: %w", err)
 	}
-	err = store.SaveIdentity(pub, priv)
+	err = saveIdentity(store, pub, priv, cmd.Encrypt)
 	if err != nil {
 		return err
 	}
-	fmt.Println(pub.String())
-	return nil
+	return out.emit(newIdentityOutput(pub, "hex"), func(w io.Writer) {
+		fmt.Fprintln(w, pub.String())
+	})
 }
 
 type IdentityCommand struct {
+	Format string `help:"The encoding of the identity. Base58 and base32 are easier to type or read aloud." enum:"hex,base58,base32" default:"hex"`
+}
+
+func (cmd *IdentityCommand) Run(database string, pass passphrase, out *output) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	pub, err := store.GetIdentity()
+	if err != nil {
+		return err
+	}
+	return out.emit(newIdentityOutput(pub, cmd.Format), func(w io.Writer) {
+		if pub == nil {
+			fmt.Fprintln(w, "No identity found.")
+			fmt.Fprintln(w, "You can use `nuntius generate` to generate an identity.")
+			return
+		}
+		fmt.Fprintln(w, formatIdentity(pub, cmd.Format))
+	})
+}
+
+// identityQR encodes an identity as a QR code
+func identityQR(pub crypto.IdentityPub) (*qrcode.QRCode, error) {
+	return qrcode.New(pub.String(), qrcode.Medium)
+}
+
+type QRCommand struct {
+	PNG  string `name:"png" help:"Write the QR code as a PNG image to this path, instead of printing it." type:"path"`
+	Size int    `help:"The width of the PNG image, in pixels." default:"256"`
 }
 
-func (cmd *IdentityCommand) Run(database string) error {
-	store, err := client.NewStore(database)
+func (cmd *QRCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
 	if err != nil {
 		return fmt.Errorf("couldn't connect to database: %w", err)
 	}
@@ -63,119 +255,1511 @@ func (cmd *IdentityCommand) Run(database string) error {
 		fmt.Println("You can use `nuntius generate` to generate an identity.")
 		return nil
 	}
+	code, err := identityQR(pub)
+	if err != nil {
+		return err
+	}
+	if cmd.PNG != "" {
+		return code.WriteFile(cmd.Size, cmd.PNG)
+	}
+	fmt.Print(code.ToSmallString(false))
+	return nil
+}
+
+type BackupCommand struct {
+}
+
+func (cmd *BackupCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	seed, err := store.GetIdentitySeed()
+	if errors.Is(err, client.ErrIdentityEncrypted) {
+		var pass string
+		pass, err = readPassphrase()
+		if err != nil {
+			return err
+		}
+		seed, err = store.GetIdentitySeedDecrypted(pass)
+	}
+	if err != nil {
+		return err
+	}
+	if seed == nil {
+		fmt.Println("No identity found.")
+		fmt.Println("You can use `nuntius generate` to generate an identity.")
+		return nil
+	}
+	mnemonic, err := crypto.MnemonicFromSeed(seed)
+	if err != nil {
+		return err
+	}
+	fmt.Println(mnemonic)
+	return nil
+}
+
+type RestoreCommand struct {
+	Mnemonic []string `arg help:"The words of the backup mnemonic"`
+	Force    bool     `help:"Overwrite existing identity"`
+	Encrypt  bool     `help:"Protect the identity with a passphrase"`
+}
+
+func (cmd *RestoreCommand) Run(database string, pass passphrase) error {
+	seed, err := crypto.SeedFromMnemonic(strings.Join(cmd.Mnemonic, " "))
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+	existingPub, err := store.GetIdentity()
+	if err != nil {
+		return err
+	}
+	pub, priv, err := crypto.IdentityFromSeed(seed)
+	if err != nil {
+		return err
+	}
+	if existingPub != nil && !bytes.Equal(existingPub, pub) && !cmd.Force {
+		fmt.Println("An existing identity exists:")
+		fmt.Println(existingPub.String())
+		fmt.Println("Use `--force` if you want to overwrite this identity.")
+		return nil
+	}
+	err = saveIdentity(store, pub, priv, cmd.Encrypt)
+	if err != nil {
+		return err
+	}
 	fmt.Println(pub.String())
 	return nil
 }
 
-type AddFriendCommand struct {
-	Name string `arg help:"The name of the friend"`
-	Pub  string `arg help:"Their public identity key"`
+type ExportCommand struct {
+	File string `arg help:"The file to write the archive to" type:"path"`
 }
 
-func (cmd *AddFriendCommand) Run(database string) error {
-	pub, err := crypto.IdentityPubFromString(cmd.Pub)
+func (cmd *ExportCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	archivePass, err := readArchivePassphrase(true)
+	if err != nil {
+		return err
+	}
+	archive, err := store.Export(archivePass)
 	if err != nil {
 		return err
 	}
+	// The archive contains our private keys, so only we should be able to read it
+	return os.WriteFile(cmd.File, archive, 0600)
+}
+
+type ImportCommand struct {
+	File  string `arg help:"The archive to restore" type:"existingfile"`
+	Force bool   `help:"Overwrite existing identity, along with everything else"`
+}
 
-	store, err := client.NewStore(database)
+func (cmd *ImportCommand) Run(database string, pass passphrase) error {
+	archive, err := os.ReadFile(cmd.File)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(database, pass)
 	if err != nil {
 		return fmt.Errorf("couldn't connect to database: %w", err)
 	}
 
-	return store.AddFriend(pub, cmd.Name)
+	archivePass, err := readArchivePassphrase(false)
+	if err != nil {
+		return err
+	}
+	err = store.Import(archive, archivePass, cmd.Force)
+	if errors.Is(err, client.ErrIdentityExists) {
+		fmt.Println("An identity already exists.")
+		fmt.Println("Use `--force` if you want to overwrite this identity, and everything else.")
+		return nil
+	}
+	return err
 }
 
-type ServerCommand struct {
-	Port int `arg help:"The port to use" default:"1234"`
+type AddFriendCommand struct {
+	Name  string `arg help:"The name of the friend" complete:"friend"`
+	Pub   string `arg help:"Their public identity key"`
+	Force bool   `help:"Replace the identity key of an existing friend"`
 }
 
-func (cmd *ServerCommand) Run(database string) error {
-	fmt.Println("Listening on port", cmd.Port)
-	server.Run(database, cmd.Port)
+func (cmd *AddFriendCommand) Run(database string, pass passphrase) error {
+	pub, err := crypto.ParseIdentityPub(cmd.Pub)
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	// We only care about the old name if it exists, so errors can be ignored
+	oldName, _ := store.GetFriendName(pub)
+	status, err := store.AddFriend(pub, cmd.Name, cmd.Force)
+	if status == client.FriendKeyConflict {
+		fmt.Printf("WARNING: %s is already a friend, with a different identity key.\n", cmd.Name)
+		fmt.Println("This could mean that someone is trying to impersonate them.")
+		fmt.Println("If you're sure the new key is correct, use --force to replace it.")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch status {
+	case client.FriendCreated:
+		fmt.Printf("Added %s as a friend.\n", cmd.Name)
+	case client.FriendUpdatedName:
+		fmt.Printf("This identity key was already a friend, and was renamed from %s to %s.\n", oldName, cmd.Name)
+	case client.FriendUnchanged:
+		fmt.Printf("%s is already a friend, with this identity key.\n", cmd.Name)
+	case client.FriendKeyReplaced:
+		fmt.Printf("The identity key for %s was replaced, and is no longer verified.\n", cmd.Name)
+		fmt.Printf("You can use `nuntius safety --verify %s` after comparing safety numbers.\n", cmd.Name)
+	}
 	return nil
 }
 
-type ChatCommand struct {
-	URL  string `arg help:"The URL used to access this server"`
-	Name string `arg help:"The name of the friend to chat with"`
+type ListFriendsCommand struct {
+}
+
+// friendOutput is the JSON output for a single friend
+type friendOutput struct {
+	Name     string `json:"name"`
+	Identity string `json:"identity"`
+	Verified bool   `json:"verified"`
+	// ChangedAt is only present if the friend's identity was ever replaced
+	ChangedAt *time.Time `json:"changed_at,omitempty"`
 }
 
-func (cmd *ChatCommand) Run(database string) error {
-	store, err := client.NewStore(database)
+func (cmd *ListFriendsCommand) Run(database string, pass passphrase, out *output) error {
+	store, err := openStore(database, pass)
 	if err != nil {
 		return fmt.Errorf("couldn't connect to database: %w", err)
 	}
 
-	pub, priv, err := store.GetFullIdentity()
+	friends, err := store.ListFriends()
 	if err != nil {
 		return err
 	}
-	if pub == nil {
-		fmt.Println("No identity found.")
-		fmt.Println("You can use `nuntius generate` to generate an identity.")
+	values := make([]friendOutput, 0, len(friends))
+	for _, friend := range friends {
+		value := friendOutput{Name: friend.Name, Identity: friend.Pub.String(), Verified: friend.Verified}
+		if !friend.ChangedAt.IsZero() {
+			changedAt := friend.ChangedAt
+			value.ChangedAt = &changedAt
+		}
+		values = append(values, value)
+	}
+	return out.emit(values, func(w io.Writer) {
+		for _, friend := range friends {
+			status := "unverified"
+			if friend.Verified {
+				status = "verified"
+			}
+			fmt.Fprintf(w, "%s: %s (%s)\n", friend.Name, friend.Pub.String(), status)
+			if !friend.ChangedAt.IsZero() {
+				fmt.Fprintf(w, "  key changed on %s\n", friend.ChangedAt.Format("2006-01-02 15:04"))
+			}
+		}
+	})
+}
+
+type RemoveFriendCommand struct {
+	Name string `arg help:"The name of the friend" complete:"friend"`
+}
+
+func (cmd *RemoveFriendCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	err = store.RemoveFriend(cmd.Name)
+	if errors.Is(err, client.ErrNoSuchFriend) {
+		fmt.Printf("No friend named %s.\n", cmd.Name)
+		return nil
+	}
+	return err
+}
+
+type RenameFriendCommand struct {
+	Old string `arg help:"The current name of the friend" complete:"friend"`
+	New string `arg help:"The new name of the friend"`
+}
+
+func (cmd *RenameFriendCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	err = store.RenameFriend(cmd.Old, cmd.New)
+	if errors.Is(err, client.ErrNoSuchFriend) {
+		fmt.Printf("No friend named %s.\n", cmd.Old)
+		return nil
+	}
+	if errors.Is(err, client.ErrFriendExists) {
+		fmt.Printf("A friend named %s already exists.\n", cmd.New)
 		return nil
 	}
+	return err
+}
+
+type BlockCommand struct {
+	Name string `arg help:"The name of the friend" complete:"friend"`
+}
+
+func (cmd *BlockCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
 
 	friendPub, err := store.GetFriend(cmd.Name)
 	if err != nil {
 		return fmt.Errorf("couldn't lookup friend %s: %w", cmd.Name, err)
 	}
 
-	api := client.NewClientAPI(cmd.URL)
-	hasPrekey, err := store.HasPrekey()
+	return store.BlockFriend(friendPub)
+}
+
+type UnblockCommand struct {
+	Name string `arg help:"The name of the friend" complete:"friend"`
+}
+
+func (cmd *UnblockCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
 	if err != nil {
-		return err
+		return fmt.Errorf("couldn't connect to database: %w", err)
 	}
-	if !hasPrekey {
-		xPub, xPriv, err := client.RenewPrekey(api, pub, priv)
-		if err != nil {
-			return err
-		}
-		err = store.SavePrekey(xPub, xPriv)
-		if err != nil {
-			return err
-		}
-		fmt.Printf("New Prekey registered:\n  %s\n", hex.EncodeToString(xPub))
+
+	friendPub, err := store.GetFriend(cmd.Name)
+	if err != nil {
+		return fmt.Errorf("couldn't lookup friend %s: %w", cmd.Name, err)
+	}
+
+	return store.UnblockFriend(friendPub)
+}
+
+type SafetyCommand struct {
+	Name   string `arg help:"The name of the friend" complete:"friend"`
+	Verify bool   `help:"Mark the friend as verified, after comparing safety numbers with them"`
+}
+
+func (cmd *SafetyCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
 	}
-	newBundle, err := client.CreateNewBundleIfNecessary(api, store, pub, priv)
+
+	pub, err := store.GetIdentity()
 	if err != nil {
 		return err
 	}
-	if newBundle {
-		fmt.Println("New bundle created.")
+	if pub == nil {
+		fmt.Println("No identity found.")
+		fmt.Println("You can use `nuntius generate` to generate an identity.")
+		return nil
 	}
 
-	in := make(chan string)
-	out, err := client.StartChat(api, store, pub, priv, friendPub, in)
+	friendPub, err := store.GetFriend(cmd.Name)
 	if err != nil {
-		return err
+		return fmt.Errorf("couldn't lookup friend %s: %w", cmd.Name, err)
 	}
-	fmt.Println("Connected.")
-	go func() {
-		reader := bufio.NewReader(os.Stdin)
-		for {
-			input, _ := reader.ReadString('\n')
-			in <- strings.TrimSuffix(input, "\n")
+
+	fmt.Println(crypto.SafetyNumber(pub, friendPub))
+	if cmd.Verify {
+		err = store.VerifyFriend(cmd.Name)
+		if err != nil {
+			return err
 		}
-	}()
-	for {
-		fmt.Printf("%s> %s\n", cmd.Name, <-out)
+		fmt.Printf("%s is now verified.\n", cmd.Name)
 	}
+	return nil
 }
 
-var cli struct {
-	Database string `optional name:"database" help:"Path to local database." type:"path"`
-
-	Generate  GenerateCommand  `cmd help:"Generate a new identity pair."`
-	Identity  IdentityCommand  `cmd help:"Fetch the current identity."`
-	AddFriend AddFriendCommand `cmd help:"Add a new friend"`
-	Server    ServerCommand    `cmd help:"Start a server."`
-	Chat      ChatCommand      `cmd help:"Chat with a friend."`
+type ResetSessionCommand struct {
+	Name string `arg help:"The name of the friend" complete:"friend"`
 }
 
-func main() {
-	ctx := kong.Parse(&cli)
-	err := ctx.Run(cli.Database)
+func (cmd *ResetSessionCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	friendPub, err := store.GetFriend(cmd.Name)
+	if err != nil {
+		return fmt.Errorf("couldn't lookup friend %s: %w", cmd.Name, err)
+	}
+
+	err = store.DeleteSession(friendPub)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("The session with %s was reset.\n", cmd.Name)
+	return nil
+}
+
+type ReceiveCommand struct {
+	URL               string        `arg optional help:"The URL used to access the server. Can be left out when set in the config file."`
+	OnetimeThreshold  int           `help:"Upload new onetime keys when fewer than this many remain on the server." default:"10"`
+	OnetimeBundleSize int           `help:"The number of onetime keys in each new bundle, shrunk to fit on the server." default:"64"`
+	PrekeyMaxAge      time.Duration `help:"Register a new prekey once the current one is older than this." default:"168h"`
+	KeyCheckInterval  time.Duration `help:"How often to check the number of onetime keys left on the server." default:"5m"`
+	WireFormat        string        `help:"The format used to exchange messages with the server. Older servers only support json." enum:"protobuf,json" default:"json"`
+}
+
+func (cmd *ReceiveCommand) resolveURL(defaultURL string) error {
+	return resolveServerArgs(defaultURL, &cmd.URL)
+}
+
+func (cmd *ReceiveCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	pub, priv, err := loadIdentity(store)
+	if err != nil {
+		return err
+	}
+	if pub == nil {
+		return errors.New("no identity found, you can use `nuntius generate` to generate one")
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	api := client.NewClientAPIWithFormat(cmd.URL, server.WireFormat(cmd.WireFormat))
+	err = prepareKeys(ctx, api, store, pub, priv, cmd.OnetimeThreshold, cmd.OnetimeBundleSize, cmd.PrekeyMaxAge, cmd.KeyCheckInterval)
+	if err != nil {
+		return err
+	}
+
+	out, err := client.Receive(ctx, api, store, pub, priv)
+	if err != nil {
+		return err
+	}
+	for event := range out {
+		switch event.Kind {
+		case client.EventMessage:
+			fmt.Printf("%s: %s\n", event.Name, event.Text)
+		case client.EventFile:
+			fmt.Printf("%s sent a file, saved to %s\n", event.Name, event.Text)
+		}
+	}
+	return nil
+}
+
+// newNotifier picks the notifiers a daemon uses, from a command and a webhook
+//
+// This returns nil when neither is set, so that messages are only saved.
+func newNotifier(command string, webhook string) client.Notifier {
+	var notifiers client.Notifiers
+	if command != "" {
+		notifiers = append(notifiers, &client.ExecNotifier{Command: command})
+	}
+	if webhook != "" {
+		notifiers = append(notifiers, &client.WebhookNotifier{URL: webhook})
+	}
+	switch len(notifiers) {
+	case 0:
+		return nil
+	case 1:
+		return notifiers[0]
+	default:
+		return notifiers
+	}
+}
+
+type DaemonCommand struct {
+	URL               string        `arg optional help:"The URL used to access the server. Can be left out when set in the config file."`
+	Notify            string        `help:"Command to run for every message, with the name of the sender and the message as arguments."`
+	Webhook           string        `help:"URL to post every message to, as JSON with the identity and name of the sender, and the message."`
+	OnetimeThreshold  int           `help:"Upload new onetime keys when fewer than this many remain on the server." default:"10"`
+	OnetimeBundleSize int           `help:"The number of onetime keys in each new bundle, shrunk to fit on the server." default:"64"`
+	PrekeyMaxAge      time.Duration `help:"Register a new prekey once the current one is older than this." default:"168h"`
+	KeyCheckInterval  time.Duration `help:"How often to check the number of onetime keys left on the server." default:"5m"`
+	WireFormat        string        `help:"The format used to exchange messages with the server. Older servers only support json." enum:"protobuf,json" default:"json"`
+}
+
+func (cmd *DaemonCommand) resolveURL(defaultURL string) error {
+	return resolveServerArgs(defaultURL, &cmd.URL)
+}
+
+func (cmd *DaemonCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	pub, priv, err := loadIdentity(store)
+	if err != nil {
+		return err
+	}
+	if pub == nil {
+		return errors.New("no identity found, you can use `nuntius generate` to generate one")
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	api := client.NewClientAPIWithFormat(cmd.URL, server.WireFormat(cmd.WireFormat))
+	err = prepareKeys(ctx, api, store, pub, priv, cmd.OnetimeThreshold, cmd.OnetimeBundleSize, cmd.PrekeyMaxAge, cmd.KeyCheckInterval)
+	if err != nil {
+		return err
+	}
+	return client.RunDaemon(ctx, api, store, pub, priv, newNotifier(cmd.Notify, cmd.Webhook))
+}
+
+type SendFileCommand struct {
+	URL        string        `arg optional help:"The URL used to access the server. Can be left out when set in the config file."`
+	Name       string        `arg optional help:"The name of the friend to send the file to" complete:"friend"`
+	Path       string        `arg optional help:"The file to send" type:"existingfile"`
+	Timeout    time.Duration `help:"How long to wait for the friend to answer and acknowledge the file." default:"30s"`
+	WireFormat string        `help:"The format used to exchange messages with the server. Older servers only support json." enum:"protobuf,json" default:"json"`
+}
+
+func (cmd *SendFileCommand) resolveURL(defaultURL string) error {
+	return resolveServerArgs(defaultURL, &cmd.URL, &cmd.Name, &cmd.Path)
+}
+
+func (cmd *SendFileCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	pub, priv, err := loadIdentity(store)
+	if err != nil {
+		return err
+	}
+	if pub == nil {
+		fmt.Println("No identity found.")
+		fmt.Println("You can use `nuntius generate` to generate an identity.")
+		return nil
+	}
+
+	friendPub, err := store.GetFriend(cmd.Name)
+	if err != nil {
+		return fmt.Errorf("couldn't lookup friend %s: %w", cmd.Name, err)
+	}
+
+	data, err := os.ReadFile(cmd.Path)
+	if err != nil {
+		return err
+	}
+	mimeType := mime.TypeByExtension(filepath.Ext(cmd.Path))
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	api := client.NewClientAPIWithFormat(cmd.URL, server.WireFormat(cmd.WireFormat))
+	fmt.Printf("Waiting for %s to connect...\n", cmd.Name)
+	err = client.SendFile(ctx, api, store, pub, priv, friendPub, filepath.Base(cmd.Path), mimeType, data, cmd.Timeout)
+	if err != nil {
+		return err
+	}
+	fmt.Println("File delivered.")
+	return nil
+}
+
+type SendCommand struct {
+	URL        string        `arg optional help:"The URL used to access the server. Can be left out when set in the config file."`
+	Name       string        `arg optional help:"The name of the friend to send the message to" complete:"friend"`
+	Message    string        `arg optional help:"The message to send"`
+	Timeout    time.Duration `help:"How long to wait for the friend to answer and acknowledge the message." default:"30s"`
+	WireFormat string        `help:"The format used to exchange messages with the server. Older servers only support json." enum:"protobuf,json" default:"json"`
+}
+
+func (cmd *SendCommand) resolveURL(defaultURL string) error {
+	return resolveServerArgs(defaultURL, &cmd.URL, &cmd.Name, &cmd.Message)
+}
+
+func (cmd *SendCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	pub, priv, err := loadIdentity(store)
+	if err != nil {
+		return err
+	}
+	if pub == nil {
+		return errors.New("no identity found, you can use `nuntius generate` to generate one")
+	}
+
+	friendPub, err := store.GetFriend(cmd.Name)
+	if err != nil {
+		return fmt.Errorf("couldn't lookup friend %s: %w", cmd.Name, err)
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	api := client.NewClientAPIWithFormat(cmd.URL, server.WireFormat(cmd.WireFormat))
+	fmt.Printf("Waiting for %s to connect...\n", cmd.Name)
+	err = client.SendMessage(ctx, api, store, pub, priv, friendPub, cmd.Message, cmd.Timeout)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Message delivered.")
+	return nil
+}
+
+type PresenceCommand struct {
+	URL  string `arg optional help:"The URL used to access the server. Can be left out when set in the config file."`
+	Name string `arg optional help:"The name of the friend" complete:"friend"`
+}
+
+func (cmd *PresenceCommand) resolveURL(defaultURL string) error {
+	return resolveServerArgs(defaultURL, &cmd.URL, &cmd.Name)
+}
+
+// presenceOutput is the JSON output of the presence command
+type presenceOutput struct {
+	Name   string `json:"name"`
+	Online bool   `json:"online"`
+}
+
+func (cmd *PresenceCommand) Run(database string, pass passphrase, out *output) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	friendPub, err := store.GetFriend(cmd.Name)
+	if err != nil {
+		return fmt.Errorf("couldn't lookup friend %s: %w", cmd.Name, err)
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	online, err := client.NewClientAPI(cmd.URL).Presence(ctx, friendPub)
+	if err != nil {
+		return err
+	}
+	return out.emit(presenceOutput{cmd.Name, online}, func(w io.Writer) {
+		if online {
+			fmt.Fprintf(w, "%s is online.\n", cmd.Name)
+		} else {
+			fmt.Fprintf(w, "%s is offline.\n", cmd.Name)
+		}
+	})
+}
+
+type PublishNameCommand struct {
+	URL  string `arg optional help:"The URL used to access the server. Can be left out when set in the config file."`
+	Name string `arg optional help:"The name to publish"`
+}
+
+func (cmd *PublishNameCommand) resolveURL(defaultURL string) error {
+	return resolveServerArgs(defaultURL, &cmd.URL, &cmd.Name)
+}
+
+func (cmd *PublishNameCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	pub, priv, err := loadIdentity(store)
+	if err != nil {
+		return err
+	}
+	if pub == nil {
+		return errors.New("no identity found, you can use `nuntius generate` to generate one")
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	err = client.PublishName(ctx, client.NewClientAPI(cmd.URL), pub, priv, cmd.Name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Published %s.\n", cmd.Name)
+	return nil
+}
+
+type FindCommand struct {
+	URL  string `arg optional help:"The URL used to access the server. Can be left out when set in the config file."`
+	Name string `arg optional help:"The name to look for"`
+}
+
+func (cmd *FindCommand) resolveURL(defaultURL string) error {
+	return resolveServerArgs(defaultURL, &cmd.URL, &cmd.Name)
+}
+
+// findOutput is the JSON output of the find command
+type findOutput struct {
+	Name     string `json:"name"`
+	Identity string `json:"identity"`
+}
+
+func (cmd *FindCommand) Run(out *output) error {
+	ctx, stop := interruptContext()
+	defer stop()
+	pub, err := client.NewClientAPI(cmd.URL).Lookup(ctx, cmd.Name)
+	if err != nil {
+		return err
+	}
+	return out.emit(findOutput{cmd.Name, pub.String()}, func(w io.Writer) {
+		fmt.Fprintln(w, pub)
+	})
+}
+
+type RegisterCommand struct {
+	URL               string        `arg optional help:"The URL used to access the server. Can be left out when set in the config file."`
+	OnetimeThreshold  int           `help:"Upload new onetime keys when fewer than this many remain on the server." default:"10"`
+	OnetimeBundleSize int           `help:"The number of onetime keys in each new bundle, shrunk to fit on the server." default:"64"`
+	PrekeyMaxAge      time.Duration `help:"Register a new prekey once the current one is older than this." default:"168h"`
+	DryRun            bool          `help:"Only show what would be registered, without saving or uploading anything."`
+}
+
+func (cmd *RegisterCommand) resolveURL(defaultURL string) error {
+	return resolveServerArgs(defaultURL, &cmd.URL)
+}
+
+// registerOutput is the JSON output of the register command
+type registerOutput struct {
+	DryRun    bool `json:"dry_run"`
+	NewPrekey bool `json:"new_prekey"`
+	Onetimes  int  `json:"onetimes"`
+	NewBundle bool `json:"new_bundle"`
+}
+
+func (cmd *RegisterCommand) Run(database string, pass passphrase, out *output) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	api := client.NewClientAPI(cmd.URL)
+	if cmd.DryRun {
+		// Planning doesn't sign anything, so the identity doesn't need to be unlocked
+		pub, err := store.GetIdentity()
+		if err != nil {
+			return err
+		}
+		if pub == nil {
+			return errors.New("no identity found, you can use `nuntius generate` to generate one")
+		}
+		plan, err := client.PlanKeys(ctx, api, store, pub, cmd.OnetimeThreshold, cmd.OnetimeBundleSize, cmd.PrekeyMaxAge)
+		if err != nil {
+			return err
+		}
+		return out.emit(registerOutput{true, plan.NewPrekey, plan.Onetimes, plan.NewBundle}, func(w io.Writer) {
+			if plan.NewPrekey {
+				fmt.Fprintln(w, "A new prekey would be registered.")
+			} else {
+				fmt.Fprintln(w, "The current prekey is still fresh.")
+			}
+			if plan.NewBundle {
+				fmt.Fprintf(w, "The server has %d onetime keys left, so a bundle of %d new keys would be uploaded.\n", plan.Onetimes, crypto.DefaultBundleSize)
+			} else {
+				fmt.Fprintf(w, "The server has %d onetime keys left, which is enough.\n", plan.Onetimes)
+			}
+		})
+	}
+
+	pub, priv, err := loadIdentity(store)
+	if err != nil {
+		return err
+	}
+	if pub == nil {
+		return errors.New("no identity found, you can use `nuntius generate` to generate one")
+	}
+	prekey, err := client.RotatePrekeyIfStale(ctx, api, store, pub, priv, cmd.PrekeyMaxAge)
+	if err != nil {
+		return err
+	}
+	onetimes, _, err := api.CountOnetimes(ctx, pub)
+	if err != nil {
+		return err
+	}
+	newBundle, err := client.CreateNewBundleIfNecessary(ctx, api, store, pub, priv, cmd.OnetimeThreshold, cmd.OnetimeBundleSize)
+	if err != nil {
+		return err
+	}
+	return out.emit(registerOutput{false, prekey != nil, onetimes, newBundle}, func(w io.Writer) {
+		if prekey != nil {
+			fmt.Fprintf(w, "New Prekey registered:\n  %s\n", hex.EncodeToString(prekey))
+		}
+		if newBundle {
+			fmt.Fprintln(w, "New bundle created.")
+		}
+		if prekey == nil && !newBundle {
+			fmt.Fprintln(w, "Keys are up to date.")
+		}
+	})
+}
+
+type OnetimeCommand struct {
+	URL   string `arg optional help:"The URL used to access the server. Can be left out when set in the config file."`
+	Count int    `help:"The number of onetime keys to upload." default:"64"`
+}
+
+func (cmd *OnetimeCommand) resolveURL(defaultURL string) error {
+	return resolveServerArgs(defaultURL, &cmd.URL)
+}
+
+// onetimeOutput is the JSON output of the onetime command
+type onetimeOutput struct {
+	Uploaded int `json:"uploaded"`
+}
+
+func (cmd *OnetimeCommand) Run(database string, pass passphrase, out *output) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	pub, priv, err := loadIdentity(store)
+	if err != nil {
+		return err
+	}
+	if pub == nil {
+		return errors.New("no identity found, you can use `nuntius generate` to generate one")
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	uploaded, err := client.CreateBundles(ctx, client.NewClientAPI(cmd.URL), store, pub, priv, cmd.Count)
+	if err != nil && uploaded > 0 {
+		return fmt.Errorf("only uploaded %d of %d onetime keys: %w", uploaded, cmd.Count, err)
+	}
+	if err != nil {
+		return err
+	}
+	return out.emit(onetimeOutput{uploaded}, func(w io.Writer) {
+		fmt.Fprintf(w, "Uploaded %d onetime keys.\n", uploaded)
+	})
+}
+
+type HistoryCommand struct {
+	Name  string `arg help:"The name of the friend" complete:"friend"`
+	Limit int    `help:"The number of messages to show" default:"20"`
+}
+
+func (cmd *HistoryCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	friendPub, err := store.GetFriend(cmd.Name)
+	if err != nil {
+		return fmt.Errorf("couldn't lookup friend %s: %w", cmd.Name, err)
+	}
+
+	messages, err := store.GetHistory(friendPub, cmd.Limit)
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		sender := cmd.Name
+		if message.Outgoing {
+			sender = "me"
+		}
+		fmt.Printf("[%s] %s> %s\n", message.SentAt.Format("2006-01-02 15:04:05"), sender, message.Body)
+	}
+	return nil
+}
+
+type SearchCommand struct {
+	Name  string `arg help:"The name of the friend" complete:"friend"`
+	Query string `arg help:"The text to look for in messages"`
+	Limit int    `help:"The number of matches to show" default:"20"`
+}
+
+func (cmd *SearchCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	friendPub, err := store.GetFriend(cmd.Name)
+	if err != nil {
+		return fmt.Errorf("couldn't lookup friend %s: %w", cmd.Name, err)
+	}
+
+	messages, err := store.SearchHistory(friendPub, cmd.Query, cmd.Limit)
+	if err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		fmt.Printf("No messages with %s contain %q.\n", cmd.Name, cmd.Query)
+		return nil
+	}
+	for _, message := range messages {
+		sender := cmd.Name
+		if message.Outgoing {
+			sender = "me"
+		}
+		fmt.Printf("[%s] %s> %s\n", message.SentAt.Format("2006-01-02 15:04:05"), sender, message.Body)
+	}
+	return nil
+}
+
+type ServerCommand struct {
+	Port                      int           `arg help:"The port to use" default:"1234"`
+	MaxMessageBytes           int64         `help:"The largest message a client can send, in bytes." default:"65536"`
+	Cert                      string        `help:"Path to a TLS certificate, enabling https." optional`
+	Key                       string        `help:"Path to the private key for the TLS certificate." optional`
+	RateLimit                 float64       `help:"The number of requests per second each client can make to the key endpoints." default:"1"`
+	RateBurst                 int           `help:"The number of requests each client can make at once to the key endpoints." default:"20"`
+	Driver                    string        `help:"The database the server uses. Postgres databases can be shared by several servers." enum:"sqlite,postgres" default:"sqlite"`
+	DSN                       string        `name:"dsn" help:"The connection string for the database, with --driver=postgres." optional`
+	LogLevel                  string        `help:"The least severe events to log. Debug logs every request, connection, and relayed message." enum:"debug,info,error" default:"info"`
+	AllowOrigin               []string      `help:"Origins, besides the server's own, whose pages can connect to the server, like https://example.com." optional`
+	AllowAllOrigins           bool          `help:"Let pages from every origin connect to the server, for local development."`
+	ReadBufferSize            int           `help:"The size of the read buffer of each connection, in bytes." default:"4096"`
+	WriteBufferSize           int           `help:"The size of the write buffer of each connection, in bytes." default:"4096"`
+	MaxConnections            int           `help:"The number of connections the server accepts at once." default:"10000"`
+	MaxConnectionsPerIdentity int           `help:"The number of connections each identity can have at once." default:"16"`
+	QueueTTL                  time.Duration `name:"queue-ttl" help:"How long messages for offline clients are kept." default:"168h"`
+	KeyTTL                    time.Duration `name:"key-ttl" help:"How long prekeys, and the onetime keys of clients that stopped uploading keys, are kept." default:"2160h"`
+	PurgeInterval             time.Duration `help:"How often expired messages and stale keys are removed." default:"1h"`
+	Directory                 bool          `help:"Let clients publish names, which anyone can look up."`
+}
+
+func (cmd *ServerCommand) Run(database string) error {
+	if (cmd.Cert == "") != (cmd.Key == "") {
+		return errors.New("both --cert and --key are needed to use TLS")
+	}
+	if cmd.Driver == server.DriverPostgres {
+		if cmd.DSN == "" {
+			return errors.New("--dsn is needed to use postgres")
+		}
+		database = cmd.DSN
+	}
+	logLevel, err := server.ParseLogLevel(cmd.LogLevel)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Listening on port", cmd.Port)
+	return server.Run(server.Config{
+		Driver:                    cmd.Driver,
+		Database:                  database,
+		Port:                      cmd.Port,
+		MaxMessageBytes:           cmd.MaxMessageBytes,
+		CertFile:                  cmd.Cert,
+		KeyFile:                   cmd.Key,
+		RateLimit:                 cmd.RateLimit,
+		RateBurst:                 cmd.RateBurst,
+		LogLevel:                  logLevel,
+		AllowedOrigins:            cmd.AllowOrigin,
+		AllowAllOrigins:           cmd.AllowAllOrigins,
+		ReadBufferSize:            cmd.ReadBufferSize,
+		WriteBufferSize:           cmd.WriteBufferSize,
+		MaxConnections:            cmd.MaxConnections,
+		MaxConnectionsPerIdentity: cmd.MaxConnectionsPerIdentity,
+		QueueTTL:                  cmd.QueueTTL,
+		KeyTTL:                    cmd.KeyTTL,
+		PurgeInterval:             cmd.PurgeInterval,
+		Directory:                 cmd.Directory,
+	})
+}
+
+// interruptContext returns a context cancelled by the first interrupt
+//
+// Later interrupts kill the process as usual, in case shutting down gets stuck.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// prepareKeys makes sure our keys on the server are fresh, and keeps them that way in the background
+func prepareKeys(ctx context.Context, api client.ClientAPI, store client.ClientStore, pub crypto.IdentityPub, priv crypto.IdentityPriv, threshold int, bundleSize int, maxAge time.Duration, interval time.Duration) error {
+	xPub, err := client.RotatePrekeyIfStale(ctx, api, store, pub, priv, maxAge)
+	if err != nil {
+		return err
+	}
+	if xPub != nil {
+		fmt.Printf("New Prekey registered:\n  %s\n", hex.EncodeToString(xPub))
+	}
+	newBundle, err := client.CreateNewBundleIfNecessary(ctx, api, store, pub, priv, threshold, bundleSize)
+	if err != nil {
+		return err
+	}
+	if newBundle {
+		fmt.Println("New bundle created.")
+	}
+	bundles := client.MaintainKeys(ctx, api, store, pub, priv, threshold, bundleSize, interval)
+	go func() {
+		for range bundles {
+			fmt.Println("New bundle created.")
+		}
+	}()
+	return nil
+}
+
+type ChatCommand struct {
+	URL               string        `arg optional help:"The URL used to access the server. Can be left out when set in the config file."`
+	Name              string        `arg optional help:"The name of the friend to chat with, or their identity" complete:"friend"`
+	OnetimeThreshold  int           `help:"Upload new onetime keys when fewer than this many remain on the server." default:"10"`
+	OnetimeBundleSize int           `help:"The number of onetime keys in each new bundle, shrunk to fit on the server." default:"64"`
+	PrekeyMaxAge      time.Duration `help:"Register a new prekey once the current one is older than this." default:"168h"`
+	KeyCheckInterval  time.Duration `help:"How often to check the number of onetime keys left on the server." default:"5m"`
+	WireFormat        string        `help:"The format used to exchange messages with the server. Older servers only support json." enum:"protobuf,json" default:"json"`
+}
+
+func (cmd *ChatCommand) resolveURL(defaultURL string) error {
+	return resolveServerArgs(defaultURL, &cmd.URL, &cmd.Name)
+}
+
+func (cmd *ChatCommand) Run(database string, pass passphrase) error {
+	return cmd.chat(database, pass, cmd.printEvents)
+}
+
+// resolveFriend looks up a friend by name, or by identity, adding unknown identities as friends
+//
+// Friends added this way are named after their identity, until they're renamed.
+func resolveFriend(store client.ClientStore, nameOrIdentity string) (crypto.IdentityPub, bool, error) {
+	pub, err := crypto.IdentityPubFromString(nameOrIdentity)
+	if err != nil {
+		pub, err = store.GetFriend(nameOrIdentity)
+		return pub, false, err
+	}
+	_, err = store.GetFriendName(pub)
+	if err == nil {
+		return pub, false, nil
+	}
+	if err != client.ErrNoSuchFriend {
+		return nil, false, err
+	}
+	_, err = store.AddFriend(pub, pub.String(), false)
+	if err != nil {
+		return nil, false, err
+	}
+	return pub, true, nil
+}
+
+// chat connects to our friend, and then hands the chat over to show until it returns
+func (cmd *ChatCommand) chat(database string, pass passphrase, show func(context.Context, <-chan client.ChatEvent, chan<- string, chan<- struct{}) error) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	pub, priv, err := loadIdentity(store)
+	if err != nil {
+		return err
+	}
+	if pub == nil {
+		fmt.Println("No identity found.")
+		fmt.Println("You can use `nuntius generate` to generate an identity.")
+		return nil
+	}
+
+	friendPub, added, err := resolveFriend(store, cmd.Name)
+	if err != nil {
+		return fmt.Errorf("couldn't lookup friend %s: %w", cmd.Name, err)
+	}
+	if added {
+		fmt.Println("Added this identity as a friend.")
+		fmt.Println("You can use `nuntius rename-friend` to give them a name.")
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	api := client.NewClientAPIWithFormat(cmd.URL, server.WireFormat(cmd.WireFormat))
+	err = prepareKeys(ctx, api, store, pub, priv, cmd.OnetimeThreshold, cmd.OnetimeBundleSize, cmd.PrekeyMaxAge, cmd.KeyCheckInterval)
+	if err != nil {
+		return err
+	}
+
+	in := make(chan string)
+	typing := make(chan struct{})
+	out, err := client.StartChat(ctx, api, store, pub, priv, friendPub, in, typing)
+	if err != nil {
+		return err
+	}
+	return show(ctx, out, in, typing)
+}
+
+// printEvents prints a line for each event in the chat, and sends each line of input
+func (cmd *ChatCommand) printEvents(ctx context.Context, out <-chan client.ChatEvent, in chan<- string, typing chan<- struct{}) error {
+	fmt.Println("Connected.")
+	fmt.Printf("Type %s to show the fingerprint of this session.\n", client.FingerprintCommand)
+	done := readInput(in, typing)
+	for {
+		var event client.ChatEvent
+		var ok bool
+		select {
+		case event, ok = <-out:
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+		switch event.Kind {
+		case client.EventMessage:
+			fmt.Printf("%s> %s\n", cmd.Name, event.Text)
+		case client.EventFile:
+			fmt.Printf("%s sent a file, saved to %s\n", cmd.Name, event.Text)
+		case client.EventTyping:
+			fmt.Printf("%s is typing...\n", cmd.Name)
+		case client.EventReceipt:
+			fmt.Printf("%s read: %s\n", cmd.Name, event.Text)
+		case client.EventDelivered:
+			fmt.Printf("%s received: %s\n", cmd.Name, event.Text)
+		case client.EventUndelivered:
+			fmt.Printf("%s didn't acknowledge: %s\n", cmd.Name, event.Text)
+		case client.EventFingerprint:
+			fmt.Printf("Session fingerprint: %s\n", event.Text)
+		case client.EventStalled:
+			fmt.Printf("The connection to the server is stalled, and couldn't send: %s\n", event.Text)
+		}
+	}
+}
+
+// TUICommand chats with a friend like ChatCommand, but in a full screen interface
+type TUICommand struct {
+	ChatCommand
+}
+
+func (cmd *TUICommand) Run(database string, pass passphrase) error {
+	return cmd.chat(database, pass, func(ctx context.Context, out <-chan client.ChatEvent, in chan<- string, typing chan<- struct{}) error {
+		return tui.Run(ctx, cmd.Name, out, in, typing)
+	})
+}
+
+// readInput sends each line of the standard input over in, until the input ends
+//
+// If typing isn't nil, it's notified as soon as a line starts arriving. The returned
+// channel is closed once there's no more input.
+func readInput(in chan<- string, typing chan<- struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			// The terminal only hands us input once it's been written, so the first
+			// byte of a line is the earliest we can tell that the user is typing
+			_, err := reader.Peek(1)
+			if err != nil {
+				return
+			}
+			if typing != nil {
+				typing <- struct{}{}
+			}
+			input, err := reader.ReadString('\n')
+			in <- strings.TrimSuffix(input, "\n")
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return done
+}
+
+type CreateGroupCommand struct {
+	Name    string   `arg help:"The name of the group"`
+	Friends []string `arg help:"The names of the friends in the group"`
+	ID      string   `help:"The hex id of an existing group to join, instead of creating a new one."`
+}
+
+func (cmd *CreateGroupCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	var id []byte
+	if cmd.ID != "" {
+		id, err = hex.DecodeString(cmd.ID)
+		if err != nil {
+			return err
+		}
+		if len(id) != client.GroupIDSize {
+			return fmt.Errorf("group id should have %d bytes, found %d", client.GroupIDSize, len(id))
+		}
+	} else {
+		id, err = client.NewGroupID()
+		if err != nil {
+			return err
+		}
+	}
+	members := make([]crypto.IdentityPub, 0, len(cmd.Friends))
+	for _, name := range cmd.Friends {
+		pub, err := store.GetFriend(name)
+		if err != nil {
+			return fmt.Errorf("couldn't lookup friend %s: %w", name, err)
+		}
+		members = append(members, pub)
+	}
+	err = store.CreateGroup(client.Group{ID: id, Name: cmd.Name, Members: members})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Group id:\n  %s\n", hex.EncodeToString(id))
+	if cmd.ID == "" {
+		fmt.Println("The other members can join with `nuntius create-group --id`.")
+	}
+	return nil
+}
+
+type ListGroupsCommand struct {
+}
+
+func (cmd *ListGroupsCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	friends, err := store.ListFriends()
+	if err != nil {
+		return err
+	}
+	names := make(map[string]string)
+	for _, friend := range friends {
+		names[string(friend.Pub)] = friend.Name
+	}
+	groups, err := store.ListGroups()
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		fmt.Printf("%s: %s\n", group.Name, hex.EncodeToString(group.ID))
+		for _, member := range group.Members {
+			name, present := names[string(member)]
+			if !present {
+				name = member.String()
+			}
+			fmt.Printf("  %s\n", name)
+		}
+	}
+	return nil
+}
+
+type GroupChatCommand struct {
+	URL               string        `arg optional help:"The URL used to access the server. Can be left out when set in the config file."`
+	Name              string        `arg optional help:"The name of the group to chat with"`
+	OnetimeThreshold  int           `help:"Upload new onetime keys when fewer than this many remain on the server." default:"10"`
+	OnetimeBundleSize int           `help:"The number of onetime keys in each new bundle, shrunk to fit on the server." default:"64"`
+	PrekeyMaxAge      time.Duration `help:"Register a new prekey once the current one is older than this." default:"168h"`
+	KeyCheckInterval  time.Duration `help:"How often to check the number of onetime keys left on the server." default:"5m"`
+	WireFormat        string        `help:"The format used to exchange messages with the server. Older servers only support json." enum:"protobuf,json" default:"json"`
+}
+
+func (cmd *GroupChatCommand) resolveURL(defaultURL string) error {
+	return resolveServerArgs(defaultURL, &cmd.URL, &cmd.Name)
+}
+
+func (cmd *GroupChatCommand) Run(database string, pass passphrase) error {
+	store, err := openStore(database, pass)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+
+	pub, priv, err := loadIdentity(store)
+	if err != nil {
+		return err
+	}
+	if pub == nil {
+		fmt.Println("No identity found.")
+		fmt.Println("You can use `nuntius generate` to generate an identity.")
+		return nil
+	}
+
+	group, err := store.GetGroup(cmd.Name)
+	if err != nil {
+		return fmt.Errorf("couldn't lookup group %s: %w", cmd.Name, err)
+	}
+	friends, err := store.ListFriends()
+	if err != nil {
+		return err
+	}
+	names := make(map[string]string)
+	for _, friend := range friends {
+		names[string(friend.Pub)] = friend.Name
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	api := client.NewClientAPIWithFormat(cmd.URL, server.WireFormat(cmd.WireFormat))
+	err = prepareKeys(ctx, api, store, pub, priv, cmd.OnetimeThreshold, cmd.OnetimeBundleSize, cmd.PrekeyMaxAge, cmd.KeyCheckInterval)
+	if err != nil {
+		return err
+	}
+
+	in := make(chan string)
+	out, err := client.StartGroupChat(ctx, api, store, pub, priv, group, in)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Connected.")
+	done := readInput(in, nil)
+	for {
+		var event client.GroupEvent
+		var ok bool
+		select {
+		case event, ok = <-out:
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+		name, present := names[string(event.From)]
+		if !present {
+			name = event.From.String()
+		}
+		fmt.Printf("%s> %s\n", name, event.Text)
+	}
+}
+
+type VerifyCommand struct {
+	Identity  string `arg help:"The identity which made the signature"`
+	Data      string `arg help:"The signed data, in hex"`
+	Signature string `arg help:"The signature, in hex"`
+	Bundle    bool   `help:"Verify the data as a bundle of onetime keys, like the server does."`
+}
+
+// verifyOutput is the JSON output of the verify command
+type verifyOutput struct {
+	Valid bool `json:"valid"`
+}
+
+// verifySignature checks a signature given on the command line, failing if any part of it is malformed
+func verifySignature(identity string, data string, signature string, bundle bool) (bool, error) {
+	pub, err := crypto.ParseIdentityPub(identity)
+	if err != nil {
+		return false, fmt.Errorf("couldn't parse identity: %w", err)
+	}
+	dataBytes, err := hex.DecodeString(data)
+	if err != nil {
+		return false, fmt.Errorf("couldn't decode data: %w", err)
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false, fmt.Errorf("couldn't decode signature: %w", err)
+	}
+	if !bundle {
+		return pub.Verify(dataBytes, sig), nil
+	}
+	bundlePub, err := crypto.BundleFromBytes(dataBytes)
+	if err != nil {
+		return false, fmt.Errorf("couldn't parse bundle: %w", err)
+	}
+	return pub.VerifyBundle(bundlePub, sig), nil
+}
+
+func (cmd *VerifyCommand) Run(out *output) error {
+	valid, err := verifySignature(cmd.Identity, cmd.Data, cmd.Signature, cmd.Bundle)
+	if err != nil {
+		return err
+	}
+	return out.emit(verifyOutput{valid}, func(w io.Writer) {
+		if valid {
+			fmt.Fprintln(w, "The signature is valid.")
+		} else {
+			fmt.Fprintln(w, "The signature is NOT valid.")
+		}
+	})
+}
+
+type VersionCommand struct{}
+
+// versionOutput describes the running build, and the protocol it speaks
+type versionOutput struct {
+	Version  string `json:"version"`
+	Commit   string `json:"commit"`
+	Date     string `json:"date"`
+	Protocol int    `json:"protocol"`
+}
+
+func (cmd *VersionCommand) Run(out *output) error {
+	version := versionOutput{buildinfo.Version, buildinfo.Commit, buildinfo.Date, server.ProtocolVersion}
+	return out.emit(version, func(w io.Writer) {
+		fmt.Fprintf(w, "nuntius %s\n", version.Version)
+		fmt.Fprintf(w, "commit: %s\n", version.Commit)
+		fmt.Fprintf(w, "built: %s\n", version.Date)
+		fmt.Fprintf(w, "protocol: %d\n", version.Protocol)
+	})
+}
+
+// databasePath is the path to the local database, which isn't expanded if it's client.MemoryDatabase
+type databasePath string
+
+func (database *databasePath) Decode(ctx *kong.DecodeContext) error {
+	var value string
+	err := ctx.Scan.PopValueInto("file", &value)
+	if err != nil {
+		return err
+	}
+	if value != client.MemoryDatabase {
+		value = kong.ExpandPath(value)
+	}
+	*database = databasePath(value)
+	return nil
+}
+
+// cliArgs describes the command line arguments
+type cliArgs struct {
+	Database       databasePath `optional name:"database" help:"Path to local database, or :memory: to keep everything in memory." placeholder:"STRING"`
+	Passphrase     string       `optional name:"passphrase" help:"Passphrase used to encrypt the private keys in the local database." env:"NUNTIUS_PASSPHRASE"`
+	PassphraseFile string       `optional name:"passphrase-file" help:"File containing the passphrase for the local database, used when --passphrase isn't given." type:"path"`
+	JSON           bool         `name:"json" help:"Print results as JSON, for commands that support it."`
+
+	Generate     GenerateCommand     `cmd help:"Generate a new identity pair."`
+	Identity     IdentityCommand     `cmd help:"Fetch the current identity."`
+	QR           QRCommand           `cmd name:"qr" help:"Show the current identity as a QR code."`
+	Backup       BackupCommand       `cmd help:"Print a mnemonic backup of the current identity."`
+	Restore      RestoreCommand      `cmd help:"Restore an identity from a mnemonic backup."`
+	Export       ExportCommand       `cmd help:"Write an encrypted archive of the identity, friends, keys, sessions, and history."`
+	Import       ImportCommand       `cmd help:"Restore everything from an archive written by export."`
+	AddFriend    AddFriendCommand    `cmd help:"Add a new friend"`
+	ListFriends  ListFriendsCommand  `cmd help:"List all friends."`
+	RemoveFriend RemoveFriendCommand `cmd help:"Remove a friend."`
+	RenameFriend RenameFriendCommand `cmd help:"Rename a friend."`
+	Block        BlockCommand        `cmd help:"Ignore all messages from a friend."`
+	Unblock      UnblockCommand      `cmd help:"Stop ignoring messages from a friend."`
+	Safety       SafetyCommand       `cmd help:"Show the safety number shared with a friend."`
+	ResetSession ResetSessionCommand `cmd help:"Forget the session with a friend, so that the next chat starts a new one."`
+	Server       ServerCommand       `cmd help:"Start a server."`
+	Chat         ChatCommand         `cmd help:"Chat with a friend."`
+	TUI          TUICommand          `cmd name:"tui" help:"Chat with a friend in a full screen interface."`
+	Send         SendCommand         `cmd help:"Send a single message to a friend."`
+	SendFile     SendFileCommand     `cmd help:"Send a file to a friend."`
+	Receive      ReceiveCommand      `cmd help:"Print the messages sent by any friend."`
+	Daemon       DaemonCommand       `cmd help:"Receive messages from any friend in the background, running a command for each of them."`
+	CreateGroup  CreateGroupCommand  `cmd help:"Create a group of friends."`
+	ListGroups   ListGroupsCommand   `cmd help:"List all groups."`
+	GroupChat    GroupChatCommand    `cmd help:"Chat with a group of friends."`
+	History      HistoryCommand      `cmd help:"Show the messages exchanged with a friend."`
+	Search       SearchCommand       `cmd help:"Search the messages exchanged with a friend."`
+	Presence     PresenceCommand     `cmd help:"Check if a friend is connected to a server."`
+	Register     RegisterCommand     `cmd help:"Register the keys of this identity with a server, if needed."`
+	Onetime      OnetimeCommand      `cmd help:"Upload new onetime keys to a server, however many it has left."`
+	PublishName  PublishNameCommand  `cmd help:"Publish a name for this identity, on a server with a directory."`
+	Find         FindCommand         `cmd help:"Find the identity which published a name, on a server with a directory."`
+	Verify       VerifyCommand       `cmd help:"Check a signature made by an identity, for debugging."`
+	Version      VersionCommand      `cmd help:"Show the version of this build, and of the protocol it uses."`
+	Completion   CompletionCommand   `cmd help:"Print a script completing commands and friend names in a shell."`
+	Complete     CompleteCommand     `cmd hidden help:"Print the completions for a command line."`
+}
+
+var cli cliArgs
+
+// configResolver fills in the flags missing from the command line with the values of a config file
+//
+// Values are looked up by the name of the flag. The url of the server is a positional
+// argument, so it's filled in by resolveServerURL instead.
+func configResolver(conf *config.Config) kong.Resolver {
+	values := map[string]interface{}{
+		"database":        conf.Database,
+		"passphrase-file": conf.PassphraseFile,
+		"notify":          conf.Notify,
+		"webhook":         conf.Webhook,
+	}
+	if conf.OnetimeThreshold != 0 {
+		values["onetime-threshold"] = conf.OnetimeThreshold
+	}
+	if conf.OnetimeBundleSize != 0 {
+		values["onetime-bundle-size"] = conf.OnetimeBundleSize
+	}
+	return kong.ResolverFunc(func(context *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+		value, present := values[flag.Name]
+		if !present || value == "" {
+			return nil, nil
+		}
+		return value, nil
+	})
+}
+
+// serverCommand is a command talking to a server, whose url can come from the config file
+type serverCommand interface {
+	resolveURL(defaultURL string) error
+}
+
+// resolveServerURL fills in the url of the server for the selected command, if it talks to one
+func resolveServerURL(ctx *kong.Context, conf *config.Config) error {
+	cmd, ok := ctx.Selected().Target.Addr().Interface().(serverCommand)
+	if !ok {
+		return nil
+	}
+	return cmd.resolveURL(conf.URL)
+}
+
+// resolveServerArgs handles the url of a server being left out of a command's arguments
+//
+// The url comes first, so leaving it out shifts the other arguments over by one.
+// In that case, the url comes from the config file instead.
+func resolveServerArgs(defaultURL string, url *string, args ...*string) error {
+	if len(args) > 0 && *args[len(args)-1] == "" {
+		for i := len(args) - 1; i > 0; i-- {
+			*args[i] = *args[i-1]
+		}
+		*args[0] = *url
+		*url = ""
+	}
+	if *url == "" {
+		*url = defaultURL
+	}
+	if *url == "" {
+		return errors.New("missing server url: pass it before the other arguments, or set url in the config file")
+	}
+	for _, arg := range args {
+		if *arg == "" {
+			return errors.New("missing arguments, see --help")
+		}
+	}
+	return nil
+}
+
+// readPassphraseFile reads the passphrase for the local database from a file, ignoring the final newline
+func readPassphraseFile(path string) (passphrase, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return passphrase(strings.TrimRight(string(data), "\r\n")), nil
+}
+
+func main() {
+	configPath, err := config.DefaultPath()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "nuntius: %v\n", err)
+		os.Exit(1)
+	}
+	conf, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "nuntius: couldn't load %s: %v\n", configPath, err)
+		os.Exit(1)
+	}
+	ctx := kong.Parse(&cli, kong.Resolvers(configResolver(conf)))
+	ctx.FatalIfErrorf(resolveServerURL(ctx, conf))
+	pass := passphrase(cli.Passphrase)
+	if pass == "" && cli.PassphraseFile != "" {
+		pass, err = readPassphraseFile(cli.PassphraseFile)
+		ctx.FatalIfErrorf(err)
+	}
+	err = ctx.Run(string(cli.Database), pass, &output{json: cli.JSON, w: os.Stdout})
 	ctx.FatalIfErrorf(err)
 }
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/kong"
+	"github.com/cronokirby/nuntius/internal/buildinfo"
+	"github.com/cronokirby/nuntius/internal/client"
+	"github.com/cronokirby/nuntius/internal/config"
+	"github.com/cronokirby/nuntius/internal/crypto"
+	"github.com/cronokirby/nuntius/internal/server"
+)
+
+// runIdentity runs the identity command, returning what it printed
+func runIdentity(t *testing.T, database string, asJSON bool) string {
+	return runIdentityInFormat(t, database, asJSON, "hex")
+}
+
+// runIdentityInFormat runs the identity command with an encoding, returning what it printed
+func runIdentityInFormat(t *testing.T, database string, asJSON bool, format string) string {
+	var buf bytes.Buffer
+	cmd := IdentityCommand{Format: format}
+	err := cmd.Run(database, "", &output{json: asJSON, w: &buf})
+	if err != nil {
+		t.Fatalf("couldn't run identity command: %v", err)
+	}
+	return buf.String()
+}
+
+func TestIdentityOutput(t *testing.T) {
+	database := path.Join(t.TempDir(), "client.db")
+	if !strings.HasPrefix(runIdentity(t, database, false), "No identity found.") {
+		t.Errorf("expected missing identity message")
+		return
+	}
+	var missing map[string]interface{}
+	err := json.Unmarshal([]byte(runIdentity(t, database, true)), &missing)
+	if err != nil {
+		t.Errorf("couldn't parse JSON output: %v", err)
+		return
+	}
+	if value, present := missing["identity"]; !present || value != nil {
+		t.Errorf("expected null identity, found %v", missing)
+		return
+	}
+
+	store, err := client.NewStore(database)
+	if err != nil {
+		t.Errorf("couldn't open store: %v", err)
+		return
+	}
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	err = store.SaveIdentity(pub, priv)
+	if err != nil {
+		t.Errorf("couldn't save identity: %v", err)
+		return
+	}
+
+	text := runIdentity(t, database, false)
+	if text != pub.String()+"\n" {
+		t.Errorf("unexpected text output: %q", text)
+		return
+	}
+	var parsed struct {
+		Identity string `json:"identity"`
+	}
+	err = json.Unmarshal([]byte(runIdentity(t, database, true)), &parsed)
+	if err != nil {
+		t.Errorf("couldn't parse JSON output: %v", err)
+		return
+	}
+	if parsed.Identity != pub.String() {
+		t.Errorf("%s != %s", parsed.Identity, pub.String())
+		return
+	}
+}
+
+func TestIdentityFormats(t *testing.T) {
+	database := path.Join(t.TempDir(), "client.db")
+	store, err := client.NewStore(database)
+	if err != nil {
+		t.Errorf("couldn't open store: %v", err)
+		return
+	}
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	err = store.SaveIdentity(pub, priv)
+	if err != nil {
+		t.Errorf("couldn't save identity: %v", err)
+		return
+	}
+	for _, format := range []string{"hex", "base58", "base32"} {
+		text := strings.TrimSpace(runIdentityInFormat(t, database, false, format))
+		decoded, err := crypto.ParseIdentityPub(text)
+		if err != nil {
+			t.Errorf("couldn't parse %s identity %q: %v", format, text, err)
+			return
+		}
+		if !bytes.Equal(decoded, pub) {
+			t.Errorf("%s: %v != %v", format, decoded, pub)
+			return
+		}
+	}
+	if runIdentityInFormat(t, database, false, "base58") != pub.Base58()+"\n" {
+		t.Errorf("base58 output doesn't match")
+		return
+	}
+}
+
+func TestIdentityQR(t *testing.T) {
+	pub, _, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	code, err := identityQR(pub)
+	if err != nil {
+		t.Errorf("couldn't encode QR code: %v", err)
+		return
+	}
+	decoded, err := crypto.IdentityPubFromString(code.Content)
+	if err != nil {
+		t.Errorf("couldn't parse QR code content: %v", err)
+		return
+	}
+	if !bytes.Equal(decoded, pub) {
+		t.Errorf("%s != %s", decoded, pub)
+		return
+	}
+
+	data, err := code.PNG(256)
+	if err != nil {
+		t.Errorf("couldn't render PNG: %v", err)
+		return
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Errorf("couldn't decode PNG: %v", err)
+		return
+	}
+	if img.Bounds().Dx() != 256 || img.Bounds().Dy() != 256 {
+		t.Errorf("unexpected image size: %v", img.Bounds())
+		return
+	}
+}
+
+// parseWithConfig parses command line arguments, using a config file for missing flags
+func parseWithConfig(t *testing.T, configFile string, args ...string) *cliArgs {
+	conf, err := config.Load(configFile)
+	if err != nil {
+		t.Fatalf("couldn't load config: %v", err)
+	}
+	parsed := cli
+	parser, err := kong.New(&parsed, kong.Resolvers(configResolver(conf)))
+	if err != nil {
+		t.Fatalf("couldn't create parser: %v", err)
+	}
+	ctx, err := parser.Parse(args)
+	if err != nil {
+		t.Fatalf("couldn't parse arguments: %v", err)
+	}
+	err = resolveServerURL(ctx, conf)
+	if err != nil {
+		t.Fatalf("couldn't resolve server url: %v", err)
+	}
+	return &parsed
+}
+
+func TestConfigDefaults(t *testing.T) {
+	configFile := path.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(configFile, []byte(`
+database = "/tmp/config.db"
+url = "http://localhost:1234"
+onetime_threshold = 3
+onetime_bundle_size = 32
+`), 0600)
+	if err != nil {
+		t.Errorf("couldn't write config: %v", err)
+		return
+	}
+
+	parsed := parseWithConfig(t, configFile, "chat", "alice")
+	if parsed.Database != "/tmp/config.db" || parsed.Chat.URL != "http://localhost:1234" || parsed.Chat.OnetimeThreshold != 3 {
+		t.Errorf("config wasn't applied: %s %s %d", parsed.Database, parsed.Chat.URL, parsed.Chat.OnetimeThreshold)
+		return
+	}
+
+	parsed = parseWithConfig(t, configFile, "--database=/tmp/flag.db", "chat", "http://example.com", "alice")
+	if parsed.Database != "/tmp/flag.db" || parsed.Chat.URL != "http://example.com" || parsed.Chat.Name != "alice" {
+		t.Errorf("flags didn't take precedence: %s %s", parsed.Database, parsed.Chat.URL)
+		return
+	}
+	if parsed.Chat.OnetimeThreshold != 3 || parsed.Chat.OnetimeBundleSize != 32 {
+		t.Errorf("config wasn't applied: %d %d", parsed.Chat.OnetimeThreshold, parsed.Chat.OnetimeBundleSize)
+		return
+	}
+
+	parsed = parseWithConfig(t, configFile, "send", "alice", "hello")
+	if parsed.Send.URL != "http://localhost:1234" || parsed.Send.Name != "alice" || parsed.Send.Message != "hello" {
+		t.Errorf("arguments weren't shifted: %s %s %s", parsed.Send.URL, parsed.Send.Name, parsed.Send.Message)
+		return
+	}
+
+	parsed = parseWithConfig(t, path.Join(t.TempDir(), "missing.toml"), "chat", "http://example.com", "alice")
+	if parsed.Chat.OnetimeThreshold != 10 || parsed.Chat.OnetimeBundleSize != 64 {
+		t.Errorf("expected default threshold and bundle size, found %d %d", parsed.Chat.OnetimeThreshold, parsed.Chat.OnetimeBundleSize)
+		return
+	}
+}
+
+func TestMemoryDatabaseFlag(t *testing.T) {
+	configFile := path.Join(t.TempDir(), "missing.toml")
+	parsed := parseWithConfig(t, configFile, "--database", client.MemoryDatabase, "list-friends")
+	if parsed.Database != client.MemoryDatabase {
+		t.Errorf("expected %s, found %s", client.MemoryDatabase, parsed.Database)
+		return
+	}
+	parsed = parseWithConfig(t, configFile, "--database", "relative.db", "list-friends")
+	if !path.IsAbs(string(parsed.Database)) {
+		t.Errorf("path wasn't expanded: %s", parsed.Database)
+		return
+	}
+}
+
+func TestMissingServerURL(t *testing.T) {
+	url, name := "alice", ""
+	err := resolveServerArgs("", &url, &name)
+	if err == nil {
+		t.Errorf("expected an error without a url")
+		return
+	}
+}
+
+func TestResolveFriend(t *testing.T) {
+	store, err := client.NewStore(path.Join(t.TempDir(), "client.db"))
+	if err != nil {
+		t.Errorf("couldn't create store: %v", err)
+		return
+	}
+	bob, _, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	_, err = store.AddFriend(bob, "bob", false)
+	if err != nil {
+		t.Errorf("couldn't add friend: %v", err)
+		return
+	}
+	for _, nameOrIdentity := range []string{"bob", bob.String()} {
+		pub, added, err := resolveFriend(store, nameOrIdentity)
+		if err != nil {
+			t.Errorf("couldn't resolve %q: %v", nameOrIdentity, err)
+			return
+		}
+		if added || !bytes.Equal(pub, bob) {
+			t.Errorf("%q: expected bob, found %s (added: %v)", nameOrIdentity, pub, added)
+			return
+		}
+	}
+
+	alice, _, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	pub, added, err := resolveFriend(store, alice.String())
+	if err != nil {
+		t.Errorf("couldn't resolve identity: %v", err)
+		return
+	}
+	if !added || !bytes.Equal(pub, alice) {
+		t.Errorf("expected alice to be added, found %s (added: %v)", pub, added)
+		return
+	}
+	name, err := store.GetFriendName(alice)
+	if err != nil {
+		t.Errorf("unknown identity wasn't added as a friend: %v", err)
+		return
+	}
+	if name != alice.String() {
+		t.Errorf("expected friend to be named after their identity, found %q", name)
+		return
+	}
+	_, added, err = resolveFriend(store, alice.String())
+	if err != nil || added {
+		t.Errorf("identity was added twice: %v", err)
+		return
+	}
+
+	_, _, err = resolveFriend(store, "carol")
+	if err == nil {
+		t.Errorf("expected an error for an unknown name")
+		return
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	pub, priv, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Errorf("couldn't generate identity: %v", err)
+		return
+	}
+	bundle, _, err := crypto.GenerateBundle(2)
+	if err != nil {
+		t.Errorf("couldn't generate bundle: %v", err)
+		return
+	}
+	data := []byte("hello")
+	sig := hex.EncodeToString(priv.Sign(data))
+	bundleSig := hex.EncodeToString(priv.SignBundle(bundle))
+
+	cases := []struct {
+		data   string
+		sig    string
+		bundle bool
+		valid  bool
+	}{
+		{hex.EncodeToString(data), sig, false, true},
+		{hex.EncodeToString([]byte("goodbye")), sig, false, false},
+		{hex.EncodeToString(bundle), bundleSig, true, true},
+		// Bundles are signed with a context, so their signature isn't valid over the raw bytes
+		{hex.EncodeToString(bundle), bundleSig, false, false},
+	}
+	for _, c := range cases {
+		valid, err := verifySignature(pub.String(), c.data, c.sig, c.bundle)
+		if err != nil {
+			t.Errorf("couldn't verify signature: %v", err)
+			return
+		}
+		if valid != c.valid {
+			t.Errorf("%s (bundle: %v): expected %v, found %v", c.data, c.bundle, c.valid, valid)
+			return
+		}
+	}
+
+	malformed := []struct {
+		identity string
+		data     string
+		sig      string
+		bundle   bool
+	}{
+		{"alice", hex.EncodeToString(data), sig, false},
+		{pub.String(), "not hex", sig, false},
+		{pub.String(), hex.EncodeToString(data), "not hex", false},
+		{pub.String(), hex.EncodeToString(data), bundleSig, true},
+	}
+	for _, c := range malformed {
+		_, err := verifySignature(c.identity, c.data, c.sig, c.bundle)
+		if err == nil {
+			t.Errorf("expected an error for %+v", c)
+			return
+		}
+	}
+}
+
+func TestNotifierFromConfig(t *testing.T) {
+	configFile := path.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(configFile, []byte(`
+url = "http://localhost:1234"
+notify = "notify-send"
+webhook = "http://localhost:5678/hook"
+`), 0600)
+	if err != nil {
+		t.Errorf("couldn't write config: %v", err)
+		return
+	}
+	parsed := parseWithConfig(t, configFile, "daemon")
+	notifiers, ok := newNotifier(parsed.Daemon.Notify, parsed.Daemon.Webhook).(client.Notifiers)
+	if !ok || len(notifiers) != 2 {
+		t.Errorf("expected both notifiers, found %#v", notifiers)
+		return
+	}
+	exec, ok := notifiers[0].(*client.ExecNotifier)
+	if !ok || exec.Command != "notify-send" {
+		t.Errorf("unexpected command notifier: %#v", notifiers[0])
+		return
+	}
+	webhook, ok := notifiers[1].(*client.WebhookNotifier)
+	if !ok || webhook.URL != "http://localhost:5678/hook" {
+		t.Errorf("unexpected webhook notifier: %#v", notifiers[1])
+		return
+	}
+	webhook, ok = newNotifier("", "http://localhost:5678/hook").(*client.WebhookNotifier)
+	if !ok || webhook.URL != "http://localhost:5678/hook" {
+		t.Errorf("expected only a webhook notifier")
+		return
+	}
+	if newNotifier("", "") != nil {
+		t.Errorf("expected no notifier without a command or webhook")
+		return
+	}
+}
+
+func TestVersionOutput(t *testing.T) {
+	defer func(version, commit, date string) {
+		buildinfo.Version, buildinfo.Commit, buildinfo.Date = version, commit, date
+	}(buildinfo.Version, buildinfo.Commit, buildinfo.Date)
+	// These are what -ldflags would set
+	buildinfo.Version = "v1.2.3"
+	buildinfo.Commit = "0123abc"
+	buildinfo.Date = "2021-06-01T12:00:00Z"
+
+	var buf bytes.Buffer
+	cmd := VersionCommand{}
+	err := cmd.Run(&output{w: &buf})
+	if err != nil {
+		t.Errorf("couldn't run version command: %v", err)
+		return
+	}
+	text := buf.String()
+	for _, expected := range []string{"v1.2.3", "0123abc", "2021-06-01T12:00:00Z", fmt.Sprintf("protocol: %d", server.ProtocolVersion)} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("%q is missing from %q", expected, text)
+			return
+		}
+	}
+
+	buf.Reset()
+	err = cmd.Run(&output{json: true, w: &buf})
+	if err != nil {
+		t.Errorf("couldn't run version command: %v", err)
+		return
+	}
+	var parsed versionOutput
+	err = json.Unmarshal(buf.Bytes(), &parsed)
+	if err != nil {
+		t.Errorf("couldn't parse JSON output: %v", err)
+		return
+	}
+	expected := versionOutput{"v1.2.3", "0123abc", "2021-06-01T12:00:00Z", server.ProtocolVersion}
+	if parsed != expected {
+		t.Errorf("%+v != %+v", parsed, expected)
+		return
+	}
+}
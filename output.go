@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// output is where commands print their results
+//
+// Results are either printed as text, for humans, or as JSON, for scripts.
+type output struct {
+	json bool
+	w    io.Writer
+}
+
+// emit prints a result, using either its JSON value, or its text representation
+func (out *output) emit(value interface{}, text func(w io.Writer)) error {
+	if !out.json {
+		text(out.w)
+		return nil
+	}
+	encoder := json.NewEncoder(out.w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}